@@ -0,0 +1,126 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/prometheus/pushgateway/bench"
+	"github.com/prometheus/pushgateway/secret"
+)
+
+// runBench implements the bench subcommand with the given arguments and
+// returns the exit code.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	var (
+		target      = fs.String("url", "http://localhost:9091", "Base URL of the Pushgateway to push to.")
+		job         = fs.String("job", "pushgateway_bench", "Job label of the groups pushed to.")
+		groups      = fs.Int("groups", 10, "Number of groups pushed to in turn, distinguished by an instance label.")
+		series      = fs.Int("series", 100, "Number of series per push.")
+		rate        = fs.Float64("rate", 0, "Total number of pushes per second. 0 pushes as fast as -concurrency allows.")
+		concurrency = fs.Int("concurrency", 10, "Maximum number of pushes in flight.")
+		duration    = fs.Duration("duration", 30*time.Second, "Duration of the run.")
+		format      = fs.String("format", bench.FormatText, "Payload format: 'text' or 'protobuf'.")
+		method      = fs.String("method", "PUT", "HTTP method of the pushes: 'PUT' or 'POST'.")
+		tokenFile   = fs.String("token-file", "", "Path to a file (or other secret source, see -secrets.refresh-interval of the server) with a bearer token to send with each push.")
+		profileFile = fs.String("profile-file", "", "If set, a CPU profile of the Pushgateway is taken via /debug/pprof/profile for the duration of the run and written to this file.")
+		profileURL  = fs.String("profile-url", "", "Base URL of the Pushgateway to take the CPU profile from, if it serves pprof on its -web.telemetry-address. Defaults to -url.")
+	)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	c := bench.Config{
+		URL:            strings.TrimSuffix(*target, "/"),
+		Job:            *job,
+		Groups:         *groups,
+		SeriesPerGroup: *series,
+		Rate:           *rate,
+		Concurrency:    *concurrency,
+		Duration:       *duration,
+		Format:         *format,
+		Method:         strings.ToUpper(*method),
+		Client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+		},
+	}
+	if *tokenFile != "" {
+		s, err := secret.New(*tokenFile, 0)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		token, _ := s.Get()
+		c.Authorization = "Bearer " + strings.TrimSpace(string(token))
+	}
+
+	profileErr := make(chan error, 1)
+	if *profileFile != "" {
+		base := c.URL
+		if *profileURL != "" {
+			base = strings.TrimSuffix(*profileURL, "/")
+		}
+		go func() { profileErr <- fetchProfile(base, *profileFile, *duration) }()
+	} else {
+		profileErr <- nil
+	}
+	fmt.Printf("Pushing to %s for %s...\n", c.URL, c.Duration)
+	res, err := bench.Run(context.Background(), c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	res.Report(os.Stdout)
+	if err := <-profileErr; err != nil {
+		fmt.Fprintln(os.Stderr, "Error taking CPU profile:", err)
+		return 1
+	}
+	return 0
+}
+
+// fetchProfile writes a CPU profile of the Pushgateway at baseURL over the
+// given duration to filename.
+func fetchProfile(baseURL, filename string, duration time.Duration) error {
+	seconds := int(duration.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	client := &http.Client{Timeout: duration + 30*time.Second}
+	resp, err := client.Get(fmt.Sprintf("%s/debug/pprof/profile?seconds=%d", baseURL, seconds))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,257 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bench generates synthetic push load against a Pushgateway and
+// measures the latency of the pushes, to make performance regressions in the
+// push path measurable. The load is steady for the whole run so that profiles
+// of the Pushgateway (see /debug/pprof) taken meanwhile are representative.
+package bench
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+	"golang.org/x/net/context"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Payload formats.
+const (
+	FormatText     = "text"
+	FormatProtobuf = "protobuf"
+)
+
+const (
+	textContentType     = "text/plain; version=0.0.4"
+	protobufContentType = "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+)
+
+// Config configures a benchmark run.
+type Config struct {
+	// URL is the base URL of the Pushgateway, e.g.
+	// 'http://localhost:9091'.
+	URL string
+	// Job is the job label of all groups pushed to. The groups are
+	// distinguished by an instance label.
+	Job string
+	// Groups is the number of groups pushed to in turn, each with
+	// SeriesPerGroup series of a gauge.
+	Groups         int
+	SeriesPerGroup int
+	// Rate is the total number of pushes per second. If not positive,
+	// pushes are sent as fast as the Concurrency allows.
+	Rate float64
+	// Concurrency is the number of pushes in flight at most.
+	Concurrency int
+	// Duration of the run.
+	Duration time.Duration
+	// Format is FormatText or FormatProtobuf.
+	Format string
+	// Method is the HTTP method of the pushes, i.e. PUT or POST.
+	Method string
+	// Authorization, if not empty, is sent as Authorization header.
+	Authorization string
+	// Client sends the pushes. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// Result is the outcome of a benchmark run.
+type Result struct {
+	// Pushes is the number of pushes sent, including failed ones.
+	Pushes int
+	// Failures counts failed pushes by status code, or by 'error' if no
+	// response was received.
+	Failures map[string]int
+	// Elapsed is the time the run took.
+	Elapsed time.Duration
+
+	latencies []time.Duration // Sorted.
+}
+
+// Percentile returns the latency below which the fraction q (between 0 and 1)
+// of the pushes completed (including failed ones).
+func (r *Result) Percentile(q float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(q*float64(len(r.latencies)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return r.latencies[i]
+}
+
+// Report writes a human-readable summary of r to w.
+func (r *Result) Report(w io.Writer) {
+	failed := 0
+	codes := make([]string, 0, len(r.Failures))
+	for code, n := range r.Failures {
+		failed += n
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	fmt.Fprintf(w, "Pushes:     %d in %s (%.1f/s)\n", r.Pushes, r.Elapsed, float64(r.Pushes)/r.Elapsed.Seconds())
+	fmt.Fprintf(w, "Failures:   %d", failed)
+	for _, code := range codes {
+		fmt.Fprintf(w, " %s=%d", code, r.Failures[code])
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Latency:    p50=%s p90=%s p99=%s max=%s\n",
+		r.Percentile(.5), r.Percentile(.9), r.Percentile(.99), r.Percentile(1),
+	)
+}
+
+// Run pushes to the Pushgateway as configured until c.Duration has passed or
+// ctx is done, and returns the result. An error is returned if c is invalid.
+func Run(ctx context.Context, c Config) (*Result, error) {
+	if c.Groups <= 0 || c.SeriesPerGroup <= 0 || c.Concurrency <= 0 {
+		return nil, fmt.Errorf("groups, series per group, and concurrency have to be positive")
+	}
+	if c.Format != FormatText && c.Format != FormatProtobuf {
+		return nil, fmt.Errorf("unknown payload format %q", c.Format)
+	}
+	if c.Method != "PUT" && c.Method != "POST" {
+		return nil, fmt.Errorf("unsupported method %q", c.Method)
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.Duration)
+	defer cancel()
+
+	var (
+		pushes = make(chan int) // Sequence numbers of the pushes.
+		wg     sync.WaitGroup
+		mtx    sync.Mutex // Protects res.
+		res    = &Result{Failures: map[string]int{}}
+	)
+	for i := 0; i < c.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := range pushes {
+				start := time.Now()
+				code := push(client, c, seq)
+				latency := time.Since(start)
+				mtx.Lock()
+				res.Pushes++
+				res.latencies = append(res.latencies, latency)
+				if code != "" {
+					res.Failures[code]++
+				}
+				mtx.Unlock()
+			}
+		}()
+	}
+
+	start := time.Now()
+	var tick <-chan time.Time
+	if c.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / c.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+loop:
+	for seq := 0; ; seq++ {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				break loop
+			}
+		}
+		select {
+		case pushes <- seq:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(pushes)
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+	return res, nil
+}
+
+// push sends the push with the given sequence number. It returns the status
+// code if the push failed, 'error' if no response was received, or an empty
+// string upon success.
+func push(client *http.Client, c Config, seq int) string {
+	group := seq % c.Groups
+	body, contentType := payload(c, seq)
+	req, err := http.NewRequest(
+		c.Method,
+		fmt.Sprintf("%s/metrics/job/%s/instance/%d", c.URL, url.PathEscape(c.Job), group),
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return "error"
+	}
+	req.Header.Set("Content-Type", contentType)
+	if c.Authorization != "" {
+		req.Header.Set("Authorization", c.Authorization)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "error"
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return strconv.Itoa(resp.StatusCode)
+	}
+	return ""
+}
+
+// payload returns the body of the push with the given sequence number and its
+// content type. The values change with every push so that nothing can be
+// skipped as a duplicate.
+func payload(c Config, seq int) ([]byte, string) {
+	mf := &dto.MetricFamily{
+		Name: proto.String("pushgateway_bench_value"),
+		Help: proto.String("Synthetic value pushed by the Pushgateway benchmark."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for i := 0; i < c.SeriesPerGroup; i++ {
+		mf.Metric = append(mf.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{{
+				Name:  proto.String("series"),
+				Value: proto.String(strconv.Itoa(i)),
+			}},
+			Gauge: &dto.Gauge{Value: proto.Float64(float64(seq + i))},
+		})
+	}
+	var buf bytes.Buffer
+	if c.Format == FormatProtobuf {
+		pbutil.WriteDelimited(&buf, mf)
+		return buf.Bytes(), protobufContentType
+	}
+	fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n", mf.GetName(), mf.GetHelp(), mf.GetName())
+	for _, m := range mf.Metric {
+		fmt.Fprintf(&buf, "%s{series=%q} %g\n", mf.GetName(), m.Label[0].GetValue(), m.Gauge.GetValue())
+	}
+	return buf.Bytes(), textContentType
+}
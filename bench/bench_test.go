@@ -0,0 +1,85 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestRun(t *testing.T) {
+	var (
+		mtx    sync.Mutex
+		paths  = map[string]int{}
+		types  = map[string]int{}
+		pushes int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		pushes++
+		paths[r.URL.Path]++
+		types[r.Header.Get("Content-Type")]++
+		if pushes%2 == 0 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	for _, format := range []string{FormatText, FormatProtobuf} {
+		mtx.Lock()
+		pushes = 0
+		mtx.Unlock()
+		res, err := Run(context.Background(), Config{
+			URL:            ts.URL,
+			Job:            "bench",
+			Groups:         3,
+			SeriesPerGroup: 5,
+			Rate:           200,
+			Concurrency:    2,
+			Duration:       200 * time.Millisecond,
+			Format:         format,
+			Method:         "PUT",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Pushes == 0 || res.Pushes > 41 {
+			t.Errorf("%s: Unexpected number of pushes %d.", format, res.Pushes)
+		}
+		if expected, got := res.Pushes/2, res.Failures["503"]; expected != got {
+			t.Errorf("%s: Wanted %d failures, got %d.", format, expected, got)
+		}
+		if res.Percentile(.5) > res.Percentile(1) || res.Percentile(1) <= 0 {
+			t.Errorf("%s: Implausible latencies p50=%s max=%s.", format, res.Percentile(.5), res.Percentile(1))
+		}
+	}
+	if len(paths) != 3 || paths["/metrics/job/bench/instance/0"] == 0 {
+		t.Errorf("Unexpected paths pushed to: %v", paths)
+	}
+	if len(types) != 2 {
+		t.Errorf("Unexpected content types: %v", types)
+	}
+
+	if _, err := Run(context.Background(), Config{Groups: 1, SeriesPerGroup: 1, Concurrency: 1, Format: "json", Method: "PUT"}); err == nil {
+		t.Error("Expected error for unknown format.")
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ConsulRegistrar registers a Pushgateway as a service with the local Consul
+// agent. The service comes with an HTTP health check against the readiness
+// endpoint of the Pushgateway so that Consul only reports it as healthy (and
+// thus to Prometheus) while it is ready.
+type ConsulRegistrar struct {
+	// Address of the Consul agent (host:port).
+	Address string
+	// Service is the name of the service to register.
+	Service string
+	// Tags are attached to the registered service.
+	Tags []string
+	// Advertise is the address (host:port) under which the Pushgateway can
+	// be reached.
+	Advertise string
+	// CheckURL is the URL Consul polls to check the health of the
+	// Pushgateway.
+	CheckURL string
+	// CheckInterval is the interval of the health check in the syntax of
+	// Consul, e.g. "10s".
+	CheckInterval string
+
+	Client *http.Client // If nil, http.DefaultClient is used.
+}
+
+type consulService struct {
+	ID      string
+	Name    string
+	Tags    []string `json:",omitempty"`
+	Address string
+	Port    int
+	Check   consulCheck
+}
+
+type consulCheck struct {
+	HTTP     string
+	Interval string
+}
+
+// ServiceID returns the ID under which the service is registered. It is unique
+// per advertised address.
+func (c *ConsulRegistrar) ServiceID() string {
+	return c.Service + "-" + c.Advertise
+}
+
+// Register implements Registrar.
+func (c *ConsulRegistrar) Register() error {
+	host, portString, err := net.SplitHostPort(c.Advertise)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return fmt.Errorf("invalid port in advertise address %q: %s", c.Advertise, err)
+	}
+	body, err := json.Marshal(consulService{
+		ID:      c.ServiceID(),
+		Name:    c.Service,
+		Tags:    c.Tags,
+		Address: host,
+		Port:    port,
+		Check: consulCheck{
+			HTTP:     c.CheckURL,
+			Interval: c.CheckInterval,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return c.put("/v1/agent/service/register", body)
+}
+
+// Deregister implements Registrar.
+func (c *ConsulRegistrar) Deregister() error {
+	return c.put("/v1/agent/service/deregister/"+url.QueryEscape(c.ServiceID()), nil)
+}
+
+func (c *ConsulRegistrar) put(path string, body []byte) error {
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("PUT", "http://"+c.Address+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code %d from Consul: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package discovery registers a Pushgateway with service discovery mechanisms
+// supported by Prometheus so that it can be found and scraped automatically.
+package discovery
+
+// Registrar registers a Pushgateway with a service discovery mechanism.
+type Registrar interface {
+	// Register announces the Pushgateway as ready to be scraped.
+	Register() error
+	// Deregister withdraws the announcement made by Register.
+	Deregister() error
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConsulRegistrar(t *testing.T) {
+	var (
+		paths   []string
+		service consulService
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			t.Errorf("Wanted method PUT, got %s.", r.Method)
+		}
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path == "/v1/agent/service/register" {
+			if err := json.NewDecoder(r.Body).Decode(&service); err != nil {
+				t.Error(err)
+			}
+		}
+	}))
+	defer ts.Close()
+
+	reg := &ConsulRegistrar{
+		Address:       strings.TrimPrefix(ts.URL, "http://"),
+		Service:       "pushgateway",
+		Tags:          []string{"a", "b"},
+		Advertise:     "pgw.example.org:9091",
+		CheckURL:      "http://pgw.example.org:9091/-/ready",
+		CheckInterval: "10s",
+	}
+	if err := reg.Register(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Deregister(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPaths := []string{
+		"/v1/agent/service/register",
+		"/v1/agent/service/deregister/pushgateway-pgw.example.org:9091",
+	}
+	if expected, got := strings.Join(expectedPaths, " "), strings.Join(paths, " "); expected != got {
+		t.Errorf("Wanted requests to %s, got %s.", expected, got)
+	}
+	if expected, got := "pgw.example.org", service.Address; expected != got {
+		t.Errorf("Wanted address %q, got %q.", expected, got)
+	}
+	if expected, got := 9091, service.Port; expected != got {
+		t.Errorf("Wanted port %d, got %d.", expected, got)
+	}
+	if expected, got := reg.CheckURL, service.Check.HTTP; expected != got {
+		t.Errorf("Wanted check URL %q, got %q.", expected, got)
+	}
+
+	reg.Advertise = "no-port"
+	if err := reg.Register(); err == nil {
+		t.Error("Expected error for advertise address without port.")
+	}
+}
+
+func TestFileSDRegistrar(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "discovery.TestFileSDRegistrar.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	reg := &FileSDRegistrar{
+		Path:      filepath.Join(tempDir, "pushgateway.json"),
+		Advertise: "pgw.example.org:9091",
+		Labels:    map[string]string{"env": "test"},
+	}
+	if err := reg.Register(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(reg.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tgs []targetGroup
+	if err := json.Unmarshal(b, &tgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgs) != 1 || len(tgs[0].Targets) != 1 || tgs[0].Targets[0] != reg.Advertise || tgs[0].Labels["env"] != "test" {
+		t.Errorf("Unexpected target groups: %s", b)
+	}
+
+	if err := reg.Deregister(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(reg.Path); !os.IsNotExist(err) {
+		t.Errorf("Wanted file to be removed, got %v.", err)
+	}
+	// Deregistering twice is fine.
+	if err := reg.Deregister(); err != nil {
+		t.Error(err)
+	}
+}
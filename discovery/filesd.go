@@ -0,0 +1,74 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FileSDRegistrar registers a Pushgateway by writing a file in the format
+// understood by the file-based service discovery of Prometheus. The file only
+// contains this Pushgateway, so every Pushgateway needs its own file (which
+// can be picked up by a glob pattern in the Prometheus configuration).
+type FileSDRegistrar struct {
+	// Path of the file to write.
+	Path string
+	// Advertise is the address (host:port) under which the Pushgateway can
+	// be reached.
+	Advertise string
+	// Labels are attached to the target.
+	Labels map[string]string
+}
+
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// Register implements Registrar. The file is written atomically so that
+// Prometheus never reads a partial file.
+func (f *FileSDRegistrar) Register() error {
+	b, err := json.MarshalIndent([]targetGroup{{
+		Targets: []string{f.Advertise},
+		Labels:  f.Labels,
+	}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), filepath.Base(f.Path)+".tmp.")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// Deregister implements Registrar by removing the file.
+func (f *FileSDRegistrar) Deregister() error {
+	if err := os.Remove(f.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"net/http"
+
+	"github.com/prometheus/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager returns an autocert.Manager obtaining certificates for the
+// ACMEHosts of the given options, or nil if there are none.
+func newACMEManager(o *Options) *autocert.Manager {
+	if len(o.ACMEHosts) == 0 {
+		return nil
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(o.ACMEHosts...),
+		Email:      o.ACMEEmail,
+	}
+	if o.ACMECacheDir != "" {
+		m.Cache = autocert.DirCache(o.ACMECacheDir)
+	}
+	if o.ACMEDirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: o.ACMEDirectoryURL}
+	}
+	return m
+}
+
+// serveACMEHTTP serves the http-01 challenges of m on the given address until
+// the returned server is closed. Other requests are redirected to HTTPS.
+func serveACMEHTTP(m *autocert.Manager, address string) *http.Server {
+	server := &http.Server{Addr: address, Handler: m.HTTPHandler(nil)}
+	go func() {
+		log.Printf("Serving ACME http-01 challenges on %s.", address)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Print("Error serving ACME http-01 challenges: ", err)
+		}
+	}()
+	return server
+}
@@ -0,0 +1,182 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/log"
+	"golang.org/x/net/context"
+
+	"github.com/prometheus/pushgateway/secret"
+)
+
+const canaryMetricName = "pushgateway_canary_heartbeat_timestamp_seconds"
+
+// canary periodically pushes a heartbeat to the Gateway it belongs to via
+// HTTP, i.e. through the same path as any other push, and instruments the
+// outcome.
+type canary struct {
+	url    string
+	token  *secret.Secret // Nil if no token is sent.
+	client *http.Client
+
+	duration    prometheus.Histogram
+	failures    prometheus.Counter
+	lastSuccess prometheus.Gauge
+}
+
+// newCanary returns a canary for a Gateway with the given options.
+func newCanary(o *Options) (*canary, error) {
+	host, port, err := net.SplitHostPort(o.ListenAddress)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		// Connect via loopback, in the IP version listened on.
+		switch {
+		case o.IPStack == IPStackIPv6 || ip != nil && ip.To4() == nil && o.IPStack != IPStackIPv4:
+			host = "::1"
+		case o.IPStack == IPStackIPv4 || ip != nil:
+			host = "127.0.0.1"
+		default:
+			host = "localhost"
+		}
+	}
+	scheme := "http"
+	transport := &http.Transport{}
+	if o.TLSCertFile != "" || len(o.ACMEHosts) > 0 {
+		scheme = "https"
+		// The certificate is not expected to be valid for the
+		// address the canary connects to. As the canary talks to its
+		// own process, there is nothing to verify anyway.
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		if len(o.ACMEHosts) > 0 {
+			// Certificates are only obtained for the ACME hosts.
+			transport.TLSClientConfig.ServerName = o.ACMEHosts[0]
+		}
+	}
+	c := &canary{
+		url: fmt.Sprintf(
+			"%s://%s/metrics/job/%s",
+			scheme, net.JoinHostPort(host, port), url.PathEscape(o.CanaryJob),
+		),
+		client: &http.Client{Transport: transport, Timeout: o.CanaryInterval},
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "pushgateway",
+			Subsystem: "canary",
+			Name:      "push_duration_seconds",
+			Help:      "Duration of the pushes of the canary, including failed ones.",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "pushgateway",
+			Subsystem: "canary",
+			Name:      "push_failures_total",
+			Help:      "Total number of failed pushes of the canary.",
+		}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "pushgateway",
+			Subsystem: "canary",
+			Name:      "last_push_success_timestamp_seconds",
+			Help:      "Unix time of the last successful push of the canary. 0 if there was none yet.",
+		}),
+	}
+	if o.CanaryTokenFile != "" {
+		token, err := secret.New(o.CanaryTokenFile, o.SecretsRefreshInterval)
+		if err != nil {
+			return nil, err
+		}
+		c.token = token
+	}
+	return c, nil
+}
+
+// run pushes every interval until ctx is done.
+func (c *canary) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := c.push(); err != nil {
+			log.Print("Canary push failed: ", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// push pushes the heartbeat once and returns an error if the push failed.
+func (c *canary) push() error {
+	start := time.Now()
+	body := fmt.Sprintf(
+		"# HELP %s Time of the last heartbeat pushed by the canary of the Pushgateway.\n# TYPE %s gauge\n%s %f\n",
+		canaryMetricName, canaryMetricName, canaryMetricName,
+		float64(start.UnixNano())/1e9,
+	)
+	err := c.doPush(body)
+	c.duration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		c.failures.Inc()
+		return err
+	}
+	c.lastSuccess.Set(float64(time.Now().UnixNano()) / 1e9)
+	return nil
+}
+
+func (c *canary) doPush(body string) error {
+	req, err := http.NewRequest("PUT", c.url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	if c.token != nil {
+		token, _ := c.token.Get()
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Describe implements prometheus.Collector.
+func (c *canary) Describe(ch chan<- *prometheus.Desc) {
+	c.duration.Describe(ch)
+	c.failures.Describe(ch)
+	c.lastSuccess.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *canary) Collect(ch chan<- prometheus.Metric) {
+	c.duration.Collect(ch)
+	c.failures.Collect(ch)
+	c.lastSuccess.Collect(ch)
+}
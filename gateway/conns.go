@@ -0,0 +1,123 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// connTracker keeps track of the connections of the HTTP server via its
+// ConnState hook, instruments them, and closes connections becoming idle
+// while more than maxIdle connections are idle already.
+type connTracker struct {
+	maxIdle int
+
+	mtx  sync.Mutex // Protects idle.
+	idle map[net.Conn]struct{}
+
+	open       prometheus.Gauge
+	idleGauge  prometheus.Gauge
+	accepted   prometheus.Counter
+	idleClosed prometheus.Counter
+}
+
+// newConnTracker returns a connTracker allowing maxIdle idle connections. If
+// maxIdle is 0, there is no limit.
+func newConnTracker(maxIdle int) *connTracker {
+	return &connTracker{
+		maxIdle: maxIdle,
+		idle:    map[net.Conn]struct{}{},
+		open: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "pushgateway",
+			Subsystem: "http",
+			Name:      "connections_open",
+			Help:      "Number of currently open HTTP connections, including idle ones.",
+		}),
+		idleGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "pushgateway",
+			Subsystem: "http",
+			Name:      "connections_idle",
+			Help:      "Number of currently open HTTP connections idle between requests (keep-alive).",
+		}),
+		accepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "pushgateway",
+			Subsystem: "http",
+			Name:      "connections_accepted_total",
+			Help:      "Total number of accepted HTTP connections.",
+		}),
+		idleClosed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "pushgateway",
+			Subsystem: "http",
+			Name:      "idle_connections_closed_total",
+			Help:      "Total number of HTTP connections closed upon becoming idle because the maximum number of idle connections was reached.",
+		}),
+	}
+}
+
+// connState is to be used as the ConnState hook of an http.Server.
+func (t *connTracker) connState(c net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		t.accepted.Inc()
+		t.open.Inc()
+	case http.StateActive:
+		t.setIdle(c, false)
+	case http.StateIdle:
+		if !t.setIdle(c, true) {
+			t.idleClosed.Inc()
+			c.Close()
+		}
+	case http.StateHijacked, http.StateClosed:
+		t.setIdle(c, false)
+		t.open.Dec()
+	}
+}
+
+// setIdle records whether c is idle. It returns false if c cannot become idle
+// because the maximum number of idle connections is reached.
+func (t *connTracker) setIdle(c net.Conn, idle bool) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if idle {
+		if t.maxIdle > 0 && len(t.idle) >= t.maxIdle {
+			return false
+		}
+		t.idle[c] = struct{}{}
+	} else {
+		delete(t.idle, c)
+	}
+	t.idleGauge.Set(float64(len(t.idle)))
+	return true
+}
+
+// Describe implements prometheus.Collector.
+func (t *connTracker) Describe(ch chan<- *prometheus.Desc) {
+	t.open.Describe(ch)
+	t.idleGauge.Describe(ch)
+	t.accepted.Describe(ch)
+	t.idleClosed.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (t *connTracker) Collect(ch chan<- prometheus.Metric) {
+	t.open.Collect(ch)
+	t.idleGauge.Collect(ch)
+	t.accepted.Collect(ch)
+	t.idleClosed.Collect(ch)
+}
@@ -0,0 +1,698 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gateway wires the storage and the HTTP handlers of the Pushgateway
+// together. It allows to run a Pushgateway as part of another Go program.
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/go-bindata-assetfs"
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/discovery"
+	"github.com/prometheus/pushgateway/handler"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Options contains options for New.
+type Options struct {
+	// ListenAddress is the address Run listens on (see IPStack).
+	ListenAddress string
+	// If TelemetryAddress is set, Run serves the metrics of the Pushgateway
+	// (see MetricsPath), the pprof endpoints under /debug/pprof, and the
+	// readiness endpoint /-/ready on that address instead of
+	// ListenAddress, so that monitoring traffic can be firewalled
+	// separately from pushes. It is plain HTTP and not subject to the
+	// Middlewares.
+	TelemetryAddress string
+	// If TLSCertFile and TLSKeyFile are set, Run serves HTTPS (including
+	// HTTP/2) with the certificate and key in the given PEM files. Both
+	// may be given as other secret sources, too (see package secret), and
+	// are reloaded upon change (see SecretsRefreshInterval).
+	TLSCertFile string
+	TLSKeyFile  string
+	// If ACMEHosts are set (instead of TLSCertFile and TLSKeyFile), Run
+	// serves HTTPS with certificates for those host names obtained and
+	// renewed automatically via ACME (e.g. from Let's Encrypt), using the
+	// tls-alpn-01 challenge on ListenAddress. If ACMEHTTPAddress is set,
+	// the http-01 challenge is served on that address, too. Certificates
+	// and the account key are cached in ACMECacheDir (if set). ACMEEmail
+	// is the contact address of the account, and ACMEDirectoryURL the
+	// directory of the certificate authority (Let's Encrypt if empty).
+	ACMEHosts        []string
+	ACMEHTTPAddress  string
+	ACMECacheDir     string
+	ACMEEmail        string
+	ACMEDirectoryURL string
+	// If TLSClientCAFile is set, TLS client certificates are verified
+	// against the CA certificates in the given PEM file (if presented by
+	// the client). Requires TLSCertFile and TLSKeyFile, or ACMEHosts.
+	TLSClientCAFile string
+	// IPStack determines the IP versions listened on.
+	IPStack IPStack
+	// If EnableH2C is true, HTTP/2 without TLS is accepted, too.
+	EnableH2C bool
+	// KeepAliveTimeout is how long an idle connection is kept open for
+	// further requests. If 0, there is no timeout. If MaxIdleConnections
+	// is positive, connections becoming idle while that many connections
+	// are idle already are closed. MaxHeaderBytes limits the size of
+	// request headers (http.DefaultMaxHeaderBytes if 0).
+	KeepAliveTimeout   time.Duration
+	MaxIdleConnections int
+	MaxHeaderBytes     int
+	// MetricsPath is the path under which the metrics of the Pushgateway,
+	// including the pushed metrics, are exposed. If empty, no metrics are
+	// exposed.
+	MetricsPath string
+	// If GroupedScrapes is true, each group is additionally exposed under
+	// its own path, listed by /api/v1/targets for the HTTP-based service
+	// discovery of Prometheus. See handler.Grouped.
+	GroupedScrapes bool
+	// IdempotencyWindow is how long the responses to requests with an
+	// Idempotency-Key header are remembered, IdempotencyMaxEntries how many
+	// of them at most. See handler.Idempotent.
+	IdempotencyWindow     time.Duration
+	IdempotencyMaxEntries int
+	// FirstClassLabels are listed first on the status page.
+	FirstClassLabels []string
+	// Storage and Push are the options for the DiskMetricStore and the
+	// push and delete handlers, respectively.
+	Storage storage.DiskMetricStoreOptions
+	Push    handler.PushOptions
+	// LoadingMode determines how requests are handled while the
+	// DiskMetricStore loads the persisted metrics. Unless it is
+	// handler.LoadingBlock, loading happens in the background (regardless
+	// of Storage.LoadInBackground), and the readiness endpoint only
+	// reports the Gateway as ready once loading is done.
+	LoadingMode handler.LoadingMode
+	// Asset and AssetDir provide the static files and templates for the
+	// web interface, as generated by go-bindata.
+	Asset    func(string) ([]byte, error)
+	AssetDir func(string) ([]string, error)
+	// Flags and BuildInfo are displayed on the status page.
+	Flags     map[string]string
+	BuildInfo map[string]string
+	// Middlewares wrap all handlers of the Gateway, the first one being
+	// the outermost. Use them for authentication, rate limiting, auditing,
+	// and the like. See handler.Chain.
+	Middlewares []handler.Middleware
+	// If ReplayFile is set, the requests recorded in it (see
+	// handler.Record) are replayed upon creation of the Gateway, bypassing
+	// the Middlewares.
+	ReplayFile string
+	// If CanaryInterval is positive, Run pushes a heartbeat to the group
+	// with CanaryJob as job label every CanaryInterval via HTTP, i.e.
+	// through the Middlewares and the listener, and exposes the outcome
+	// as metrics. If CanaryTokenFile is set, the token in that file (or
+	// other secret source, see package secret) is sent as bearer token
+	// with each push.
+	CanaryInterval  time.Duration
+	CanaryJob       string
+	CanaryTokenFile string
+	// SecretsRefreshInterval is the interval at which TLSCertFile,
+	// TLSKeyFile, and CanaryTokenFile are checked for changes. If not
+	// positive, they are only read once.
+	SecretsRefreshInterval time.Duration
+	// If LeaseFile is set, the Gateway only accepts pushes and deletions
+	// while it holds the leader lease in that file (see package lease),
+	// identified by InstanceID. The lease is acquired or renewed every
+	// third of LeaseTTL. While standing by, the Gateway does not persist
+	// its metrics. Upon becoming the leader, it reloads the metrics
+	// persisted by the previous leader. Hence, all instances sharing the
+	// lease file have to share Storage.PersistenceFile, too.
+	LeaseFile  string
+	LeaseTTL   time.Duration
+	InstanceID string
+	// If DisableDelete is true, the DELETE method is not served, neither
+	// by the API nor by the deprecated API. If DisablePostMerge is true,
+	// POST requests replace the group like PUT requests instead of
+	// merging into it.
+	DisableDelete    bool
+	DisablePostMerge bool
+	// Registrars are used to register the Gateway with service discovery
+	// mechanisms while Run is serving requests.
+	Registrars []discovery.Registrar
+}
+
+// Gateway is a Pushgateway, consisting of a DiskMetricStore and the HTTP
+// handlers to push metrics to it and to expose them.
+type Gateway struct {
+	opts    *Options
+	ms      *storage.DiskMetricStore
+	canary  *canary
+	elector *elector
+	router  *httprouter.Router
+	acme    *autocert.Manager
+	handler http.Handler
+	server  *http.Server
+
+	telemetry       *httprouter.Router // Nil unless TelemetryAddress is set.
+	telemetryServer *http.Server
+
+	mtx         sync.RWMutex // Protects ready and listenAddrs.
+	ready       bool
+	listenAddrs []string
+}
+
+// New creates a Gateway with the given options and starts its
+// DiskMetricStore. To serve requests, either call Run, or mount the Handler
+// in an http.Server of your own. In the latter case, the DiskMetricStore has
+// to be shut down via MetricStore().Shutdown() once the Gateway is not needed
+// anymore.
+//
+// The DiskMetricStore is registered with the default Prometheus registry, and
+// the pushed metrics are injected into the exposition of the default registry
+// via prometheus.SetMetricFamilyInjectionHook. Hence, only one Gateway may be
+// created per process.
+func New(o *Options) (*Gateway, error) {
+	if (o.TLSCertFile == "") != (o.TLSKeyFile == "") {
+		return nil, errors.New("TLS certificate and key file have to be set together")
+	}
+	if o.TLSCertFile != "" && len(o.ACMEHosts) > 0 {
+		return nil, errors.New("TLS certificate file and ACME hosts are mutually exclusive")
+	}
+	if o.TLSClientCAFile != "" && o.TLSCertFile == "" && len(o.ACMEHosts) == 0 {
+		return nil, errors.New("TLS client CA file requires a TLS certificate and key file or ACME hosts")
+	}
+
+	storageOpts := o.Storage
+	if o.LoadingMode != handler.LoadingBlock {
+		storageOpts.LoadInBackground = true
+	}
+	ms := storage.NewDiskMetricStore(&storageOpts)
+	if err := prometheus.Register(ms); err != nil {
+		ms.Shutdown()
+		return nil, err
+	}
+	pushOpts := &o.Push
+	// Expose the pushed metrics and the per-group push statistics.
+	prometheus.SetMetricFamilyInjectionHook(func() []*dto.MetricFamily {
+		mfs := ms.GetMetricFamilies()
+		if pushOpts.GroupStats != nil {
+			mfs = append(mfs, pushOpts.GroupStats.MetricFamilies()...)
+		}
+		return mfs
+	})
+	// Enable collect checks for debugging.
+	// prometheus.EnableCollectChecks(true)
+
+	scrapes := handler.NewScrapeTracker(pushOpts.TrustedProxies)
+	if err := prometheus.Register(scrapes); err != nil {
+		ms.Shutdown()
+		return nil, err
+	}
+
+	freeze := handler.NewFreeze(pushOpts.TrustedProxies)
+	if err := prometheus.Register(freeze); err != nil {
+		ms.Shutdown()
+		return nil, err
+	}
+
+	r := httprouter.New()
+	// Telemetry is served by r, too, unless it has a listener of its own.
+	telemetry := r
+	if o.TelemetryAddress != "" {
+		telemetry = httprouter.New()
+	}
+	if o.MetricsPath != "" {
+		telemetry.Handler("GET", o.MetricsPath, scrapes.Handler(prometheus.InstrumentHandler("prometheus", handler.Metrics())))
+	}
+
+	// Handlers for pushing and deleting metrics.
+	ic := handler.NewIdempotencyCache(o.IdempotencyWindow, o.IdempotencyMaxEntries)
+	postReplace := o.DisablePostMerge
+	r.PUT("/metrics/job/:job/*labels", handler.Idempotent(ic, handler.Push(ms, true, pushOpts)))
+	r.POST("/metrics/job/:job/*labels", handler.Idempotent(ic, handler.Push(ms, postReplace, pushOpts)))
+	r.PATCH("/metrics/job/:job/*labels", handler.Idempotent(ic, handler.Patch(ms, pushOpts)))
+	r.PUT("/metrics/job/:job", handler.Idempotent(ic, handler.Push(ms, true, pushOpts)))
+	r.POST("/metrics/job/:job", handler.Idempotent(ic, handler.Push(ms, postReplace, pushOpts)))
+	r.PATCH("/metrics/job/:job", handler.Idempotent(ic, handler.Patch(ms, pushOpts)))
+	if !o.DisableDelete {
+		r.DELETE("/metrics/job/:job/*labels", handler.Idempotent(ic, handler.Delete(ms, pushOpts)))
+		r.DELETE("/metrics/job/:job", handler.Idempotent(ic, handler.Delete(ms, pushOpts)))
+	}
+	r.GET("/metrics/job/:job/*labels", handler.Group(ms, pushOpts))
+	r.GET("/metrics/job/:job", handler.Group(ms, pushOpts))
+
+	// Handlers for scraping groups as individual targets.
+	if o.GroupedScrapes {
+		r.GET("/metrics/grouped/:hash", handler.Grouped(ms))
+		r.GET("/api/v1/targets", handler.GroupedTargets(ms))
+	}
+
+	// Handlers for the deprecated API.
+	r.PUT("/metrics/jobs/:job/instances/:instance", handler.Idempotent(ic, handler.LegacyPush(ms, true, pushOpts)))
+	r.POST("/metrics/jobs/:job/instances/:instance", handler.Idempotent(ic, handler.LegacyPush(ms, postReplace, pushOpts)))
+	r.PUT("/metrics/jobs/:job", handler.Idempotent(ic, handler.LegacyPush(ms, true, pushOpts)))
+	r.POST("/metrics/jobs/:job", handler.Idempotent(ic, handler.LegacyPush(ms, postReplace, pushOpts)))
+	if !o.DisableDelete {
+		r.DELETE("/metrics/jobs/:job/instances/:instance", handler.Idempotent(ic, handler.LegacyDelete(ms)))
+		r.DELETE("/metrics/jobs/:job", handler.Idempotent(ic, handler.LegacyDelete(ms)))
+	}
+
+	// Handler for restoring deleted groups.
+	if o.Storage.TombstoneRetention > 0 {
+		r.POST("/api/v1/metrics/job/:job/*labels", handler.Restore(ms, pushOpts))
+	}
+
+	// Handlers for deleting groups or single metric families via the API.
+	if !o.DisableDelete {
+		r.DELETE("/api/v1/metrics/job/:job/*labels", handler.Idempotent(ic, handler.Delete(ms, pushOpts)))
+		r.DELETE("/api/v1/metrics/job/:job", handler.Idempotent(ic, handler.Delete(ms, pushOpts)))
+	}
+
+	// Handler for admin operations.
+	r.POST("/api/v1/admin/compact", handler.Compact(ms))
+	r.GET("/api/v1/admin/freeze", freeze.Handler(true))
+	r.POST("/api/v1/admin/freeze", freeze.Handler(true))
+	r.POST("/api/v1/admin/unfreeze", freeze.Handler(false))
+
+	// Handler for the quota of a job.
+	if pushOpts.Quotas != nil {
+		r.GET("/api/v1/quota/:job", handler.QuotaStatus(ms, pushOpts.Quotas))
+	}
+
+	// Handlers for the annotations of a group.
+	r.GET("/api/v1/annotations/job/:job/*labels", handler.Annotations(ms, pushOpts))
+	r.POST("/api/v1/annotations/job/:job/*labels", handler.Annotations(ms, pushOpts))
+	r.GET("/api/v1/annotations/job/:job", handler.Annotations(ms, pushOpts))
+	r.POST("/api/v1/annotations/job/:job", handler.Annotations(ms, pushOpts))
+
+	// Handlers for echoing pushes as they would be stored.
+	r.POST("/api/v1/echo", handler.Echo(ms, pushOpts))
+	r.POST("/api/v1/echo/job/:job/*labels", handler.Echo(ms, pushOpts))
+	r.POST("/api/v1/echo/job/:job", handler.Echo(ms, pushOpts))
+
+	// Handlers for the recorded history of a group.
+	if o.Storage.HistoryDir != "" {
+		r.GET("/api/v1/history/job/:job/*labels", handler.History(ms, pushOpts))
+		r.GET("/api/v1/history/job/:job", handler.History(ms, pushOpts))
+	}
+
+	// Handler for exporting all stored metrics.
+	r.GET("/api/v1/export", handler.Export(ms))
+
+	// Handlers for listing and deleting groups selected by label matchers.
+	r.GET("/api/v1/groups", handler.Groups(ms, pushOpts, false))
+	if !o.DisableDelete {
+		r.DELETE("/api/v1/groups", handler.Groups(ms, pushOpts, true))
+	}
+
+	// Handler for the state of asynchronous pushes.
+	if pushOpts.Tracker != nil {
+		r.GET("/api/v1/push/:id", handler.PushStatus(pushOpts.Tracker))
+	}
+
+	if o.Asset != nil {
+		r.Handler("GET", "/static/*filepath", prometheus.InstrumentHandler(
+			"static",
+			http.FileServer(
+				&assetfs.AssetFS{Asset: o.Asset, AssetDir: o.AssetDir},
+			),
+		))
+		statusHandler := prometheus.InstrumentHandlerFunc("status", handler.Status(ms, o.Asset, o.Flags, o.BuildInfo, o.FirstClassLabels))
+		r.Handler("GET", "/status", statusHandler)
+		r.Handler("GET", "/", statusHandler)
+	}
+
+	// Re-enable pprof.
+	telemetry.GET("/debug/pprof/*pprof", handlePprof)
+
+	// Freezing, standing by, and loading only apply to requests that made it through the
+	// configured Middlewares.
+	var leadership *handler.Leadership
+	if o.LeaseFile != "" {
+		if o.LeaseTTL <= 0 {
+			ms.Shutdown()
+			return nil, errors.New("lease TTL has to be positive")
+		}
+		leadership = handler.NewLeadership()
+		if err := prometheus.Register(leadership); err != nil {
+			ms.Shutdown()
+			return nil, err
+		}
+		ms.SetPersisting(false)
+	}
+	inner := freeze.Middleware()(r)
+	if leadership != nil {
+		inner = leadership.Middleware()(inner)
+	}
+	inner = handler.WhileLoading(ms, o.LoadingMode)(inner)
+	g := &Gateway{
+		opts:    o,
+		ms:      ms,
+		router:  r,
+		acme:    newACMEManager(o),
+		handler: handler.Chain(inner, o.Middlewares...),
+	}
+	if leadership != nil {
+		g.elector = newElector(o, ms, leadership)
+	}
+	telemetry.GET("/-/ready", g.handleReady)
+	if telemetry != r {
+		g.telemetry = telemetry
+		g.telemetryServer = &http.Server{
+			Addr:           o.TelemetryAddress,
+			Handler:        telemetry,
+			IdleTimeout:    o.KeepAliveTimeout,
+			MaxHeaderBytes: o.MaxHeaderBytes,
+		}
+	}
+	// Handler for the load, the advised backoff, the listen addresses, and
+	// the scrape activity.
+	r.GET("/api/v1/status", handler.LoadStatus(ms, pushOpts, g.ListenAddresses, scrapes, leadership))
+
+	if o.CanaryInterval > 0 {
+		c, err := newCanary(o)
+		if err != nil {
+			ms.Shutdown()
+			return nil, err
+		}
+		if err := prometheus.Register(c); err != nil {
+			ms.Shutdown()
+			return nil, err
+		}
+		g.canary = c
+	}
+
+	if o.ReplayFile != "" {
+		if err := replay(r, o.ReplayFile); err != nil {
+			ms.Shutdown()
+			return nil, err
+		}
+	}
+
+	conns := newConnTracker(o.MaxIdleConnections)
+	if err := prometheus.Register(conns); err != nil {
+		ms.Shutdown()
+		return nil, err
+	}
+	server := &http.Server{
+		Addr:           o.ListenAddress,
+		Handler:        g.handler,
+		IdleTimeout:    o.KeepAliveTimeout,
+		MaxHeaderBytes: o.MaxHeaderBytes,
+		ConnState:      conns.connState,
+	}
+	if o.EnableH2C {
+		server.Handler = h2c.NewHandler(g.handler, &http2.Server{})
+	}
+	if err := http2.ConfigureServer(server, nil); err != nil {
+		ms.Shutdown()
+		return nil, err
+	}
+
+	g.server = server
+	return g, nil
+}
+
+// Handler returns the http.Handler serving the API, the web interface, and
+// (if configured) the metrics of the Gateway, wrapped by the configured
+// Middlewares. Its readiness endpoint /-/ready only reports the Gateway as
+// ready while Run is serving requests. If Options.TelemetryAddress is set,
+// the metrics, the pprof endpoints, and /-/ready are served by
+// TelemetryHandler instead.
+func (g *Gateway) Handler() http.Handler {
+	return g.handler
+}
+
+// TelemetryHandler returns the http.Handler serving the metrics, the pprof
+// endpoints, and the readiness endpoint of the Gateway if
+// Options.TelemetryAddress is set, or nil otherwise.
+func (g *Gateway) TelemetryHandler() http.Handler {
+	if g.telemetry == nil {
+		return nil
+	}
+	return g.telemetry
+}
+
+// ListenAddresses returns the addresses Run listens on, with host and port
+// resolved (e.g. '[::]:9091' for ':9091'). It returns nil before Run has
+// started to listen.
+func (g *Gateway) ListenAddresses() []string {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	return g.listenAddrs
+}
+
+// MetricStore returns the DiskMetricStore of the Gateway.
+func (g *Gateway) MetricStore() *storage.DiskMetricStore {
+	return g.ms
+}
+
+// Run listens on the configured address (and TelemetryAddress, if set) and
+// serves requests until ctx is done. Then it shuts down the DiskMetricStore (which includes persisting the
+// metrics). An error is returned if serving failed for another reason than ctx
+// being done, or if shutting down the DiskMetricStore failed.
+func (g *Gateway) Run(ctx context.Context) error {
+	listeners, err := listen(g.opts.ListenAddress, g.opts.IPStack)
+	if err != nil {
+		g.ms.Shutdown()
+		return err
+	}
+	var telemetryListeners []net.Listener
+	if g.telemetryServer != nil {
+		telemetryListeners, err = listen(g.opts.TelemetryAddress, g.opts.IPStack)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			g.ms.Shutdown()
+			return err
+		}
+	}
+	closeListeners := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+		for _, l := range telemetryListeners {
+			l.Close()
+		}
+	}
+	addrs := make([]string, len(listeners))
+	for i, l := range listeners {
+		addrs[i] = l.Addr().String()
+	}
+	g.mtx.Lock()
+	g.listenAddrs = addrs
+	g.mtx.Unlock()
+	log.Printf("Listening on %s.", strings.Join(addrs, ", "))
+	if len(telemetryListeners) > 0 {
+		telemetryAddrs := make([]string, len(telemetryListeners))
+		for i, l := range telemetryListeners {
+			telemetryAddrs[i] = l.Addr().String()
+		}
+		log.Printf("Serving telemetry on %s.", strings.Join(telemetryAddrs, ", "))
+	}
+	if g.opts.TLSCertFile != "" || g.acme != nil {
+		if g.acme != nil {
+			g.server.TLSConfig.GetCertificate = g.acme.GetCertificate
+			g.server.TLSConfig.NextProtos = append(g.server.TLSConfig.NextProtos, acme.ALPNProto)
+			if g.opts.ACMEHTTPAddress != "" {
+				defer serveACMEHTTP(g.acme, g.opts.ACMEHTTPAddress).Close()
+			}
+		} else {
+			certs, err := newCertReloader(g.opts.TLSCertFile, g.opts.TLSKeyFile, g.opts.SecretsRefreshInterval)
+			if err != nil {
+				closeListeners()
+				g.ms.Shutdown()
+				return err
+			}
+			g.server.TLSConfig.GetCertificate = certs.GetCertificate
+		}
+		if g.opts.TLSClientCAFile != "" {
+			pool, err := loadCertPool(g.opts.TLSClientCAFile)
+			if err != nil {
+				closeListeners()
+				g.ms.Shutdown()
+				return err
+			}
+			g.server.TLSConfig.ClientCAs = pool
+			g.server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		for i, l := range listeners {
+			listeners[i] = tls.NewListener(l, g.server.TLSConfig)
+		}
+	}
+
+	g.setReady(true)
+	for _, reg := range g.opts.Registrars {
+		if err := reg.Register(); err != nil {
+			log.Print("Error registering with service discovery: ", err)
+		}
+	}
+	var withdrawOnce sync.Once
+	withdraw := func() {
+		withdrawOnce.Do(func() {
+			g.setReady(false)
+			for _, reg := range g.opts.Registrars {
+				if err := reg.Deregister(); err != nil {
+					log.Print("Error deregistering from service discovery: ", err)
+				}
+			}
+		})
+	}
+
+	stopped := make(chan struct{})
+	electorDone := make(chan struct{})
+	cancelElector := func() {}
+	if g.elector != nil {
+		var electorCtx context.Context
+		electorCtx, cancelElector = context.WithCancel(ctx)
+		go func() {
+			g.elector.run(electorCtx)
+			close(electorDone)
+		}()
+	} else {
+		close(electorDone)
+	}
+	if g.canary != nil {
+		canaryCtx, cancelCanary := context.WithCancel(ctx)
+		defer cancelCanary()
+		go g.canary.run(canaryCtx, g.opts.CanaryInterval)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			withdraw()
+			closeListeners()
+		case <-stopped:
+		}
+	}()
+	serveErrs := make(chan error, len(listeners)+len(telemetryListeners))
+	for _, l := range listeners {
+		go func(l net.Listener) { serveErrs <- g.server.Serve(l) }(l)
+	}
+	for _, l := range telemetryListeners {
+		go func(l net.Listener) { serveErrs <- g.telemetryServer.Serve(l) }(l)
+	}
+	// Once serving on one listener ends, stop serving on the others, too.
+	serveErr := <-serveErrs
+	closeListeners()
+	for i := 1; i < len(listeners)+len(telemetryListeners); i++ {
+		<-serveErrs
+	}
+	close(stopped)
+	withdraw()
+	log.Print("HTTP server stopped: ", serveErr)
+	if ctx.Err() != nil {
+		serveErr = nil
+	}
+
+	// To give running connections a chance to submit their payload, we wait
+	// for 1sec, but we don't want to wait long (e.g. until all connections
+	// are done) to not delay the shutdown.
+	time.Sleep(time.Second)
+	// The lease must not change hands before the final persistence.
+	cancelElector()
+	<-electorDone
+	err = g.ms.Shutdown()
+	if g.elector != nil {
+		g.elector.release()
+	}
+	if err != nil {
+		log.Print("Problem shutting down metric storage: ", err)
+		return err
+	}
+	return serveErr
+}
+
+// replay replays the requests recorded in the given file with h.
+func replay(h http.Handler, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	log.Printf("Replaying requests from '%s'...", filename)
+	statuses, err := handler.Replay(h, f)
+	if err != nil {
+		return fmt.Errorf("error replaying requests from %s: %s", filename, err)
+	}
+	log.Printf("Replayed requests by resulting status code: %v", statuses)
+	return nil
+}
+
+// loadCertPool returns a CertPool with the certificates in the given PEM file.
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", filename)
+	}
+	return pool, nil
+}
+
+func (g *Gateway) setReady(ready bool) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.ready = ready
+}
+
+func (g *Gateway) handleReady(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	if !g.ready {
+		http.Error(w, "Pushgateway is not ready.", http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case <-g.ms.Loaded():
+	default:
+		http.Error(w, "Pushgateway is still loading persisted metrics.", http.StatusServiceUnavailable)
+		return
+	}
+	if g.elector != nil && !g.elector.leadership.Status().Leader {
+		http.Error(w, "Pushgateway is standing by.", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("Pushgateway is ready.\n"))
+}
+
+func handlePprof(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	switch p.ByName("pprof") {
+	case "/cmdline":
+		pprof.Cmdline(w, r)
+	case "/profile":
+		pprof.Profile(w, r)
+	case "/symbol":
+		pprof.Symbol(w, r)
+	default:
+		pprof.Index(w, r)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestNew only creates a single Gateway, see New. Apart from the metrics path,
+// all options have their zero value.
+func TestNew(t *testing.T) {
+	g, err := New(&Options{MetricsPath: "/metrics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.MetricStore().Shutdown()
+	h := g.Handler()
+
+	req, err := http.NewRequest("PUT", "http://example.org/metrics/job/testjob", bytes.NewBufferString("some_metric 3.14\nother_metric 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v: %s", expected, got, w.Body)
+	}
+	time.Sleep(10 * time.Millisecond) // Give the DiskMetricStore time to process the push.
+
+	req, err = http.NewRequest("GET", "http://example.org/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := `some_metric{job="testjob"} 3.14`, w.Body.String(); !strings.Contains(got, expected) {
+		t.Errorf("Wanted %q in exposition, got %q.", expected, got)
+	}
+
+	// Delete a single metric family via the API.
+	req, err = http.NewRequest("DELETE", "http://example.org/api/v1/metrics/job/testjob?metric=some_metric", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v: %s", expected, got, w.Body)
+	}
+	time.Sleep(10 * time.Millisecond) // Give the DiskMetricStore time to process the deletion.
+
+	req, err = http.NewRequest("GET", "http://example.org/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if unexpected, got := `some_metric{job="testjob"}`, w.Body.String(); strings.Contains(got, unexpected) {
+		t.Errorf("Unexpected %q in exposition after deletion, got %q.", unexpected, got)
+	}
+	if expected, got := `other_metric{job="testjob"} 1`, w.Body.String(); !strings.Contains(got, expected) {
+		t.Errorf("Wanted %q in exposition, got %q.", expected, got)
+	}
+}
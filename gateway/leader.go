@@ -0,0 +1,118 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"time"
+
+	"github.com/prometheus/log"
+	"golang.org/x/net/context"
+
+	"github.com/prometheus/pushgateway/handler"
+	"github.com/prometheus/pushgateway/lease"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// elector acquires and renews the leader lease and switches the Gateway
+// between leading and standing by accordingly.
+type elector struct {
+	lease      *lease.FileLease
+	ms         *storage.DiskMetricStore
+	leadership *handler.Leadership
+
+	leader  bool
+	expires time.Time // Expiry of the lease while leader.
+}
+
+func newElector(o *Options, ms *storage.DiskMetricStore, leadership *handler.Leadership) *elector {
+	return &elector{
+		lease: &lease.FileLease{
+			Path:   o.LeaseFile,
+			Holder: o.InstanceID,
+			TTL:    o.LeaseTTL,
+		},
+		ms:         ms,
+		leadership: leadership,
+	}
+}
+
+// run tries to acquire or renew the lease every third of its TTL until ctx is
+// done. Then, the lease is released if held.
+func (e *elector) run(ctx context.Context) {
+	ticker := time.NewTicker(e.lease.TTL / 3)
+	defer ticker.Stop()
+	for {
+		e.try(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *elector) try(now time.Time) {
+	rec, err := e.lease.TryAcquire(now)
+	if err != nil {
+		log.Print("Error acquiring leader lease: ", err)
+		if e.leader && !now.Add(e.lease.TTL/3).Before(e.expires) {
+			// The lease might expire before the next attempt, after
+			// which another instance might take over.
+			e.stepDown("")
+		}
+		return
+	}
+	if rec.Holder != e.lease.Holder {
+		if e.leader {
+			e.stepDown(rec.Holder)
+			return
+		}
+		e.leadership.Set(false, rec.Holder)
+		return
+	}
+	e.expires = rec.Expires
+	if e.leader {
+		return
+	}
+	// Take over the state persisted by the previous leader before
+	// accepting any writes.
+	if err := e.ms.Reload(); err != nil {
+		log.Print("Error reloading persisted metrics, not taking over leadership: ", err)
+		return
+	}
+	e.ms.SetPersisting(true)
+	e.leader = true
+	e.leadership.Set(true, rec.Holder)
+	log.Printf("Acquired leader lease as %s.", rec.Holder)
+}
+
+func (e *elector) stepDown(holder string) {
+	e.leadership.Set(false, holder)
+	e.ms.SetPersisting(false)
+	e.leader = false
+	log.Printf("Lost leader lease, standing by (leader is %q).", holder)
+}
+
+// release gives up the lease if held, after the last writes have been
+// persisted, so that a standby can take over right away.
+func (e *elector) release() {
+	if !e.leader {
+		return
+	}
+	if err := e.lease.Release(); err != nil {
+		log.Print("Error releasing leader lease: ", err)
+		return
+	}
+	log.Print("Released leader lease.")
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/prometheus/pushgateway/handler"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+func newTestElector(dir, id string) *elector {
+	ms := storage.NewDiskMetricStore(&storage.DiskMetricStoreOptions{
+		PersistenceFile:     path.Join(dir, "persistence"),
+		PersistenceInterval: time.Hour,
+	})
+	return newElector(&Options{
+		LeaseFile:  path.Join(dir, "lease"),
+		LeaseTTL:   time.Minute,
+		InstanceID: id,
+	}, ms, handler.NewLeadership())
+}
+
+func TestElector(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "gateway.TestElector.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	a := newTestElector(tempDir, "a")
+	b := newTestElector(tempDir, "b")
+	defer a.ms.Shutdown()
+	defer b.ms.Shutdown()
+
+	check := func(step string, e *elector, leader bool, holder string) {
+		status := e.leadership.Status()
+		if e.leader != leader || status.Leader != leader {
+			t.Errorf("%s: Wanted %s to be leader %v, got %v (status %v).", step, e.lease.Holder, leader, e.leader, status.Leader)
+		}
+		if status.Holder != holder {
+			t.Errorf("%s: Wanted holder %q for %s, got %q.", step, holder, e.lease.Holder, status.Holder)
+		}
+	}
+
+	now := time.Now()
+	a.try(now)
+	b.try(now)
+	check("acquire", a, true, "a")
+	check("acquire", b, false, "a")
+
+	// Failing to renew the lease keeps the leadership only as long as the
+	// lease cannot expire before the next attempt.
+	lockFile := path.Join(tempDir, "lease.lock")
+	if err := ioutil.WriteFile(lockFile, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	a.try(now.Add(time.Minute / 3))
+	check("first failed renewal", a, true, "a")
+	a.try(now.Add(2 * time.Minute / 3))
+	check("second failed renewal", a, false, "")
+	if err := os.Remove(lockFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance takes over once the lease has expired.
+	later := now.Add(time.Minute + time.Second)
+	b.try(later)
+	a.try(later)
+	check("take over", b, true, "b")
+	check("take over", a, false, "b")
+}
+
+func TestElectorReloadError(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "gateway.TestElectorReloadError.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	e := newTestElector(tempDir, "a")
+	defer e.ms.Shutdown()
+
+	// Persisted metrics that cannot be read must not be taken over.
+	persistenceFile := path.Join(tempDir, "persistence")
+	if err := ioutil.WriteFile(persistenceFile, []byte("garbage"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	e.try(now)
+	if e.leader || e.leadership.Status().Leader {
+		t.Error("Leader despite unreadable persisted metrics.")
+	}
+
+	if err := os.Remove(persistenceFile); err != nil {
+		t.Fatal(err)
+	}
+	e.try(now.Add(time.Minute / 3))
+	if !e.leader || !e.leadership.Status().Leader {
+		t.Error("Not leader after persisted metrics became readable.")
+	}
+}
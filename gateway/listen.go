@@ -0,0 +1,102 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// IPStack determines which IP versions Run listens on.
+type IPStack int
+
+// Possible values for IPStack.
+const (
+	// IPStackDual listens with a single socket as the operating system
+	// provides for the ListenAddress. For an unspecified host (like ':9091'
+	// or '[::]:9091'), that is usually a dual-stack socket accepting IPv4
+	// and IPv6, unless IPv6 sockets are configured to be IPv6-only (e.g.
+	// net.ipv6.bindv6only=1 on Linux).
+	IPStackDual IPStack = iota
+	// IPStackSeparate listens with separate IPv4 and IPv6 sockets on the
+	// same port, independent of the configuration of the operating system.
+	// The ListenAddress must not specify a host.
+	IPStackSeparate
+	// IPStackIPv4 only listens on IPv4.
+	IPStackIPv4
+	// IPStackIPv6 only listens on IPv6.
+	IPStackIPv6
+)
+
+// ParseIPStack returns the IPStack for the given name, which is one of 'dual',
+// 'separate', 'ipv4', or 'ipv6'.
+func ParseIPStack(name string) (IPStack, error) {
+	switch name {
+	case "dual":
+		return IPStackDual, nil
+	case "separate":
+		return IPStackSeparate, nil
+	case "ipv4":
+		return IPStackIPv4, nil
+	case "ipv6":
+		return IPStackIPv6, nil
+	}
+	return 0, fmt.Errorf("unknown IP stack %q", name)
+}
+
+// listen returns the listeners for the given address and IP stack.
+func listen(addr string, stack IPStack) ([]net.Listener, error) {
+	switch stack {
+	case IPStackIPv4:
+		l, err := net.Listen("tcp4", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	case IPStackIPv6:
+		l, err := net.Listen("tcp6", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	case IPStackSeparate:
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+			return nil, errors.New("separate IPv4 and IPv6 listeners require a listen address without host, like ':9091'")
+		}
+		l4, err := net.Listen("tcp4", net.JoinHostPort("0.0.0.0", port))
+		if err != nil {
+			return nil, err
+		}
+		// With port 0, use the port chosen for IPv4 for IPv6, too.
+		_, port, _ = net.SplitHostPort(l4.Addr().String())
+		// Go sets IPV6_V6ONLY on "tcp6" sockets, so that binding
+		// does not conflict with the IPv4 socket.
+		l6, err := net.Listen("tcp6", net.JoinHostPort("::", port))
+		if err != nil {
+			l4.Close()
+			return nil, err
+		}
+		return []net.Listener{l4, l6}, nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
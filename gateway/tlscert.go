@@ -0,0 +1,76 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/prometheus/log"
+
+	"github.com/prometheus/pushgateway/secret"
+)
+
+// certReloader provides the TLS certificate from a certificate and a key
+// secret, parsing them again whenever one of them has changed.
+type certReloader struct {
+	cert, key *secret.Secret
+
+	mtx                     sync.Mutex // Protects the fields below.
+	certVersion, keyVersion uint64
+	current                 *tls.Certificate
+}
+
+// newCertReloader returns a certReloader for the given secret sources. An error
+// is returned if they cannot be read or do not form a valid key pair.
+func newCertReloader(certSpec, keySpec string, refresh time.Duration) (*certReloader, error) {
+	cert, err := secret.New(certSpec, refresh)
+	if err != nil {
+		return nil, err
+	}
+	key, err := secret.New(keySpec, refresh)
+	if err != nil {
+		return nil, err
+	}
+	c := &certReloader{cert: cert, key: key}
+	certPEM, certVersion := cert.Get()
+	keyPEM, keyVersion := key.Get()
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	c.certVersion, c.keyVersion, c.current = certVersion, keyVersion, &pair
+	return c, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. While certificate and
+// key do not match (e.g. in the middle of a rotation), the previous
+// certificate is used.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certPEM, certVersion := c.cert.Get()
+	keyPEM, keyVersion := c.key.Get()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if certVersion != c.certVersion || keyVersion != c.keyVersion {
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			log.Print("Error loading changed TLS certificate, keeping the previous one: ", err)
+			return c.current, nil
+		}
+		c.certVersion, c.keyVersion, c.current = certVersion, keyVersion, &pair
+		log.Print("Loaded changed TLS certificate.")
+	}
+	return c.current, nil
+}
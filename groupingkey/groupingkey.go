@@ -0,0 +1,151 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package groupingkey implements the encodings of the grouping key of a group
+// of metrics in the Pushgateway, i.e. of its grouping labels. External tools
+// (like cleanup scripts or dashboards) can use it to compute the same keys as
+// the Pushgateway.
+//
+// The encodings are versioned by Version. The hash returned by Hash is used
+// to identify groups in persistence files, in the URL paths of groups scraped
+// individually (/metrics/grouped/<hash>), and in the directory names of the
+// history. Hence, it is never changed within a version.
+package groupingkey
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version is the version of the encodings implemented by this package.
+const Version = 1
+
+const (
+	// Hash version 1 is the 64-bit FNV-1a hash.
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+
+	// separator cannot occur in valid UTF-8 and separates label names and
+	// values in Hash.
+	separator = 0xff
+
+	// FingerprintPrefix is the prefix of the fingerprints returned by
+	// Fingerprint, naming the hash function.
+	FingerprintPrefix = "sha256:"
+)
+
+// Hash returns the 64-bit hash of the grouping key with the given labels: The
+// labels are sorted by name, and each name and value, followed by a 0xff byte,
+// is fed into the 64-bit FNV-1a hash function. An empty label set results in
+// the FNV-1a offset basis. This is the same as LabelsToSignature of the
+// Prometheus model package.
+//
+// As 0xff cannot occur in valid UTF-8, label names and values are separated
+// unambiguously as long as they are valid UTF-8, but, being a 64-bit
+// non-cryptographic hash, accidental or crafted collisions are possible. Use
+// Fingerprint where that is a concern.
+func Hash(labels map[string]string) uint64 {
+	h := uint64(offset64)
+	for _, name := range sortedNames(labels) {
+		h = hashAdd(h, name)
+		h = hashAdd(h, labels[name])
+	}
+	return h
+}
+
+func hashAdd(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= prime64
+	}
+	h ^= separator
+	h *= prime64
+	return h
+}
+
+// Format returns the hexadecimal notation of the given hash, as used by the
+// Pushgateway in URL paths and file names, i.e. 16 lower-case digits.
+func Format(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// Parse parses a hash in the notation returned by Format.
+func Parse(s string) (uint64, error) {
+	if len(s) != 16 {
+		return 0, fmt.Errorf("invalid grouping key hash %q: not 16 digits", s)
+	}
+	hash, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid grouping key hash %q: %s", s, err)
+	}
+	return hash, nil
+}
+
+// Fingerprint returns a collision-resistant fingerprint of the grouping key
+// with the given labels, consisting of FingerprintPrefix and the hexadecimal
+// SHA-256 hash of the labels sorted by name, each name and value preceded by
+// its length in bytes as uvarint. Unlike Hash, it is unambiguous for arbitrary
+// label values, including invalid UTF-8 and 0xff bytes.
+func Fingerprint(labels map[string]string) string {
+	h := sha256.New()
+	var buf [binary.MaxVarintLen64]byte
+	write := func(s string) {
+		n := binary.PutUvarint(buf[:], uint64(len(s)))
+		h.Write(buf[:n])
+		h.Write([]byte(s))
+	}
+	for _, name := range sortedNames(labels) {
+		write(name)
+		write(labels[name])
+	}
+	return FingerprintPrefix + hex.EncodeToString(h.Sum(nil))
+}
+
+// Path returns the URL path of the group with the given labels relative to
+// /metrics, i.e. '/job/<job>' followed by '/<name>/<value>' for each other
+// label, sorted by name. An error is returned if the job label is missing or
+// empty, or if a label value contains a '/' (which the Pushgateway cannot
+// route, even if escaped).
+func Path(labels map[string]string) (string, error) {
+	job := labels["job"]
+	if job == "" {
+		return "", fmt.Errorf("job label missing in grouping key %v", labels)
+	}
+	parts := []string{"", "job", job}
+	for _, name := range sortedNames(labels) {
+		if name == "job" {
+			continue
+		}
+		parts = append(parts, name, labels[name])
+	}
+	for _, part := range parts {
+		if strings.Contains(part, "/") {
+			return "", fmt.Errorf("grouping key %v contains '/', which cannot be part of a URL path", labels)
+		}
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+func sortedNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package groupingkey
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/model"
+)
+
+func TestHash(t *testing.T) {
+	for _, labels := range []map[string]string{
+		nil,
+		{"job": "foo"},
+		{"job": "foo", "instance": "bar"},
+		{"job": "foo", "instance": "", "a": "ä/\n"},
+	} {
+		// Persisted keys depend on this.
+		if expected, got := model.LabelsToSignature(labels), Hash(labels); expected != got {
+			t.Errorf("%v: Wanted hash %x, got %x.", labels, expected, got)
+		}
+	}
+	if expected, got := "cbf29ce484222325", Format(Hash(nil)); expected != got {
+		t.Errorf("Wanted %q, got %q.", expected, got)
+	}
+}
+
+func TestFormatParse(t *testing.T) {
+	hash := Hash(map[string]string{"job": "foo"})
+	got, err := Parse(Format(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != hash {
+		t.Errorf("Wanted %x, got %x.", hash, got)
+	}
+	for _, s := range []string{"", "123", "000000000000000g", "00000000000000000"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Expected error parsing %q.", s)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	// The separator of Hash as part of a label value.
+	a := map[string]string{"job": "a\xffx\xffb"}
+	b := map[string]string{"job": "a", "x": "b"}
+	if Hash(a) != Hash(b) {
+		t.Errorf("Expected hashes of %q and %q to collide.", a, b)
+	}
+	if Fingerprint(a) == Fingerprint(b) {
+		t.Errorf("Fingerprints of %q and %q collide.", a, b)
+	}
+	if expected, got := Fingerprint(map[string]string{"job": "foo", "a": "b"}), Fingerprint(map[string]string{"a": "b", "job": "foo"}); expected != got {
+		t.Errorf("Fingerprint depends on order: %q vs. %q.", expected, got)
+	}
+	if expected, got := "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", Fingerprint(nil); expected != got {
+		t.Errorf("Wanted %q, got %q.", expected, got)
+	}
+}
+
+func TestPath(t *testing.T) {
+	for _, s := range []struct {
+		labels   map[string]string
+		expected string
+	}{
+		{map[string]string{"job": "foo"}, "/job/foo"},
+		{map[string]string{"job": "foo", "instance": "bar", "a": "b"}, "/job/foo/a/b/instance/bar"},
+		{map[string]string{"instance": "bar"}, ""},
+		{map[string]string{"job": "foo", "path": "/tmp"}, ""},
+	} {
+		got, err := Path(s.labels)
+		if s.expected == "" {
+			if err == nil {
+				t.Errorf("%v: Expected error, got %q.", s.labels, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != s.expected {
+			t.Errorf("%v: Wanted %q, got %q.", s.labels, s.expected, got)
+		}
+	}
+}
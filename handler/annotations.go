@@ -0,0 +1,133 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/groupingkey"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// annotationHeader is the header to attach an annotation to the pushed group
+// with, in the form '<name>=<value>'. It may be repeated.
+const annotationHeader = "X-Pushgateway-Annotation"
+
+// parseAnnotations returns the annotations set by annotationHeader in r, or nil
+// if there are none.
+func parseAnnotations(r *http.Request) (map[string]string, error) {
+	values := r.Header[annotationHeader]
+	if len(values) == 0 {
+		return nil, nil
+	}
+	annotations := make(map[string]string, len(values))
+	for _, v := range values {
+		i := strings.Index(v, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("malformed %s header %q, expected '<name>=<value>'", annotationHeader, v)
+		}
+		annotations[strings.TrimSpace(v[:i])] = strings.TrimSpace(v[i+1:])
+	}
+	return annotations, nil
+}
+
+// Annotations returns a handler for the annotations of a single group, whose
+// grouping labels are determined in the same way as for the handler returned
+// by Push with the same PushOptions. A GET request returns the annotations as
+// a JSON object. A POST request merges the annotations in the JSON object in
+// the request body into those of the group, where an empty value removes an
+// annotation, without pushing any metrics. If there is no such group, the
+// response has status code 404.
+//
+// The returned handler is already instrumented for Prometheus.
+func Annotations(ms storage.MetricStore, o *PushOptions) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	var ps httprouter.Params
+	var mtx sync.Mutex // Protects ps.
+
+	instrumentedHandlerFunc := prometheus.InstrumentHandlerFunc(
+		"annotations",
+		func(w http.ResponseWriter, r *http.Request) {
+			job := ps.ByName("job")
+			labelsString := ps.ByName("labels")
+			mtx.Unlock()
+
+			labels, err := splitLabels(labelsString)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if job == "" {
+				http.Error(w, "job name is required", http.StatusBadRequest)
+				return
+			}
+			labels["job"] = job
+			if r.Method != "GET" {
+				if err := enforceGroupingLabels(r, labels); err != nil {
+					http.Error(w, err.Error(), http.StatusForbidden)
+					return
+				}
+			}
+			autoFillGroupingLabel(r, labels, o)
+
+			group, ok := ms.GetMetricGroup(groupingkey.Hash(labels))
+			if !ok {
+				http.Error(w, "group not found", http.StatusNotFound)
+				return
+			}
+			if r.Method == "GET" {
+				annotations := group.Annotations
+				if annotations == nil {
+					annotations = map[string]string{}
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(annotations)
+				return
+			}
+
+			var annotations map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&annotations); err != nil {
+				http.Error(w, fmt.Sprintf("error parsing annotations: %s", err), http.StatusBadRequest)
+				return
+			}
+			done := make(chan error, 1)
+			ms.SubmitWriteRequest(storage.WriteRequest{
+				Labels:         labels,
+				Timestamp:      time.Now(),
+				MetricFamilies: map[string]*dto.MetricFamily{},
+				Annotations:    annotations,
+				Done:           done,
+			})
+			if err := <-done; err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		},
+	)
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		mtx.Lock()
+		ps = params
+		instrumentedHandlerFunc(w, r)
+	}
+}
@@ -0,0 +1,361 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/log"
+
+	"github.com/prometheus/pushgateway/secret"
+)
+
+// An Authenticator determines the identity of the client of a request from the
+// credentials contained in it. Implement it to plug a custom authentication
+// mechanism into the Authenticate Middleware.
+type Authenticator interface {
+	// Authenticate returns the identity of the client and true if r
+	// carries valid credentials. Otherwise, it returns false.
+	Authenticate(r *http.Request) (string, bool)
+}
+
+// A JobAuthorizer restricts the jobs an authenticated client may push to or
+// delete from. Authenticators may implement it.
+type JobAuthorizer interface {
+	// AuthorizeJob returns whether the client of r may change the metrics
+	// of the given job. It is only called after Authenticate has succeeded
+	// for r.
+	AuthorizeJob(r *http.Request, job string) bool
+}
+
+// A GroupingLabeler determines grouping labels from the identity of an
+// authenticated client. They are enforced for the pushes and deletions of the
+// client (see WithGroupingLabels). Authenticators may implement it.
+type GroupingLabeler interface {
+	// GroupingLabels returns the grouping labels of the client of r. It
+	// is only called after Authenticate has succeeded for r.
+	GroupingLabels(r *http.Request) map[string]string
+}
+
+// Authenticate returns a Middleware that authenticates requests with the given
+// Authenticators, which are tried in order. The identity returned by the first
+// successful Authenticator is made available via Identity. If that
+// Authenticator is also a JobAuthorizer, requests other than GET and HEAD for
+// a job the client is not authorized for are rejected with status code 403,
+// and the authorization is made available via JobAuthorized for handlers
+// changing the groups of several jobs at once. If it is a GroupingLabeler, the grouping labels of the client are made
+// available via GroupingLabels.
+// Requests no Authenticator succeeds for are rejected with status code 401,
+// unless anonymousReads is true and the request is a GET or HEAD request (so
+// that Prometheus can still scrape the Pushgateway without credentials).
+func Authenticate(anonymousReads bool, authenticators ...Authenticator) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, a := range authenticators {
+				identity, ok := a.Authenticate(r)
+				if !ok {
+					continue
+				}
+				if ja, ok := a.(JobAuthorizer); ok && r.Method != "GET" && r.Method != "HEAD" {
+					if job := jobFromPath(r.URL.Path); job != "" && !ja.AuthorizeJob(r, job) {
+						if isPush(r) {
+							pushesRejected.WithLabelValues(rejectUnauthorized).Inc()
+						}
+						http.Error(w, fmt.Sprintf("%s may not change job %q", identity, job), http.StatusForbidden)
+						return
+					}
+				}
+				if ja, ok := a.(JobAuthorizer); ok {
+					authReq := r
+					r = WithJobAuthorization(r, func(job string) bool { return ja.AuthorizeJob(authReq, job) })
+				}
+				r = WithIdentity(r, identity)
+				if gl, ok := a.(GroupingLabeler); ok {
+					r = WithGroupingLabels(r, gl.GroupingLabels(r))
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			if anonymousReads && (r.Method == "GET" || r.Method == "HEAD") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if isPush(r) {
+				pushesRejected.WithLabelValues(rejectUnauthorized).Inc()
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="Pushgateway"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+		})
+	}
+}
+
+// jobFromPath returns the job name from the path of a request to the push,
+// delete, restore, or annotations API (including the deprecated push API), or
+// an empty string if the path is none of those.
+func jobFromPath(path string) string {
+	path = strings.TrimPrefix(path, "/api/v1")
+	for _, prefix := range []string{"/metrics/job/", "/metrics/jobs/", "/annotations/job/"} {
+		if strings.HasPrefix(path, prefix) {
+			return strings.SplitN(strings.TrimPrefix(path, prefix), "/", 2)[0]
+		}
+	}
+	return ""
+}
+
+// AdminOnly returns a Middleware that rejects requests to the admin API (like
+// freezing or compaction) with methods other than GET and HEAD with status
+// code 403 unless the client has been authenticated (see Identity) as one of
+// the given identities. Use it after Authenticate, so that clients allowed to
+// push are not automatically allowed to administer the Pushgateway.
+func AdminOnly(identities []string) Middleware {
+	admins := make(map[string]struct{}, len(identities))
+	for _, identity := range identities {
+		admins[identity] = struct{}{}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" && r.Method != "HEAD" && strings.HasPrefix(r.URL.Path, adminPathPrefix) {
+				identity := Identity(r)
+				if _, ok := admins[identity]; identity == "" || !ok {
+					http.Error(w, "admin identity required", http.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// BasicAuthenticator authenticates requests by HTTP basic authentication. It
+// maps user names to passwords. The identity is the user name.
+type BasicAuthenticator map[string]string
+
+// Authenticate implements Authenticator.
+func (a BasicAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	expected, ok := a[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		return "", false
+	}
+	return user, true
+}
+
+// TokenAuthenticator authenticates requests by a bearer token in the
+// Authorization header. It maps identities to tokens.
+type TokenAuthenticator map[string]string
+
+// Authenticate implements Authenticator.
+func (a TokenAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+	for identity, expected := range a {
+		if subtle.ConstantTimeCompare(token, []byte(expected)) == 1 {
+			return identity, true
+		}
+	}
+	return "", false
+}
+
+const (
+	// signatureHeader is the header carrying the signature checked by
+	// HMACAuthenticator, in the form 'sha256=<hex-encoded HMAC>'.
+	signatureHeader = "X-Signature"
+	// signatureTimestampHeader is the header carrying the time of signing
+	// as Unix time in seconds.
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	// maxSignatureAge is how far the time of signing may be off the
+	// current time.
+	maxSignatureAge = 5 * time.Minute
+	// maxSignedBodySize is the maximum size of the body of a request
+	// authenticated by HMACAuthenticator.
+	maxSignedBodySize = 32 << 20
+)
+
+// HMACAuthenticator authenticates requests to the push and delete API by an
+// HMAC-SHA256 keyed with the shared secret of the job in the path of the
+// request, in the X-Signature header. The HMAC is calculated over the method,
+// the request URI (path and query), the X-Signature-Timestamp header (the time
+// of signing as Unix time in seconds), and the body, each but the body followed
+// by a newline. Signatures more than 5 minutes off the current time and bodies
+// bigger than 32MiB are rejected. It maps jobs to secrets. The identity is the
+// job name. The body is read completely for verification and replaced by a
+// copy for the handlers down the chain.
+type HMACAuthenticator map[string]string
+
+// Authenticate implements Authenticator.
+func (a HMACAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	sig := r.Header.Get(signatureHeader)
+	if !strings.HasPrefix(sig, "sha256=") {
+		return "", false
+	}
+	expected, err := hex.DecodeString(strings.TrimPrefix(sig, "sha256="))
+	if err != nil {
+		return "", false
+	}
+	ts := r.Header.Get(signatureTimestampHeader)
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", false
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > maxSignatureAge || age < -maxSignatureAge {
+		return "", false
+	}
+	job := jobFromPath(r.URL.Path)
+	secret, ok := a[job]
+	if !ok {
+		return "", false
+	}
+	var body []byte
+	if r.Body != nil {
+		if body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxSignedBodySize+1)); err != nil {
+			return "", false
+		}
+		if len(body) > maxSignedBodySize {
+			return "", false
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", r.Method, r.URL.RequestURI(), ts)
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return "", false
+	}
+	return job, true
+}
+
+// ClientCertAuthenticator authenticates requests by the TLS client certificate
+// the connection has been established with. The certificate must have been
+// verified, i.e. the server has to be configured with client CAs. The
+// identity is the common name of the certificate's subject.
+type ClientCertAuthenticator struct{}
+
+// Authenticate implements Authenticator.
+func (ClientCertAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if cn == "" {
+		return "", false
+	}
+	return cn, true
+}
+
+// LoadCredentials reads a file with one "<name>:<secret>" pair per line and
+// returns a map from names to secrets, as used by BasicAuthenticator (user
+// names and passwords), TokenAuthenticator (identities and tokens), and
+// HMACAuthenticator (jobs and shared secrets). See ParseCredentials for the
+// format.
+func LoadCredentials(filename string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCredentials(data, filename)
+}
+
+// ParseCredentials parses data with one "<name>:<secret>" pair per line into a
+// map from names to secrets. Empty lines and lines starting with "#" are
+// ignored. Errors are prefixed with source and the line number.
+func ParseCredentials(data []byte, source string) (map[string]string, error) {
+	credentials := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected <name>:<secret>", source, n)
+		}
+		credentials[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// SecretAuthenticator is an Authenticator with credentials (see
+// ParseCredentials) read from a secret.Secret, e.g. a file updated upon
+// rotation. Whenever the secret changes, the credentials are parsed again and
+// handed to a constructor like BasicAuthenticator for the Authenticator doing
+// the actual work. If changed credentials cannot be parsed, the error is logged
+// and the previous credentials are kept. Use NewSecretAuthenticator to create
+// one.
+type SecretAuthenticator struct {
+	secret *secret.Secret
+	new    func(credentials map[string]string) Authenticator
+
+	mtx     sync.Mutex // Protects the fields below.
+	version uint64
+	current Authenticator
+}
+
+// NewSecretAuthenticator returns a SecretAuthenticator for the credentials in
+// s, creating the underlying Authenticator with new. An error is returned if
+// the current credentials cannot be parsed.
+func NewSecretAuthenticator(s *secret.Secret, new func(credentials map[string]string) Authenticator) (*SecretAuthenticator, error) {
+	a := &SecretAuthenticator{secret: s, new: new}
+	value, version := s.Get()
+	credentials, err := ParseCredentials(value, s.String())
+	if err != nil {
+		return nil, err
+	}
+	a.version, a.current = version, new(credentials)
+	return a, nil
+}
+
+// Authenticate implements Authenticator.
+func (a *SecretAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	return a.authenticator().Authenticate(r)
+}
+
+func (a *SecretAuthenticator) authenticator() Authenticator {
+	value, version := a.secret.Get()
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if version != a.version {
+		a.version = version
+		credentials, err := ParseCredentials(value, a.secret.String())
+		if err != nil {
+			log.Print("Error parsing changed credentials, keeping the previous ones: ", err)
+		} else {
+			a.current = a.new(credentials)
+		}
+	}
+	return a.current
+}
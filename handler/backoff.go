@@ -0,0 +1,113 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Bounds of the delay advised to clients of overload responses in the
+// Retry-After header. In between, the delay grows exponentially with the load.
+const (
+	minRetryAfter = time.Second
+	maxRetryAfter = 64 * time.Second
+)
+
+// Load is the load of the Pushgateway as reported by LoadStatus.
+type Load struct {
+	// Load is the maximum of WriteQueueUtilization and
+	// MemoryUtilization. At 1, pushes are rejected.
+	Load                  float64 `json:"load"`
+	WriteQueueUtilization float64 `json:"writeQueueUtilization"`
+	// MemoryUtilization is the MemoryUsage of the MetricStore relative to
+	// PushOptions.MaxMemoryBytes. It is 0 if there is no memory limit.
+	MemoryUtilization float64 `json:"memoryUtilization"`
+	// RetryAfterSeconds is the delay advised to clients of rejected
+	// pushes at the current load.
+	RetryAfterSeconds int `json:"retryAfterSeconds"`
+}
+
+// currentLoad returns the current load of the MetricStore.
+func currentLoad(ms storage.MetricStore, o *PushOptions) Load {
+	s := Load{WriteQueueUtilization: ms.WriteQueueUtilization()}
+	if o.MaxMemoryBytes > 0 {
+		s.MemoryUtilization = float64(ms.MemoryUsage()) / float64(o.MaxMemoryBytes)
+	}
+	s.Load = math.Max(s.WriteQueueUtilization, s.MemoryUtilization)
+	s.RetryAfterSeconds = retryAfterSeconds(retryAfter(s.Load))
+	return s
+}
+
+// retryAfter returns the delay to advise clients at the given load. It doubles
+// from minRetryAfter at no load to maxRetryAfter at full load (or more).
+func retryAfter(load float64) time.Duration {
+	load = math.Min(math.Max(load, 0), 1)
+	return time.Duration(float64(minRetryAfter) * math.Exp2(load*math.Log2(float64(maxRetryAfter/minRetryAfter))))
+}
+
+// retryAfterSeconds returns d in seconds, rounded up, as used in the
+// Retry-After header.
+func retryAfterSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// setRetryAfter sets the Retry-After header of the response to d.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(d)))
+}
+
+// LoadStatus returns a handler that reports the current load of the
+// Pushgateway and the delay advised to clients of rejected pushes as a JSON
+// object (see Load). If listenAddresses is not nil, the addresses it returns
+// are reported, too, in the listenAddresses field. If scrapes is not nil, the
+// scrape activity is reported in the scrapes field (see ScrapeStatus). If
+// leadership is not nil, its state is reported in the leadership field (see
+// LeadershipStatus).
+func LoadStatus(
+	ms storage.MetricStore,
+	o *PushOptions,
+	listenAddresses func() []string,
+	scrapes *ScrapeTracker,
+	leadership *Leadership,
+) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		resp := struct {
+			Load
+			ListenAddresses []string          `json:"listenAddresses,omitempty"`
+			Scrapes         *ScrapeStatus     `json:"scrapes,omitempty"`
+			Leadership      *LeadershipStatus `json:"leadership,omitempty"`
+		}{Load: currentLoad(ms, o)}
+		if listenAddresses != nil {
+			resp.ListenAddresses = listenAddresses()
+		}
+		if scrapes != nil {
+			s := scrapes.Status()
+			resp.Scrapes = &s
+		}
+		if leadership != nil {
+			s := leadership.Status()
+			resp.Leadership = &s
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
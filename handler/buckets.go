@@ -0,0 +1,90 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"math"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// checkBuckets checks the histograms and summaries in metricFamilies for
+// consistency. The upper bounds of the buckets of a histogram must be strictly
+// increasing and their cumulative counts must not decrease. The sample count,
+// if pushed at all, must equal the count of the +Inf bucket or, if there is
+// none, must not be lower than the count of the last bucket. The quantiles of
+// a summary must be distinct. As the text format parser collects all samples of the same series
+// into one metric, pushing a histogram or summary twice in the same request
+// (e.g. with different bucket sets) typically violates these rules. An error
+// describing the first violation found is returned.
+//
+// The MetricStore always replaces a pushed metric family as a whole, so
+// buckets of different pushes are never mixed. Rejecting inconsistent pushes
+// here ensures that the stored histograms are consistent, too.
+func checkBuckets(metricFamilies map[string]*dto.MetricFamily) error {
+	for name, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			var err error
+			switch {
+			case m.Histogram != nil:
+				err = checkHistogram(m.GetHistogram())
+			case m.Summary != nil:
+				err = checkSummary(m.GetSummary())
+			}
+			if err != nil {
+				return fmt.Errorf("metric family %q: series with labels %s: %s", name, labelPairsString(m.GetLabel()), err)
+			}
+		}
+	}
+	return nil
+}
+
+func checkHistogram(h *dto.Histogram) error {
+	var (
+		lastBound = math.Inf(-1)
+		lastCount uint64
+	)
+	for i, b := range h.GetBucket() {
+		bound, count := b.GetUpperBound(), b.GetCumulativeCount()
+		if i > 0 && !(bound > lastBound) {
+			return fmt.Errorf("bucket with upper bound %v follows bucket with upper bound %v", bound, lastBound)
+		}
+		if count < lastCount {
+			return fmt.Errorf("bucket with upper bound %v has count %d, lower than count %d of bucket with upper bound %v", bound, count, lastCount, lastBound)
+		}
+		lastBound, lastCount = bound, count
+	}
+	if len(h.GetBucket()) == 0 || h.SampleCount == nil {
+		return nil
+	}
+	if math.IsInf(lastBound, +1) && h.GetSampleCount() != lastCount {
+		return fmt.Errorf("sample count %d differs from count %d of the +Inf bucket", h.GetSampleCount(), lastCount)
+	}
+	if h.GetSampleCount() < lastCount {
+		return fmt.Errorf("sample count %d is lower than count %d of bucket with upper bound %v", h.GetSampleCount(), lastCount, lastBound)
+	}
+	return nil
+}
+
+func checkSummary(s *dto.Summary) error {
+	seen := make(map[float64]struct{}, len(s.GetQuantile()))
+	for _, q := range s.GetQuantile() {
+		if _, ok := seen[q.GetQuantile()]; ok {
+			return fmt.Errorf("duplicate quantile %v", q.GetQuantile())
+		}
+		seen[q.GetQuantile()] = struct{}{}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Compacter is implemented by metric stores that support compaction, like the
+// DiskMetricStore.
+type Compacter interface {
+	Compact() (storage.CompactionResult, error)
+}
+
+// Compact returns a handler that compacts the metric store and reports the
+// result as a JSON object. If rewriting the persistence file fails, the
+// response has status code 500, but the result is reported nevertheless.
+func Compact(c Compacter) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		result, err := c.Compact()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		resp := struct {
+			storage.CompactionResult
+			Error string `json:"error,omitempty"`
+		}{CompactionResult: result}
+		if result.Err != nil {
+			resp.Error = result.Err.Error()
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
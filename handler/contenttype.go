@@ -0,0 +1,133 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// ContentTypeMode determines how the Content-Type header of pushes is
+// interpreted.
+type ContentTypeMode int
+
+// Possible values for ContentTypeMode.
+const (
+	// ContentTypeLenient parses bodies as delimited protobuf messages if
+	// the Content-Type says so, and everything else (including binary
+	// bodies of other types) in the text format.
+	ContentTypeLenient ContentTypeMode = iota
+	// ContentTypeStrict only accepts the text format (text/plain, with
+	// an optional version 0.0.4, and the default for pushes without a
+	// Content-Type) and delimited protobuf messages. Other types are
+	// rejected with status code 415. The charset parameter of the text
+	// format is honored: UTF-8 and US-ASCII are taken as is, ISO-8859-1 is
+	// converted to UTF-8, other charsets are rejected with status code
+	// 415, too.
+	ContentTypeStrict
+)
+
+// ParseContentTypeMode returns the ContentTypeMode for the given name, which is
+// one of 'lenient' or 'strict'.
+func ParseContentTypeMode(name string) (ContentTypeMode, error) {
+	switch name {
+	case "lenient":
+		return ContentTypeLenient, nil
+	case "strict":
+		return ContentTypeStrict, nil
+	}
+	return 0, fmt.Errorf("unknown content type handling %q", name)
+}
+
+// supportedMediaTypes lists the media types accepted in ContentTypeStrict
+// mode, for error messages.
+const supportedMediaTypes = "supported are text/plain; version=0.0.4 and application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+
+// negotiateContentType checks the Content-Type of the push r in
+// ContentTypeStrict mode. An error is returned if it is not supported, in
+// which case the push has to be rejected with status code 415. A body in
+// ISO-8859-1 is replaced by a reader converting it to UTF-8. In
+// ContentTypeLenient mode, nothing is checked.
+func negotiateContentType(r *http.Request, mode ContentTypeMode) error {
+	if mode == ContentTypeLenient {
+		return nil
+	}
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return nil
+	}
+	mediatype, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return fmt.Errorf("malformed Content-Type %q: %s", ct, err)
+	}
+	switch mediatype {
+	case "application/vnd.google.protobuf":
+		if params["proto"] != "io.prometheus.client.MetricFamily" || params["encoding"] != "delimited" {
+			return fmt.Errorf("unsupported Content-Type %q, %s", ct, supportedMediaTypes)
+		}
+		return nil
+	case "text/plain":
+		if v, ok := params["version"]; ok && v != "0.0.4" {
+			return fmt.Errorf("unsupported text format version %q, %s", v, supportedMediaTypes)
+		}
+		switch charset := strings.ToLower(params["charset"]); charset {
+		case "", "utf-8", "utf8", "us-ascii":
+		case "iso-8859-1", "latin1":
+			if r.Body != nil {
+				r.Body = latin1Reader{bufio.NewReader(r.Body), r.Body}
+			}
+		default:
+			return fmt.Errorf("unsupported charset %q, the text format is UTF-8", charset)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported Content-Type %q, %s", ct, supportedMediaTypes)
+}
+
+// latin1Reader converts ISO-8859-1 read from r to UTF-8.
+type latin1Reader struct {
+	r *bufio.Reader
+	io.Closer
+}
+
+// Read implements io.Reader. It only returns complete UTF-8 sequences and only
+// blocks until the first byte is available.
+func (l latin1Reader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if n > 0 && l.r.Buffered() == 0 {
+			break
+		}
+		b, err := l.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		if b < utf8.RuneSelf {
+			p[n] = b
+			n++
+			continue
+		}
+		if n+2 > len(p) {
+			l.r.UnreadByte()
+			break
+		}
+		n += utf8.EncodeRune(p[n:], rune(b))
+	}
+	return n, nil
+}
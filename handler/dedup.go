@@ -0,0 +1,100 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"crypto/sha256"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/pushgateway/groupingkey"
+)
+
+// PushDeduplicator detects pushes of the exact same payload to the same group
+// within a time window, as they are typically caused by buggy retry loops. It
+// is safe for concurrent use.
+type PushDeduplicator struct {
+	window time.Duration
+	skip   bool
+
+	mtx       sync.Mutex // Protects the fields below.
+	pushes    map[uint64]dedupEntry
+	lastSweep time.Time
+}
+
+type dedupEntry struct {
+	fingerprint [sha256.Size]byte
+	time        time.Time
+}
+
+// NewPushDeduplicator returns a PushDeduplicator with the given window. If skip
+// is true, duplicate synchronous pushes are answered with status code 202
+// without being applied. If window is not positive, nil is returned, which is
+// a valid value for PushOptions.Deduplicator (disabling the detection).
+func NewPushDeduplicator(window time.Duration, skip bool) *PushDeduplicator {
+	if window <= 0 {
+		return nil
+	}
+	return &PushDeduplicator{
+		window:    window,
+		skip:      skip,
+		pushes:    map[uint64]dedupEntry{},
+		lastSweep: time.Now(),
+	}
+}
+
+// fingerprintBody replaces the body of r by a reader that feeds everything
+// read from the body into the returned hash. The method and Content-Type of r
+// are part of the fingerprint, too.
+func fingerprintBody(r *http.Request) hash.Hash {
+	h := sha256.New()
+	io.WriteString(h, r.Method)
+	h.Write([]byte{0})
+	io.WriteString(h, r.Header.Get("Content-Type"))
+	h.Write([]byte{0})
+	r.Body = ioutil.NopCloser(io.TeeReader(r.Body, h))
+	return h
+}
+
+// isDuplicate returns whether a push with the same fingerprint has been
+// applied to the group with the given labels within the window. If not, the
+// push is remembered as the most recent one for the group. Duplicates are not
+// remembered so that the window isn't extended by repeated duplicates.
+func (d *PushDeduplicator) isDuplicate(labels map[string]string, h hash.Hash) bool {
+	var fingerprint [sha256.Size]byte
+	copy(fingerprint[:], h.Sum(nil))
+	key := groupingkey.Hash(labels)
+	now := time.Now()
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if now.Sub(d.lastSweep) > d.window {
+		for k, e := range d.pushes {
+			if now.Sub(e.time) > d.window {
+				delete(d.pushes, k)
+			}
+		}
+		d.lastSweep = now
+	}
+	if e, ok := d.pushes[key]; ok && e.fingerprint == fingerprint && now.Sub(e.time) <= d.window {
+		return true
+	}
+	d.pushes[key] = dedupEntry{fingerprint: fingerprint, time: now}
+	return false
+}
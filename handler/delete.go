@@ -24,20 +24,27 @@ import (
 	"github.com/prometheus/pushgateway/storage"
 )
 
-// Delete returns a handler that accepts delete requests.
+// Delete returns a handler that accepts delete requests. The grouping labels
+// are determined in the same way as for the handler returned by Push with the
+// same PushOptions. If the request has a "metric" query parameter, only the
+// metric family with that name is deleted from the group.
 //
 // The returned handler is already instrumented for Prometheus.
-func Delete(ms storage.MetricStore) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+func Delete(ms storage.MetricStore, o *PushOptions) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	var ps httprouter.Params
 	var mtx sync.Mutex // Protects ps.
 
 	instrumentedHandlerFunc := prometheus.InstrumentHandlerFunc(
 		"delete",
-		func(w http.ResponseWriter, _ *http.Request) {
+		func(w http.ResponseWriter, r *http.Request) {
 			job := ps.ByName("job")
 			labelsString := ps.ByName("labels")
 			mtx.Unlock()
 
+			var metricName string
+			if r.URL != nil {
+				metricName = r.URL.Query().Get("metric")
+			}
 			labels, err := splitLabels(labelsString)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
@@ -48,10 +55,19 @@ func Delete(ms storage.MetricStore) func(http.ResponseWriter, *http.Request, htt
 				return
 			}
 			labels["job"] = job
+			if err := enforceGroupingLabels(r, labels); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			autoFillGroupingLabel(r, labels, o)
 			ms.SubmitWriteRequest(storage.WriteRequest{
-				Labels:    labels,
-				Timestamp: time.Now(),
+				Labels:           labels,
+				Timestamp:        time.Now(),
+				MetricFamilyName: metricName,
 			})
+			if o.GroupStats != nil && metricName == "" {
+				o.GroupStats.forget(labels)
+			}
 			w.WriteHeader(http.StatusAccepted)
 		},
 	)
@@ -72,7 +88,7 @@ func LegacyDelete(ms storage.MetricStore) func(http.ResponseWriter, *http.Reques
 
 	instrumentedHandlerFunc := prometheus.InstrumentHandlerFunc(
 		"delete",
-		func(w http.ResponseWriter, _ *http.Request) {
+		func(w http.ResponseWriter, r *http.Request) {
 			job := ps.ByName("job")
 			instance := ps.ByName("instance")
 			mtx.Unlock()
@@ -85,6 +101,10 @@ func LegacyDelete(ms storage.MetricStore) func(http.ResponseWriter, *http.Reques
 			if instance != "" {
 				labels["instance"] = instance
 			}
+			if err := enforceGroupingLabels(r, labels); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
 			ms.SubmitWriteRequest(storage.WriteRequest{
 				Labels:    labels,
 				Timestamp: time.Now(),
@@ -0,0 +1,195 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/text"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Echo returns a handler that parses and processes the request body in the
+// same way as the handler returned by Push with the same PushOptions, without
+// storing anything, and responds with the resulting metric families in the
+// canonical text format, i.e. sorted by metric name and label values, with
+// sorted labels. This allows authors of client libraries and scripts to
+// verify that their output ends up as intended.
+//
+// If the request has a grouping key (in the same URL path format as a push),
+// the grouping labels are applied and the push is checked for consistency
+// with the MetricStore as a PUT request would be. Everything that would lead
+// to a rejection of the push or to a change of what has been pushed (like a
+// sanitized label value) is reported as a warning, one per comment line
+// starting with '# WARNING:' before the metric families. Hence, the response
+// is still valid text format. Only an unparseable body results in status code
+// 400. The lenient query parameter is honored as for a push.
+//
+// The returned handler is already instrumented for Prometheus.
+func Echo(ms storage.MetricStore, o *PushOptions) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	var ps httprouter.Params
+	var mtx sync.Mutex // Protects ps.
+
+	instrumentedHandlerFunc := prometheus.InstrumentHandlerFunc(
+		"echo",
+		func(w http.ResponseWriter, r *http.Request) {
+			job := ps.ByName("job")
+			labelsString := ps.ByName("labels")
+			mtx.Unlock()
+
+			labels, err := splitLabels(labelsString)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if job != "" {
+				labels["job"] = job
+				autoFillGroupingLabel(r, labels, o)
+			}
+
+			if err := negotiateContentType(r, o.ContentTypes); err != nil {
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+				return
+			}
+			metricFamilies, skipped, err := parseMetricFamilies(r, queryParamIsTrue(r, "lenient"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var warnings []string
+			for _, l := range skipped {
+				warnings = append(warnings, fmt.Sprintf("skipped malformed line %d: %s: %q", l.Line, l.Error, l.Text))
+			}
+			if job != "" {
+				if err := checkLabelConflicts(metricFamilies, labels); err != nil {
+					if o.LabelConflicts == LabelConflictsReject {
+						warnings = append(warnings, "push would be rejected: "+err.Error())
+					} else {
+						warnings = append(warnings, err.Error())
+					}
+				}
+			}
+			warnings = append(warnings, echoLabelValueWarnings(metricFamilies, labels, o)...)
+			if invalid, err := checkSampleValues(metricFamilies, SampleValuesReject); invalid > 0 {
+				switch o.SampleValues {
+				case SampleValuesReject:
+					warnings = append(warnings, "push would be rejected: "+err.Error())
+				case SampleValuesDrop:
+					warnings = append(warnings, "samples would be dropped: "+err.Error())
+					checkSampleValues(metricFamilies, SampleValuesDrop)
+				default:
+					warnings = append(warnings, err.Error())
+				}
+			}
+			if err := checkBuckets(metricFamilies); err != nil {
+				warnings = append(warnings, "push would be rejected: "+err.Error())
+			}
+			if err := checkTimestampAge(metricFamilies, o.MaxTimestampAge, time.Now()); err != nil {
+				warnings = append(warnings, "push would be rejected: "+err.Error())
+			}
+			if transformed := transformValues(job, metricFamilies, o.Transforms); len(transformed) > 0 {
+				warnings = append(warnings, "values would be transformed: "+strings.Join(transformed, ", "))
+			}
+			if job != "" {
+				sanitizeLabels(metricFamilies, labels, o.metricAutoFillLabel(), o.LabelConflicts != LabelConflictsKeep)
+				for _, p := range checkPush(ms, labels, metricFamilies, true) {
+					warnings = append(warnings, "push would be rejected: "+p)
+				}
+			} else {
+				sanitizeLabels(metricFamilies, labels, "", false)
+			}
+
+			w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+			for _, warning := range warnings {
+				fmt.Fprintln(w, "# WARNING:", strings.Replace(warning, "\n", " ", -1))
+			}
+			writeCanonical(w, metricFamilies)
+		},
+	)
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		mtx.Lock()
+		ps = params
+		instrumentedHandlerFunc(w, r)
+	}
+}
+
+// echoLabelValueWarnings returns warnings for the label values that the
+// LabelValues mode in o would reject or sanitize, and sanitizes them if it
+// would.
+func echoLabelValueWarnings(
+	metricFamilies map[string]*dto.MetricFamily,
+	labels map[string]string,
+	o *PushOptions,
+) []string {
+	err := checkLabelValues(metricFamilies, labels, o.MaxLabelValueBytes, LabelValuesReject)
+	if err == nil {
+		return nil
+	}
+	switch o.LabelValues {
+	case LabelValuesReject:
+		return []string{"push would be rejected: " + err.Error()}
+	case LabelValuesSanitize:
+		checkLabelValues(metricFamilies, labels, o.MaxLabelValueBytes, LabelValuesSanitize)
+		return []string{"label values would be sanitized: " + err.Error()}
+	}
+	return []string{err.Error()}
+}
+
+// writeCanonical writes metricFamilies in the text format, sorted by metric
+// name, with the metrics of each family sorted by their label values. The
+// label pairs of each metric must already be sorted.
+func writeCanonical(w http.ResponseWriter, metricFamilies map[string]*dto.MetricFamily) {
+	names := make([]string, 0, len(metricFamilies))
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mf := metricFamilies[name]
+		sort.Sort(metricsByLabels(mf.Metric))
+		if _, err := text.MetricFamilyToText(w, mf); err != nil {
+			// Too late to change the status code.
+			return
+		}
+	}
+}
+
+// metricsByLabels sorts metrics with sorted label pairs by their label names
+// and values.
+type metricsByLabels []*dto.Metric
+
+func (s metricsByLabels) Len() int      { return len(s) }
+func (s metricsByLabels) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s metricsByLabels) Less(i, j int) bool {
+	a, b := s[i].GetLabel(), s[j].GetLabel()
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k].GetName() != b[k].GetName() {
+			return a[k].GetName() < b[k].GetName()
+		}
+		if a[k].GetValue() != b[k].GetValue() {
+			return a[k].GetValue() < b[k].GetValue()
+		}
+	}
+	return len(a) < len(b)
+}
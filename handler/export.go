@@ -0,0 +1,209 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/log"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+const openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// Export returns a handler that writes all metrics currently stored as a single
+// document in the format given by the 'format' query parameter. The only
+// supported format is 'openmetrics' (see WriteOpenMetrics), suitable for
+// backfilling into Prometheus with 'promtool tsdb create-blocks-from
+// openmetrics'.
+func Export(ms storage.MetricStore) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if format := r.URL.Query().Get("format"); format != "openmetrics" {
+			http.Error(w, fmt.Sprintf("unsupported export format %q, only 'openmetrics' is supported", format), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", openMetricsContentType)
+		if err := WriteOpenMetrics(w, ms.GetMetricFamiliesMap()); err != nil {
+			// Too late to change the status code.
+			log.Printf("Error exporting metrics: %s", err)
+		}
+	}
+}
+
+// WriteOpenMetrics writes the metrics of all groups as a single document in the
+// OpenMetrics text format to w. Metric families of the same name from different
+// groups are merged. If their types differ, the type of the family that sorts
+// first by grouping key wins, and the metrics of the other families are
+// skipped. Samples without an explicit timestamp get the time of their push as
+// timestamp. Counters whose name does not end in '_total' are exported as type
+// 'unknown' so that their series keep their names (OpenMetrics requires the
+// suffix for counter samples).
+func WriteOpenMetrics(w io.Writer, groups storage.GroupingKeyToMetricGroup) error {
+	type timestampedMetric struct {
+		metric *dto.Metric
+		pushed time.Time
+	}
+	type family struct {
+		help    string
+		mType   dto.MetricType
+		metrics []timestampedMetric
+	}
+
+	keys := make([]uint64, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	families := map[string]*family{}
+	for _, key := range keys {
+		for name, tmf := range groups[key].Metrics {
+			mf := tmf.MetricFamily
+			f, ok := families[name]
+			if !ok {
+				f = &family{help: mf.GetHelp(), mType: mf.GetType()}
+				families[name] = f
+			} else if f.mType != mf.GetType() {
+				log.Printf(
+					"Metric family %q of group %v has type %s, conflicting with type %s, skipping it in export.",
+					name, groups[key].Labels, mf.GetType(), f.mType,
+				)
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				f.metrics = append(f.metrics, timestampedMetric{m, tmf.Timestamp})
+			}
+		}
+	}
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		f := families[name]
+		omName, omType := name, "unknown"
+		switch f.mType {
+		case dto.MetricType_COUNTER:
+			if strings.HasSuffix(name, "_total") {
+				omName, omType = strings.TrimSuffix(name, "_total"), "counter"
+			}
+		case dto.MetricType_GAUGE:
+			omType = "gauge"
+		case dto.MetricType_SUMMARY:
+			omType = "summary"
+		case dto.MetricType_HISTOGRAM:
+			omType = "histogram"
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", omName, omType)
+		if f.help != "" {
+			fmt.Fprintf(bw, "# HELP %s %s\n", omName, escapeOpenMetrics(f.help))
+		}
+		for _, tm := range f.metrics {
+			writeOpenMetricsMetric(bw, name, f.mType, tm.metric, tm.pushed)
+		}
+	}
+	fmt.Fprint(bw, "# EOF\n")
+	return bw.Flush()
+}
+
+// writeOpenMetricsMetric writes the samples of m, a metric of the family with
+// the given name and type, to w.
+func writeOpenMetricsMetric(w io.Writer, name string, mType dto.MetricType, m *dto.Metric, pushed time.Time) {
+	ts := strconv.FormatFloat(float64(pushed.UnixNano()/int64(time.Millisecond))/1e3, 'f', -1, 64)
+	if m.TimestampMs != nil {
+		ts = strconv.FormatFloat(float64(m.GetTimestampMs())/1e3, 'f', -1, 64)
+	}
+	sample := func(suffix string, v float64, extraName, extraValue string) {
+		fmt.Fprintf(w, "%s%s%s %s %s\n", name, suffix, openMetricsLabels(m.GetLabel(), extraName, extraValue), formatOpenMetricsFloat(v), ts)
+	}
+	switch mType {
+	case dto.MetricType_COUNTER:
+		sample("", m.GetCounter().GetValue(), "", "")
+	case dto.MetricType_GAUGE:
+		sample("", m.GetGauge().GetValue(), "", "")
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		for _, q := range s.GetQuantile() {
+			sample("", q.GetValue(), "quantile", formatOpenMetricsFloat(q.GetQuantile()))
+		}
+		sample("_sum", s.GetSampleSum(), "", "")
+		sample("_count", float64(s.GetSampleCount()), "", "")
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		infSeen := false
+		for _, b := range h.GetBucket() {
+			sample("_bucket", float64(b.GetCumulativeCount()), "le", formatOpenMetricsFloat(b.GetUpperBound()))
+			infSeen = infSeen || math.IsInf(b.GetUpperBound(), +1)
+		}
+		if !infSeen {
+			sample("_bucket", float64(h.GetSampleCount()), "le", "+Inf")
+		}
+		sample("_sum", h.GetSampleSum(), "", "")
+		sample("_count", float64(h.GetSampleCount()), "", "")
+	default:
+		sample("", m.GetUntyped().GetValue(), "", "")
+	}
+}
+
+// openMetricsLabels returns the label set of the given label pairs plus the
+// label extraName (if not empty) in the OpenMetrics text format.
+func openMetricsLabels(lps []*dto.LabelPair, extraName, extraValue string) string {
+	if len(lps) == 0 && extraName == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(lps)+1)
+	for _, lp := range lps {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, lp.GetName(), escapeOpenMetrics(lp.GetValue())))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// escapeOpenMetrics escapes label values and help strings as required by the
+// OpenMetrics text format.
+func escapeOpenMetrics(s string) string {
+	return openMetricsEscaper.Replace(s)
+}
+
+// formatOpenMetricsFloat formats v as required by the OpenMetrics text format.
+func formatOpenMetricsFloat(v float64) string {
+	switch {
+	case math.IsInf(v, +1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,164 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/log"
+)
+
+// adminPathPrefix is the path prefix of the admin API, which is exempt from a
+// Freeze so that it can be lifted again.
+const adminPathPrefix = "/api/v1/admin/"
+
+var frozenDesc = prometheus.NewDesc(
+	"pushgateway_frozen",
+	"1 if the Pushgateway is frozen, i.e. rejects pushes and deletions, 0 otherwise.",
+	nil, nil,
+)
+
+// FreezeStatus is the state of a Freeze as reported by its handlers.
+type FreezeStatus struct {
+	Frozen bool `json:"frozen"`
+	// Reason and Since are only set while frozen.
+	Reason string     `json:"reason,omitempty"`
+	Since  *time.Time `json:"since,omitempty"`
+}
+
+// Freeze allows to switch the Pushgateway into a read-only mode at runtime,
+// e.g. during maintenance windows or migrations. While frozen, its Middleware
+// rejects all requests other than GET and HEAD, apart from those to the admin
+// API, while scrapes continue. It is a prometheus.Collector exposing whether
+// the Pushgateway is frozen. Use NewFreeze to create one.
+type Freeze struct {
+	trustedProxies []*net.IPNet
+
+	mtx    sync.RWMutex // Protects status.
+	status FreezeStatus
+}
+
+// NewFreeze returns a Freeze that is not frozen. Freezing and unfreezing is
+// logged with the identity of the client (see Identity) or, if it has not been
+// authenticated, its IP address, determined honoring the given trusted
+// proxies (see PushOptions.TrustedProxies).
+func NewFreeze(trustedProxies []*net.IPNet) *Freeze {
+	return &Freeze{trustedProxies: trustedProxies}
+}
+
+// Status returns the current state.
+func (f *Freeze) Status() FreezeStatus {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	return f.status
+}
+
+// Set freezes (with the given reason) or unfreezes the Pushgateway. Freezing
+// it again only updates the reason.
+func (f *Freeze) Set(frozen bool, reason string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if !frozen {
+		f.status = FreezeStatus{}
+		return
+	}
+	if !f.status.Frozen {
+		now := time.Now()
+		f.status.Since = &now
+	}
+	f.status.Frozen = true
+	f.status.Reason = reason
+}
+
+// Middleware returns a Middleware rejecting requests with methods other than
+// GET and HEAD with status code 503 and the reason of the freeze while frozen.
+// Requests to the admin API are always passed on.
+func (f *Freeze) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" || r.Method == "HEAD" || strings.HasPrefix(r.URL.Path, adminPathPrefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			s := f.Status()
+			if !s.Frozen {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if isPush(r) {
+				pushesRejected.WithLabelValues(rejectFrozen).Inc()
+			}
+			msg := "Pushgateway is frozen"
+			if s.Reason != "" {
+				msg += ": " + s.Reason
+			}
+			http.Error(w, msg, http.StatusServiceUnavailable)
+		})
+	}
+}
+
+// Handler returns a handler that reports the state of f as a JSON object (see
+// FreezeStatus) for a GET request. For a POST request, it freezes (if frozen
+// is true) or unfreezes the Pushgateway first. The reason of a freeze is taken
+// from the 'reason' field of a JSON object in the request body, if any.
+func (f *Freeze) Handler(frozen bool) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if r.Method == "POST" {
+			var req struct {
+				Reason string `json:"reason"`
+			}
+			if frozen && r.Body != nil {
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+					http.Error(w, fmt.Sprintf("error parsing request: %s", err), http.StatusBadRequest)
+					return
+				}
+			}
+			f.Set(frozen, req.Reason)
+			client := Identity(r)
+			if client == "" {
+				client = clientIP(r, f.trustedProxies)
+			}
+			if frozen {
+				log.Printf("Pushgateway frozen by %s: %q", client, req.Reason)
+			} else {
+				log.Printf("Pushgateway unfrozen by %s.", client)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f.Status())
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (f *Freeze) Describe(ch chan<- *prometheus.Desc) {
+	ch <- frozenDesc
+}
+
+// Collect implements prometheus.Collector.
+func (f *Freeze) Collect(ch chan<- prometheus.Metric) {
+	var frozen float64
+	if f.Status().Frozen {
+		frozen = 1
+	}
+	ch <- prometheus.MustNewConstMetric(frozenDesc, prometheus.GaugeValue, frozen)
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/text"
+
+	"github.com/prometheus/pushgateway/groupingkey"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Group returns a handler that writes the metrics currently stored for a single
+// group in the text format, sorted by metric name. The grouping labels are
+// determined in the same way as for the handler returned by Push with the same
+// PushOptions. The Last-Modified header is set to the time of the last push to
+// the group. If there is no such group, the response has status code 404.
+//
+// The returned handler is already instrumented for Prometheus.
+func Group(ms storage.MetricStore, o *PushOptions) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	var ps httprouter.Params
+	var mtx sync.Mutex // Protects ps.
+
+	instrumentedHandlerFunc := prometheus.InstrumentHandlerFunc(
+		"group",
+		func(w http.ResponseWriter, r *http.Request) {
+			job := ps.ByName("job")
+			labelsString := ps.ByName("labels")
+			mtx.Unlock()
+
+			labels, err := splitLabels(labelsString)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if job == "" {
+				http.Error(w, "job name is required", http.StatusBadRequest)
+				return
+			}
+			labels["job"] = job
+			autoFillGroupingLabel(r, labels, o)
+
+			group, ok := ms.GetMetricGroup(groupingkey.Hash(labels))
+			if !ok {
+				http.Error(w, "group not found", http.StatusNotFound)
+				return
+			}
+			writeGroup(w, group)
+		},
+	)
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		mtx.Lock()
+		ps = params
+		instrumentedHandlerFunc(w, r)
+	}
+}
+
+// writeGroup writes the metrics of group in the text format, sorted by metric
+// name, and sets the Last-Modified header to the time of the last push to it.
+func writeGroup(w http.ResponseWriter, group storage.MetricGroup) {
+	names := make([]string, 0, len(group.Metrics))
+	for name := range group.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+	if last := group.LastPushTime(); !last.IsZero() {
+		w.Header().Set("Last-Modified", last.UTC().Format(http.TimeFormat))
+	}
+	for _, name := range names {
+		if _, err := text.MetricFamilyToText(w, group.Metrics[name].MetricFamily); err != nil {
+			// Too late to change the status code.
+			return
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/pushgateway/groupingkey"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// groupedTargetLabelPrefix is the prefix of the meta labels carrying the
+// grouping labels of the targets listed by GroupedTargets.
+const groupedTargetLabelPrefix = "__meta_pushgateway_group_"
+
+// groupedPath returns the path under which Grouped serves the group with the
+// given grouping key.
+func groupedPath(key uint64) string {
+	return "/metrics/grouped/" + groupingkey.Format(key)
+}
+
+// Grouped returns a handler that writes the metrics currently stored for the
+// group whose grouping key is the 'hash' parameter (see groupingkey.Format),
+// in the same way as the handler returned by Group. If there is no such
+// group, the response has status code 404. Together with GroupedTargets, it
+// allows Prometheus to scrape each group as an individual target.
+//
+// The returned handler is already instrumented for Prometheus.
+func Grouped(ms storage.MetricStore) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	var ps httprouter.Params
+	var mtx sync.Mutex // Protects ps.
+
+	instrumentedHandlerFunc := prometheus.InstrumentHandlerFunc(
+		"grouped",
+		func(w http.ResponseWriter, r *http.Request) {
+			hash := ps.ByName("hash")
+			mtx.Unlock()
+
+			key, err := groupingkey.Parse(hash)
+			if err != nil {
+				http.Error(w, "group not found", http.StatusNotFound)
+				return
+			}
+			group, ok := ms.GetMetricGroup(key)
+			if !ok {
+				http.Error(w, "group not found", http.StatusNotFound)
+				return
+			}
+			writeGroup(w, group)
+		},
+	)
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		mtx.Lock()
+		ps = params
+		instrumentedHandlerFunc(w, r)
+	}
+}
+
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// GroupedTargets returns a handler that lists all groups as scrape targets in
+// the format of the HTTP-based service discovery of Prometheus. Each target is
+// the host of the request, with the path of the group as served by Grouped in
+// the __metrics_path__ label and the grouping labels as meta labels prefixed
+// by '__meta_pushgateway_group_'. Targets are sorted by path.
+func GroupedTargets(ms storage.MetricStore) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		groups := ms.GetMetricFamiliesMap()
+		tgs := make([]targetGroup, 0, len(groups))
+		for key, group := range groups {
+			labels := make(map[string]string, len(group.Labels)+1)
+			for name, value := range group.Labels {
+				labels[groupedTargetLabelPrefix+name] = value
+			}
+			labels["__metrics_path__"] = groupedPath(key)
+			tgs = append(tgs, targetGroup{Targets: []string{r.Host}, Labels: labels})
+		}
+		sort.Slice(tgs, func(i, j int) bool {
+			return tgs[i].Labels["__metrics_path__"] < tgs[j].Labels["__metrics_path__"]
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tgs)
+	}
+}
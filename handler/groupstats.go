@@ -0,0 +1,164 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/groupingkey"
+)
+
+const (
+	groupPushesName     = "pushgateway_group_pushes_total"
+	groupPushesHelp     = "Total number of pushes to the group, including failed ones."
+	groupLastStatusName = "pushgateway_group_last_push_http_status"
+	groupLastStatusHelp = "HTTP status code of the response to the last push to the group."
+	groupDuplicatesName = "pushgateway_group_duplicate_pushes_total"
+	groupDuplicatesHelp = "Total number of pushes to the group repeating the payload of a recent push."
+)
+
+// GroupStats counts the pushes per group and remembers the HTTP status code of
+// the response to the last push. It is safe for concurrent use.
+type GroupStats struct {
+	autoFillLabel string
+
+	mtx    sync.Mutex // Protects groups.
+	groups map[uint64]*groupStat
+}
+
+type groupStat struct {
+	labels     map[string]string
+	pushes     int
+	lastStatus int
+	duplicates int
+}
+
+// NewGroupStats returns an empty GroupStats. The metrics exposed by it get the
+// grouping labels of their group and the autoFillLabel with an empty value
+// (unless it is part of the grouping labels or autoFillLabel is empty).
+func NewGroupStats(autoFillLabel string) *GroupStats {
+	return &GroupStats{
+		autoFillLabel: autoFillLabel,
+		groups:        map[uint64]*groupStat{},
+	}
+}
+
+// observe records a push to the group with the given grouping labels. Failed
+// pushes are only recorded for groups with statistics already, i.e. groups a
+// push has been accepted for before, so that clients cannot create an
+// unbounded number of series by pushing garbage to arbitrary groups.
+func (gs *GroupStats) observe(labels map[string]string, status int) {
+	key := groupingkey.Hash(labels)
+
+	gs.mtx.Lock()
+	defer gs.mtx.Unlock()
+
+	g, ok := gs.groups[key]
+	if !ok {
+		if status >= 300 {
+			return
+		}
+		g = &groupStat{labels: labels}
+		gs.groups[key] = g
+	}
+	g.pushes++
+	g.lastStatus = status
+}
+
+// observeDuplicate records a duplicate push to the group with the given
+// grouping labels. The push itself has to be recorded with observe, too.
+func (gs *GroupStats) observeDuplicate(labels map[string]string) {
+	key := groupingkey.Hash(labels)
+
+	gs.mtx.Lock()
+	defer gs.mtx.Unlock()
+
+	g, ok := gs.groups[key]
+	if !ok {
+		g = &groupStat{labels: labels}
+		gs.groups[key] = g
+	}
+	g.duplicates++
+}
+
+// forget removes all statistics about the group with the given grouping
+// labels.
+func (gs *GroupStats) forget(labels map[string]string) {
+	gs.mtx.Lock()
+	defer gs.mtx.Unlock()
+	delete(gs.groups, groupingkey.Hash(labels))
+}
+
+// MetricFamilies returns the statistics as metric families, one series per
+// group. It is meant to be used in an injection hook for the Prometheus
+// client library, together with the MetricFamilies from the MetricStore.
+func (gs *GroupStats) MetricFamilies() []*dto.MetricFamily {
+	pushes := &dto.MetricFamily{
+		Name: proto.String(groupPushesName),
+		Help: proto.String(groupPushesHelp),
+		Type: dto.MetricType_COUNTER.Enum(),
+	}
+	lastStatus := &dto.MetricFamily{
+		Name: proto.String(groupLastStatusName),
+		Help: proto.String(groupLastStatusHelp),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	duplicates := &dto.MetricFamily{
+		Name: proto.String(groupDuplicatesName),
+		Help: proto.String(groupDuplicatesHelp),
+		Type: dto.MetricType_COUNTER.Enum(),
+	}
+
+	gs.mtx.Lock()
+	defer gs.mtx.Unlock()
+
+	if len(gs.groups) == 0 {
+		return nil
+	}
+	for _, g := range gs.groups {
+		lps := make([]*dto.LabelPair, 0, len(g.labels)+1)
+		for ln, lv := range g.labels {
+			lps = append(lps, &dto.LabelPair{
+				Name:  proto.String(ln),
+				Value: proto.String(lv),
+			})
+		}
+		if _, ok := g.labels[gs.autoFillLabel]; !ok && gs.autoFillLabel != "" {
+			lps = append(lps, &dto.LabelPair{
+				Name:  proto.String(gs.autoFillLabel),
+				Value: proto.String(""),
+			})
+		}
+		sort.Sort(prometheus.LabelPairSorter(lps))
+		pushes.Metric = append(pushes.Metric, &dto.Metric{
+			Label:   lps,
+			Counter: &dto.Counter{Value: proto.Float64(float64(g.pushes))},
+		})
+		lastStatus.Metric = append(lastStatus.Metric, &dto.Metric{
+			Label: lps,
+			Gauge: &dto.Gauge{Value: proto.Float64(float64(g.lastStatus))},
+		})
+		duplicates.Metric = append(duplicates.Metric, &dto.Metric{
+			Label:   lps,
+			Counter: &dto.Counter{Value: proto.Float64(float64(g.duplicates))},
+		})
+	}
+	return []*dto.MetricFamily{pushes, lastStatus, duplicates}
+}
@@ -14,25 +14,65 @@
 package handler
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/julienschmidt/httprouter"
 	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+	"github.com/prometheus/client_golang/model"
+	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 
+	"github.com/prometheus/pushgateway/groupingkey"
+	"github.com/prometheus/pushgateway/secret"
 	"github.com/prometheus/pushgateway/storage"
 )
 
 type MockMetricStore struct {
-	lastWriteRequest storage.WriteRequest
+	lastWriteRequest      storage.WriteRequest
+	metricGroups          storage.GroupingKeyToMetricGroup
+	memoryUsage           int64
+	writeQueueUtilization float64
+	writeErr              error // Sent to Done of write requests.
 }
 
 func (m *MockMetricStore) SubmitWriteRequest(req storage.WriteRequest) {
 	m.lastWriteRequest = req
+	if req.Done != nil {
+		req.Done <- m.writeErr
+	}
 }
 
 func (m *MockMetricStore) GetMetricFamilies() []*dto.MetricFamily {
@@ -40,7 +80,44 @@ func (m *MockMetricStore) GetMetricFamilies() []*dto.MetricFamily {
 }
 
 func (m *MockMetricStore) GetMetricFamiliesMap() storage.GroupingKeyToMetricGroup {
-	panic("not implemented")
+	return m.metricGroups
+}
+
+func (m *MockMetricStore) GetMetricGroup(key uint64) (storage.MetricGroup, bool) {
+	group, ok := m.metricGroups[key]
+	return group, ok
+}
+
+func (m *MockMetricStore) GetGroupingKeys() []uint64 {
+	keys := make([]uint64, 0, len(m.metricGroups))
+	for key := range m.metricGroups {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func (m *MockMetricStore) GetJobUsage(job string) storage.JobUsage {
+	var u storage.JobUsage
+	for _, group := range m.metricGroups {
+		if group.Labels["job"] != job {
+			continue
+		}
+		u.Groups++
+		for _, tmf := range group.Metrics {
+			u.Series += len(tmf.MetricFamily.GetMetric())
+			u.Bytes += int64(proto.Size(tmf.MetricFamily))
+		}
+	}
+	return u
+}
+
+func (m *MockMetricStore) MemoryUsage() int64 {
+	return m.memoryUsage
+}
+
+func (m *MockMetricStore) WriteQueueUtilization() float64 {
+	return m.writeQueueUtilization
 }
 
 func (m *MockMetricStore) Shutdown() error {
@@ -49,8 +126,8 @@ func (m *MockMetricStore) Shutdown() error {
 
 func TestPush(t *testing.T) {
 	mms := MockMetricStore{}
-	handler := Push(&mms, false)
-	legacyHandler := LegacyPush(&mms, false)
+	handler := Push(&mms, false, &PushOptions{AutoFillLabel: "instance"})
+	legacyHandler := LegacyPush(&mms, false, &PushOptions{AutoFillLabel: "instance"})
 	req, err := http.NewRequest("POST", "http://example.org/", &bytes.Buffer{})
 	if err != nil {
 		t.Fatal(err)
@@ -338,66 +415,3253 @@ another_metric{instance="baz"} 42
 	}
 }
 
-func TestDelete(t *testing.T) {
-	mms := MockMetricStore{}
-	handler := Delete(&mms)
+func TestPushLabelConflicts(t *testing.T) {
+	body := `
+some_metric{job="testjob",instance="bar"} 3.14
+another_metric{instance="testinstance"} 42
+`
+	params := httprouter.Params{
+		httprouter.Param{Key: "job", Value: "testjob"},
+		httprouter.Param{Key: "labels", Value: "/instance/testinstance"},
+	}
 
-	// No job name.
-	mms.lastWriteRequest = storage.WriteRequest{}
+	// Overwrite mode.
+	mms := MockMetricStore{}
+	handler := Push(&mms, false, &PushOptions{AutoFillLabel: "instance"})
+	req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
 	w := httptest.NewRecorder()
-	handler(
-		w, &http.Request{},
-		httprouter.Params{},
-	)
+	handler(w, req, params)
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := `name:"some_metric" type:UNTYPED metric:<label:<name:"instance" value:"testinstance" > label:<name:"job" value:"testjob" > untyped:<value:3.14 > > `, mms.lastWriteRequest.MetricFamilies["some_metric"].String(); expected != got {
+		t.Errorf("Wanted metric family %v, got %v.", expected, got)
+	}
+
+	// Reject mode.
+	mms = MockMetricStore{}
+	handler = Push(&mms, false, &PushOptions{AutoFillLabel: "instance", LabelConflicts: LabelConflictsReject})
+	req, err = http.NewRequest("POST", "http://example.org/", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler(w, req, params)
 	if expected, got := http.StatusBadRequest, w.Code; expected != got {
 		t.Errorf("Wanted status code %v, got %v.", expected, got)
 	}
+	if expected, got := "metric \"some_metric\" has label instance=\"bar\", conflicting with instance=\"testinstance\" from the grouping key\n", w.Body.String(); expected != got {
+		t.Errorf("Wanted body %q, got %q.", expected, got)
+	}
 	if !mms.lastWriteRequest.Timestamp.IsZero() {
-		t.Errorf("Write request timestamp unexpectedly set: %#v", mms.lastWriteRequest)
+		t.Errorf("Write request unexpectedly submitted: %#v", mms.lastWriteRequest)
 	}
 
-	// With job name, but no instance name.
-	mms.lastWriteRequest = storage.WriteRequest{}
+	// Reject mode, but no conflict as the values agree.
+	req, err = http.NewRequest(
+		"POST", "http://example.org/",
+		bytes.NewBufferString(`some_metric{job="testjob",instance="testinstance"} 3.14`+"\n"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
 	w = httptest.NewRecorder()
-	handler(
-		w, &http.Request{},
-		httprouter.Params{
-			httprouter.Param{Key: "job", Value: "testjob"},
+	handler(w, req, params)
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+
+	// Keep mode.
+	mms = MockMetricStore{}
+	handler = Push(&mms, false, &PushOptions{AutoFillLabel: "instance", LabelConflicts: LabelConflictsKeep})
+	req, err = http.NewRequest("POST", "http://example.org/", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler(w, req, params)
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := `name:"some_metric" type:UNTYPED metric:<label:<name:"instance" value:"bar" > label:<name:"job" value:"testjob" > untyped:<value:3.14 > > `, mms.lastWriteRequest.MetricFamilies["some_metric"].String(); expected != got {
+		t.Errorf("Wanted metric family %v, got %v.", expected, got)
+	}
+	if expected, got := `name:"another_metric" type:UNTYPED metric:<label:<name:"instance" value:"testinstance" > label:<name:"job" value:"testjob" > untyped:<value:42 > > `, mms.lastWriteRequest.MetricFamilies["another_metric"].String(); expected != got {
+		t.Errorf("Wanted metric family %v, got %v.", expected, got)
+	}
+}
+
+func TestPushAutoFillLabel(t *testing.T) {
+	for autoFillLabel, expected := range map[string]string{
+		"":    `name:"some_metric" type:UNTYPED metric:<label:<name:"job" value:"testjob" > untyped:<value:3.14 > > `,
+		"pod": `name:"some_metric" type:UNTYPED metric:<label:<name:"job" value:"testjob" > label:<name:"pod" value:"" > untyped:<value:3.14 > > `,
+	} {
+		mms := MockMetricStore{}
+		handler := Push(&mms, false, &PushOptions{AutoFillLabel: autoFillLabel})
+		req, err := http.NewRequest(
+			"POST", "http://example.org/",
+			bytes.NewBufferString("some_metric 3.14\n"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req, httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}})
+		if expected, got := http.StatusAccepted, w.Code; expected != got {
+			t.Errorf("Wanted status code %v, got %v.", expected, got)
+		}
+		if got := mms.lastWriteRequest.MetricFamilies["some_metric"].String(); expected != got {
+			t.Errorf("Wanted metric family %v, got %v.", expected, got)
+		}
+	}
+}
+
+func TestPushMemoryLimit(t *testing.T) {
+	for memoryUsage, expected := range map[int64]int{
+		1000: http.StatusAccepted,
+		1001: 507,
+	} {
+		mms := MockMetricStore{memoryUsage: memoryUsage}
+		handler := Push(&mms, true, &PushOptions{MaxMemoryBytes: 1000})
+		req, err := http.NewRequest(
+			"PUT", "http://example.org/",
+			bytes.NewBufferString("some_metric 3.14\n"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req, httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}})
+		if got := w.Code; expected != got {
+			t.Errorf("Wanted status code %v, got %v.", expected, got)
+		}
+		if rejected := mms.lastWriteRequest.Timestamp.IsZero(); rejected != (expected == 507) {
+			t.Errorf("Write request submitted: %t, status code %v.", !rejected, expected)
+		}
+	}
+}
+
+// timeRecordingReader records the time of the first call of Read.
+type timeRecordingReader struct {
+	io.Reader
+	firstRead time.Time
+}
+
+func (r *timeRecordingReader) Read(p []byte) (int, error) {
+	if r.firstRead.IsZero() {
+		r.firstRead = time.Now()
+	}
+	return r.Reader.Read(p)
+}
+
+func TestPushReplace(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Push(&mms, true, &PushOptions{})
+	body := &timeRecordingReader{Reader: bytes.NewBufferString("some_metric 3.14\n")}
+	req, err := http.NewRequest("PUT", "http://example.org/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req, httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}})
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	// The group is replaced in one write request, stamped with the time
+	// the push was received rather than the time it was parsed.
+	if !mms.lastWriteRequest.Replace {
+		t.Error("Write request does not replace the group.")
+	}
+	if ts := mms.lastWriteRequest.Timestamp; ts.IsZero() || ts.After(body.firstRead) {
+		t.Errorf("Wanted write request timestamp before %v, got %v.", body.firstRead, ts)
+	}
+}
+
+func TestPushQuota(t *testing.T) {
+	mms := MockMetricStore{metricGroups: storage.GroupingKeyToMetricGroup{}}
+	labels := map[string]string{"job": "testjob", "instance": "a"}
+	mms.metricGroups[model.LabelsToSignature(labels)] = storage.MetricGroup{
+		Labels: labels,
+		Metrics: storage.NameToTimestampedMetricFamilyMap{
+			"some_metric": storage.TimestampedMetricFamily{
+				MetricFamily: &dto.MetricFamily{
+					Name:   proto.String("some_metric"),
+					Type:   dto.MetricType_UNTYPED.Enum(),
+					Metric: []*dto.Metric{{Untyped: &dto.Untyped{Value: proto.Float64(1)}}, {Untyped: &dto.Untyped{Value: proto.Float64(2)}}},
+				},
+			},
 		},
-	)
+	}
+	labels = map[string]string{"job": "testjob", "instance": "b"}
+	mms.metricGroups[model.LabelsToSignature(labels)] = storage.MetricGroup{Labels: labels}
+	quotas := &Quotas{
+		Default: Quota{MaxGroups: 2, MaxSeries: 3},
+		Jobs:    map[string]Quota{"bigjob": {}},
+	}
+
+	scenarios := []struct {
+		job, instance string
+		replace       bool
+		body          string
+		expected      int
+	}{
+		{"testjob", "b", false, "some_metric 1\n", http.StatusAccepted},
+		{"testjob", "b", false, "some_metric 1\nother_metric 2\n", 429},
+		{"testjob", "c", false, "some_metric 1\n", 429},
+		// Replaced metric families do not count.
+		{"testjob", "a", false, "some_metric 1\nother_metric 2\n", http.StatusAccepted},
+		{"testjob", "a", true, "a 1\nb 2\nc 3\n", http.StatusAccepted},
+		{"testjob", "a", false, "other_metric 1\nother_metric{x=\"y\"} 2\n", 429},
+		{"testjob", "a", true, "a 1\nb 2\nc 3\nd 4\n", http.StatusRequestEntityTooLarge},
+		{"otherjob", "a", false, "some_metric 1\n", http.StatusAccepted},
+		{"bigjob", "a", false, "a 1\nb 2\nc 3\nd 4\n", http.StatusAccepted},
+	}
+	for i, s := range scenarios {
+		req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		Push(&mms, s.replace, &PushOptions{Quotas: quotas})(w, req, httprouter.Params{
+			httprouter.Param{Key: "job", Value: s.job},
+			httprouter.Param{Key: "labels", Value: "/instance/" + s.instance},
+		})
+		if got := w.Code; s.expected != got {
+			t.Errorf("%d: Wanted status code %v, got %v: %s", i, s.expected, got, w.Body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	QuotaStatus(&mms, quotas)(w, &http.Request{}, httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}})
+	if expected, got := `{"job":"testjob","quota":{"maxGroups":2,"maxSeries":3,"maxBytes":0},"usage":{"groups":2,"series":2,"bytes":41},"remaining":{"groups":0,"series":1,"bytes":null}}`+"\n", w.Body.String(); expected != got {
+		t.Errorf("Wanted quota status %s, got %s.", expected, got)
+	}
+}
+
+func TestPushLenient(t *testing.T) {
+	body := "a 1\nbad line here\n# TYPE c counter\nb{ 2\nc 3\nd 1 2 3\n"
+
+	mms := MockMetricStore{}
+	handler := Push(&mms, false, &PushOptions{Tracker: NewPushTracker(time.Minute)})
+	params := httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}}
+
+	// Without lenient parsing, the push is rejected.
+	req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req, params)
+	if expected, got := http.StatusInternalServerError, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+
+	req, err = http.NewRequest("POST", "http://example.org/?lenient=true", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler(w, req, params)
 	if expected, got := http.StatusAccepted, w.Code; expected != got {
 		t.Errorf("Wanted status code %v, got %v.", expected, got)
 	}
-	if mms.lastWriteRequest.Timestamp.IsZero() {
-		t.Errorf("Write request timestamp not set: %#v", mms.lastWriteRequest)
+	if expected, got := 2, len(mms.lastWriteRequest.MetricFamilies); expected != got {
+		t.Errorf("Wanted %d metric families, got %v.", expected, mms.lastWriteRequest.MetricFamilies)
 	}
-	if expected, got := "testjob", mms.lastWriteRequest.Labels["job"]; expected != got {
-		t.Errorf("Wanted job %v, got %v.", expected, got)
+	if _, ok := mms.lastWriteRequest.MetricFamilies["c"]; !ok {
+		t.Error("Metric family c missing.")
 	}
-	if expected, got := "", mms.lastWriteRequest.Labels["instance"]; expected != got {
-		t.Errorf("Wanted instance %v, got %v.", expected, got)
+	lines := strings.Split(w.Body.String(), "\n")
+	if expected, got := "Skipped 3 malformed lines:", lines[0]; expected != got {
+		t.Fatalf("Wanted %q, got %q.", expected, w.Body.String())
+	}
+	for i, prefix := range []string{"- line 2: ", "- line 4: ", "- line 6: "} {
+		if !strings.HasPrefix(lines[i+1], prefix) {
+			t.Errorf("Wanted line starting with %q, got %q.", prefix, lines[i+1])
+		}
 	}
 
-	// With job name and instance name.
-	mms.lastWriteRequest = storage.WriteRequest{}
+	// Asynchronous pushes report the skipped lines in the JSON response.
+	req, err = http.NewRequest("POST", "http://example.org/?lenient=true&async=true", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
 	w = httptest.NewRecorder()
-	handler(
-		w, &http.Request{},
-		httprouter.Params{
-			httprouter.Param{Key: "job", Value: "testjob"},
-			httprouter.Param{Key: "labels", Value: "/instance/testinstance"},
-		},
+	handler(w, req, params)
+	var resp struct {
+		ID           string        `json:"id"`
+		SkippedLines []skippedLine `json:"skippedLines"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := (skippedLine{Line: 4, Text: "b{ 2"}), resp.SkippedLines[1]; expected.Line != got.Line || expected.Text != got.Text || got.Error == "" {
+		t.Errorf("Wanted skipped line %v, got %v.", expected, got)
+	}
+}
+
+func TestPushTimeout(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Push(&mms, false, &PushOptions{Timeout: 10 * time.Millisecond})
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, err := http.NewRequest("POST", "http://example.org/", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before dto.Metric
+	pushTimeouts.Write(&before)
+
+	w := httptest.NewRecorder()
+	handler(w, req, httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}})
+	if expected, got := http.StatusRequestTimeout, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if !mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request unexpectedly submitted: %#v", mms.lastWriteRequest)
+	}
+	var after dto.Metric
+	pushTimeouts.Write(&after)
+	if expected, got := before.GetCounter().GetValue()+1, after.GetCounter().GetValue(); expected != got {
+		t.Errorf("Wanted %v timeouts, got %v.", expected, got)
+	}
+	// The body is not read anymore once the handler has returned.
+	if _, err := pw.Write([]byte("a 1\n")); err != io.ErrClosedPipe {
+		t.Errorf("Wanted %v writing to the body, got %v.", io.ErrClosedPipe, err)
+	}
+}
+
+func TestPushTimeoutServer(t *testing.T) {
+	mms := MockMetricStore{}
+	push := Push(&mms, false, &PushOptions{Timeout: 10 * time.Millisecond})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		push(w, r, httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}})
+	}))
+	defer server.Close()
+
+	// A client sending the headers but not the complete body is cut off by
+	// the read deadline.
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "POST / HTTP/1.1\r\nHost: example.org\r\nContent-Length: 100\r\n\r\na 1\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := http.StatusRequestTimeout, resp.StatusCode; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if !resp.Close {
+		t.Error("Wanted connection to be closed.")
+	}
+}
+
+func TestPushAutoFillClientIP(t *testing.T) {
+	mms := MockMetricStore{}
+	o := &PushOptions{AutoFillLabel: "instance", AutoFillMode: AutoFillClientIP}
+	handler := Push(&mms, false, o)
+	req, err := http.NewRequest(
+		"POST", "http://example.org/",
+		bytes.NewBufferString("some_metric 3.14\n"),
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "192.0.2.7:34567"
+
+	// Instance is filled in from the client IP.
+	w := httptest.NewRecorder()
+	handler(w, req, httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}})
 	if expected, got := http.StatusAccepted, w.Code; expected != got {
 		t.Errorf("Wanted status code %v, got %v.", expected, got)
 	}
-	if mms.lastWriteRequest.Timestamp.IsZero() {
-		t.Errorf("Write request timestamp not set: %#v", mms.lastWriteRequest)
-	}
-	if expected, got := "testjob", mms.lastWriteRequest.Labels["job"]; expected != got {
-		t.Errorf("Wanted job %v, got %v.", expected, got)
+	if expected, got := "192.0.2.7", mms.lastWriteRequest.Labels["instance"]; expected != got {
+		t.Errorf("Wanted instance %v, got %v.", expected, got)
 	}
+
+	// An explicit instance is left alone.
+	req.Body = ioutil.NopCloser(bytes.NewBufferString("some_metric 3.14\n"))
+	w = httptest.NewRecorder()
+	handler(w, req, httprouter.Params{
+		httprouter.Param{Key: "job", Value: "testjob"},
+		httprouter.Param{Key: "labels", Value: "/instance/testinstance"},
+	})
 	if expected, got := "testinstance", mms.lastWriteRequest.Labels["instance"]; expected != got {
 		t.Errorf("Wanted instance %v, got %v.", expected, got)
 	}
+
+	// Deletion from the same client deletes the same group.
+	w = httptest.NewRecorder()
+	Delete(&mms, o)(w, req, httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}})
+	if expected, got := "192.0.2.7", mms.lastWriteRequest.Labels["instance"]; expected != got {
+		t.Errorf("Wanted instance %v, got %v.", expected, got)
+	}
+}
+
+func TestPushAutoFillModes(t *testing.T) {
+	for _, s := range []struct {
+		mode           AutoFillMode
+		groupingLabels map[string]string
+		metricLabels   string
+	}{
+		{
+			mode:           AutoFillEmpty,
+			groupingLabels: map[string]string{"job": "testjob"},
+			metricLabels:   `label:<name:"instance" value:"" > label:<name:"job" value:"testjob" > `,
+		},
+		{
+			mode:           AutoFillStatic,
+			groupingLabels: map[string]string{"job": "testjob", "instance": "default"},
+			metricLabels:   `label:<name:"instance" value:"default" > label:<name:"job" value:"testjob" > `,
+		},
+		{
+			mode:           AutoFillOmit,
+			groupingLabels: map[string]string{"job": "testjob"},
+			metricLabels:   `label:<name:"job" value:"testjob" > `,
+		},
+	} {
+		mms := MockMetricStore{}
+		o := &PushOptions{AutoFillLabel: "instance", AutoFillMode: s.mode, AutoFillStaticValue: "default"}
+		req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString("some_metric 3.14\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		Push(&mms, false, o)(w, req, httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}})
+		if expected, got := http.StatusAccepted, w.Code; expected != got {
+			t.Errorf("%d: Wanted status code %v, got %v.", s.mode, expected, got)
+		}
+		if expected, got := s.groupingLabels, mms.lastWriteRequest.Labels; !reflect.DeepEqual(expected, got) {
+			t.Errorf("%d: Wanted grouping labels %v, got %v.", s.mode, expected, got)
+		}
+		expected := `name:"some_metric" type:UNTYPED metric:<` + s.metricLabels + `untyped:<value:3.14 > > `
+		if got := mms.lastWriteRequest.MetricFamilies["some_metric"].String(); expected != got {
+			t.Errorf("%d: Wanted metric family %s, got %s.", s.mode, expected, got)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		remoteAddr, xff, xRealIP, expected string
+	}{
+		{"198.51.100.3:1234", "", "", "198.51.100.3"},
+		// Headers from untrusted peers are ignored.
+		{"198.51.100.3:1234", "203.0.113.9", "203.0.113.8", "198.51.100.3"},
+		{"10.1.2.3:1234", "203.0.113.9", "203.0.113.8", "203.0.113.9"},
+		{"10.1.2.3:1234", "", "203.0.113.8", "203.0.113.8"},
+		// Trusted proxies in the chain are skipped, spoofed entries
+		// left of the first untrusted address are ignored.
+		{"10.1.2.3:1234", "6.6.6.6, 203.0.113.9, 192.0.2.1", "", "203.0.113.9"},
+		{"192.0.2.1:1234", "10.0.0.1, 10.0.0.2", "", "10.0.0.1"},
+		{"10.1.2.3:1234", "garbage", "", "10.1.2.3"},
+		{"", "203.0.113.9", "", "localhost"},
+	} {
+		req, err := http.NewRequest("POST", "http://example.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = c.remoteAddr
+		if c.xff != "" {
+			req.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if c.xRealIP != "" {
+			req.Header.Set("X-Real-IP", c.xRealIP)
+		}
+		if got := clientIP(req, trusted); c.expected != got {
+			t.Errorf("%+v: Wanted client IP %v, got %v.", c, c.expected, got)
+		}
+	}
+
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("Expected error for invalid network.")
+	}
+	if _, err := ParseTrustedProxies("not-an-ip"); err == nil {
+		t.Error("Expected error for invalid IP address.")
+	}
+}
+
+func TestGroupStats(t *testing.T) {
+	mms := MockMetricStore{}
+	o := &PushOptions{AutoFillLabel: "instance", GroupStats: NewGroupStats("instance")}
+	handler := Push(&mms, false, o)
+	params := httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}}
+
+	for _, body := range []string{"some_metric 3.14\n", "some_metric 3.14\n", "blablabla\n"} {
+		req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler(httptest.NewRecorder(), req, params)
+	}
+
+	mfs := o.GroupStats.MetricFamilies()
+	if expected, got := 3, len(mfs); expected != got {
+		t.Fatalf("Wanted %d metric families, got %d.", expected, got)
+	}
+	if expected, got := `name:"pushgateway_group_pushes_total" help:"Total number of pushes to the group, including failed ones." type:COUNTER metric:<label:<name:"instance" value:"" > label:<name:"job" value:"testjob" > counter:<value:3 > > `, mfs[0].String(); expected != got {
+		t.Errorf("Wanted metric family %v, got %v.", expected, got)
+	}
+	if expected, got := `name:"pushgateway_group_last_push_http_status" help:"HTTP status code of the response to the last push to the group." type:GAUGE metric:<label:<name:"instance" value:"" > label:<name:"job" value:"testjob" > gauge:<value:500 > > `, mfs[1].String(); expected != got {
+		t.Errorf("Wanted metric family %v, got %v.", expected, got)
+	}
+
+	// Failed pushes to groups without statistics are not recorded.
+	req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString("blablabla\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler(httptest.NewRecorder(), req, httprouter.Params{httprouter.Param{Key: "job", Value: "otherjob"}})
+	if expected, got := 1, len(o.GroupStats.MetricFamilies()[0].Metric); expected != got {
+		t.Errorf("Wanted %d series, got %d.", expected, got)
+	}
+
+	// Deleting the group removes its statistics.
+	Delete(&mms, o)(httptest.NewRecorder(), &http.Request{}, params)
+	if mfs := o.GroupStats.MetricFamilies(); len(mfs) != 0 {
+		t.Errorf("Wanted no metric families, got %v.", mfs)
+	}
+}
+
+func TestPushDuplicates(t *testing.T) {
+	mms := MockMetricStore{}
+	o := &PushOptions{
+		GroupStats:   NewGroupStats(""),
+		Deduplicator: NewPushDeduplicator(time.Minute, true),
+	}
+	handler := Push(&mms, false, o)
+	params := httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}}
+
+	for i, body := range []string{"some_metric 3.14\n", "some_metric 3.14\n", "some_metric 2.71\n"} {
+		mms.lastWriteRequest = storage.WriteRequest{}
+		req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req, params)
+		if expected, got := http.StatusAccepted, w.Code; expected != got {
+			t.Errorf("%d: Wanted status code %v, got %v.", i, expected, got)
+		}
+		// The second push is a duplicate and must not be applied.
+		if expected, got := i != 1, !mms.lastWriteRequest.Timestamp.IsZero(); expected != got {
+			t.Errorf("%d: Wanted write request submitted to be %v, got %v.", i, expected, got)
+		}
+	}
+
+	mfs := o.GroupStats.MetricFamilies()
+	if expected, got := 3, len(mfs); expected != got {
+		t.Fatalf("Wanted %d metric families, got %d.", expected, got)
+	}
+	if expected, got := `name:"pushgateway_group_duplicate_pushes_total" help:"Total number of pushes to the group repeating the payload of a recent push." type:COUNTER metric:<label:<name:"job" value:"testjob" > counter:<value:1 > > `, mfs[2].String(); expected != got {
+		t.Errorf("Wanted metric family %v, got %v.", expected, got)
+	}
+
+	// A disabled deduplicator is nil.
+	if d := NewPushDeduplicator(0, true); d != nil {
+		t.Errorf("Wanted nil deduplicator, got %v.", d)
+	}
+}
+
+func TestPushDryRun(t *testing.T) {
+	mms := MockMetricStore{
+		metricGroups: storage.GroupingKeyToMetricGroup{
+			1: storage.MetricGroup{
+				Labels: map[string]string{"job": "otherjob"},
+				Metrics: storage.NameToTimestampedMetricFamilyMap{
+					"some_metric": storage.TimestampedMetricFamily{
+						MetricFamily: &dto.MetricFamily{
+							Name: proto.String("some_metric"),
+							Type: dto.MetricType_GAUGE.Enum(),
+						},
+					},
+				},
+			},
+		},
+	}
+	handler := Push(&mms, true, &PushOptions{AutoFillLabel: "instance"})
+	params := httprouter.Params{
+		httprouter.Param{Key: "job", Value: "testjob"},
+		httprouter.Param{Key: "labels", Value: "/instance/testinstance"},
+	}
+
+	// Consistent push.
+	req, err := http.NewRequest(
+		"PUT", "http://example.org/?dry_run=true",
+		bytes.NewBufferString("# TYPE some_metric gauge\nsome_metric 3.14\nanother_metric 42\n"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req, params)
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := "Push would be accepted: 2 metric families with 2 metrics.\n", w.Body.String(); expected != got {
+		t.Errorf("Wanted body %q, got %q.", expected, got)
+	}
+	if !mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request unexpectedly submitted: %#v", mms.lastWriteRequest)
+	}
+
+	// Inconsistent type.
+	req, err = http.NewRequest(
+		"PUT", "http://example.org/?dry_run=true",
+		bytes.NewBufferString("# TYPE some_metric counter\nsome_metric 3.14\n"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler(w, req, params)
+	if expected, got := http.StatusBadRequest, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if !strings.Contains(w.Body.String(), `metric family "some_metric" has type COUNTER, but type GAUGE`) {
+		t.Errorf("Type inconsistency not reported, got body %q.", w.Body.String())
+	}
+	if !mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request unexpectedly submitted: %#v", mms.lastWriteRequest)
+	}
+
+	// Duplicate series caused by the grouping labels.
+	req, err = http.NewRequest(
+		"PUT", "http://example.org/?dry_run=true",
+		bytes.NewBufferString("another_metric{instance=\"a\"} 1\nanother_metric{instance=\"b\"} 2\n"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler(w, req, params)
+	if expected, got := http.StatusBadRequest, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if !strings.Contains(w.Body.String(), `metric family "another_metric" contains duplicate series`) {
+		t.Errorf("Duplicate series not reported, got body %q.", w.Body.String())
+	}
+}
+
+func TestPushAsync(t *testing.T) {
+	mms := MockMetricStore{}
+	pt := NewPushTracker(time.Minute)
+	handler := Push(&mms, false, &PushOptions{Tracker: pt})
+	statusHandler := PushStatus(pt)
+
+	req, err := http.NewRequest(
+		"POST", "http://example.org/?async=true",
+		bytes.NewBufferString("some_metric 3.14\n"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req, httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}})
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	var resp struct{ ID string }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "/api/v1/push/"+resp.ID, w.Header().Get("Location"); expected != got {
+		t.Errorf("Wanted Location header %q, got %q.", expected, got)
+	}
+
+	var status struct{ Status string }
+	for i := 0; i < 100 && status.Status != "committed"; i++ {
+		time.Sleep(time.Millisecond) // Give the tracker time to update.
+		w = httptest.NewRecorder()
+		statusHandler(w, &http.Request{}, httprouter.Params{httprouter.Param{Key: "id", Value: resp.ID}})
+		if expected, got := http.StatusOK, w.Code; expected != got {
+			t.Fatalf("Wanted status code %v, got %v.", expected, got)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected, got := "committed", status.Status; expected != got {
+		t.Errorf("Wanted push status %q, got %q.", expected, got)
+	}
+
+	// Unknown ID.
+	w = httptest.NewRecorder()
+	statusHandler(w, &http.Request{}, httprouter.Params{httprouter.Param{Key: "id", Value: "foo"}})
+	if expected, got := http.StatusNotFound, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+
+	// Asynchronous pushes disabled.
+	handler = Push(&mms, false, &PushOptions{AutoFillLabel: "instance"})
+	w = httptest.NewRecorder()
+	handler(w, req, httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}})
+	if expected, got := http.StatusBadRequest, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Idempotent(NewIdempotencyCache(time.Minute, 2), Push(&mms, false, &PushOptions{AutoFillLabel: "instance"}))
+	params := httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}}
+	newRequest := func(body string) *http.Request {
+		req, err := http.NewRequest("POST", "http://example.org/metrics/job/testjob", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Idempotency-Key", "abc")
+		return req
+	}
+
+	// First request is applied.
+	w := httptest.NewRecorder()
+	handler(w, newRequest("some_metric 3.14\n"), params)
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request timestamp not set: %#v", mms.lastWriteRequest)
+	}
+
+	// Retry is not applied again, but gets the same response.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	w = httptest.NewRecorder()
+	handler(w, newRequest("some_metric 3.14\n"), params)
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := "true", w.Header().Get("Idempotent-Replayed"); expected != got {
+		t.Errorf("Wanted Idempotent-Replayed header %q, got %q.", expected, got)
+	}
+	if !mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request unexpectedly submitted: %#v", mms.lastWriteRequest)
+	}
+
+	// Same key with a different body is rejected.
+	w = httptest.NewRecorder()
+	handler(w, newRequest("some_metric 42\n"), params)
+	if expected, got := 422, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if !mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request unexpectedly submitted: %#v", mms.lastWriteRequest)
+	}
+
+	// Without a key, every request is applied.
+	req := newRequest("some_metric 3.14\n")
+	req.Header.Del("Idempotency-Key")
+	w = httptest.NewRecorder()
+	handler(w, req, params)
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request timestamp not set: %#v", mms.lastWriteRequest)
+	}
+
+	// Keys are scoped by client.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	w = httptest.NewRecorder()
+	handler(w, WithIdentity(newRequest("some_metric 3.14\n"), "alice"), params)
+	if expected, got := "", w.Header().Get("Idempotent-Replayed"); expected != got {
+		t.Errorf("Wanted Idempotent-Replayed header %q, got %q.", expected, got)
+	}
+	if mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request timestamp not set: %#v", mms.lastWriteRequest)
+	}
+
+	// Once more keys than the maximum number of entries are used, the
+	// response expiring first is forgotten.
+	req = newRequest("some_metric 3.14\n")
+	req.Header.Set("Idempotency-Key", "def")
+	handler(httptest.NewRecorder(), req, params)
+	mms.lastWriteRequest = storage.WriteRequest{}
+	w = httptest.NewRecorder()
+	handler(w, newRequest("some_metric 3.14\n"), params)
+	if expected, got := "", w.Header().Get("Idempotent-Replayed"); expected != got {
+		t.Errorf("Wanted Idempotent-Replayed header %q, got %q.", expected, got)
+	}
+	if mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request timestamp not set: %#v", mms.lastWriteRequest)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Patch(&mms, &PushOptions{AutoFillLabel: "instance"})
+	params := httprouter.Params{{Key: "job", Value: "testjob"}, {Key: "labels", Value: "/instance/testinstance"}}
+
+	req, err := http.NewRequest("PATCH", "http://example.org/", bytes.NewBufferString("some_metric{shard=\"1\"} 3.14\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req, params)
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	wr := mms.lastWriteRequest
+	if !wr.Patch || wr.Replace || wr.Timestamp.IsZero() {
+		t.Errorf("Unexpected write request %#v.", wr)
+	}
+	if expected, got := `name:"some_metric" type:UNTYPED metric:<label:<name:"instance" value:"testinstance" > label:<name:"job" value:"testjob" > label:<name:"shard" value:"1" > untyped:<value:3.14 > > `, wr.MetricFamilies["some_metric"].String(); expected != got {
+		t.Errorf("Wanted metric family %s, got %s.", expected, got)
+	}
+
+	mms.writeErr = errors.New(`unknown metric family "some_metric"`)
+	req, err = http.NewRequest("PATCH", "http://example.org/", bytes.NewBufferString("some_metric 3.14\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler(w, req, params)
+	if expected, got := http.StatusBadRequest, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+
+	mms.writeErr = storage.ErrSuperseded
+	req, err = http.NewRequest("PATCH", "http://example.org/", bytes.NewBufferString("some_metric 3.14\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler(w, req, params)
+	if expected, got := http.StatusConflict, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Delete(&mms, &PushOptions{AutoFillLabel: "instance"})
+
+	// No job name.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	w := httptest.NewRecorder()
+	handler(
+		w, &http.Request{},
+		httprouter.Params{},
+	)
+	if expected, got := http.StatusBadRequest, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if !mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request timestamp unexpectedly set: %#v", mms.lastWriteRequest)
+	}
+
+	// With job name, but no instance name.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	w = httptest.NewRecorder()
+	handler(
+		w, &http.Request{},
+		httprouter.Params{
+			httprouter.Param{Key: "job", Value: "testjob"},
+		},
+	)
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request timestamp not set: %#v", mms.lastWriteRequest)
+	}
+	if expected, got := "testjob", mms.lastWriteRequest.Labels["job"]; expected != got {
+		t.Errorf("Wanted job %v, got %v.", expected, got)
+	}
+	if expected, got := "", mms.lastWriteRequest.Labels["instance"]; expected != got {
+		t.Errorf("Wanted instance %v, got %v.", expected, got)
+	}
+
+	// With job name and instance name.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	w = httptest.NewRecorder()
+	handler(
+		w, &http.Request{},
+		httprouter.Params{
+			httprouter.Param{Key: "job", Value: "testjob"},
+			httprouter.Param{Key: "labels", Value: "/instance/testinstance"},
+		},
+	)
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request timestamp not set: %#v", mms.lastWriteRequest)
+	}
+	if expected, got := "testjob", mms.lastWriteRequest.Labels["job"]; expected != got {
+		t.Errorf("Wanted job %v, got %v.", expected, got)
+	}
+	if expected, got := "testinstance", mms.lastWriteRequest.Labels["instance"]; expected != got {
+		t.Errorf("Wanted instance %v, got %v.", expected, got)
+	}
+}
+
+func TestLegacyDeleteGroupingLabels(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := LegacyDelete(&mms)
+	req := WithGroupingLabels(&http.Request{}, map[string]string{"namespace": "ns1", "pod": "pod1"})
+	params := httprouter.Params{
+		httprouter.Param{Key: "job", Value: "testjob"},
+		httprouter.Param{Key: "instance", Value: "testinstance"},
+	}
+
+	// The grouping labels of the client are added.
+	w := httptest.NewRecorder()
+	handler(w, req, params)
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	expected := map[string]string{"job": "testjob", "instance": "testinstance", "namespace": "ns1", "pod": "pod1"}
+	if got := mms.lastWriteRequest.Labels; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted grouping labels %v, got %v.", expected, got)
+	}
+
+	// Conflicting grouping labels are rejected.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	req = WithGroupingLabels(&http.Request{}, map[string]string{"instance": "other"})
+	w = httptest.NewRecorder()
+	handler(w, req, params)
+	if expected, got := http.StatusForbidden, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if mms.lastWriteRequest.Labels != nil {
+		t.Errorf("Unexpected write request %v.", mms.lastWriteRequest)
+	}
+}
+
+func TestDeleteMetric(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Delete(&mms, &PushOptions{})
+
+	for _, s := range []struct {
+		url        string
+		labels     string
+		expected   map[string]string
+		metricName string
+	}{
+		{
+			"http://example.org/metrics/job/testjob?metric=some_metric", "",
+			map[string]string{"job": "testjob"},
+			"some_metric",
+		},
+		{
+			"http://example.org/metrics/job/testjob/instance/testinstance?metric=some_metric", "/instance/testinstance",
+			map[string]string{"job": "testjob", "instance": "testinstance"},
+			"some_metric",
+		},
+		// A grouping label named "metric" deletes the whole group.
+		{
+			"http://example.org/metrics/job/testjob/instance/testinstance/metric/some_metric", "/instance/testinstance/metric/some_metric",
+			map[string]string{"job": "testjob", "instance": "testinstance", "metric": "some_metric"},
+			"",
+		},
+	} {
+		mms.lastWriteRequest = storage.WriteRequest{}
+		req, err := http.NewRequest("DELETE", s.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler(
+			w, req,
+			httprouter.Params{
+				httprouter.Param{Key: "job", Value: "testjob"},
+				httprouter.Param{Key: "labels", Value: s.labels},
+			},
+		)
+		if expected, got := http.StatusAccepted, w.Code; expected != got {
+			t.Errorf("%s: Wanted status code %v, got %v.", s.url, expected, got)
+		}
+		if mms.lastWriteRequest.MetricFamilies != nil {
+			t.Errorf("%s: Unexpected metric families in delete request: %v", s.url, mms.lastWriteRequest.MetricFamilies)
+		}
+		if expected, got := s.expected, mms.lastWriteRequest.Labels; !reflect.DeepEqual(expected, got) {
+			t.Errorf("%s: Wanted labels %v, got %v.", s.url, expected, got)
+		}
+		if expected, got := s.metricName, mms.lastWriteRequest.MetricFamilyName; expected != got {
+			t.Errorf("%s: Wanted metric name %q, got %q.", s.url, expected, got)
+		}
+	}
+}
+
+func TestRestore(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Restore(&mms, &PushOptions{})
+
+	w := httptest.NewRecorder()
+	handler(w, &http.Request{}, httprouter.Params{
+		httprouter.Param{Key: "job", Value: "testjob"},
+		httprouter.Param{Key: "labels", Value: "/instance/testinstance/restore"},
+	})
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if !mms.lastWriteRequest.Restore {
+		t.Errorf("Wanted a restore request, got %v.", mms.lastWriteRequest)
+	}
+	if expected, got := "testjob", mms.lastWriteRequest.Labels["job"]; expected != got {
+		t.Errorf("Wanted job label %q, got %q.", expected, got)
+	}
+	if expected, got := "testinstance", mms.lastWriteRequest.Labels["instance"]; expected != got {
+		t.Errorf("Wanted instance label %q, got %q.", expected, got)
+	}
+
+	mms.lastWriteRequest = storage.WriteRequest{}
+	w = httptest.NewRecorder()
+	handler(w, &http.Request{}, httprouter.Params{
+		httprouter.Param{Key: "job", Value: "testjob"},
+		httprouter.Param{Key: "labels", Value: "/instance/testinstance"},
+	})
+	if expected, got := http.StatusNotFound, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if mms.lastWriteRequest.Restore {
+		t.Errorf("Unexpected restore request %v.", mms.lastWriteRequest)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	mms := MockMetricStore{metricGroups: storage.GroupingKeyToMetricGroup{}}
+	labels := map[string]string{"job": "testjob", "instance": "testinstance"}
+	mms.metricGroups[model.LabelsToSignature(labels)] = storage.MetricGroup{
+		Labels: labels,
+		Metrics: storage.NameToTimestampedMetricFamilyMap{
+			"b_metric": storage.TimestampedMetricFamily{
+				MetricFamily: &dto.MetricFamily{
+					Name: proto.String("b_metric"),
+					Type: dto.MetricType_UNTYPED.Enum(),
+					Metric: []*dto.Metric{{
+						Label: []*dto.LabelPair{
+							{Name: proto.String("instance"), Value: proto.String("testinstance")},
+							{Name: proto.String("job"), Value: proto.String("testjob")},
+						},
+						Untyped: &dto.Untyped{Value: proto.Float64(2)},
+					}},
+				},
+			},
+			"a_metric": storage.TimestampedMetricFamily{
+				MetricFamily: &dto.MetricFamily{
+					Name: proto.String("a_metric"),
+					Help: proto.String("Some help."),
+					Type: dto.MetricType_COUNTER.Enum(),
+					Metric: []*dto.Metric{{
+						Label: []*dto.LabelPair{
+							{Name: proto.String("instance"), Value: proto.String("testinstance")},
+							{Name: proto.String("job"), Value: proto.String("testjob")},
+						},
+						Counter: &dto.Counter{Value: proto.Float64(1)},
+					}},
+				},
+			},
+		},
+	}
+	handler := Group(&mms, &PushOptions{})
+
+	w := httptest.NewRecorder()
+	handler(w, &http.Request{}, httprouter.Params{
+		httprouter.Param{Key: "job", Value: "testjob"},
+		httprouter.Param{Key: "labels", Value: "/instance/testinstance"},
+	})
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	expected := `# HELP a_metric Some help.
+# TYPE a_metric counter
+a_metric{instance="testinstance",job="testjob"} 1
+# TYPE b_metric untyped
+b_metric{instance="testinstance",job="testjob"} 2
+`
+	if got := w.Body.String(); expected != got {
+		t.Errorf("Wanted body %q, got %q.", expected, got)
+	}
+
+	// Unknown group.
+	w = httptest.NewRecorder()
+	handler(w, &http.Request{}, httprouter.Params{
+		httprouter.Param{Key: "job", Value: "testjob"},
+	})
+	if expected, got := http.StatusNotFound, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+
+	// The same group as an individual target.
+	w = httptest.NewRecorder()
+	GroupedTargets(&mms)(w, &http.Request{Host: "example.org:9091"}, nil)
+	var targets []targetGroup
+	if err := json.NewDecoder(w.Body).Decode(&targets); err != nil {
+		t.Fatal(err)
+	}
+	path := groupedPath(model.LabelsToSignature(labels))
+	expectedTargets := []targetGroup{{
+		Targets: []string{"example.org:9091"},
+		Labels: map[string]string{
+			"__metrics_path__":                  path,
+			"__meta_pushgateway_group_job":      "testjob",
+			"__meta_pushgateway_group_instance": "testinstance",
+		},
+	}}
+	if !reflect.DeepEqual(expectedTargets, targets) {
+		t.Errorf("Wanted targets %v, got %v.", expectedTargets, targets)
+	}
+	w = httptest.NewRecorder()
+	Grouped(&mms)(w, &http.Request{}, httprouter.Params{
+		httprouter.Param{Key: "hash", Value: path[len("/metrics/grouped/"):]},
+	})
+	if got := w.Body.String(); expected != got {
+		t.Errorf("Wanted body %q, got %q.", expected, got)
+	}
+	for _, hash := range []string{"0", "xyz"} {
+		w = httptest.NewRecorder()
+		Grouped(&mms)(w, &http.Request{}, httprouter.Params{
+			httprouter.Param{Key: "hash", Value: hash},
+		})
+		if expected, got := http.StatusNotFound, w.Code; expected != got {
+			t.Errorf("Wanted status code %v, got %v.", expected, got)
+		}
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	mms := MockMetricStore{metricGroups: storage.GroupingKeyToMetricGroup{}}
+	push := Push(&mms, true, &PushOptions{})
+	params := httprouter.Params{{Key: "job", Value: "testjob"}}
+
+	req, err := http.NewRequest("PUT", "http://example.org/", bytes.NewBufferString("a 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add(annotationHeader, "build_url=https://ci.example.org/build/1?a=b")
+	req.Header.Add(annotationHeader, " git_sha = abc123 ")
+	w := httptest.NewRecorder()
+	push(w, req, params)
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	expected := map[string]string{"build_url": "https://ci.example.org/build/1?a=b", "git_sha": "abc123"}
+	if got := mms.lastWriteRequest.Annotations; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted annotations %v, got %v.", expected, got)
+	}
+
+	req, err = http.NewRequest("PUT", "http://example.org/", bytes.NewBufferString("a 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add(annotationHeader, "=value")
+	w = httptest.NewRecorder()
+	push(w, req, params)
+	if expected, got := http.StatusBadRequest, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+
+	h := Annotations(&mms, &PushOptions{})
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/api/v1/annotations/job/testjob", nil), params)
+	if expected, got := http.StatusNotFound, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+
+	mms.metricGroups[model.LabelsToSignature(map[string]string{"job": "testjob"})] = storage.MetricGroup{
+		Labels:      map[string]string{"job": "testjob"},
+		Metrics:     storage.NameToTimestampedMetricFamilyMap{},
+		Annotations: map[string]string{"git_sha": "abc123"},
+	}
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/api/v1/annotations/job/testjob", nil), params)
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := "{\"git_sha\":\"abc123\"}\n", w.Body.String(); expected != got {
+		t.Errorf("Wanted body %q, got %q.", expected, got)
+	}
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/api/v1/annotations/job/testjob", bytes.NewBufferString(`{"owner": "team-a"}`)), params)
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := map[string]string{"owner": "team-a"}, mms.lastWriteRequest.Annotations; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted annotations %v, got %v.", expected, got)
+	}
+	if mms.lastWriteRequest.MetricFamilies == nil || len(mms.lastWriteRequest.MetricFamilies) > 0 || mms.lastWriteRequest.Replace {
+		t.Errorf("Unexpected write request %#v.", mms.lastWriteRequest)
+	}
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/api/v1/annotations/job/testjob", bytes.NewBufferString(`["owner"]`)), params)
+	if expected, got := http.StatusBadRequest, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+}
+
+func TestExport(t *testing.T) {
+	mms := MockMetricStore{metricGroups: storage.GroupingKeyToMetricGroup{}}
+	pushed := time.Unix(1500000000, 500000000)
+	for _, instance := range []string{"i2", "i1"} {
+		labels := map[string]string{"job": "testjob", "instance": instance}
+		lps := []*dto.LabelPair{
+			{Name: proto.String("instance"), Value: proto.String(instance)},
+			{Name: proto.String("job"), Value: proto.String("testjob")},
+		}
+		mms.metricGroups[model.LabelsToSignature(labels)] = storage.MetricGroup{
+			Labels: labels,
+			Metrics: storage.NameToTimestampedMetricFamilyMap{
+				"requests_total": storage.TimestampedMetricFamily{
+					Timestamp: pushed,
+					MetricFamily: &dto.MetricFamily{
+						Name:   proto.String("requests_total"),
+						Help:   proto.String("Some \"help\".\nMore help."),
+						Type:   dto.MetricType_COUNTER.Enum(),
+						Metric: []*dto.Metric{{Label: lps, Counter: &dto.Counter{Value: proto.Float64(3)}}},
+					},
+				},
+				"errors": storage.TimestampedMetricFamily{
+					Timestamp: pushed,
+					MetricFamily: &dto.MetricFamily{
+						Name:   proto.String("errors"),
+						Type:   dto.MetricType_COUNTER.Enum(),
+						Metric: []*dto.Metric{{Label: lps, Counter: &dto.Counter{Value: proto.Float64(1)}}},
+					},
+				},
+			},
+		}
+	}
+	mms.metricGroups[model.LabelsToSignature(map[string]string{"job": "other"})] = storage.MetricGroup{
+		Labels: map[string]string{"job": "other"},
+		Metrics: storage.NameToTimestampedMetricFamilyMap{
+			"latency_seconds": storage.TimestampedMetricFamily{
+				Timestamp: pushed,
+				MetricFamily: &dto.MetricFamily{
+					Name: proto.String("latency_seconds"),
+					Type: dto.MetricType_HISTOGRAM.Enum(),
+					Metric: []*dto.Metric{{
+						Label: []*dto.LabelPair{{Name: proto.String("job"), Value: proto.String("other")}},
+						Histogram: &dto.Histogram{
+							SampleCount: proto.Uint64(4),
+							SampleSum:   proto.Float64(2.5),
+							Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(3)}},
+						},
+						TimestampMs: proto.Int64(1400000000123),
+					}},
+				},
+			},
+		},
+	}
+
+	h := Export(&mms)
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/api/v1/export", nil), nil)
+	if expected, got := http.StatusBadRequest, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/api/v1/export?format=openmetrics", nil), nil)
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := openMetricsContentType, w.Header().Get("Content-Type"); expected != got {
+		t.Errorf("Wanted Content-Type %q, got %q.", expected, got)
+	}
+	// Groups are ordered by grouping key, hence the order of i1 and i2
+	// depends on their hashes.
+	i1, i2 := "i1", "i2"
+	if model.LabelsToSignature(map[string]string{"job": "testjob", "instance": "i2"}) <
+		model.LabelsToSignature(map[string]string{"job": "testjob", "instance": "i1"}) {
+		i1, i2 = i2, i1
+	}
+	expected := `# TYPE errors unknown
+errors{instance="` + i1 + `",job="testjob"} 1 1500000000.5
+errors{instance="` + i2 + `",job="testjob"} 1 1500000000.5
+# TYPE latency_seconds histogram
+latency_seconds_bucket{job="other",le="0.5"} 3 1400000000.123
+latency_seconds_bucket{job="other",le="+Inf"} 4 1400000000.123
+latency_seconds_sum{job="other"} 2.5 1400000000.123
+latency_seconds_count{job="other"} 4 1400000000.123
+# TYPE requests counter
+# HELP requests Some \"help\".\nMore help.
+requests_total{instance="` + i1 + `",job="testjob"} 3 1500000000.5
+requests_total{instance="` + i2 + `",job="testjob"} 3 1500000000.5
+# EOF
+`
+	if got := w.Body.String(); expected != got {
+		t.Errorf("Wanted body\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestPushPreconditions(t *testing.T) {
+	lastPush := time.Now().Add(-time.Minute)
+	labels := map[string]string{"job": "testjob"}
+	mms := MockMetricStore{metricGroups: storage.GroupingKeyToMetricGroup{
+		model.LabelsToSignature(labels): storage.MetricGroup{
+			Labels: labels,
+			Metrics: storage.NameToTimestampedMetricFamilyMap{
+				"some_metric": storage.TimestampedMetricFamily{
+					Timestamp:    lastPush,
+					MetricFamily: &dto.MetricFamily{Name: proto.String("some_metric")},
+				},
+			},
+		},
+	}}
+	handler := Push(&mms, false, &PushOptions{})
+
+	for _, c := range []struct {
+		job, query, ifUnmodifiedSince string
+		expected                      int
+	}{
+		{"testjob", "", "", http.StatusAccepted},
+		{"testjob", "min_age=30s", "", http.StatusAccepted},
+		{"testjob", "min_age=5m", "", http.StatusPreconditionFailed},
+		{"testjob", "min_age=garbage", "", http.StatusBadRequest},
+		{"testjob", "", lastPush.Add(-time.Minute).UTC().Format(http.TimeFormat), http.StatusPreconditionFailed},
+		{"testjob", "", lastPush.UTC().Format(http.TimeFormat), http.StatusAccepted},
+		{"testjob", "", "garbage", http.StatusAccepted},
+		{"otherjob", "min_age=5m", "", http.StatusAccepted},
+	} {
+		req, err := http.NewRequest(
+			"POST", "http://example.org/?"+c.query,
+			bytes.NewBufferString("some_metric 3.14\n"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.ifUnmodifiedSince != "" {
+			req.Header.Set("If-Unmodified-Since", c.ifUnmodifiedSince)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req, httprouter.Params{httprouter.Param{Key: "job", Value: c.job}})
+		if got := w.Code; c.expected != got {
+			t.Errorf("%+v: Wanted status code %v, got %v.", c, c.expected, got)
+		}
+	}
+}
+
+type fakeCompacter struct {
+	result storage.CompactionResult
+	err    error
+}
+
+func (c fakeCompacter) Compact() (storage.CompactionResult, error) {
+	return c.result, c.err
+}
+
+func TestCompact(t *testing.T) {
+	w := httptest.NewRecorder()
+	Compact(fakeCompacter{result: storage.CompactionResult{ReclaimedGroups: 3}})(w, &http.Request{}, nil)
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 3., got["reclaimedGroups"]; expected != got {
+		t.Errorf("Wanted %v reclaimed groups, got %v.", expected, got)
+	}
+
+	w = httptest.NewRecorder()
+	Compact(fakeCompacter{result: storage.CompactionResult{Err: errors.New("disk full")}})(w, &http.Request{}, nil)
+	if expected, got := http.StatusInternalServerError, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if !strings.Contains(w.Body.String(), `"error":"disk full"`) {
+		t.Errorf("Error missing in body %q.", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	Compact(fakeCompacter{err: storage.ErrShutdown})(w, &http.Request{}, nil)
+	if expected, got := http.StatusServiceUnavailable, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+}
+
+type fakeHistorian []storage.HistoryEntry
+
+func (h fakeHistorian) History(labels map[string]string) ([]storage.HistoryEntry, error) {
+	if labels["job"] != "testjob" {
+		return nil, nil
+	}
+	return h, nil
+}
+
+func TestHistory(t *testing.T) {
+	t0 := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	gauge := func(v float64) []*dto.MetricFamily {
+		return []*dto.MetricFamily{{
+			Name:   proto.String("g"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(v)}}},
+		}}
+	}
+	history := History(fakeHistorian{
+		{Timestamp: t0.Add(time.Hour), Start: t0.Add(time.Hour), MetricFamilies: gauge(2)},
+		{Timestamp: t0, Start: t0, MetricFamilies: gauge(1)},
+	}, &PushOptions{})
+	params := httprouter.Params{{Key: "job", Value: "testjob"}}
+
+	for _, s := range []struct {
+		query  string
+		status int
+		body   string
+	}{
+		{"", http.StatusOK, `[{"timestamp":"2015-06-01T13:00:00Z","start":"2015-06-01T13:00:00Z","metrics":"# TYPE g gauge\ng 2\n"},{"timestamp":"2015-06-01T12:00:00Z","start":"2015-06-01T12:00:00Z","metrics":"# TYPE g gauge\ng 1\n"}]` + "\n"},
+		{"?at=2015-06-01T12:30:00Z", http.StatusOK, "# TYPE g gauge\ng 1\n"},
+		{"?at=2015-06-01T13:00:00Z", http.StatusOK, "# TYPE g gauge\ng 2\n"},
+		{"?at=2015-06-01T11:00:00Z", http.StatusNotFound, "no state recorded at that time\n"},
+		{"?at=yesterday", http.StatusBadRequest, ""},
+	} {
+		req, err := http.NewRequest("GET", "http://example.org/api/v1/history/job/testjob"+s.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		history(w, req, params)
+		if got := w.Code; s.status != got {
+			t.Errorf("%q: Wanted status code %v, got %v.", s.query, s.status, got)
+		}
+		if got := w.Body.String(); s.body != "" && s.body != got {
+			t.Errorf("%q: Wanted body %q, got %q.", s.query, s.body, got)
+		}
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	var order []string
+	tag := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	identities := []string{}
+	h := Chain(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identities = append(identities, Identity(r))
+			w.WriteHeader(http.StatusAccepted)
+		}),
+		tag("first"),
+		Authenticate(
+			true,
+			BasicAuthenticator{"alice": "secret"},
+			TokenAuthenticator{"bob": "t0ken"},
+		),
+		tag("second"),
+	)
+
+	scenarios := []struct {
+		method, user, password, token string
+		expected                      int
+		identity                      string
+	}{
+		{"PUT", "alice", "secret", "", http.StatusAccepted, "alice"},
+		{"PUT", "alice", "wrong", "", http.StatusUnauthorized, ""},
+		{"PUT", "", "", "t0ken", http.StatusAccepted, "bob"},
+		{"PUT", "", "", "wrong", http.StatusUnauthorized, ""},
+		{"PUT", "", "", "", http.StatusUnauthorized, ""},
+		{"GET", "", "", "", http.StatusAccepted, ""},
+	}
+	for i, s := range scenarios {
+		order, identities = nil, nil
+		req, err := http.NewRequest(s.method, "http://example.org/metrics/job/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.user != "" {
+			req.SetBasicAuth(s.user, s.password)
+		}
+		if s.token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if got := w.Code; s.expected != got {
+			t.Errorf("%d: Wanted status code %v, got %v.", i, s.expected, got)
+		}
+		if s.expected == http.StatusUnauthorized {
+			if expected, got := "first", strings.Join(order, ","); expected != got {
+				t.Errorf("%d: Wanted middlewares %q to be called, got %q.", i, expected, got)
+			}
+			continue
+		}
+		if expected, got := "first,second", strings.Join(order, ","); expected != got {
+			t.Errorf("%d: Wanted middlewares %q to be called, got %q.", i, expected, got)
+		}
+		if expected, got := s.identity, identities[0]; expected != got {
+			t.Errorf("%d: Wanted identity %q, got %q.", i, expected, got)
+		}
+	}
+}
+
+func TestHMACAuthenticator(t *testing.T) {
+	body := "some_metric 3.14\n"
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	sign := func(secret, method, uri, ts, body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		io.WriteString(mac, method+"\n"+uri+"\n"+ts+"\n"+body)
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	var received string
+	h := Authenticate(true, HMACAuthenticator{"foo": "s3cret"})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			received = string(b)
+			if expected, got := "foo", Identity(r); expected != got {
+				t.Errorf("Wanted identity %q, got %q.", expected, got)
+			}
+			w.WriteHeader(http.StatusAccepted)
+		}),
+	)
+
+	uri := "/metrics/job/foo/instance/a"
+	for i, s := range []struct {
+		method, job, body, signature, timestamp string
+		expected                                int
+	}{
+		{"PUT", "foo", body, sign("s3cret", "PUT", uri, now, body), now, http.StatusAccepted},
+		{"PUT", "foo", body, sign("wrong", "PUT", uri, now, body), now, http.StatusUnauthorized},
+		{"PUT", "foo", body, sign("s3cret", "PUT", uri, now, body+"x 1\n"), now, http.StatusUnauthorized},
+		{"PUT", "foo", body, "sha256=xyz", now, http.StatusUnauthorized},
+		{"PUT", "foo", body, "", now, http.StatusUnauthorized},
+		{"PUT", "bar", body, sign("s3cret", "PUT", "/metrics/job/bar/instance/a", now, body), now, http.StatusUnauthorized}, // No secret for job bar.
+		// Replays with another method, path, or timestamp.
+		{"DELETE", "foo", "", sign("s3cret", "PUT", uri, now, ""), now, http.StatusUnauthorized},
+		{"POST", "foo", body, sign("s3cret", "PUT", uri, now, body), now, http.StatusUnauthorized},
+		{"PUT", "foo", body, sign("s3cret", "PUT", "/metrics/job/foo/instance/b", now, body), now, http.StatusUnauthorized},
+		{"PUT", "foo", body, sign("s3cret", "PUT", uri, stale, body), now, http.StatusUnauthorized},
+		{"PUT", "foo", body, sign("s3cret", "PUT", uri, stale, body), stale, http.StatusUnauthorized},
+		{"PUT", "foo", body, sign("s3cret", "PUT", uri, now, body), "", http.StatusUnauthorized},
+		{"DELETE", "foo", "", sign("s3cret", "DELETE", uri, now, ""), now, http.StatusAccepted},
+	} {
+		received = ""
+		req, err := http.NewRequest(s.method, "http://example.org/metrics/job/"+s.job+"/instance/a", bytes.NewBufferString(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.signature != "" {
+			req.Header.Set(signatureHeader, s.signature)
+		}
+		if s.timestamp != "" {
+			req.Header.Set(signatureTimestampHeader, s.timestamp)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if got := w.Code; s.expected != got {
+			t.Errorf("%d: Wanted status code %v, got %v.", i, s.expected, got)
+		}
+		if s.expected == http.StatusAccepted && received != s.body {
+			t.Errorf("%d: Wanted body %q passed on, got %q.", i, s.body, received)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	rl := &rateLimiter{rate: 2, burst: 3, buckets: map[string]*tokenBucket{}}
+	now := time.Now()
+	rl.lastSweep = now
+	for i, s := range []struct {
+		client   string
+		after    time.Duration
+		expected bool
+	}{
+		{"a", 0, true},
+		{"a", 0, true},
+		{"a", 0, true},
+		{"a", 0, false},
+		{"b", 0, true}, // Separate bucket per client.
+		{"a", 499 * time.Millisecond, false},
+		{"a", time.Millisecond, true}, // 1 token after 500ms.
+		{"a", 0, false},
+		{"a", time.Hour, true}, // Bucket swept and full again.
+		{"a", 0, true},
+		{"a", 0, true},
+		{"a", 0, false},
+	} {
+		now = now.Add(s.after)
+		if got := rl.allow(s.client, now); s.expected != got {
+			t.Errorf("%d: Wanted %t, got %t.", i, s.expected, got)
+		}
+	}
+
+	h := RateLimit(1, 1, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := &http.Request{RemoteAddr: "192.0.2.1:1234"}
+	for _, expected := range []int{http.StatusOK, 429} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if got := w.Code; expected != got {
+			t.Errorf("Wanted status code %v, got %v.", expected, got)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	var buf bytes.Buffer
+	h := Chain(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		}),
+		Authenticate(true, TokenAuthenticator{"bob": "t0ken"}),
+		Audit(&buf, nil),
+	)
+	for _, method := range []string{"GET", "DELETE"} {
+		req, err := http.NewRequest(method, "http://example.org/metrics/job/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", "Bearer t0ken")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	fields := strings.Fields(buf.String())
+	if expected, got := 7, len(fields); expected != got {
+		t.Fatalf("Wanted %d fields in audit log, got %q.", expected, buf.String())
+	}
+	if expected, got := `192.0.2.1 "bob" DELETE "/metrics/job/foo" 202`, strings.Join(fields[1:6], " "); expected != got {
+		t.Errorf("Wanted audit log line %q, got %q.", expected, got)
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	f, err := ioutil.TempFile("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, "# Comment.\nallow 192.0.2.0/24\n\ndeny 192.0.2.128/25\nallow 2001:db8::1\n")
+	f.Close()
+
+	filter, err := NewIPFilter(f.Name(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := filter.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	check := func(method, remoteAddr string, expected int) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, &http.Request{Method: method, RemoteAddr: remoteAddr})
+		if got := w.Code; expected != got {
+			t.Errorf("%s from %s: Wanted status code %v, got %v.", method, remoteAddr, expected, got)
+		}
+	}
+	check("PUT", "192.0.2.1:1234", http.StatusOK)
+	check("DELETE", "192.0.2.200:1234", http.StatusForbidden) // Deny wins.
+	check("POST", "198.51.100.1:1234", http.StatusForbidden)  // Not allowed.
+	check("POST", "[2001:db8::1]:1234", http.StatusOK)
+	check("GET", "198.51.100.1:1234", http.StatusOK) // Reads are not filtered.
+
+	// A broken file keeps the previous rules in effect.
+	if err := ioutil.WriteFile(f.Name(), []byte("permit 198.51.100.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := filter.Reload(); err == nil {
+		t.Error("Expected error for unknown action.")
+	}
+	check("PUT", "192.0.2.1:1234", http.StatusOK)
+
+	if err := ioutil.WriteFile(f.Name(), []byte("deny 192.0.2.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := filter.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	check("PUT", "192.0.2.1:1234", http.StatusForbidden)
+	check("PUT", "198.51.100.1:1234", http.StatusOK) // No allow rules left.
+}
+
+func TestRetiredJobs(t *testing.T) {
+	f, err := ioutil.TempFile("", "retired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, "# Comment.\nold_job use new_job instead\n\nsilent_job\n")
+	f.Close()
+
+	rj, err := NewRetiredJobs(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(job string, status int, msg string) {
+		req, err := http.NewRequest("PUT", "http://example.org/", bytes.NewBufferString("a 1\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		params := httprouter.Params{httprouter.Param{Key: "job", Value: job}}
+		Push(&MockMetricStore{}, true, &PushOptions{RetiredJobs: rj})(w, req, params)
+		if got := w.Code; status != got {
+			t.Errorf("%s: Wanted status code %v, got %v.", job, status, got)
+		}
+		if !strings.Contains(w.Body.String(), msg) {
+			t.Errorf("%s: Wanted %q in response, got %q.", job, msg, w.Body.String())
+		}
+	}
+	check("old_job", http.StatusGone, "use new_job instead")
+	check("silent_job", http.StatusGone, "retired")
+	check("new_job", http.StatusAccepted, "")
+
+	if err := ioutil.WriteFile(f.Name(), []byte("new_job\nnew_job\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := rj.Reload(); err == nil {
+		t.Error("Expected error for duplicate job.")
+	}
+	check("new_job", http.StatusAccepted, "")
+}
+
+func TestLoadCredentials(t *testing.T) {
+	f, err := ioutil.TempFile("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, "# Comment.\nalice:secret\n\nbob:t0k:en\n")
+	f.Close()
+
+	credentials, err := LoadCredentials(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "map[alice:secret bob:t0k:en]", fmt.Sprint(credentials); expected != got {
+		t.Errorf("Wanted credentials %s, got %s.", expected, got)
+	}
+
+	f, err = os.OpenFile(f.Name(), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(f, "alice\n")
+	f.Close()
+	if _, err := LoadCredentials(f.Name()); err == nil {
+		t.Error("Expected error for malformed line.")
+	}
+}
+
+func TestSecretAuthenticator(t *testing.T) {
+	f, err := ioutil.TempFile("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, "alice:secret\n")
+	f.Close()
+	s, err := secret.New(f.Name(), time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewSecretAuthenticator(s, func(c map[string]string) Authenticator { return BasicAuthenticator(c) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(user, password string, ok bool) {
+		req, err := http.NewRequest("PUT", "http://example.org/metrics/job/testjob", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(user, password)
+		if _, got := a.Authenticate(req); got != ok {
+			t.Errorf("%s:%s: Wanted authenticated %t, got %t.", user, password, ok, got)
+		}
+	}
+	check("alice", "secret", true)
+
+	// Rotated credentials take effect, malformed ones are ignored.
+	if err := ioutil.WriteFile(f.Name(), []byte("alice:rotated\nbob:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	check("alice", "secret", false)
+	check("alice", "rotated", true)
+	if err := ioutil.WriteFile(f.Name(), []byte("malformed\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	check("bob", "secret", true)
+}
+
+func TestKubernetesAuthenticator(t *testing.T) {
+	reviews := 0
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reviews++
+		if r.URL.Path != "/apis/authentication.k8s.io/v1/tokenreviews" || r.Header.Get("Authorization") != "Bearer own-token" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		var review tokenReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			t.Error(err)
+			return
+		}
+		review.Status.Audiences = review.Spec.Audiences
+		switch review.Spec.Token {
+		case "other-audience-token":
+			review.Status.Authenticated = true
+			review.Status.User.Username = "system:serviceaccount:ns1:batch"
+			review.Status.User.Extra = map[string][]string{kubernetesPodNameExtra: {"pod1"}}
+			review.Status.Audiences = []string{"other"}
+		case "pod-token":
+			review.Status.Authenticated = true
+			review.Status.User.Username = "system:serviceaccount:ns1:batch"
+			review.Status.User.Extra = map[string][]string{kubernetesPodNameExtra: {"pod1"}}
+		case "unbound-token":
+			review.Status.Authenticated = true
+			review.Status.User.Username = "system:serviceaccount:ns1:batch"
+		case "user-token":
+			review.Status.Authenticated = true
+			review.Status.User.Username = "alice"
+		}
+		json.NewEncoder(w).Encode(review)
+	}))
+	defer apiServer.Close()
+
+	tempDir, err := ioutil.TempDir("", "handler.TestKubernetesAuthenticator.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	tokenFile := path.Join(tempDir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("own-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	token, err := secret.New(tokenFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &KubernetesAuthenticator{
+		APIServer:      apiServer.URL,
+		Token:          token,
+		Audiences:      []string{"pushgateway"},
+		NamespaceLabel: "namespace",
+		PodLabel:       "pod",
+		CacheTTL:       time.Minute,
+	}
+
+	mms := MockMetricStore{}
+	params := httprouter.Params{
+		httprouter.Param{Key: "job", Value: "testjob"},
+		httprouter.Param{Key: "labels", Value: "/instance/i1"},
+	}
+	push := Push(&mms, true, &PushOptions{})
+	h := Authenticate(false, a)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		push(w, r, params)
+	}))
+	for _, s := range []struct {
+		token  string
+		labels string
+		status int
+	}{
+		{"pod-token", "/instance/i1", http.StatusAccepted},
+		{"pod-token", "/instance/i1/pod/pod1", http.StatusAccepted},
+		{"pod-token", "/instance/i1/pod/pod2", http.StatusForbidden},
+		{"unbound-token", "/instance/i1", http.StatusUnauthorized},
+		{"user-token", "/instance/i1", http.StatusUnauthorized},
+		{"other-audience-token", "/instance/i1", http.StatusUnauthorized},
+		{"invalid-token", "/instance/i1", http.StatusUnauthorized},
+		{"invalid-token", "/instance/i1", http.StatusUnauthorized},
+	} {
+		params[1].Value = s.labels
+		req, err := http.NewRequest("PUT", "http://example.org/metrics/job/testjob"+s.labels, bytes.NewBufferString("a 1\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+s.token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if expected, got := s.status, w.Code; expected != got {
+			t.Errorf("%s with %s: wanted status code %v, got %v: %s", s.token, s.labels, expected, got, w.Body)
+		}
+		if s.status == http.StatusAccepted {
+			expected := map[string]string{"job": "testjob", "instance": "i1", "namespace": "ns1", "pod": "pod1"}
+			if got := mms.lastWriteRequest.Labels; !reflect.DeepEqual(expected, got) {
+				t.Errorf("%s with %s: wanted grouping labels %v, got %v.", s.token, s.labels, expected, got)
+			}
+		}
+	}
+	// Reviews of valid tokens are cached, those of invalid tokens are not.
+	if expected, got := 6, reviews; expected != got {
+		t.Errorf("Wanted %d token reviews, got %d.", expected, got)
+	}
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetches := 0
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		fmt.Fprintf(
+			w, `{"keys": [{"kty": "RSA", "kid": "key1", "n": %q, "e": %q}]}`,
+			base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		)
+	}))
+	defer jwks.Close()
+
+	sign := func(kid string, claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(signed))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := map[string]interface{}{
+		"sub": "batch", "iss": "https://idp", "aud": []string{"pgw"}, "exp": exp,
+		"jobs": []string{"job1", "job2"},
+	}
+	with := func(k string, v interface{}) map[string]interface{} {
+		claims := map[string]interface{}{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		claims[k] = v
+		return claims
+	}
+
+	a := &JWTAuthenticator{
+		JWKSURL:   jwks.URL,
+		Issuer:    "https://idp",
+		Audience:  "pgw",
+		JobsClaim: "jobs",
+	}
+	h := Authenticate(true, a)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, Identity(r))
+	}))
+
+	scenarios := []struct {
+		token    string
+		path     string
+		expected int
+	}{
+		{sign("key1", valid), "/metrics/job/job1", http.StatusOK},
+		{sign("key1", valid), "/metrics/job/job2/instance/a", http.StatusOK},
+		{sign("key1", valid), "/metrics/job/job3", http.StatusForbidden},
+		{sign("key1", valid), "/api/v1/metrics/job/job3/restore", http.StatusForbidden},
+		{sign("key1", with("jobs", "*")), "/metrics/jobs/job3", http.StatusOK},
+		{sign("key1", with("exp", time.Now().Add(-time.Minute).Unix())), "/metrics/job/job1", http.StatusUnauthorized},
+		{sign("key1", with("nbf", exp)), "/metrics/job/job1", http.StatusUnauthorized},
+		{sign("key1", with("iss", "https://evil")), "/metrics/job/job1", http.StatusUnauthorized},
+		{sign("key1", with("aud", "other")), "/metrics/job/job1", http.StatusUnauthorized},
+		{sign("key2", valid), "/metrics/job/job1", http.StatusUnauthorized},
+		{sign("key1", valid)[:20] + "x" + sign("key1", valid)[21:], "/metrics/job/job1", http.StatusUnauthorized},
+		{"garbage", "/metrics/job/job1", http.StatusUnauthorized},
+	}
+	for i, s := range scenarios {
+		req, err := http.NewRequest("POST", "http://example.org"+s.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+s.token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if got := w.Code; s.expected != got {
+			t.Errorf("%d: Wanted status code %v, got %v: %s", i, s.expected, got, w.Body)
+		}
+		if s.expected == http.StatusOK && w.Body.String() != "batch" {
+			t.Errorf("%d: Wanted identity %q, got %q.", i, "batch", w.Body)
+		}
+	}
+	// The unknown key did not trigger a refetch right after the first
+	// fetch, but it does a minute later.
+	if expected, got := 1, fetches; expected != got {
+		t.Errorf("Wanted %d fetches of the JWKS, got %d.", expected, got)
+	}
+	a.lastFetch = a.lastFetch.Add(-2 * time.Minute)
+	req, err := http.NewRequest("POST", "http://example.org/metrics/job/job1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+sign("key2", valid))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if expected, got := 2, fetches; expected != got {
+		t.Errorf("Wanted %d fetches of the JWKS, got %d.", expected, got)
+	}
+}
+
+func TestJWTKeyFetch(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		fetches int
+	)
+	release := make(chan struct{})
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		fetches++
+		mtx.Unlock()
+		<-release
+		fmt.Fprint(w, `{"keys": [{"kty": "RSA", "kid": "key1", "n": "AQAB", "e": "AQAB"}, {"kty": "RSA", "kid": "key2", "n": "AQAB", "e": "AQAB"}]}`)
+	}))
+	defer jwks.Close()
+	known := &rsa.PublicKey{N: big.NewInt(1), E: 1}
+	a := &JWTAuthenticator{
+		JWKSURL:   jwks.URL,
+		keys:      map[string]crypto.PublicKey{"key1": known},
+		lastFetch: time.Now().Add(-2 * jwksRefreshInterval),
+	}
+
+	// The refresh of the stale keys is slow...
+	refreshed := make(chan error)
+	go func() {
+		_, err := a.key("key1")
+		refreshed <- err
+	}()
+	for {
+		mtx.Lock()
+		n := fetches
+		mtx.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// ...but doesn't block the known key...
+	if key, err := a.key("key1"); err != nil || key != known {
+		t.Errorf("Wanted known key during refresh, got %v, %v.", key, err)
+	}
+	// ...while a new key waits for the refresh in progress.
+	waited := make(chan error)
+	go func() {
+		_, err := a.key("key2")
+		waited <- err
+	}()
+	select {
+	case err := <-waited:
+		t.Fatalf("Lookup of new key returned before the refresh finished: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	if err := <-refreshed; err != nil {
+		t.Error(err)
+	}
+	if err := <-waited; err != nil {
+		t.Error(err)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if expected, got := 1, fetches; expected != got {
+		t.Errorf("Wanted %d fetches of the JWKS, got %d.", expected, got)
+	}
+}
+
+func TestVerifyJWTSignatureES(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := "header.payload"
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pad := func(b []byte, size int) []byte {
+		return append(make([]byte, size-len(b)), b...)
+	}
+	if err := verifyJWTSignature("ES256", &key.PublicKey, signed, append(pad(r.Bytes(), 32), pad(s.Bytes(), 32)...)); err != nil {
+		t.Errorf("Wanted valid signature, got %v.", err)
+	}
+	// The same r and s padded to a different size are rejected.
+	if err := verifyJWTSignature("ES256", &key.PublicKey, signed, append(pad(r.Bytes(), 33), pad(s.Bytes(), 33)...)); err == nil {
+		t.Error("Wanted error for signature of wrong length.")
+	}
+}
+
+func TestPushesRejected(t *testing.T) {
+	rejected := func(reason string) float64 {
+		var m dto.Metric
+		if err := pushesRejected.WithLabelValues(reason).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	before := map[string]float64{}
+	for _, reason := range []string{rejectParseError, rejectInconsistent, rejectTooLarge, rejectUnauthorized, rejectRateLimited} {
+		before[reason] = rejected(reason)
+	}
+
+	mms := MockMetricStore{memoryUsage: 2}
+	params := httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}}
+	for _, s := range []struct {
+		url  string
+		body string
+		o    *PushOptions
+	}{
+		{"http://example.org/", "bla bla\n", &PushOptions{}},
+		{"http://example.org/?dry_run=true", "bla bla\n", &PushOptions{}}, // Not counted.
+		{"http://example.org/", "a{job=\"other\"} 1\n", &PushOptions{LabelConflicts: LabelConflictsReject}},
+		{"http://example.org/", "a 1\n", &PushOptions{MaxMemoryBytes: 1}},
+		{"http://example.org/", "a 1\nb 2\n", &PushOptions{Quotas: &Quotas{Default: Quota{MaxSeries: 1}}}},
+	} {
+		req, err := http.NewRequest("POST", s.url, bytes.NewBufferString(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		Push(&mms, false, s.o)(httptest.NewRecorder(), req, params)
+	}
+
+	h := Chain(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		Authenticate(false, TokenAuthenticator{"bob": "t0ken"}),
+		RateLimit(1, 1, nil),
+	)
+	for _, token := range []string{"wrong", "t0ken", "t0ken"} {
+		req, err := http.NewRequest("PUT", "http://example.org/metrics/job/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", "Bearer "+token)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for reason, expected := range map[string]float64{
+		rejectParseError:   1,
+		rejectInconsistent: 1,
+		rejectTooLarge:     2,
+		rejectUnauthorized: 1,
+		rejectRateLimited:  1,
+	} {
+		if got := rejected(reason) - before[reason]; expected != got {
+			t.Errorf("Wanted %v rejected pushes for reason %q, got %v.", expected, reason, got)
+		}
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	var recorded bytes.Buffer
+	h := Chain(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+		}),
+		Record(&recorded),
+	)
+	for _, s := range []struct{ method, url, body string }{
+		{"PUT", "http://example.org/metrics/job/foo", "a 1\n"},
+		{"GET", "http://example.org/metrics", ""},
+		{"DELETE", "http://example.org/metrics/job/foo", ""},
+		{"POST", "http://example.org/metrics/job/bar?dry_run=true", "b 2\nc 3\n"},
+	} {
+		req, err := http.NewRequest(s.method, s.url, strings.NewReader(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if strings.Contains(recorded.String(), "secret") {
+		t.Error("Authorization header recorded.")
+	}
+
+	var replayed []string
+	statuses, err := Replay(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Leave the body of the POST unread.
+			if r.Method == "POST" {
+				w.WriteHeader(http.StatusBadRequest)
+				replayed = append(replayed, r.Method+" "+r.URL.RequestURI()+" "+r.RemoteAddr)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			replayed = append(replayed, r.Method+" "+r.URL.RequestURI()+" "+r.RemoteAddr+" "+strings.TrimSpace(string(body)))
+		}),
+		&recorded,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"PUT /metrics/job/foo 192.0.2.1:1234 a 1",
+		"DELETE /metrics/job/foo 192.0.2.1:1234 ",
+		"POST /metrics/job/bar?dry_run=true 192.0.2.1:1234",
+	}
+	if fmt.Sprint(expected) != fmt.Sprint(replayed) {
+		t.Errorf("Wanted replayed requests %q, got %q.", expected, replayed)
+	}
+	if expected, got := map[int]int{http.StatusOK: 2, http.StatusBadRequest: 1}, statuses; fmt.Sprint(expected) != fmt.Sprint(got) {
+		t.Errorf("Wanted status codes %v, got %v.", expected, got)
+	}
+
+	if _, err := Replay(http.NotFoundHandler(), strings.NewReader("garbage\n")); err == nil {
+		t.Error("Wanted error for garbage.")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for load, expected := range map[float64]time.Duration{
+		-1:  time.Second,
+		0:   time.Second,
+		0.5: 8 * time.Second,
+		1:   64 * time.Second,
+		2:   64 * time.Second,
+	} {
+		if got := retryAfter(load); expected != got.Round(time.Millisecond) {
+			t.Errorf("Wanted delay %v at load %v, got %v.", expected, load, got)
+		}
+	}
+
+	// Overloaded metric store.
+	for _, s := range []struct {
+		mms        MockMetricStore
+		status     int
+		retryAfter string
+	}{
+		{MockMetricStore{}, http.StatusAccepted, ""},
+		{MockMetricStore{writeQueueUtilization: 1}, http.StatusServiceUnavailable, "64"},
+		{MockMetricStore{memoryUsage: 1001, writeQueueUtilization: 0.5}, 507, "64"},
+	} {
+		req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString("a 1\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		Push(&s.mms, false, &PushOptions{MaxMemoryBytes: 1000})(w, req, httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}})
+		if got := w.Code; s.status != got {
+			t.Errorf("Wanted status code %v, got %v.", s.status, got)
+		}
+		if got := w.Header().Get("Retry-After"); s.retryAfter != got {
+			t.Errorf("Wanted Retry-After %q, got %q.", s.retryAfter, got)
+		}
+	}
+
+	// Rate limiting.
+	rl := &rateLimiter{rate: 0.1, burst: 1, buckets: map[string]*tokenBucket{}}
+	now := time.Now()
+	rl.allow("a", now)
+	for _, expected := range []time.Duration{10 * time.Second, 10 * time.Second, 10 * time.Second, 10 * time.Second, 16 * time.Second, 32 * time.Second, 64 * time.Second, 64 * time.Second} {
+		if rl.allow("a", now) {
+			t.Fatal("Request unexpectedly allowed.")
+		}
+		if got := rl.retryAfter("a", now); expected != got {
+			t.Errorf("Wanted delay %v, got %v.", expected, got)
+		}
+	}
+
+	// Status API.
+	w := httptest.NewRecorder()
+	mms := MockMetricStore{memoryUsage: 250, writeQueueUtilization: 0.125}
+	listenAddresses := func() []string { return []string{"0.0.0.0:9091", "[::]:9091"} }
+	LoadStatus(&mms, &PushOptions{MaxMemoryBytes: 1000}, listenAddresses, nil, nil)(w, nil, nil)
+	var status struct {
+		Load
+		ListenAddresses []string `json:"listenAddresses"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (Load{Load: 0.25, WriteQueueUtilization: 0.125, MemoryUtilization: 0.25, RetryAfterSeconds: 3}); expected != status.Load {
+		t.Errorf("Wanted load %+v, got %+v.", expected, status.Load)
+	}
+	if expected, got := listenAddresses(), status.ListenAddresses; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted listen addresses %v, got %v.", expected, got)
+	}
+}
+
+func TestPushLabelValues(t *testing.T) {
+	body := "a{foo=\"line1\\nline2\"} 1\nb{bar=\"äöü\"} 2\n"
+	params := httprouter.Params{
+		httprouter.Param{Key: "job", Value: "testjob"},
+		httprouter.Param{Key: "labels", Value: "/instance/in\tstance"},
+	}
+	for _, s := range []struct {
+		mode     LabelValueMode
+		maxBytes int
+		status   int
+		labels   map[string]string // Label values of the pushed metrics.
+	}{
+		{LabelValuesKeep, 4, http.StatusAccepted, map[string]string{"foo": "line1\nline2", "bar": "äöü", "instance": "in\tstance"}},
+		{LabelValuesSanitize, 0, http.StatusAccepted, map[string]string{"foo": "line1 line2", "bar": "äöü", "instance": "in stance"}},
+		{LabelValuesSanitize, 5, http.StatusAccepted, map[string]string{"foo": "line1", "bar": "äö", "instance": "in st"}},
+		{LabelValuesReject, 0, http.StatusBadRequest, nil},
+	} {
+		mms := MockMetricStore{}
+		req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		Push(&mms, false, &PushOptions{LabelValues: s.mode, MaxLabelValueBytes: s.maxBytes})(w, req, params)
+		if got := w.Code; s.status != got {
+			t.Errorf("%d: Wanted status code %v, got %v.", s.mode, s.status, got)
+		}
+		if s.labels == nil {
+			continue
+		}
+		got := map[string]string{}
+		for _, mf := range mms.lastWriteRequest.MetricFamilies {
+			for _, lp := range mf.GetMetric()[0].GetLabel() {
+				if lp.GetName() != "job" {
+					got[lp.GetName()] = lp.GetValue()
+				}
+			}
+		}
+		if fmt.Sprint(s.labels) != fmt.Sprint(got) {
+			t.Errorf("%d: Wanted label values %q, got %q.", s.mode, s.labels, got)
+		}
+		if expected, got := s.labels["instance"], mms.lastWriteRequest.Labels["instance"]; expected != got {
+			t.Errorf("%d: Wanted grouping label value %q, got %q.", s.mode, expected, got)
+		}
+	}
+}
+
+func TestPushValidationWebhook(t *testing.T) {
+	var received webhookRequest
+	response := `{"allowed": true}`
+	status := http.StatusOK
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, response)
+	}))
+	defer webhook.Close()
+
+	params := httprouter.Params{
+		httprouter.Param{Key: "job", Value: "testjob"},
+		httprouter.Param{Key: "labels", Value: "/instance/testinstance"},
+	}
+	for _, s := range []struct {
+		response string
+		status   int
+		failOpen bool
+		expected int
+	}{
+		{`{"allowed": true}`, http.StatusOK, false, http.StatusAccepted},
+		{`{"allowed": false, "message": "no foo allowed"}`, http.StatusOK, false, 422},
+		{`{"allowed": true}`, http.StatusInternalServerError, false, http.StatusServiceUnavailable},
+		{`{"allowed": true}`, http.StatusInternalServerError, true, http.StatusAccepted},
+		{`garbage`, http.StatusOK, false, http.StatusServiceUnavailable},
+	} {
+		response, status = s.response, s.status
+		received = webhookRequest{}
+		mms := MockMetricStore{}
+		req, err := http.NewRequest("PUT", "http://example.org/", bytes.NewBufferString("foo{bar=\"baz\"} 1\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		o := &PushOptions{Validator: &WebhookValidator{URL: webhook.URL, FailOpen: s.failOpen}}
+		Push(&mms, true, o)(w, req, params)
+		if expected, got := s.expected, w.Code; expected != got {
+			t.Errorf("%s, %d: Wanted status code %v, got %v.", s.response, s.status, expected, got)
+		}
+		if s.expected == 422 && !strings.Contains(w.Body.String(), "no foo allowed") {
+			t.Errorf("Wanted message of the webhook in response, got %q.", w.Body.String())
+		}
+		if accepted := mms.lastWriteRequest.Labels != nil; accepted != (s.expected == http.StatusAccepted) {
+			t.Errorf("%s, %d: Wanted push accepted %t, got %t.", s.response, s.status, !accepted, accepted)
+		}
+		if received.Method != "PUT" || received.GroupingKey["instance"] != "testinstance" {
+			t.Errorf("Unexpected webhook request %+v.", received)
+		}
+		if len(received.MetricFamilies) != 1 || received.MetricFamilies[0].Name != "foo" ||
+			received.MetricFamilies[0].Metrics[0].Labels["bar"] != "baz" ||
+			received.MetricFamilies[0].Metrics[0].Value != "1" {
+			t.Errorf("Unexpected metric families in webhook request %+v.", received.MetricFamilies)
+		}
+	}
+}
+
+func TestScrapeTracker(t *testing.T) {
+	st := NewScrapeTracker(nil)
+	if s := st.Status(); s.Total != 0 || s.LastScrape != nil || s.LastScraper != "" {
+		t.Errorf("Wanted no scrapes, got %+v.", s)
+	}
+
+	metrics := st.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "some_metric 1\n")
+	}))
+	before := time.Now()
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest("GET", "http://example.org/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "192.0.2.1:12345"
+		w := httptest.NewRecorder()
+		metrics.ServeHTTP(w, req)
+		if expected, got := "some_metric 1\n", w.Body.String(); expected != got {
+			t.Errorf("Wanted body %q, got %q.", expected, got)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	LoadStatus(&MockMetricStore{}, &PushOptions{}, nil, st, nil)(w, nil, nil)
+	var status struct {
+		Scrapes ScrapeStatus `json:"scrapes"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 3, status.Scrapes.Total; expected != got {
+		t.Errorf("Wanted %d scrapes, got %d.", expected, got)
+	}
+	if expected, got := "192.0.2.1", status.Scrapes.LastScraper; expected != got {
+		t.Errorf("Wanted last scraper %q, got %q.", expected, got)
+	}
+	if ls := status.Scrapes.LastScrape; ls == nil || ls.Before(before) {
+		t.Errorf("Wanted last scrape after %v, got %v.", before, ls)
+	}
+}
+
+func TestDurationHistograms(t *testing.T) {
+	count := func(h *prometheus.HistogramVec, format string) uint64 {
+		var m dto.Metric
+		if err := h.WithLabelValues(format).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+
+	before := count(pushParseDuration, "text")
+	req, err := http.NewRequest("PUT", "http://example.org/", bytes.NewBufferString("a 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := parseMetricFamilies(req, false); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := before+1, count(pushParseDuration, "text"); expected != got {
+		t.Errorf("Wanted %d observed text parses, got %d.", expected, got)
+	}
+
+	before = count(scrapeEncodeDuration, "protobuf")
+	req, err = http.NewRequest("GET", "http://example.org/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited")
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	Metrics().ServeHTTP(w, req)
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Fatalf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := "gzip", w.HeaderMap.Get("Content-Encoding"); expected != got {
+		t.Errorf("Wanted Content-Encoding %q, got %q.", expected, got)
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mf dto.MetricFamily
+	if _, err := pbutil.ReadDelimited(gz, &mf); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := before+1, count(scrapeEncodeDuration, "protobuf"); expected != got {
+		t.Errorf("Wanted %d observed protobuf encodings, got %d.", expected, got)
+	}
+}
+
+func TestFormatName(t *testing.T) {
+	for contentType, expected := range map[string]string{
+		"text/plain; version=0.0.4": "text",
+		"application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited":    "protobuf",
+		"application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=text":         "protobuf_text",
+		"application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=compact-text": "protobuf_compact",
+		"application/openmetrics-text; version=1.0.0":                                                     "unknown",
+		"": "unknown",
+	} {
+		if got := formatName(contentType); expected != got {
+			t.Errorf("%q: Wanted format %q, got %q.", contentType, expected, got)
+		}
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	f := NewFreeze(nil)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	h := f.Middleware()(next)
+	request := func(method, path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://example.org"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if expected, got := http.StatusAccepted, request("PUT", "/metrics/job/a").Code; expected != got {
+		t.Errorf("Wanted status code %v before freeze, got %v.", expected, got)
+	}
+
+	req, err := http.NewRequest("POST", "http://example.org/api/v1/admin/freeze", bytes.NewBufferString(`{"reason":"maintenance"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	f.Handler(true)(w, req, nil)
+	var status FreezeStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Frozen || status.Reason != "maintenance" || status.Since == nil {
+		t.Errorf("Unexpected status after freeze: %+v", status)
+	}
+
+	for _, s := range []struct {
+		method, path string
+		expected     int
+	}{
+		{"PUT", "/metrics/job/a", http.StatusServiceUnavailable},
+		{"DELETE", "/metrics/job/a", http.StatusServiceUnavailable},
+		{"GET", "/metrics", http.StatusAccepted},
+		{"POST", "/api/v1/admin/unfreeze", http.StatusAccepted},
+	} {
+		w := request(s.method, s.path)
+		if got := w.Code; s.expected != got {
+			t.Errorf("%s %s: Wanted status code %v, got %v.", s.method, s.path, s.expected, got)
+		}
+		if s.expected == http.StatusServiceUnavailable && !strings.Contains(w.Body.String(), "maintenance") {
+			t.Errorf("%s %s: Wanted reason in body, got %q.", s.method, s.path, w.Body.String())
+		}
+	}
+
+	req, err = http.NewRequest("POST", "http://example.org/api/v1/admin/unfreeze", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Handler(false)(httptest.NewRecorder(), req, nil)
+	if status := f.Status(); status.Frozen || status.Reason != "" || status.Since != nil {
+		t.Errorf("Unexpected status after unfreeze: %+v", status)
+	}
+	if expected, got := http.StatusAccepted, request("PUT", "/metrics/job/a").Code; expected != got {
+		t.Errorf("Wanted status code %v after unfreeze, got %v.", expected, got)
+	}
+}
+
+type fakeLoader chan struct{}
+
+func (l fakeLoader) Loaded() <-chan struct{} { return l }
+
+func TestWhileLoading(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	do := func(h http.Handler, method string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://example.org/metrics/job/testjob", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	loader := make(fakeLoader)
+	reject := WhileLoading(loader, LoadingReject)(next)
+	if expected, got := http.StatusOK, do(reject, "GET").Code; expected != got {
+		t.Errorf("Wanted status code %v for GET, got %v.", expected, got)
+	}
+	w := do(reject, "PUT")
+	if expected, got := http.StatusServiceUnavailable, w.Code; expected != got {
+		t.Errorf("Wanted status code %v for PUT, got %v.", expected, got)
+	}
+	if expected, got := "5", w.Header().Get("Retry-After"); expected != got {
+		t.Errorf("Wanted Retry-After %q, got %q.", expected, got)
+	}
+
+	queued := make(chan int)
+	go func() { queued <- do(WhileLoading(loader, LoadingQueue)(next), "DELETE").Code }()
+	select {
+	case code := <-queued:
+		t.Fatalf("DELETE not held back while loading, got status code %v.", code)
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(loader)
+	if expected, got := http.StatusOK, <-queued; expected != got {
+		t.Errorf("Wanted status code %v for queued DELETE, got %v.", expected, got)
+	}
+	if expected, got := http.StatusOK, do(reject, "PUT").Code; expected != got {
+		t.Errorf("Wanted status code %v for PUT after loading, got %v.", expected, got)
+	}
+}
+
+func TestLeadership(t *testing.T) {
+	l := NewLeadership()
+	h := l.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://example.org"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	l.Set(false, "other:9091")
+	for _, s := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/metrics", http.StatusOK},
+		{"PUT", "/metrics/job/testjob", http.StatusServiceUnavailable},
+		{"DELETE", "/metrics/job/testjob", http.StatusServiceUnavailable},
+		{"POST", "/api/v1/admin/freeze", http.StatusOK},
+	} {
+		w := do(s.method, s.path)
+		if w.Code != s.status {
+			t.Errorf("%s %s: Wanted status code %v while standing by, got %v.", s.method, s.path, s.status, w.Code)
+		}
+		if w.Code != http.StatusOK && !strings.Contains(w.Body.String(), "other:9091") {
+			t.Errorf("%s %s: Leader not reported in %q.", s.method, s.path, w.Body.String())
+		}
+	}
+
+	l.Set(true, "self:9091")
+	if expected, got := http.StatusOK, do("PUT", "/metrics/job/testjob").Code; expected != got {
+		t.Errorf("Wanted status code %v as leader, got %v.", expected, got)
+	}
+	if s := l.Status(); !s.Leader || s.Holder != "self:9091" || s.Since == nil {
+		t.Errorf("Unexpected status as leader: %+v", s)
+	}
+}
+
+func TestPushSampleValues(t *testing.T) {
+	body := "a 1\nb NaN\nc{x=\"1\"} +Inf\nc{x=\"2\"} 2\n# TYPE d summary\nd{quantile=\"0.5\"} NaN\nd_sum 0\nd_count 0\n"
+	params := httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}}
+	for _, s := range []struct {
+		mode     SampleValueMode
+		status   int
+		families []string // Names of the pushed metric families.
+		series   int      // Number of pushed series.
+	}{
+		{SampleValuesKeep, http.StatusAccepted, []string{"a", "b", "c", "d"}, 5},
+		{SampleValuesDrop, http.StatusAccepted, []string{"a", "c", "d"}, 3},
+		{SampleValuesReject, http.StatusBadRequest, nil, 0},
+	} {
+		mms := MockMetricStore{}
+		req, err := http.NewRequest("PUT", "http://example.org/", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		Push(&mms, true, &PushOptions{SampleValues: s.mode})(w, req, params)
+		if got := w.Code; s.status != got {
+			t.Errorf("%d: Wanted status code %v, got %v.", s.mode, s.status, got)
+		}
+		var families []string
+		series := 0
+		for name, mf := range mms.lastWriteRequest.MetricFamilies {
+			families = append(families, name)
+			series += len(mf.GetMetric())
+		}
+		sort.Strings(families)
+		if !reflect.DeepEqual(s.families, families) || s.series != series {
+			t.Errorf("%d: Wanted families %v with %d series, got %v with %d series.", s.mode, s.families, s.series, families, series)
+		}
+	}
+}
+
+func TestDiffSchema(t *testing.T) {
+	parse := func(body string) map[string]*dto.MetricFamily {
+		mfs, _, err := parseTextLeniently(strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mfs
+	}
+	group := storage.MetricGroup{Metrics: storage.NameToTimestampedMetricFamilyMap{}}
+	for name, mf := range parse("a{x=\"1\"} 1\n# TYPE b counter\nb 1\nc{y=\"1\"} 1\nd 1\n") {
+		group.Metrics[name] = storage.TimestampedMetricFamily{MetricFamily: mf}
+	}
+	pushed := parse("a{x=\"2\"} 1\n# TYPE b gauge\nb 1\nc{z=\"1\"} 1\ne 1\n")
+
+	for _, s := range []struct {
+		replace bool
+		changes []string
+	}{
+		{false, []string{
+			"b changed type from counter to gauge",
+			"c added labels z and removed labels y",
+			"e added",
+		}},
+		{true, []string{
+			"b changed type from counter to gauge",
+			"c added labels z and removed labels y",
+			"d removed",
+			"e added",
+		}},
+	} {
+		var changes []string
+		for _, c := range diffSchema(group, pushed, s.replace) {
+			changes = append(changes, c.String())
+		}
+		if !reflect.DeepEqual(s.changes, changes) {
+			t.Errorf("replace=%t: Wanted changes %q, got %q.", s.replace, s.changes, changes)
+		}
+	}
+}
+
+func TestPushBuckets(t *testing.T) {
+	params := httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}}
+	for i, s := range []struct {
+		body   string
+		status int
+	}{
+		{ // Valid histogram.
+			"# TYPE h histogram\nh_bucket{le=\"1\"} 1\nh_bucket{le=\"2\"} 3\nh_bucket{le=\"+Inf\"} 4\nh_sum 5\nh_count 4\n",
+			http.StatusAccepted,
+		},
+		{ // Valid histogram without +Inf bucket and count.
+			"# TYPE h histogram\nh_bucket{le=\"1\"} 1\nh_bucket{le=\"2\"} 3\n",
+			http.StatusAccepted,
+		},
+		{ // Decreasing count.
+			"# TYPE h histogram\nh_bucket{le=\"1\"} 3\nh_bucket{le=\"2\"} 1\nh_bucket{le=\"+Inf\"} 4\nh_count 4\n",
+			http.StatusBadRequest,
+		},
+		{ // Count differing from +Inf bucket.
+			"# TYPE h histogram\nh_bucket{le=\"1\"} 1\nh_bucket{le=\"+Inf\"} 4\nh_count 5\n",
+			http.StatusBadRequest,
+		},
+		{ // Count lower than last bucket.
+			"# TYPE h histogram\nh_bucket{le=\"1\"} 3\nh_count 2\n",
+			http.StatusBadRequest,
+		},
+		{ // Same histogram twice with different buckets.
+			"# TYPE h histogram\nh_bucket{le=\"1\"} 1\nh_bucket{le=\"+Inf\"} 1\nh_count 1\nh_bucket{le=\"0.5\"} 0\nh_bucket{le=\"+Inf\"} 1\nh_count 1\n",
+			http.StatusBadRequest,
+		},
+		{ // Valid summary.
+			"# TYPE s summary\ns{quantile=\"0.5\"} 1\ns{quantile=\"0.9\"} 2\ns_sum 3\ns_count 2\n",
+			http.StatusAccepted,
+		},
+		{ // Duplicate quantile.
+			"# TYPE s summary\ns{quantile=\"0.5\"} 1\ns{quantile=\"0.5\"} 2\ns_sum 3\ns_count 2\n",
+			http.StatusBadRequest,
+		},
+	} {
+		for _, method := range []string{"PUT", "POST"} {
+			mms := MockMetricStore{}
+			req, err := http.NewRequest(method, "http://example.org/", bytes.NewBufferString(s.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			Push(&mms, method == "PUT", &PushOptions{})(w, req, params)
+			if got := w.Code; s.status != got {
+				t.Errorf("%d, %s: Wanted status code %v, got %v: %s", i, method, s.status, got, w.Body)
+			}
+			if wrote := mms.lastWriteRequest.MetricFamilies != nil; wrote != (s.status == http.StatusAccepted) {
+				t.Errorf("%d, %s: Unexpected write request %v.", i, method, mms.lastWriteRequest)
+			}
+		}
+	}
+}
+
+func TestPushMaxTimestampAge(t *testing.T) {
+	params := httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}}
+	nowMs := time.Now().UnixNano() / int64(time.Millisecond)
+	for i, s := range []struct {
+		body   string
+		maxAge time.Duration
+		status int
+	}{
+		{"a 1\n", time.Minute, http.StatusAccepted},
+		{fmt.Sprintf("a 1 %d\n", nowMs-30000), time.Minute, http.StatusAccepted},
+		{fmt.Sprintf("a 1 %d\nb 1 %d\n", nowMs, nowMs-120000), time.Minute, http.StatusBadRequest},
+		{fmt.Sprintf("a 1 %d\n", nowMs-120000), 0, http.StatusAccepted},
+	} {
+		mms := MockMetricStore{}
+		req, err := http.NewRequest("PUT", "http://example.org/", bytes.NewBufferString(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		Push(&mms, true, &PushOptions{MaxTimestampAge: s.maxAge})(w, req, params)
+		if got := w.Code; s.status != got {
+			t.Errorf("%d: Wanted status code %v, got %v: %s", i, s.status, got, w.Body)
+		}
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "handler.TestTransforms.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	load := func(content string) ([]Transform, error) {
+		filename := path.Join(tempDir, "transforms.json")
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return LoadTransforms(filename)
+	}
+
+	for _, content := range []string{
+		`[{"metric": "(", "factor": 2}]`,
+		`[{"metric": "a", "job": "[", "factor": 2}]`,
+		`[{"metric": "a"}]`,
+		`[{"metric": "a", "factor": -1}]`,
+		`[{"metric": "a", "min": 2, "max": 1}]`,
+	} {
+		if _, err := load(content); err == nil {
+			t.Errorf("Expected error loading %s.", content)
+		}
+	}
+
+	transforms, err := load(`[
+		{"metric": ".*_milliseconds", "job": "legacy-*", "factor": 0.001},
+		{"metric": "percent", "min": 0, "max": 100}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("PUT", "http://example.org/", bytes.NewBufferString(`duration_milliseconds 1500
+# TYPE latency_milliseconds histogram
+latency_milliseconds_bucket{le="100"} 1
+latency_milliseconds_bucket{le="+Inf"} 2
+latency_milliseconds_sum 350
+latency_milliseconds_count 2
+percent 120
+x_milliseconds_total 2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfs, _, err := parseMetricFamilies(req, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := []string(nil), transformValues("batch", mfs, transforms[:1]); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted transformed metric families %v for other job, got %v.", expected, got)
+	}
+	expected := []string{"duration_milliseconds", "latency_milliseconds", "percent"}
+	if got := transformValues("legacy-backup", mfs, transforms); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted transformed metric families %v, got %v.", expected, got)
+	}
+	for _, check := range []struct {
+		name     string
+		expected float64
+		got      float64
+	}{
+		{"duration_milliseconds", 1.5, mfs["duration_milliseconds"].Metric[0].GetUntyped().GetValue()},
+		{"latency_milliseconds le", 0.1, mfs["latency_milliseconds"].Metric[0].GetHistogram().Bucket[0].GetUpperBound()},
+		{"latency_milliseconds sum", 0.35, mfs["latency_milliseconds"].Metric[0].GetHistogram().GetSampleSum()},
+		{"percent", 100, mfs["percent"].Metric[0].GetUntyped().GetValue()},
+		{"x_milliseconds_total", 2, mfs["x_milliseconds_total"].Metric[0].GetUntyped().GetValue()},
+	} {
+		if math.Abs(check.expected-check.got) > 1e-9 {
+			t.Errorf("%s: wanted %g, got %g.", check.name, check.expected, check.got)
+		}
+	}
+}
+
+func TestPushContentTypes(t *testing.T) {
+	params := httprouter.Params{httprouter.Param{Key: "job", Value: "testjob"}}
+	for i, s := range []struct {
+		contentType string
+		body        string
+		mode        ContentTypeMode
+		status      int
+	}{
+		{"application/octet-stream", "a 1\n", ContentTypeLenient, http.StatusAccepted},
+		{"application/octet-stream", "a 1\n", ContentTypeStrict, http.StatusUnsupportedMediaType},
+		{"application/json", "a 1\n", ContentTypeStrict, http.StatusUnsupportedMediaType},
+		{"", "a 1\n", ContentTypeStrict, http.StatusAccepted},
+		{"text/plain; version=0.0.4", "a 1\n", ContentTypeStrict, http.StatusAccepted},
+		{"text/plain; version=1.0.0", "a 1\n", ContentTypeStrict, http.StatusUnsupportedMediaType},
+		{"text/plain; charset=utf-16", "a 1\n", ContentTypeStrict, http.StatusUnsupportedMediaType},
+		{"text/plain; charset=ISO-8859-1", "a{x=\"\xe4\xf6\"} 1\n", ContentTypeStrict, http.StatusAccepted},
+		{"application/vnd.google.protobuf; encoding=text", "a 1\n", ContentTypeStrict, http.StatusUnsupportedMediaType},
+	} {
+		mms := MockMetricStore{}
+		req, err := http.NewRequest("PUT", "http://example.org/", bytes.NewBufferString(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.contentType != "" {
+			req.Header.Set("Content-Type", s.contentType)
+		}
+		w := httptest.NewRecorder()
+		Push(&mms, true, &PushOptions{ContentTypes: s.mode})(w, req, params)
+		if got := w.Code; s.status != got {
+			t.Errorf("%d: Wanted status code %v, got %v: %s", i, s.status, got, w.Body)
+		}
+	}
+
+	// ISO-8859-1 is converted to UTF-8.
+	mms := MockMetricStore{}
+	req, err := http.NewRequest("PUT", "http://example.org/", bytes.NewBufferString("a{x=\"\xe4\xf6\"} 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=latin1")
+	Push(&mms, true, &PushOptions{ContentTypes: ContentTypeStrict})(httptest.NewRecorder(), req, params)
+	for _, lp := range mms.lastWriteRequest.MetricFamilies["a"].GetMetric()[0].GetLabel() {
+		if expected, got := "äö", lp.GetValue(); lp.GetName() == "x" && expected != got {
+			t.Errorf("Wanted label value %q, got %q.", expected, got)
+		}
+	}
+}
+
+func TestPushRequireInstance(t *testing.T) {
+	for i, s := range []struct {
+		labels string
+		o      PushOptions
+		status int
+	}{
+		{"/instance/inst", PushOptions{RequireInstance: true}, http.StatusAccepted},
+		{"", PushOptions{RequireInstance: true}, http.StatusBadRequest},
+		{"/instance/", PushOptions{RequireInstance: true}, http.StatusBadRequest},
+		{"", PushOptions{RequireInstance: true, AutoFillLabel: "instance", AutoFillMode: AutoFillStatic, AutoFillStaticValue: "x"}, http.StatusAccepted},
+		{"", PushOptions{}, http.StatusAccepted},
+	} {
+		mms := MockMetricStore{}
+		req, err := http.NewRequest("PUT", "http://example.org/", bytes.NewBufferString("a 1\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		params := httprouter.Params{
+			httprouter.Param{Key: "job", Value: "testjob"},
+			httprouter.Param{Key: "labels", Value: s.labels},
+		}
+		Push(&mms, true, &s.o)(w, req, params)
+		if got := w.Code; s.status != got {
+			t.Errorf("%d: Wanted status code %v, got %v: %s", i, s.status, got, w.Body)
+		}
+	}
+}
+
+func TestEcho(t *testing.T) {
+	mms := MockMetricStore{metricGroups: storage.GroupingKeyToMetricGroup{}}
+	labels := map[string]string{"job": "otherjob"}
+	mms.metricGroups[model.LabelsToSignature(labels)] = storage.MetricGroup{
+		Labels: labels,
+		Metrics: storage.NameToTimestampedMetricFamilyMap{
+			"b": storage.TimestampedMetricFamily{
+				MetricFamily: &dto.MetricFamily{
+					Name:   proto.String("b"),
+					Type:   dto.MetricType_GAUGE.Enum(),
+					Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+				},
+			},
+		},
+	}
+	body := "b{z=\"1\",a=\"x\"} 2\nb{a=\"w\"} 1\na{x=\"line1\\nline2\"} NaN\n"
+	echo := Echo(&mms, &PushOptions{LabelValues: LabelValuesSanitize, SampleValues: SampleValuesDrop})
+
+	for _, s := range []struct {
+		params   httprouter.Params
+		expected string
+	}{
+		{
+			nil,
+			`# WARNING: label values would be sanitized: metric family "a": value of label "x" contains control characters: "line1\nline2"
+# WARNING: samples would be dropped: metric family "a": sample with labels map[x:line1 line2] has value NaN
+# TYPE b untyped
+b{a="w"} 1
+b{a="x",z="1"} 2
+`,
+		},
+		{
+			httprouter.Params{{Key: "job", Value: "testjob"}},
+			`# WARNING: label values would be sanitized: metric family "a": value of label "x" contains control characters: "line1\nline2"
+# WARNING: samples would be dropped: metric family "a": sample with labels map[x:line1 line2] has value NaN
+# WARNING: push would be rejected: metric family "b" has type UNTYPED, but type GAUGE in group map[job:otherjob]
+# TYPE b untyped
+b{a="w",job="testjob"} 1
+b{a="x",job="testjob",z="1"} 2
+`,
+		},
+	} {
+		req, err := http.NewRequest("POST", "http://example.org/api/v1/echo", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		echo(w, req, s.params)
+		if expected, got := http.StatusOK, w.Code; expected != got {
+			t.Errorf("Wanted status code %v, got %v.", expected, got)
+		}
+		if got := w.Body.String(); s.expected != got {
+			t.Errorf("Wanted body %q, got %q.", s.expected, got)
+		}
+	}
+
+	// Unparseable.
+	req, err := http.NewRequest("POST", "http://example.org/api/v1/echo", bytes.NewBufferString("a{ 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	echo(w, req, nil)
+	if expected, got := http.StatusBadRequest, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	mms := MockMetricStore{metricGroups: storage.GroupingKeyToMetricGroup{}}
+	for i := 0; i < 2500; i++ {
+		labels := map[string]string{"job": "batch", "instance": fmt.Sprint(i)}
+		if i%2 == 1 {
+			labels["job"] = "other"
+		}
+		mms.metricGroups[model.LabelsToSignature(labels)] = storage.MetricGroup{Labels: labels}
+	}
+
+	type line struct {
+		Group *struct {
+			Labels map[string]string `json:"labels"`
+			Path   string            `json:"path"`
+		} `json:"group"`
+		Progress *selectorProgress `json:"progress"`
+		Done     *selectorProgress `json:"done"`
+	}
+	run := func(method, query string, r *http.Request) (*httptest.ResponseRecorder, []line) {
+		if r == nil {
+			var err error
+			r, err = http.NewRequest(method, "http://example.org/api/v1/groups?"+query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		w := httptest.NewRecorder()
+		Groups(&mms, &PushOptions{}, method == "DELETE")(w, r, nil)
+		var lines []line
+		dec := json.NewDecoder(w.Body)
+		for w.Code == http.StatusOK && dec.More() {
+			var l line
+			if err := dec.Decode(&l); err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, l)
+		}
+		return w, lines
+	}
+
+	w, lines := run("GET", "match=job%3Dbatch&match=instance%3D~1.*", nil)
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	var groups, progress int
+	for _, l := range lines[:len(lines)-1] {
+		switch {
+		case l.Group != nil:
+			groups++
+			if l.Group.Labels["job"] != "batch" || !strings.HasPrefix(l.Group.Labels["instance"], "1") {
+				t.Errorf("Unexpected group %v.", l.Group.Labels)
+			}
+			if expected, got := "/metrics/job/batch/instance/"+l.Group.Labels["instance"], l.Group.Path; expected != got {
+				t.Errorf("Wanted path %q, got %q.", expected, got)
+			}
+		case l.Progress != nil:
+			progress++
+			if expected, got := progress*selectorProgressInterval, l.Progress.Processed; expected != got {
+				t.Errorf("Wanted %d groups processed, got %d.", expected, got)
+			}
+		}
+	}
+	// Even instances 10-18, 100-198, 1000-1998.
+	if expected, got := 555, groups; expected != got {
+		t.Errorf("Wanted %d groups, got %d.", expected, got)
+	}
+	if expected, got := 2, progress; expected != got {
+		t.Errorf("Wanted %d progress lines, got %d.", expected, got)
+	}
+	if expected, got := (&selectorProgress{Processed: 2500, Matched: 555, Total: 2500}), lines[len(lines)-1].Done; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted done line %v, got %v.", expected, got)
+	}
+
+	// Invalid matchers and unrestricted deletes.
+	for _, q := range []string{"match=job", "match=1job%3Dx", "match=job%3D~(", "match=job%3C%3Dx", ""} {
+		if w, _ := run("DELETE", q, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Query %q: wanted status code %v, got %v.", q, http.StatusBadRequest, w.Code)
+		}
+	}
+	if mms.lastWriteRequest.Labels != nil {
+		t.Errorf("Unexpected write request %v.", mms.lastWriteRequest)
+	}
+
+	// Deletes are restricted to the grouping labels of the client.
+	req, err := http.NewRequest("DELETE", "http://example.org/api/v1/groups?match=job!%3Dbatch", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = WithGroupingLabels(req, map[string]string{"instance": "7"})
+	_, lines = run("DELETE", "", req)
+	if expected, got := (&selectorProgress{Processed: 2500, Matched: 1, Total: 2500}), lines[len(lines)-1].Done; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted done line %v, got %v.", expected, got)
+	}
+	if expected, got := map[string]string{"job": "other", "instance": "7"}, mms.lastWriteRequest.Labels; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted write request for %v, got %v.", expected, got)
+	}
+	if mms.lastWriteRequest.MetricFamilies != nil || mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Wanted timestamped delete request, got %v.", mms.lastWriteRequest)
+	}
+
+	// A disconnected client aborts the operation.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	req, err = http.NewRequest("DELETE", "http://example.org/api/v1/groups?match=job%3Dbatch", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	cancel()
+	_, lines = run("DELETE", "", req.WithContext(ctx))
+	if len(lines) != 0 || mms.lastWriteRequest.Labels != nil {
+		t.Errorf("Wanted aborted delete, got %d lines and write request %v.", len(lines), mms.lastWriteRequest)
+	}
+}
+
+func TestPushJSONResponse(t *testing.T) {
+	existing := map[string]string{"job": "testjob", "instance": "old"}
+	mms := MockMetricStore{metricGroups: storage.GroupingKeyToMetricGroup{
+		groupingkey.Hash(existing): storage.MetricGroup{
+			Labels: existing,
+			Metrics: storage.NameToTimestampedMetricFamilyMap{
+				"a": {MetricFamily: &dto.MetricFamily{Name: proto.String("a"), Metric: []*dto.Metric{{}}}},
+				"c": {MetricFamily: &dto.MetricFamily{Name: proto.String("c"), Metric: []*dto.Metric{{}, {}}}},
+			},
+		},
+	}}
+	for i, s := range []struct {
+		method, instance, accept string
+		created                  bool
+		json                     bool
+		families, series         int
+	}{
+		{"PUT", "new", "application/json", true, true, 2, 3},
+		{"PUT", "old", "text/plain, application/json; q=0.9", false, true, 2, 3},
+		{"POST", "old", "application/json", false, true, 3, 5}, // Merged with c.
+		{"PUT", "new", "", false, false, 0, 0},
+		{"PUT", "new", "*/*", false, false, 0, 0},
+	} {
+		req, err := http.NewRequest(s.method, "http://example.org/metrics/job/testjob/instance/"+s.instance, bytes.NewBufferString("a 1\nb{x=\"1\"} 1\nb{x=\"2\"} 2\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", s.accept)
+		w := httptest.NewRecorder()
+		params := httprouter.Params{
+			httprouter.Param{Key: "job", Value: "testjob"},
+			httprouter.Param{Key: "labels", Value: "/instance/" + s.instance},
+		}
+		Push(&mms, s.method == "PUT", &PushOptions{})(w, req, params)
+		if expected, got := http.StatusAccepted, w.Code; expected != got {
+			t.Errorf("%d: Wanted status code %v, got %v.", i, expected, got)
+		}
+		if !s.json {
+			if w.Body.Len() != 0 {
+				t.Errorf("%d: Wanted empty body, got %q.", i, w.Body)
+			}
+			continue
+		}
+		if expected, got := "application/json", w.Header().Get("Content-Type"); expected != got {
+			t.Errorf("%d: Wanted Content-Type %q, got %q.", i, expected, got)
+		}
+		var got pushResult
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		labels := map[string]string{"job": "testjob", "instance": s.instance}
+		expected := pushResult{
+			URL:            "http://example.org/metrics/job/testjob/instance/" + s.instance,
+			GroupingKey:    labels,
+			Hash:           groupingkey.Format(groupingkey.Hash(labels)),
+			Created:        s.created,
+			MetricFamilies: s.families,
+			Series:         s.series,
+		}
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("%d: Wanted %+v, got %+v.", i, expected, got)
+		}
+	}
+}
+
+// jobAuthenticator authenticates every request as alice, who may only change
+// the given jobs.
+type jobAuthenticator map[string]bool
+
+func (a jobAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	return "alice", true
+}
+
+func (a jobAuthenticator) AuthorizeJob(r *http.Request, job string) bool {
+	return a[job]
+}
+
+func TestJobAuthorizationBypasses(t *testing.T) {
+	auth := Authenticate(false, jobAuthenticator{"a": true})
+
+	// Deleting by label matchers only deletes groups of authorized jobs.
+	mms := MockMetricStore{metricGroups: storage.GroupingKeyToMetricGroup{}}
+	for _, job := range []string{"a", "b"} {
+		labels := map[string]string{"job": job}
+		mms.metricGroups[groupingkey.Hash(labels)] = storage.MetricGroup{Labels: labels}
+	}
+	groups := auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Groups(&mms, &PushOptions{}, true)(w, r, nil)
+	}))
+	for _, match := range []string{"job%3Db", "job%3D~.%2A"} {
+		mms.lastWriteRequest = storage.WriteRequest{}
+		req, err := http.NewRequest("DELETE", "http://example.org/api/v1/groups?match="+match, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		groups.ServeHTTP(w, req)
+		if job := mms.lastWriteRequest.Labels["job"]; job == "b" {
+			t.Errorf("Match %q: group of unauthorized job deleted.", match)
+		}
+		if strings.Contains(w.Body.String(), `"job":"b"`) {
+			t.Errorf("Match %q: group of unauthorized job listed: %s", match, w.Body)
+		}
+	}
+	if expected, got := "a", mms.lastWriteRequest.Labels["job"]; expected != got {
+		t.Errorf("Wanted group of job %q deleted, got %q.", expected, got)
+	}
+
+	// Annotations and admin requests.
+	admin := func(identities ...string) http.Handler {
+		return Chain(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+			auth, AdminOnly(identities),
+		)
+	}
+	for i, s := range []struct {
+		h            http.Handler
+		method, path string
+		expected     int
+	}{
+		{admin(), "POST", "/api/v1/annotations/job/b", http.StatusForbidden},
+		{admin(), "POST", "/api/v1/annotations/job/a/instance/x", http.StatusOK},
+		{admin(), "POST", "/api/v1/admin/freeze", http.StatusForbidden},
+		{admin(), "POST", "/api/v1/admin/compact", http.StatusForbidden},
+		{admin(), "GET", "/api/v1/admin/freeze", http.StatusOK},
+		{admin("bob"), "POST", "/api/v1/admin/unfreeze", http.StatusForbidden},
+		{admin("alice"), "POST", "/api/v1/admin/unfreeze", http.StatusOK},
+	} {
+		req, err := http.NewRequest(s.method, "http://example.org"+s.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		s.h.ServeHTTP(w, req)
+		if got := w.Code; s.expected != got {
+			t.Errorf("%d: Wanted status code %v, got %v.", i, s.expected, got)
+		}
+	}
 }
@@ -0,0 +1,141 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/text"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Historian is implemented by metric stores that record the history of
+// groups, like the DiskMetricStore.
+type Historian interface {
+	History(labels map[string]string) ([]storage.HistoryEntry, error)
+}
+
+type historyEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Start     time.Time `json:"start"`
+	Metrics   string    `json:"metrics"`
+}
+
+// History returns a handler that reports the recorded states of a group (see
+// storage.DiskMetricStoreOptions.HistoryDir) as a JSON array of objects with
+// the time of the push ('timestamp'), the time of the first push downsampled
+// into the entry ('start'), and the metrics of the group in the text format
+// ('metrics'), most recent first. The grouping labels are determined in the
+// same way as for the handler returned by Push with the same PushOptions.
+//
+// If the query parameter 'at' is set to a time in RFC 3339 format, only the
+// metrics of the most recent state recorded at or before that time are
+// written, in the text format, as the handler returned by Group would have
+// written them back then. If there is no such state, the response has status
+// code 404.
+//
+// The returned handler is already instrumented for Prometheus.
+func History(h Historian, o *PushOptions) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	var ps httprouter.Params
+	var mtx sync.Mutex // Protects ps.
+
+	instrumentedHandlerFunc := prometheus.InstrumentHandlerFunc(
+		"history",
+		func(w http.ResponseWriter, r *http.Request) {
+			job := ps.ByName("job")
+			labelsString := ps.ByName("labels")
+			mtx.Unlock()
+
+			labels, err := splitLabels(labelsString)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if job == "" {
+				http.Error(w, "job name is required", http.StatusBadRequest)
+				return
+			}
+			labels["job"] = job
+			autoFillGroupingLabel(r, labels, o)
+
+			var at time.Time
+			if s := r.URL.Query().Get("at"); s != "" {
+				if at, err = time.Parse(time.RFC3339, s); err != nil {
+					http.Error(w, fmt.Sprintf("invalid time %q: %s", s, err), http.StatusBadRequest)
+					return
+				}
+			}
+
+			entries, err := h.History(labels)
+			if err == storage.ErrNoHistory {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if !at.IsZero() {
+				for _, e := range entries {
+					if e.Timestamp.After(at) {
+						continue
+					}
+					w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+					w.Header().Set("Last-Modified", e.Timestamp.UTC().Format(http.TimeFormat))
+					for _, mf := range e.MetricFamilies {
+						if _, err := text.MetricFamilyToText(w, mf); err != nil {
+							// Too late to change the status code.
+							return
+						}
+					}
+					return
+				}
+				http.Error(w, "no state recorded at that time", http.StatusNotFound)
+				return
+			}
+
+			resp := make([]historyEntry, 0, len(entries))
+			for _, e := range entries {
+				var buf bytes.Buffer
+				for _, mf := range e.MetricFamilies {
+					if _, err := text.MetricFamilyToText(&buf, mf); err != nil {
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+						return
+					}
+				}
+				resp = append(resp, historyEntry{
+					Timestamp: e.Timestamp,
+					Start:     e.Start,
+					Metrics:   buf.String(),
+				})
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+		},
+	)
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		mtx.Lock()
+		ps = params
+		instrumentedHandlerFunc(w, r)
+	}
+}
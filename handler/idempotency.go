@@ -0,0 +1,249 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+
+	// maxIdempotentRequestSize is the maximum size of the body of a
+	// request to be de-duplicated. Bigger requests are passed on
+	// unconditionally.
+	maxIdempotentRequestSize = 8 << 20
+	// maxIdempotentResponseSize is the maximum size of the body of a
+	// response to be remembered. Responses to pushes are much smaller.
+	maxIdempotentResponseSize = 64 << 10
+)
+
+// IdempotencyCache remembers the responses to requests carrying an
+// Idempotency-Key header for a limited time. Keys are scoped by the
+// authenticated identity of the client (see Identity). It is safe for
+// concurrent use.
+type IdempotencyCache struct {
+	window     time.Duration
+	maxEntries int
+
+	mtx       sync.Mutex // Protects the fields below.
+	responses map[string]*idempotentResponse
+	// completed contains the keys of the completed responses, least
+	// recently completed (and thus expiring) first.
+	completed *list.List
+}
+
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte
+	expires     time.Time
+	done        bool          // False while the original request is in flight.
+	elem        *list.Element // In completed, once done.
+	status      int
+	contentType string
+	body        []byte
+}
+
+// NewIdempotencyCache returns an IdempotencyCache that remembers responses for
+// the given window. At most maxEntries responses are remembered at a time, the
+// ones expiring first are forgotten first. If window or maxEntries is not
+// positive, nil is returned, which is a valid argument for Idempotent
+// (disabling de-duplication).
+func NewIdempotencyCache(window time.Duration, maxEntries int) *IdempotencyCache {
+	if window <= 0 || maxEntries <= 0 {
+		return nil
+	}
+	return &IdempotencyCache{
+		window:     window,
+		maxEntries: maxEntries,
+		responses:  map[string]*idempotentResponse{},
+		completed:  list.New(),
+	}
+}
+
+// Idempotent wraps a handler so that a request carrying an Idempotency-Key
+// header is only passed on if no request with the same key has been seen
+// within the window of the IdempotencyCache. Otherwise, the response to the
+// original request is returned again (with an additional Idempotent-Replayed
+// header). If the method, path, or body of the retried request differ from the
+// original request, the retry is rejected with status 422. If the original
+// request is still being processed, the retry is rejected with status 409.
+// Requests without an Idempotency-Key header or with a body bigger than 8MiB
+// are passed on unconditionally. Responses bigger than 64KiB are not
+// remembered. If ic is nil, h is returned unchanged.
+func Idempotent(ic *IdempotencyCache, h httprouter.Handle) httprouter.Handle {
+	if ic == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			h(w, r, params)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxIdempotentRequestSize+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxIdempotentRequestSize {
+			r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+			h(w, r, params)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(r, body)
+		key = Identity(r) + "\x00" + key
+
+		resp, isNew := ic.lookup(key, fingerprint)
+		switch {
+		case isNew:
+			// Handled below.
+		case resp.fingerprint != fingerprint:
+			http.Error(
+				w, "Idempotency-Key has already been used for a different request",
+				422, // Unprocessable Entity.
+			)
+			return
+		case !resp.done:
+			http.Error(
+				w, "request with the same Idempotency-Key is still being processed",
+				http.StatusConflict,
+			)
+			return
+		default:
+			if resp.contentType != "" {
+				w.Header().Set("Content-Type", resp.contentType)
+			}
+			w.Header().Set(idempotencyReplayedHeader, "true")
+			w.WriteHeader(resp.status)
+			w.Write(resp.body)
+			return
+		}
+
+		rw := &recordingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		h(rw, r, params)
+		ic.complete(key, rw)
+	}
+}
+
+// lookup returns a copy of the response remembered for key. If there is none,
+// a new in-flight entry is created for key, and true is returned as second
+// value. If all maxEntries entries are in flight, no entry is created.
+func (ic *IdempotencyCache) lookup(key string, fingerprint [sha256.Size]byte) (idempotentResponse, bool) {
+	now := time.Now()
+
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
+
+	for e := ic.completed.Front(); e != nil; e = ic.completed.Front() {
+		k := e.Value.(string)
+		if now.Before(ic.responses[k].expires) && len(ic.responses) < ic.maxEntries {
+			break
+		}
+		ic.forget(k)
+	}
+	if resp, ok := ic.responses[key]; ok {
+		return *resp, false
+	}
+	resp := &idempotentResponse{fingerprint: fingerprint}
+	if len(ic.responses) < ic.maxEntries {
+		ic.responses[key] = resp
+	}
+	return *resp, true
+}
+
+// complete stores the response recorded by rw for key. Server errors and
+// responses bigger than maxIdempotentResponseSize are not remembered so that
+// the request can be retried.
+func (ic *IdempotencyCache) complete(key string, rw *recordingResponseWriter) {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
+
+	resp, ok := ic.responses[key]
+	if !ok {
+		return
+	}
+	if rw.status >= 500 || rw.tooLarge {
+		delete(ic.responses, key)
+		return
+	}
+	resp.done = true
+	resp.expires = time.Now().Add(ic.window)
+	resp.elem = ic.completed.PushBack(key)
+	resp.status = rw.status
+	resp.contentType = rw.Header().Get("Content-Type")
+	resp.body = rw.body.Bytes()
+}
+
+// forget removes the completed response for key. The caller must hold mtx.
+func (ic *IdempotencyCache) forget(key string) {
+	ic.completed.Remove(ic.responses[key].elem)
+	delete(ic.responses, key)
+}
+
+func requestFingerprint(r *http.Request, body []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(r.Method))
+	h.Write([]byte{0})
+	h.Write([]byte(r.URL.Path))
+	h.Write([]byte{0})
+	h.Write(body)
+	var fingerprint [sha256.Size]byte
+	copy(fingerprint[:], h.Sum(nil))
+	return fingerprint
+}
+
+// recordingResponseWriter passes everything through to the wrapped
+// ResponseWriter but records the status code and the body, unless the body is
+// bigger than maxIdempotentResponseSize.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	tooLarge    bool
+}
+
+// Unwrap returns the wrapped ResponseWriter (see http.ResponseController).
+func (rw *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *recordingResponseWriter) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingResponseWriter) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	if rw.body.Len()+len(b) > maxIdempotentResponseSize {
+		rw.tooLarge = true
+	} else {
+		rw.body.Write(b)
+	}
+	return rw.ResponseWriter.Write(b)
+}
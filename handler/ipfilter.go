@@ -0,0 +1,134 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// IPFilter restricts the clients allowed to change the state of the
+// Pushgateway, i.e. to send requests with methods other than GET and HEAD, by
+// their IP address (see clientIP). The rules are read from a file with one
+// rule per line, either "allow <network>" or "deny <network>", where a network
+// is an IP address or a network in CIDR notation. Empty lines and lines
+// starting with '#' are ignored. A client within a denied network is rejected.
+// Otherwise, if there are allowed networks, a client is only accepted if it is
+// within one of them. It is safe for concurrent use.
+type IPFilter struct {
+	filename       string
+	trustedProxies []*net.IPNet
+
+	mtx         sync.RWMutex // Protects allow and deny.
+	allow, deny []*net.IPNet
+}
+
+// NewIPFilter returns an IPFilter with the rules read from the given file.
+func NewIPFilter(filename string, trustedProxies []*net.IPNet) (*IPFilter, error) {
+	f := &IPFilter{filename: filename, trustedProxies: trustedProxies}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the rules from the file again. If that fails, the previous
+// rules stay in effect.
+func (f *IPFilter) Reload() error {
+	file, err := os.Open(f.filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var allow, deny []*net.IPNet
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected '<allow|deny> <network>'", f.filename, n)
+		}
+		nets, err := ParseTrustedProxies(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", f.filename, n, err)
+		}
+		switch fields[0] {
+		case "allow":
+			allow = append(allow, nets...)
+		case "deny":
+			deny = append(deny, nets...)
+		default:
+			return fmt.Errorf("%s:%d: unknown action %q", f.filename, n, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.allow, f.deny = allow, deny
+	return nil
+}
+
+// allowed returns whether the client with the given IP address is allowed.
+func (f *IPFilter) allowed(ip net.IP) bool {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+
+	if ip == nil {
+		return len(f.allow) == 0 && len(f.deny) == 0
+	}
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware returns a Middleware rejecting requests with methods other than
+// GET and HEAD from clients that are not allowed with status code 403.
+func (f *IPFilter) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" && r.Method != "HEAD" &&
+				!f.allowed(net.ParseIP(clientIP(r, f.trustedProxies))) {
+				if isPush(r) {
+					pushesRejected.WithLabelValues(rejectUnauthorized).Inc()
+				}
+				http.Error(w, "client IP address not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
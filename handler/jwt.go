@@ -0,0 +1,362 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // Register SHA-256 for crypto.Hash.
+	_ "crypto/sha512" // Register SHA-384 and SHA-512 for crypto.Hash.
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jwksRefreshInterval    = time.Hour
+	jwksMinRefreshInterval = time.Minute
+)
+
+// JWTAuthenticator authenticates requests by a JSON Web Token (JWT) passed as
+// bearer token in the Authorization header, as issued by OpenID Connect
+// providers. The signature of the token is verified with the keys published
+// at JWKSURL (RS256, RS384, RS512, ES256, ES384, and ES512 are supported).
+// The keys are fetched upon first use, refreshed every hour, and refetched if
+// a token is signed with an unknown key (at most once per minute). The
+// identity is the 'sub' claim of the token.
+//
+// JWTAuthenticator is also a JobAuthorizer: If JobsClaim is set, the claim of
+// that name (a string or an array of strings) lists the jobs the client may
+// push to or delete from. "*" allows all jobs.
+type JWTAuthenticator struct {
+	JWKSURL string
+	// If Issuer is set, the 'iss' claim must be equal to it.
+	Issuer string
+	// If Audience is set, the 'aud' claim must contain it.
+	Audience  string
+	JobsClaim string
+	// Client is used to fetch the keys. If nil, http.DefaultClient is
+	// used.
+	Client *http.Client
+
+	mtx       sync.Mutex // Protects the fields below.
+	keys      map[string]crypto.PublicKey
+	lastFetch time.Time
+	// fetching is closed once the fetch of the keys in progress (if any)
+	// is done.
+	fetching chan struct{}
+}
+
+// Authenticate implements Authenticator.
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	claims, err := a.verifiedClaims(r)
+	if err != nil {
+		return "", false
+	}
+	sub, _ := claims["sub"].(string)
+	return sub, sub != ""
+}
+
+// AuthorizeJob implements JobAuthorizer. As it is only called after
+// Authenticate has succeeded for r, the signature of the token is not verified
+// again.
+func (a *JWTAuthenticator) AuthorizeJob(r *http.Request, job string) bool {
+	if a.JobsClaim == "" {
+		return true
+	}
+	parts, err := bearerJWT(r)
+	if err != nil {
+		return false
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return false
+	}
+	for _, j := range stringOrStrings(claims[a.JobsClaim]) {
+		if j == job || j == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerJWT returns the header, the payload, and the signature of the JWT
+// passed as bearer token in r, each still base64-encoded.
+func bearerJWT(r *http.Request) ([]string, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, errors.New("no bearer token")
+	}
+	parts := strings.Split(strings.TrimPrefix(auth, "Bearer "), ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+	return parts, nil
+}
+
+// verifiedClaims returns the claims of the bearer token of r after verifying
+// its signature, its expiry, and (if configured) its issuer and audience.
+func (a *JWTAuthenticator) verifiedClaims(r *http.Request) (map[string]interface{}, error) {
+	parts, err := bearerJWT(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); !ok || now >= exp {
+		return nil, errors.New("JWT expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, errors.New("JWT not valid yet")
+	}
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return nil, errors.New("unexpected JWT issuer")
+	}
+	if a.Audience != "" {
+		found := false
+		for _, aud := range stringOrStrings(claims["aud"]) {
+			if aud == a.Audience {
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.New("unexpected JWT audience")
+		}
+	}
+	return claims, nil
+}
+
+// key returns the public key with the given ID, fetching the keys if needed.
+// The keys are fetched without holding the lock so that a slow JWKS endpoint
+// doesn't block the authentication with known keys. Only one fetch is in
+// progress at a time, which concurrent lookups of unknown keys wait for.
+func (a *JWTAuthenticator) key(kid string) (crypto.PublicKey, error) {
+	a.mtx.Lock()
+	key, ok := a.keys[kid]
+	since := time.Since(a.lastFetch)
+	if ok && (since < jwksRefreshInterval || a.fetching != nil) {
+		a.mtx.Unlock()
+		return key, nil
+	}
+	if fetching := a.fetching; fetching != nil {
+		a.mtx.Unlock()
+		<-fetching
+		a.mtx.Lock()
+		key, ok = a.keys[kid]
+		a.mtx.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown key ID %q", kid)
+		}
+		return key, nil
+	}
+	if !ok && since < jwksMinRefreshInterval {
+		a.mtx.Unlock()
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	fetching := make(chan struct{})
+	a.fetching = fetching
+	a.lastFetch = time.Now()
+	a.mtx.Unlock()
+
+	keys, err := a.fetchKeys()
+
+	a.mtx.Lock()
+	if err == nil {
+		a.keys = keys
+	}
+	a.fetching = nil
+	a.mtx.Unlock()
+	close(fetching)
+
+	if err != nil {
+		if ok {
+			// Keep using the known key until the JWKS endpoint is
+			// back.
+			return key, nil
+		}
+		return nil, err
+	}
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	return key, nil
+}
+
+func (a *JWTAuthenticator) fetchKeys() (map[string]crypto.PublicKey, error) {
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(a.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS from %s: unexpected status %s", a.JWKSURL, resp.Status)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("decoding JWKS from %s: %s", a.JWKSURL, err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err1 := decodeBigInt(k.N)
+			e, err2 := decodeBigInt(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, err1 := decodeBigInt(k.X)
+			y, err2 := decodeBigInt(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		}
+	}
+	return keys, nil
+}
+
+// verifyJWTSignature verifies the signature sig of signed with the given key
+// according to the given JWT algorithm.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported JWT algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			break
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			break
+		}
+		// The signature is r and s, each padded to the size of the curve.
+		if size := (k.Curve.Params().BitSize + 7) / 8; len(sig) != 2*size {
+			return errors.New("invalid JWT signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:len(sig)/2])
+		s := new(big.Int).SetBytes(sig[len(sig)/2:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid JWT signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("JWT algorithm %q does not match key", alg)
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// stringOrStrings returns the strings in a JSON value that is either a string
+// or an array of strings.
+func stringOrStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var ss []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	}
+	return nil
+}
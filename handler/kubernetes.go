@@ -0,0 +1,319 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/log"
+
+	"github.com/prometheus/pushgateway/secret"
+)
+
+const (
+	// kubernetesServiceAccountDir is where Kubernetes mounts the token and
+	// the CA certificate of the service account of a pod.
+	kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// kubernetesPodNameExtra is the key of the extra user info of a token
+	// review carrying the name of the pod a token is bound to.
+	kubernetesPodNameExtra = "authentication.kubernetes.io/pod-name"
+	// maxKubernetesReviews limits the number of cached token reviews. The
+	// least recently used review is evicted to make room for a new one.
+	maxKubernetesReviews = 10000
+)
+
+// KubernetesAuthenticator authenticates requests by a Kubernetes service
+// account token passed as bearer token in the Authorization header. Tokens
+// are verified by a TokenReview sent to the Kubernetes API server, whose
+// result is cached for CacheTTL if the token is valid. The identity is the user name of the
+// service account, i.e. 'system:serviceaccount:<namespace>:<name>'. Tokens of
+// other users are rejected.
+//
+// KubernetesAuthenticator is also a GroupingLabeler: The namespace of the
+// service account and the pod the token is bound to (if NamespaceLabel and
+// PodLabel are set, respectively) become grouping labels of the pushes and
+// deletions of the client, so that pods cannot push to (or delete) groups of
+// other pods. If PodLabel is set, tokens not bound to a pod (like legacy
+// service account token secrets) are rejected.
+type KubernetesAuthenticator struct {
+	// APIServer is the base URL of the Kubernetes API server, e.g.
+	// 'https://kubernetes.default.svc'.
+	APIServer string
+	// Token authenticates the Pushgateway to the API server. Its service
+	// account needs permission to create TokenReviews (as granted by the
+	// ClusterRole system:auth-delegator).
+	Token *secret.Secret
+	// If Audiences is not empty, tokens must be issued for at least one
+	// of them, as confirmed by the audiences in the status of the
+	// TokenReview.
+	Audiences      []string
+	NamespaceLabel string
+	PodLabel       string
+	CacheTTL       time.Duration
+	// Client sends the TokenReviews. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	mtx     sync.Mutex // Protects reviews and lru.
+	reviews map[[sha256.Size]byte]*list.Element
+	// lru contains the cached reviews, least recently used first.
+	lru *list.List
+}
+
+// kubernetesReview is the result of a TokenReview.
+type kubernetesReview struct {
+	identity string
+	labels   map[string]string
+	ok       bool
+	expires  time.Time
+}
+
+// cachedKubernetesReview is an element of KubernetesAuthenticator.lru.
+type cachedKubernetesReview struct {
+	key [sha256.Size]byte
+	kubernetesReview
+}
+
+// NewInClusterKubernetesAuthenticator returns a KubernetesAuthenticator that
+// talks to the API server of the Kubernetes cluster the Pushgateway is running
+// in, authenticated by the service account of its pod, whose token is re-read
+// every refresh interval (see secret.New). NamespaceLabel and PodLabel are set
+// to 'namespace' and 'pod', CacheTTL to one minute.
+func NewInClusterKubernetesAuthenticator(refresh time.Duration) (*KubernetesAuthenticator, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in Kubernetes: KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT not set")
+	}
+	token, err := secret.New(kubernetesServiceAccountDir+"/token", refresh)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates found in the CA certificate of the service account")
+	}
+	return &KubernetesAuthenticator{
+		APIServer:      "https://" + net.JoinHostPort(host, port),
+		Token:          token,
+		NamespaceLabel: "namespace",
+		PodLabel:       "pod",
+		CacheTTL:       time.Minute,
+		Client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// Authenticate implements Authenticator.
+func (a *KubernetesAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	rev := a.review(r)
+	return rev.identity, rev.ok
+}
+
+// GroupingLabels implements GroupingLabeler.
+func (a *KubernetesAuthenticator) GroupingLabels(r *http.Request) map[string]string {
+	return a.review(r).labels
+}
+
+// review returns the (possibly cached) result of reviewing the bearer token of
+// r. Only reviews of valid tokens are cached, so that requests with random
+// tokens cannot push the reviews of legitimate clients out of the cache.
+// Reviews failing for reasons other than an invalid token are logged.
+func (a *KubernetesAuthenticator) review(r *http.Request) kubernetesReview {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return kubernetesReview{}
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	if rev, ok := a.cachedReview(key, now); ok {
+		return rev
+	}
+	rev, err := a.sendReview(token)
+	if err != nil {
+		log.Printf("Error reviewing Kubernetes token: %s", err)
+		return kubernetesReview{}
+	}
+	if rev.ok {
+		rev.expires = now.Add(a.CacheTTL)
+		a.cacheReview(key, rev)
+	}
+	return rev
+}
+
+// cachedReview returns the unexpired cached review for key, if any, and marks
+// it as most recently used.
+func (a *KubernetesAuthenticator) cachedReview(key [sha256.Size]byte, now time.Time) (kubernetesReview, bool) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	e, ok := a.reviews[key]
+	if !ok {
+		return kubernetesReview{}, false
+	}
+	cached := e.Value.(*cachedKubernetesReview)
+	if !now.Before(cached.expires) {
+		a.lru.Remove(e)
+		delete(a.reviews, key)
+		return kubernetesReview{}, false
+	}
+	a.lru.MoveToBack(e)
+	return cached.kubernetesReview, true
+}
+
+// cacheReview caches rev for key, evicting the least recently used review if
+// the cache is full.
+func (a *KubernetesAuthenticator) cacheReview(key [sha256.Size]byte, rev kubernetesReview) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.reviews == nil {
+		a.reviews = map[[sha256.Size]byte]*list.Element{}
+		a.lru = list.New()
+	}
+	if e, ok := a.reviews[key]; ok {
+		e.Value.(*cachedKubernetesReview).kubernetesReview = rev
+		a.lru.MoveToBack(e)
+		return
+	}
+	if len(a.reviews) >= maxKubernetesReviews {
+		oldest := a.lru.Front()
+		a.lru.Remove(oldest)
+		delete(a.reviews, oldest.Value.(*cachedKubernetesReview).key)
+	}
+	a.reviews[key] = a.lru.PushBack(&cachedKubernetesReview{key: key, kubernetesReview: rev})
+}
+
+// tokenReview is the subset of a Kubernetes TokenReview (API group
+// authentication.k8s.io/v1) used by KubernetesAuthenticator.
+type tokenReview struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Token     string   `json:"token"`
+		Audiences []string `json:"audiences,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Authenticated bool `json:"authenticated"`
+		User          struct {
+			Username string              `json:"username"`
+			Extra    map[string][]string `json:"extra"`
+		} `json:"user"`
+		Audiences []string `json:"audiences"`
+		Error     string   `json:"error"`
+	} `json:"status"`
+}
+
+// sendReview sends a TokenReview for the given token to the API server and
+// returns the result. An error is only returned if the review itself failed.
+func (a *KubernetesAuthenticator) sendReview(token string) (kubernetesReview, error) {
+	var rev kubernetesReview
+	req := tokenReview{APIVersion: "authentication.k8s.io/v1", Kind: "TokenReview"}
+	req.Spec.Token = token
+	req.Spec.Audiences = a.Audiences
+	body, err := json.Marshal(req)
+	if err != nil {
+		return rev, err
+	}
+	httpReq, err := http.NewRequest(
+		"POST", strings.TrimSuffix(a.APIServer, "/")+"/apis/authentication.k8s.io/v1/tokenreviews",
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return rev, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if a.Token != nil {
+		ownToken, _ := a.Token.Get()
+		httpReq.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(ownToken)))
+	}
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return rev, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return rev, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var res tokenReview
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return rev, err
+	}
+	if !res.Status.Authenticated {
+		return rev, nil
+	}
+	// An API server not supporting audiences ignores them in the spec and
+	// omits them in the status.
+	if len(a.Audiences) > 0 && !intersects(a.Audiences, res.Status.Audiences) {
+		return rev, nil
+	}
+
+	// Service account user names are 'system:serviceaccount:<namespace>:<name>'.
+	parts := strings.Split(res.Status.User.Username, ":")
+	if len(parts) != 4 || parts[0] != "system" || parts[1] != "serviceaccount" {
+		return rev, nil
+	}
+	labels := map[string]string{}
+	if a.NamespaceLabel != "" {
+		labels[a.NamespaceLabel] = parts[2]
+	}
+	if a.PodLabel != "" {
+		pods := res.Status.User.Extra[kubernetesPodNameExtra]
+		if len(pods) != 1 || pods[0] == "" {
+			return rev, nil
+		}
+		labels[a.PodLabel] = pods[0]
+	}
+	rev.identity = res.Status.User.Username
+	rev.labels = labels
+	rev.ok = true
+	return rev, nil
+}
+
+// intersects returns whether a and b have at least one element in common.
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// LabelValueMode determines how pushed label values that are longer than
+// PushOptions.MaxLabelValueBytes or that contain control characters (like
+// newlines embedded by careless shell scripts) are handled.
+type LabelValueMode int
+
+// Possible values for LabelValueMode.
+const (
+	// LabelValuesKeep stores all label values as pushed.
+	LabelValuesKeep LabelValueMode = iota
+	// LabelValuesSanitize replaces control characters by spaces and
+	// truncates label values to MaxLabelValueBytes.
+	LabelValuesSanitize
+	// LabelValuesReject rejects the push with status code 400.
+	LabelValuesReject
+)
+
+// ParseLabelValueMode returns the LabelValueMode for the given name, which is
+// one of 'keep', 'sanitize', or 'reject'.
+func ParseLabelValueMode(name string) (LabelValueMode, error) {
+	switch name {
+	case "keep":
+		return LabelValuesKeep, nil
+	case "sanitize":
+		return LabelValuesSanitize, nil
+	case "reject":
+		return LabelValuesReject, nil
+	}
+	return 0, fmt.Errorf("unknown handling of label values %q", name)
+}
+
+// checkLabelValues checks the grouping labels and the label values of the
+// metrics in metricFamilies against maxBytes (if positive) and for control
+// characters. In LabelValuesSanitize mode, offending values are fixed in
+// place. In LabelValuesReject mode, an error describing the first offending
+// value is returned.
+func checkLabelValues(
+	metricFamilies map[string]*dto.MetricFamily,
+	groupingLabels map[string]string,
+	maxBytes int,
+	mode LabelValueMode,
+) error {
+	if mode == LabelValuesKeep {
+		return nil
+	}
+	for ln, lv := range groupingLabels {
+		if !labelValueOK(lv, maxBytes) {
+			if mode == LabelValuesReject {
+				return labelValueError(ln, lv, maxBytes)
+			}
+			groupingLabels[ln] = sanitizeLabelValue(lv, maxBytes)
+		}
+	}
+	for name, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				lv := lp.GetValue()
+				if labelValueOK(lv, maxBytes) {
+					continue
+				}
+				if mode == LabelValuesReject {
+					return fmt.Errorf("metric family %q: %s", name, labelValueError(lp.GetName(), lv, maxBytes))
+				}
+				lp.Value = proto.String(sanitizeLabelValue(lv, maxBytes))
+			}
+		}
+	}
+	return nil
+}
+
+// labelValueOK returns whether lv is at most maxBytes long (if maxBytes is
+// positive) and free of control characters.
+func labelValueOK(lv string, maxBytes int) bool {
+	return (maxBytes <= 0 || len(lv) <= maxBytes) && strings.IndexFunc(lv, unicode.IsControl) < 0
+}
+
+func labelValueError(ln, lv string, maxBytes int) error {
+	if maxBytes > 0 && len(lv) > maxBytes {
+		return fmt.Errorf("value of label %q is %d bytes long, exceeding the limit of %d bytes", ln, len(lv), maxBytes)
+	}
+	return fmt.Errorf("value of label %q contains control characters: %q", ln, lv)
+}
+
+// sanitizeLabelValue replaces control characters in lv by spaces and truncates
+// it to at most maxBytes (if positive) without splitting a UTF-8 sequence.
+func sanitizeLabelValue(lv string, maxBytes int) string {
+	lv = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, lv)
+	if maxBytes <= 0 || len(lv) <= maxBytes {
+		return lv
+	}
+	n := maxBytes
+	for n > 0 && !utf8.RuneStart(lv[n]) {
+		n--
+	}
+	return lv[:n]
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var leaderDesc = prometheus.NewDesc(
+	"pushgateway_leader",
+	"1 if the Pushgateway holds the leader lease and accepts pushes and deletions, 0 if it is standing by.",
+	nil, nil,
+)
+
+// LeadershipStatus is the state of a Leadership as reported by LoadStatus.
+type LeadershipStatus struct {
+	Leader bool `json:"leader"`
+	// Holder is the ID of the current holder of the lease, if known.
+	Holder string `json:"holder,omitempty"`
+	// Since is the time the lease has been acquired. Only set while
+	// leader.
+	Since *time.Time `json:"since,omitempty"`
+}
+
+// Leadership tracks whether the Pushgateway is the leader among several
+// instances sharing their storage, as determined by a lease. While not the
+// leader, i.e. while standing by, its Middleware rejects all requests other
+// than GET and HEAD, apart from those to the admin API. It is a
+// prometheus.Collector exposing whether the Pushgateway is the leader. Use
+// NewLeadership to create one.
+type Leadership struct {
+	mtx    sync.RWMutex // Protects status.
+	status LeadershipStatus
+}
+
+// NewLeadership returns a Leadership that is standing by.
+func NewLeadership() *Leadership {
+	return &Leadership{}
+}
+
+// Status returns the current state.
+func (l *Leadership) Status() LeadershipStatus {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	return l.status
+}
+
+// Set records whether the Pushgateway is the leader and the ID of the current
+// holder of the lease.
+func (l *Leadership) Set(leader bool, holder string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if !leader {
+		l.status = LeadershipStatus{Holder: holder}
+		return
+	}
+	if !l.status.Leader {
+		now := time.Now()
+		l.status.Since = &now
+	}
+	l.status.Leader = true
+	l.status.Holder = holder
+}
+
+// Middleware returns a Middleware rejecting requests with methods other than
+// GET and HEAD with status code 503 while standing by. The ID of the current
+// holder of the lease, if known, is reported in the response. Requests to the
+// admin API are always passed on.
+func (l *Leadership) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" || r.Method == "HEAD" || strings.HasPrefix(r.URL.Path, adminPathPrefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			s := l.Status()
+			if s.Leader {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if isPush(r) {
+				pushesRejected.WithLabelValues(rejectStandby).Inc()
+			}
+			msg := "Pushgateway is standing by"
+			if s.Holder != "" {
+				msg += ", the leader is " + s.Holder
+			}
+			http.Error(w, msg, http.StatusServiceUnavailable)
+		})
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (l *Leadership) Describe(ch chan<- *prometheus.Desc) {
+	ch <- leaderDesc
+}
+
+// Collect implements prometheus.Collector.
+func (l *Leadership) Collect(ch chan<- prometheus.Metric) {
+	var leader float64
+	if l.Status().Leader {
+		leader = 1
+	}
+	ch <- prometheus.MustNewConstMetric(leaderDesc, prometheus.GaugeValue, leader)
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// loadingRetryAfter is the delay advised in the Retry-After header of requests
+// rejected while the metric store is loading.
+const loadingRetryAfter = 5 * time.Second
+
+// LoadingMode determines how requests changing the metric store (i.e. with
+// methods other than GET and HEAD) are handled while the persisted metrics are
+// still being loaded upon start-up.
+type LoadingMode int
+
+// Possible values for LoadingMode.
+const (
+	// LoadingBlock loads the persisted metrics before any request is
+	// served.
+	LoadingBlock LoadingMode = iota
+	// LoadingQueue serves requests right away, but holds back requests
+	// changing the metric store until loading is done.
+	LoadingQueue
+	// LoadingReject serves requests right away, but rejects requests
+	// changing the metric store with status code 503 and a Retry-After
+	// header until loading is done.
+	LoadingReject
+)
+
+// ParseLoadingMode returns the LoadingMode for the given name, which is one of
+// 'block', 'queue', or 'reject'.
+func ParseLoadingMode(name string) (LoadingMode, error) {
+	switch name {
+	case "block":
+		return LoadingBlock, nil
+	case "queue":
+		return LoadingQueue, nil
+	case "reject":
+		return LoadingReject, nil
+	}
+	return 0, fmt.Errorf("unknown loading mode %q", name)
+}
+
+// Loader is implemented by metric stores that load persisted metrics in the
+// background, like the DiskMetricStore.
+type Loader interface {
+	// Loaded returns a channel that is closed once loading is done.
+	Loaded() <-chan struct{}
+}
+
+// WhileLoading returns a Middleware handling requests with methods other than
+// GET and HEAD according to mode until l is loaded. Holding back a request in
+// LoadingQueue mode ends early if the client goes away. In LoadingBlock mode,
+// requests are passed on as is.
+func WhileLoading(l Loader, mode LoadingMode) Middleware {
+	return func(next http.Handler) http.Handler {
+		if mode == LoadingBlock {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" || r.Method == "HEAD" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			select {
+			case <-l.Loaded():
+				next.ServeHTTP(w, r)
+				return
+			default:
+			}
+			if mode == LoadingReject {
+				if isPush(r) {
+					pushesRejected.WithLabelValues(rejectLoading).Inc()
+				}
+				setRetryAfter(w, loadingRetryAfter)
+				http.Error(w, "Pushgateway is still loading persisted metrics", http.StatusServiceUnavailable)
+				return
+			}
+			select {
+			case <-l.Loaded():
+				next.ServeHTTP(w, r)
+			case <-r.Context().Done():
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var scrapeEncodeDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "pushgateway_scrape_encode_duration_seconds",
+		Help:    "Time spent collecting and encoding the metrics of the Pushgateway for scrapes, by format ('text' or 'protobuf').",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	},
+	[]string{"format"},
+)
+
+func init() {
+	prometheus.MustRegister(scrapeEncodeDuration)
+}
+
+// Metrics returns a handler serving the metrics of the Pushgateway like
+// prometheus.UninstrumentedHandler. The time it takes to collect and encode
+// them is observed by the exposition format negotiated with the client. As the
+// response is buffered, the time spent sending it to the client is not
+// included.
+func Metrics() http.Handler {
+	h := prometheus.UninstrumentedHandler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bw := &bufferedResponseWriter{header: w.Header(), code: http.StatusOK}
+		start := time.Now()
+		h.ServeHTTP(bw, r)
+		scrapeEncodeDuration.WithLabelValues(formatName(w.Header().Get("Content-Type"))).Observe(time.Since(start).Seconds())
+		w.WriteHeader(bw.code)
+		w.Write(bw.Bytes())
+	})
+}
+
+// formatName returns the value of the format label of scrapeEncodeDuration for
+// the given content type of a response. Content types of unknown formats
+// yield "unknown".
+func formatName(contentType string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "unknown"
+	}
+	switch {
+	case mediaType == "text/plain":
+		return "text"
+	case mediaType != "application/vnd.google.protobuf":
+		return "unknown"
+	}
+	switch params["encoding"] {
+	case "delimited":
+		return "protobuf"
+	case "text":
+		return "protobuf_text"
+	case "compact-text":
+		return "protobuf_compact"
+	}
+	return "unknown"
+}
+
+// bufferedResponseWriter is an http.ResponseWriter buffering the body and
+// status code of a response. Headers are set directly in the given header.
+type bufferedResponseWriter struct {
+	header http.Header
+	code   int
+	bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header { return w.header }
+
+func (w *bufferedResponseWriter) WriteHeader(code int) { w.code = code }
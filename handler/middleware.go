@@ -0,0 +1,271 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Middleware wraps an http.Handler to add behavior like authentication, rate
+// limiting, or auditing.
+type Middleware func(http.Handler) http.Handler
+
+// Chain returns h wrapped by the given middlewares. The first middleware is
+// the outermost one, i.e. it sees a request first.
+func Chain(h http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a shallow copy of r that carries the given identity of
+// the client. Authenticating middlewares use it to make the identity
+// available to the middlewares and handlers further down the chain.
+func WithIdentity(r *http.Request, identity string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+}
+
+// Identity returns the identity of the client of r as set by WithIdentity, or
+// an empty string if the client has not been authenticated.
+func Identity(r *http.Request) string {
+	identity, _ := r.Context().Value(identityKey{}).(string)
+	return identity
+}
+
+type groupingLabelsKey struct{}
+
+// WithGroupingLabels returns a shallow copy of r that carries the given
+// grouping labels determined from the identity of the client. The handlers
+// for pushes and deletions add them to the grouping key and reject requests
+// whose grouping key contains one of them with a different value.
+func WithGroupingLabels(r *http.Request, labels map[string]string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), groupingLabelsKey{}, labels))
+}
+
+// GroupingLabels returns the grouping labels set by WithGroupingLabels, or nil
+// if there are none.
+func GroupingLabels(r *http.Request) map[string]string {
+	labels, _ := r.Context().Value(groupingLabelsKey{}).(map[string]string)
+	return labels
+}
+
+type jobAuthorizationKey struct{}
+
+// WithJobAuthorization returns a shallow copy of r that carries a function
+// reporting whether the client may change the metrics of a given job.
+// Authenticating middlewares use it for handlers that change groups of several
+// jobs at once, whose job cannot be checked from the path of the request.
+func WithJobAuthorization(r *http.Request, authorized func(job string) bool) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), jobAuthorizationKey{}, authorized))
+}
+
+type responseControllerKey struct{}
+
+// withResponseController returns a shallow copy of r that carries a
+// ResponseController for w. Handlers instrumented by
+// prometheus.InstrumentHandlerFunc only get a wrapped ResponseWriter that
+// cannot be unwrapped, so the ResponseController has to be created before.
+func withResponseController(r *http.Request, w http.ResponseWriter) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), responseControllerKey{}, http.NewResponseController(w)))
+}
+
+// responseController returns the ResponseController set by
+// withResponseController, or one for w if there is none.
+func responseController(r *http.Request, w http.ResponseWriter) *http.ResponseController {
+	if rc, ok := r.Context().Value(responseControllerKey{}).(*http.ResponseController); ok {
+		return rc
+	}
+	return http.NewResponseController(w)
+}
+
+// JobAuthorized returns whether the client of r may change the metrics of the
+// given job as reported by the function set by WithJobAuthorization. Without
+// such a function, all jobs are authorized.
+func JobAuthorized(r *http.Request, job string) bool {
+	authorized, _ := r.Context().Value(jobAuthorizationKey{}).(func(string) bool)
+	return authorized == nil || authorized(job)
+}
+
+// RateLimit returns a Middleware that limits the requests per client to rate
+// requests per second on average, with bursts of up to burst requests.
+// Clients are told apart by their identity (see Identity), or by their IP
+// address (see clientIP) if they have not been authenticated. Requests
+// exceeding the limit are rejected with status code 429 and a Retry-After
+// header, which doubles with every further rejection of the same client until
+// it is allowed a request again (but it is at least the time until the next
+// request is allowed). Hence, RateLimit has to come after any authenticating
+// middleware in the chain.
+func RateLimit(rate float64, burst int, trustedProxies []*net.IPNet) Middleware {
+	rl := &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client := Identity(r)
+			if client == "" {
+				client = clientIP(r, trustedProxies)
+			}
+			if now := time.Now(); !rl.allow(client, now) {
+				setRetryAfter(w, rl.retryAfter(client, now))
+				if isPush(r) {
+					pushesRejected.WithLabelValues(rejectRateLimited).Inc()
+				}
+				http.Error(w, "rate limit exceeded", 429) // Too Many Requests.
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type rateLimiter struct {
+	rate, burst float64
+
+	mtx       sync.Mutex // Protects the fields below.
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// rejected is the number of requests rejected since the last allowed
+	// one.
+	rejected int
+}
+
+// allow takes a token from the bucket of the given client and returns whether
+// there was one.
+func (rl *rateLimiter) allow(client string, now time.Time) bool {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	// Buckets that have been full for a while are equivalent to no bucket.
+	fullAfter := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	if now.Sub(rl.lastSweep) > fullAfter+time.Minute {
+		for c, b := range rl.buckets {
+			if now.Sub(b.last) > fullAfter {
+				delete(rl.buckets, c)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	b, ok := rl.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		b.rejected++
+		return false
+	}
+	b.tokens--
+	b.rejected = 0
+	return true
+}
+
+// retryAfter returns the delay to advise the given client after a rejected
+// request at the given time, doubling from minRetryAfter with every rejection
+// in a row up to maxRetryAfter, but at least the time until the next token.
+func (rl *rateLimiter) retryAfter(client string, now time.Time) time.Duration {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	b, ok := rl.buckets[client]
+	if !ok {
+		return minRetryAfter
+	}
+	d := maxRetryAfter
+	if b.rejected <= 7 {
+		d = minRetryAfter << uint(b.rejected-1)
+	}
+	if d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+	if next := time.Duration((1 - b.tokens) / rl.rate * float64(time.Second)); next > d {
+		d = next
+	}
+	return d
+}
+
+// Audit returns a Middleware that writes a line to w for each request that
+// might change the state of the Pushgateway, i.e. for all requests with
+// methods other than GET and HEAD. The line contains the time, the client IP
+// address (see clientIP), the identity of the client (see Identity, "-" if
+// not authenticated), the method, the path, the status code of the response,
+// and the duration of the request. Audit has to come after any authenticating
+// middleware in the chain, or failed authentications are not audited.
+func Audit(w io.Writer, trustedProxies []*net.IPNet) Middleware {
+	var mtx sync.Mutex // Serializes writes to w.
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" || r.Method == "HEAD" {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			start := time.Now()
+			sw := &statusRecordingResponseWriter{ResponseWriter: rw, status: http.StatusOK}
+			next.ServeHTTP(sw, r)
+
+			identity := Identity(r)
+			if identity == "" {
+				identity = "-"
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			fmt.Fprintf(
+				w, "%s %s %s %s %s %d %v\n",
+				start.UTC().Format(time.RFC3339), clientIP(r, trustedProxies),
+				strconv.Quote(identity), r.Method, strconv.Quote(r.URL.Path),
+				sw.status, time.Since(start),
+			)
+		})
+	}
+}
+
+// statusRecordingResponseWriter records the status code of the response.
+type statusRecordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecordingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap returns the wrapped ResponseWriter (see http.ResponseController).
+func (w *statusRecordingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,144 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Patch returns a handler that updates only the values of the metrics in the
+// request body, leaving all other metrics of the group untouched (see the Patch
+// field of storage.WriteRequest). The grouping labels are determined in the
+// same way as for the handler returned by Push with the same PushOptions, and
+// the pushed metrics are checked and labeled in the same way, too. Unlike a
+// push, the response is only sent once the update has been applied. If the
+// group lacks any of the metric families or metrics, nothing is changed, and
+// the response has status code 400.
+//
+// The returned handler is already instrumented for Prometheus.
+func Patch(ms storage.MetricStore, o *PushOptions) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	var ps httprouter.Params
+	var mtx sync.Mutex // Protects ps.
+
+	instrumentedHandlerFunc := prometheus.InstrumentHandlerFunc(
+		"patch",
+		func(w http.ResponseWriter, r *http.Request) {
+			job := ps.ByName("job")
+			labelsString := ps.ByName("labels")
+			mtx.Unlock()
+
+			received := time.Now()
+			labels, err := splitLabels(labelsString)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if job == "" {
+				http.Error(w, "job name is required", http.StatusBadRequest)
+				return
+			}
+			labels["job"] = job
+			reject := func(reason, msg string, status int) {
+				pushesRejected.WithLabelValues(reason).Inc()
+				http.Error(w, msg, status)
+			}
+			if err := enforceGroupingLabels(r, labels); err != nil {
+				reject(rejectUnauthorized, err.Error(), http.StatusForbidden)
+				return
+			}
+			autoFillGroupingLabel(r, labels, o)
+			if ms.WriteQueueUtilization() >= 1 {
+				setRetryAfter(w, retryAfter(currentLoad(ms, o).Load))
+				reject(rejectOverloaded, "write queue of the metric store is full", http.StatusServiceUnavailable)
+				return
+			}
+			if err := negotiateContentType(r, o.ContentTypes); err != nil {
+				reject(rejectContentType, err.Error(), http.StatusUnsupportedMediaType)
+				return
+			}
+			metricFamilies, _, err := parseMetricFamiliesWithTimeout(w, r, o.Timeout, false)
+			if err == errPushTimeout {
+				pushTimeouts.Inc()
+				w.Header().Set("Connection", "close")
+				http.Error(w, err.Error(), http.StatusRequestTimeout)
+				return
+			}
+			if err != nil {
+				reject(rejectParseError, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if o.LabelConflicts == LabelConflictsReject {
+				if err := checkLabelConflicts(metricFamilies, labels); err != nil {
+					reject(rejectInconsistent, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if err := checkLabelValues(metricFamilies, labels, o.MaxLabelValueBytes, o.LabelValues); err != nil {
+				reject(rejectLabelValue, err.Error(), http.StatusBadRequest)
+				return
+			}
+			invalid, err := checkSampleValues(metricFamilies, o.SampleValues)
+			if invalid > 0 {
+				invalidSampleValues.WithLabelValues(labels["job"]).Add(float64(invalid))
+			}
+			if err != nil {
+				reject(rejectSampleValue, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := checkBuckets(metricFamilies); err != nil {
+				reject(rejectBuckets, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := checkTimestampAge(metricFamilies, o.MaxTimestampAge, received); err != nil {
+				reject(rejectTimestampAge, err.Error(), http.StatusBadRequest)
+				return
+			}
+			transformValues(labels["job"], metricFamilies, o.Transforms)
+			sanitizeLabels(metricFamilies, labels, o.metricAutoFillLabel(), o.LabelConflicts != LabelConflictsKeep)
+			if reason, status, err := validatePush(o, r.Method, labels, metricFamilies); err != nil {
+				reject(reason, err.Error(), status)
+				return
+			}
+
+			done := make(chan error, 1)
+			ms.SubmitWriteRequest(storage.WriteRequest{
+				Labels:         labels,
+				Timestamp:      received,
+				MetricFamilies: metricFamilies,
+				Patch:          true,
+				Done:           done,
+			})
+			switch err := <-done; err {
+			case nil:
+				w.WriteHeader(http.StatusOK)
+			case storage.ErrSuperseded:
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				reject(rejectUnknownMetric, err.Error(), http.StatusBadRequest)
+			}
+		},
+	)
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		mtx.Lock()
+		ps = params
+		instrumentedHandlerFunc(w, withResponseController(r, w))
+	}
+}
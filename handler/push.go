@@ -14,12 +14,17 @@
 package handler
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"mime"
 	"net"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -27,22 +32,269 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/julienschmidt/httprouter"
 	"github.com/matttproud/golang_protobuf_extensions/pbutil"
-	"github.com/prometheus/client_golang/model"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/text"
+	"github.com/prometheus/log"
 
 	dto "github.com/prometheus/client_model/go"
 
+	"github.com/prometheus/pushgateway/groupingkey"
 	"github.com/prometheus/pushgateway/storage"
 )
 
+var pushTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "pushgateway_push_timeouts_total",
+	Help: "Total number of pushes aborted because their body could not be read and parsed in time.",
+})
+
+var pushParseDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "pushgateway_push_parse_duration_seconds",
+		Help:    "Time spent reading and parsing the bodies of pushes, by format ('text' or 'protobuf').",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	},
+	[]string{"format"},
+)
+
+// Reasons for rejected pushes, used as label values of pushesRejected.
+const (
+	rejectParseError    = "parse_error"
+	rejectInconsistent  = "inconsistent"
+	rejectTooLarge      = "too_large"
+	rejectUnauthorized  = "unauthorized"
+	rejectRateLimited   = "rate_limited"
+	rejectOverloaded    = "overloaded"
+	rejectLabelValue    = "invalid_label_value"
+	rejectUnknownMetric = "unknown_metric"
+	rejectDenied        = "denied"
+	rejectUnvalidated   = "validation_failed"
+	rejectFrozen        = "frozen"
+	rejectSampleValue   = "invalid_sample_value"
+	rejectBuckets       = "invalid_buckets"
+	rejectLoading       = "loading"
+	rejectStandby       = "standby"
+	rejectTimestampAge  = "timestamp_too_old"
+	rejectNoInstance    = "missing_instance"
+	rejectRetired       = "retired"
+	rejectContentType   = "unsupported_media_type"
+)
+
+var pushesRejected = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pushgateway_pushes_rejected_total",
+		Help: "Total number of rejected pushes by reason (dry runs excluded).",
+	},
+	[]string{"reason"},
+)
+
+func init() {
+	prometheus.MustRegister(pushTimeouts)
+	prometheus.MustRegister(pushParseDuration)
+	prometheus.MustRegister(pushesRejected)
+	for _, reason := range []string{
+		rejectParseError, rejectInconsistent, rejectTooLarge,
+		rejectUnauthorized, rejectRateLimited, rejectOverloaded,
+		rejectLabelValue, rejectUnknownMetric, rejectDenied,
+		rejectUnvalidated, rejectFrozen, rejectSampleValue,
+		rejectBuckets, rejectLoading, rejectStandby,
+		rejectTimestampAge, rejectNoInstance, rejectRetired,
+		rejectContentType,
+	} {
+		pushesRejected.WithLabelValues(reason)
+	}
+}
+
+// isPush returns whether r is a push, i.e. a PUT, POST, or PATCH request.
+func isPush(r *http.Request) bool {
+	return r.Method == "PUT" || r.Method == "POST" || r.Method == "PATCH"
+}
+
+// PushOptions contains options for the handlers returned by Push and
+// LegacyPush.
+type PushOptions struct {
+	// Tracker keeps track of asynchronous pushes. If nil, asynchronous
+	// pushes are rejected.
+	Tracker *PushTracker
+	// AutoFillLabel is the name of the label that is added with an empty
+	// value to all pushed metrics that have no such label, neither in the
+	// grouping key nor in the body. The Prometheus server will then not
+	// attach its own label of that name upon scraping. Typically, this is
+	// the 'instance' label. If empty, no label is added.
+	AutoFillLabel string
+	// AutoFillMode determines how the AutoFillLabel is filled in.
+	AutoFillMode AutoFillMode
+	// AutoFillStaticValue is the value of the AutoFillLabel in
+	// AutoFillStatic mode.
+	AutoFillStaticValue string
+	// LabelConflicts determines how pushed metrics with a grouping label
+	// whose value differs from the one in the grouping key are handled.
+	LabelConflicts LabelConflictMode
+	// LabelValues determines how label values (in the grouping key and in
+	// the body) are handled that are longer than MaxLabelValueBytes (if
+	// positive) or that contain control characters.
+	LabelValues        LabelValueMode
+	MaxLabelValueBytes int
+	// SampleValues determines how pushed samples with a NaN or infinite
+	// value are handled.
+	SampleValues SampleValueMode
+	// GroupStats, if not nil, records the pushes per group.
+	GroupStats *GroupStats
+	// If MaxMemoryBytes is positive, pushes are rejected with status code
+	// 507 as long as the MemoryUsage of the MetricStore exceeds it. (Pushes
+	// are always rejected with status code 503 while the write queue of
+	// the MetricStore is full.) Both responses come with a Retry-After
+	// header growing with the load (see LoadStatus).
+	MaxMemoryBytes int64
+	// If Timeout is positive, pushes whose body has not been completely
+	// read and parsed within that time are aborted with status code 408.
+	Timeout time.Duration
+	// TrustedProxies are the networks of reverse proxies whose
+	// X-Forwarded-For and X-Real-IP headers are honored when determining
+	// the IP address of the client. See clientIP.
+	TrustedProxies []*net.IPNet
+	// Deduplicator, if not nil, detects repeated pushes of the same
+	// payload to the same group.
+	Deduplicator *PushDeduplicator
+	// Quotas, if not nil, limits the metrics stored per job. Pushes
+	// exceeding the quota are rejected with status code 413 or 429.
+	Quotas *Quotas
+	// Validator, if not nil, is asked to accept each push (including dry
+	// runs and PATCH requests) after it has been parsed and labeled.
+	// Denied pushes are rejected with status code 422, pushes that could
+	// not be validated with status code 503.
+	Validator PushValidator
+	// If SchemaDiffs is true, each push (apart from dry runs) is compared
+	// to the group it is pushed to. Added and removed metric families as
+	// well as changed types and label names are logged and counted in
+	// pushgateway_schema_changes_total.
+	SchemaDiffs bool
+	// If MaxTimestampAge is positive, pushes containing a sample with an
+	// explicit timestamp older than MaxTimestampAge are rejected with
+	// status code 400.
+	MaxTimestampAge time.Duration
+	// If RequireInstance is true, pushes to a group without (or with an
+	// empty) instance label in its grouping key are rejected with status
+	// code 400. It always checks the label named "instance", so a label
+	// added by AutoFillMode only counts if AutoFillLabel is "instance".
+	RequireInstance bool
+	// RetiredJobs, if not nil, lists jobs whose pushes are rejected with
+	// status code 410.
+	RetiredJobs *RetiredJobs
+	// ContentTypes determines how the Content-Type header of pushes is
+	// interpreted.
+	ContentTypes ContentTypeMode
+	// Transforms are applied to the sample values of pushes (including
+	// dry runs and PATCH requests) after they have been checked.
+	Transforms []Transform
+}
+
+// validatePush asks the Validator in o, if any, to accept the push. If it is not
+// accepted, the reason and status code to reject it with are returned together
+// with the error.
+func validatePush(o *PushOptions, method string, labels map[string]string, metricFamilies map[string]*dto.MetricFamily) (string, int, error) {
+	if o.Validator == nil {
+		return "", 0, nil
+	}
+	err := o.Validator.ValidatePush(method, labels, metricFamilies)
+	if err == nil {
+		return "", 0, nil
+	}
+	if _, ok := err.(*PushDeniedError); ok {
+		return rejectDenied, 422, err // 422 Unprocessable Entity.
+	}
+	return rejectUnvalidated, http.StatusServiceUnavailable, err
+}
+
+// AutoFillMode determines how the AutoFillLabel is filled in.
+type AutoFillMode int
+
+// Possible values for AutoFillMode.
+const (
+	// AutoFillEmpty adds the AutoFillLabel with an empty value to all
+	// pushed metrics lacking it.
+	AutoFillEmpty AutoFillMode = iota
+	// AutoFillClientIP adds the AutoFillLabel to the grouping key if it is
+	// missing there, with the IP address of the client as value.
+	AutoFillClientIP
+	// AutoFillClientHostname works like AutoFillClientIP but uses the name
+	// the IP address of the client resolves to via reverse DNS lookup. If
+	// the lookup fails, the IP address is used.
+	AutoFillClientHostname
+	// AutoFillStatic adds the AutoFillLabel to the grouping key if it is
+	// missing there, with the AutoFillStaticValue as value.
+	AutoFillStatic
+	// AutoFillOmit does not add the AutoFillLabel at all, i.e. it has the
+	// same effect as an empty AutoFillLabel.
+	AutoFillOmit
+)
+
+// ParseAutoFillMode returns the AutoFillMode for the given name, which is one
+// of 'empty', 'client-ip', 'client-hostname', 'static', or 'omit'.
+func ParseAutoFillMode(name string) (AutoFillMode, error) {
+	switch name {
+	case "empty":
+		return AutoFillEmpty, nil
+	case "client-ip":
+		return AutoFillClientIP, nil
+	case "client-hostname":
+		return AutoFillClientHostname, nil
+	case "static":
+		return AutoFillStatic, nil
+	case "omit":
+		return AutoFillOmit, nil
+	}
+	return 0, fmt.Errorf("unknown auto-fill mode %q", name)
+}
+
+// metricAutoFillLabel returns the label to add with an empty value to pushed
+// metrics lacking it (see sanitizeLabels), which is the AutoFillLabel unless
+// in AutoFillOmit mode.
+func (o *PushOptions) metricAutoFillLabel() string {
+	if o.AutoFillMode == AutoFillOmit {
+		return ""
+	}
+	return o.AutoFillLabel
+}
+
+// LabelConflictMode determines how pushed metrics with a grouping label whose
+// value differs from the one in the grouping key are handled.
+type LabelConflictMode int
+
+// Possible values for LabelConflictMode.
+const (
+	// LabelConflictsOverwrite silently overwrites the value with the one
+	// from the grouping key, i.e. all stored metrics carry the grouping
+	// labels (suitable for honor_labels: true in the Prometheus scrape
+	// configuration).
+	LabelConflictsOverwrite LabelConflictMode = iota
+	// LabelConflictsReject rejects the push with status code 400.
+	LabelConflictsReject
+	// LabelConflictsKeep keeps the value pushed in the body. Grouping
+	// labels are only added to metrics lacking them.
+	LabelConflictsKeep
+)
+
+// ParseLabelConflictMode returns the LabelConflictMode for the given name,
+// which is one of 'overwrite', 'reject', or 'keep'.
+func ParseLabelConflictMode(name string) (LabelConflictMode, error) {
+	switch name {
+	case "overwrite":
+		return LabelConflictsOverwrite, nil
+	case "reject":
+		return LabelConflictsReject, nil
+	case "keep":
+		return LabelConflictsKeep, nil
+	}
+	return 0, fmt.Errorf("unknown handling of label conflicts %q", name)
+}
+
 // Push returns an http.Handler which accepts samples over HTTP and stores them
 // in the MetricStore. If replace is true, all metrics for the job and instance
 // given by the request are deleted before new ones are stored.
 //
 // The returned handler is already instrumented for Prometheus.
 func Push(
-	ms storage.MetricStore, replace bool,
+	ms storage.MetricStore, replace bool, o *PushOptions,
 ) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	var ps httprouter.Params
 	var mtx sync.Mutex // Protects ps.
@@ -64,55 +316,21 @@ func Push(
 				return
 			}
 			labels["job"] = job
-
-			if replace {
-				ms.SubmitWriteRequest(storage.WriteRequest{
-					Labels:    labels,
-					Timestamp: time.Now(),
-				})
-			}
-
-			var metricFamilies map[string]*dto.MetricFamily
-			ctMediatype, ctParams, ctErr := mime.ParseMediaType(r.Header.Get("Content-Type"))
-			if ctErr == nil && ctMediatype == "application/vnd.google.protobuf" &&
-				ctParams["encoding"] == "delimited" &&
-				ctParams["proto"] == "io.prometheus.client.MetricFamily" {
-				metricFamilies = map[string]*dto.MetricFamily{}
-				for {
-					mf := &dto.MetricFamily{}
-					if _, err = pbutil.ReadDelimited(r.Body, mf); err != nil {
-						if err == io.EOF {
-							err = nil
-						}
-						break
-					}
-					metricFamilies[mf.GetName()] = mf
-				}
-			} else {
-				// We could do further content-type checks here, but the
-				// fallback for now will anyway be the text format
-				// version 0.0.4, so just go for it and see if it works.
-				var parser text.Parser
-				metricFamilies, err = parser.TextToMetricFamilies(r.Body)
-			}
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			if err := enforceGroupingLabels(r, labels); err != nil {
+				pushesRejected.WithLabelValues(rejectUnauthorized).Inc()
+				http.Error(w, err.Error(), http.StatusForbidden)
 				return
 			}
-			sanitizeLabels(metricFamilies, labels)
-			ms.SubmitWriteRequest(storage.WriteRequest{
-				Labels:         labels,
-				Timestamp:      time.Now(),
-				MetricFamilies: metricFamilies,
-			})
-			w.WriteHeader(http.StatusAccepted)
+			autoFillGroupingLabel(r, labels, o)
+
+			push(w, r, ms, labels, replace, o)
 		},
 	)
 
 	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 		mtx.Lock()
 		ps = params
-		instrumentedHandlerFunc(w, r)
+		instrumentedHandlerFunc(w, withResponseController(r, w))
 	}
 }
 
@@ -124,7 +342,7 @@ func Push(
 //
 // The returned handler is already instrumented for Prometheus.
 func LegacyPush(
-	ms storage.MetricStore, replace bool,
+	ms storage.MetricStore, replace bool, o *PushOptions,
 ) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	var ps httprouter.Params
 	var mtx sync.Mutex // Protects ps.
@@ -136,80 +354,563 @@ func LegacyPush(
 			instance := ps.ByName("instance")
 			mtx.Unlock()
 
-			var err error
 			if job == "" {
 				http.Error(w, "job name is required", http.StatusBadRequest)
 				return
 			}
 			if instance == "" {
-				// Remote IP number (without port).
-				instance, _, err = net.SplitHostPort(r.RemoteAddr)
-				if err != nil || instance == "" {
-					instance = "localhost"
-				}
+				instance = clientIP(r, o.TrustedProxies)
 			}
 			labels := map[string]string{"job": job, "instance": instance}
-			if replace {
-				ms.SubmitWriteRequest(storage.WriteRequest{
-					Labels:    labels,
-					Timestamp: time.Now(),
-				})
-			}
-
-			var metricFamilies map[string]*dto.MetricFamily
-			ctMediatype, ctParams, ctErr := mime.ParseMediaType(r.Header.Get("Content-Type"))
-			if ctErr == nil && ctMediatype == "application/vnd.google.protobuf" &&
-				ctParams["encoding"] == "delimited" &&
-				ctParams["proto"] == "io.prometheus.client.MetricFamily" {
-				metricFamilies = map[string]*dto.MetricFamily{}
-				for {
-					mf := &dto.MetricFamily{}
-					if _, err = pbutil.ReadDelimited(r.Body, mf); err != nil {
-						if err == io.EOF {
-							err = nil
-						}
-						break
-					}
-					metricFamilies[mf.GetName()] = mf
-				}
-			} else {
-				// We could do further content-type checks here, but the
-				// fallback for now will anyway be the text format
-				// version 0.0.4, so just go for it and see if it works.
-				var parser text.Parser
-				metricFamilies, err = parser.TextToMetricFamilies(r.Body)
-			}
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			if err := enforceGroupingLabels(r, labels); err != nil {
+				pushesRejected.WithLabelValues(rejectUnauthorized).Inc()
+				http.Error(w, err.Error(), http.StatusForbidden)
 				return
 			}
-			sanitizeLabels(metricFamilies, labels)
-			ms.SubmitWriteRequest(storage.WriteRequest{
-				Labels:         labels,
-				Timestamp:      time.Now(),
-				MetricFamilies: metricFamilies,
-			})
-			w.WriteHeader(http.StatusAccepted)
+			push(w, r, ms, labels, replace, o)
 		},
 	)
 
 	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 		mtx.Lock()
 		ps = params
-		instrumentedHandlerFunc(w, r)
+		instrumentedHandlerFunc(w, withResponseController(r, w))
 	}
 }
 
+// push does the actual work of Push and LegacyPush once the grouping labels
+// have been extracted from the request. If the request has the dry_run query
+// parameter set to true, the pushed metrics are parsed and checked, but
+// nothing is submitted to the MetricStore. Instead, the result of the checks
+// is reported in the response. If the request has the async query parameter
+// set to true, the response contains an ID to query the state of the push
+// later. If the request has the lenient query parameter set to true, malformed
+// lines in the text format are skipped and reported in the response.
+func push(
+	w http.ResponseWriter, r *http.Request,
+	ms storage.MetricStore, labels map[string]string, replace bool,
+	o *PushOptions,
+) {
+	// The write request is stamped with the time the push was received,
+	// which decides over conflicting write requests for the group.
+	received := time.Now()
+	dryRun := queryParamIsTrue(r, "dry_run")
+	if o.GroupStats != nil && !dryRun {
+		rw := &recordingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() { o.GroupStats.observe(labels, rw.status) }()
+		w = rw
+	}
+	// reject responds with an error and counts the rejection.
+	reject := func(reason, msg string, status int) {
+		if !dryRun {
+			pushesRejected.WithLabelValues(reason).Inc()
+		}
+		http.Error(w, msg, status)
+	}
+	if err := o.RetiredJobs.check(labels["job"]); err != nil {
+		reject(rejectRetired, err.Error(), http.StatusGone)
+		return
+	}
+	if o.RequireInstance && labels["instance"] == "" {
+		reject(rejectNoInstance, "instance label is required in the grouping key", http.StatusBadRequest)
+		return
+	}
+	async := queryParamIsTrue(r, "async") && !dryRun
+	lenient := queryParamIsTrue(r, "lenient")
+	if async && o.Tracker == nil {
+		http.Error(w, "asynchronous pushes are not enabled", http.StatusBadRequest)
+		return
+	}
+	if o.MaxMemoryBytes > 0 && !dryRun && ms.MemoryUsage() > o.MaxMemoryBytes {
+		setRetryAfter(w, retryAfter(currentLoad(ms, o).Load))
+		reject(
+			rejectTooLarge, "memory limit of the metric store exceeded",
+			507, // Insufficient Storage.
+		)
+		return
+	}
+	if !dryRun && ms.WriteQueueUtilization() >= 1 {
+		setRetryAfter(w, retryAfter(currentLoad(ms, o).Load))
+		reject(rejectOverloaded, "write queue of the metric store is full", http.StatusServiceUnavailable)
+		return
+	}
+	if ok, err := checkPushPreconditions(r, ms, labels); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if !ok {
+		http.Error(w, "group has been pushed to more recently", http.StatusPreconditionFailed)
+		return
+	}
+	annotations, err := parseAnnotations(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := negotiateContentType(r, o.ContentTypes); err != nil {
+		reject(rejectContentType, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	var fingerprint hash.Hash
+	if o.Deduplicator != nil && !dryRun {
+		fingerprint = fingerprintBody(r)
+	}
+
+	metricFamilies, skipped, err := parseMetricFamiliesWithTimeout(w, r, o.Timeout, lenient)
+	if err == errPushTimeout {
+		log.Printf(
+			"Push from %s (%s) to group %v aborted after %v.",
+			clientIP(r, o.TrustedProxies), r.UserAgent(), labels, o.Timeout,
+		)
+		pushTimeouts.Inc()
+		// The read deadline has expired, so the connection cannot be
+		// reused.
+		w.Header().Set("Connection", "close")
+		http.Error(w, err.Error(), http.StatusRequestTimeout)
+		return
+	}
+	if err != nil {
+		reject(rejectParseError, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if o.LabelConflicts == LabelConflictsReject {
+		if err := checkLabelConflicts(metricFamilies, labels); err != nil {
+			reject(rejectInconsistent, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := checkLabelValues(metricFamilies, labels, o.MaxLabelValueBytes, o.LabelValues); err != nil {
+		reject(rejectLabelValue, err.Error(), http.StatusBadRequest)
+		return
+	}
+	invalid, err := checkSampleValues(metricFamilies, o.SampleValues)
+	if invalid > 0 && !dryRun {
+		invalidSampleValues.WithLabelValues(labels["job"]).Add(float64(invalid))
+	}
+	if err != nil {
+		reject(rejectSampleValue, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkBuckets(metricFamilies); err != nil {
+		reject(rejectBuckets, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkTimestampAge(metricFamilies, o.MaxTimestampAge, received); err != nil {
+		reject(rejectTimestampAge, err.Error(), http.StatusBadRequest)
+		return
+	}
+	transformValues(labels["job"], metricFamilies, o.Transforms)
+	sanitizeLabels(metricFamilies, labels, o.metricAutoFillLabel(), o.LabelConflicts != LabelConflictsKeep)
+	if o.Quotas != nil {
+		if status, err := checkQuota(ms, o.Quotas, labels, metricFamilies, replace); err != nil {
+			reject(rejectTooLarge, err.Error(), status)
+			return
+		}
+	}
+	if reason, status, err := validatePush(o, r.Method, labels, metricFamilies); err != nil {
+		reject(reason, err.Error(), status)
+		return
+	}
+	if dryRun {
+		writeDryRunResult(w, checkPush(ms, labels, metricFamilies, replace), metricFamilies)
+		writeSkippedLines(w, skipped)
+		return
+	}
+	if fingerprint != nil && o.Deduplicator.isDuplicate(labels, fingerprint) {
+		if o.GroupStats != nil {
+			o.GroupStats.observeDuplicate(labels)
+		}
+		if o.Deduplicator.skip && !async {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+	}
+	if o.SchemaDiffs {
+		reportSchemaChanges(ms, labels, metricFamilies, replace)
+	}
+	wr := storage.WriteRequest{
+		Labels:         labels,
+		Timestamp:      received,
+		MetricFamilies: metricFamilies,
+		Annotations:    annotations,
+		Replace:        replace,
+	}
+	var result *pushResult
+	if acceptsJSON(r) {
+		// Determined before submitting, as the write request is only
+		// queued.
+		result = newPushResult(r, ms, labels, metricFamilies, replace)
+	}
+	if !async {
+		ms.SubmitWriteRequest(wr)
+		if result != nil {
+			result.SkippedLines = skipped
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(result)
+			return
+		}
+		if len(skipped) > 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		w.WriteHeader(http.StatusAccepted)
+		writeSkippedLines(w, skipped)
+		return
+	}
+	done := make(chan error, 1)
+	wr.Done = done
+	id, err := o.Tracker.track(done)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ms.SubmitWriteRequest(wr)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/v1/push/"+id)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(struct {
+		ID           string        `json:"id"`
+		SkippedLines []skippedLine `json:"skippedLines,omitempty"`
+		*pushResult
+	}{id, skipped, result})
+}
+
+// pushResult is the JSON response to a successful push if the client accepts
+// JSON. MetricFamilies and Series count what the group contains after the push,
+// i.e. after a POST, they include the metric families of the group not
+// replaced by the push. Created is true if the group did not exist when the
+// push was submitted.
+type pushResult struct {
+	URL            string            `json:"url,omitempty"`
+	GroupingKey    map[string]string `json:"groupingKey"`
+	Hash           string            `json:"hash"`
+	Created        bool              `json:"created"`
+	MetricFamilies int               `json:"metricFamilies"`
+	Series         int               `json:"series"`
+	SkippedLines   []skippedLine     `json:"skippedLines,omitempty"`
+}
+
+// newPushResult returns the pushResult of a push of metricFamilies to the
+// group with the given grouping labels, replacing the group if replace is true
+// and merging into it otherwise. The URL of the group is derived from the host
+// of r. It is empty if the group cannot be addressed by a URL (see
+// groupingkey.Path).
+func newPushResult(
+	r *http.Request, ms storage.MetricStore,
+	labels map[string]string, metricFamilies map[string]*dto.MetricFamily,
+	replace bool,
+) *pushResult {
+	key := groupingkey.Hash(labels)
+	group, exists := ms.GetMetricGroup(key)
+	res := &pushResult{
+		GroupingKey:    labels,
+		Hash:           groupingkey.Format(key),
+		Created:        !exists,
+		MetricFamilies: len(metricFamilies),
+	}
+	for _, mf := range metricFamilies {
+		res.Series += len(mf.GetMetric())
+	}
+	if !replace {
+		for name, tmf := range group.Metrics {
+			if _, ok := metricFamilies[name]; !ok {
+				res.MetricFamilies++
+				res.Series += len(tmf.MetricFamily.GetMetric())
+			}
+		}
+	}
+	if p, err := groupingkey.Path(labels); err == nil {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		res.URL = scheme + "://" + r.Host + "/metrics" + p
+	}
+	return res
+}
+
+// acceptsJSON returns whether the Accept header of r explicitly includes
+// application/json.
+func acceptsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediatype, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediatype == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// enforceGroupingLabels adds the grouping labels determined from the identity
+// of the client (see WithGroupingLabels) to labels. It returns an error if
+// labels already contains one of them with a different value, in which case
+// the request has to be rejected with status code 403.
+func enforceGroupingLabels(r *http.Request, labels map[string]string) error {
+	for name, value := range GroupingLabels(r) {
+		if v, ok := labels[name]; ok && v != value {
+			return fmt.Errorf("grouping label %s=%q conflicts with the identity of the client (%s=%q)", name, v, name, value)
+		}
+		labels[name] = value
+	}
+	return nil
+}
+
+// autoFillGroupingLabel adds the AutoFillLabel to labels if it is missing there
+// and the AutoFillMode requires a static value or one derived from the client.
+func autoFillGroupingLabel(r *http.Request, labels map[string]string, o *PushOptions) {
+	if o.AutoFillLabel == "" || o.AutoFillMode == AutoFillEmpty || o.AutoFillMode == AutoFillOmit {
+		return
+	}
+	if _, ok := labels[o.AutoFillLabel]; ok {
+		return
+	}
+	if o.AutoFillMode == AutoFillStatic {
+		labels[o.AutoFillLabel] = o.AutoFillStaticValue
+		return
+	}
+	value := clientIP(r, o.TrustedProxies)
+	if o.AutoFillMode == AutoFillClientHostname {
+		if names, err := net.LookupAddr(value); err == nil && len(names) > 0 {
+			value = strings.TrimSuffix(names[0], ".")
+		}
+	}
+	labels[o.AutoFillLabel] = value
+}
+
+// checkPushPreconditions returns whether the group with the given grouping
+// labels fulfills the preconditions of the request r. The group must not have
+// been pushed to after the time in the If-Unmodified-Since header (which is
+// ignored if it cannot be parsed), and its last push must be at least as old as
+// the duration in the min_age query parameter. A group that doesn't exist
+// fulfills all preconditions. An error is returned if min_age cannot be
+// parsed. Note that the check is not atomic with the subsequent write, i.e. a
+// concurrent push may still happen in between.
+func checkPushPreconditions(r *http.Request, ms storage.MetricStore, labels map[string]string) (bool, error) {
+	ifUnmodifiedSince, err := http.ParseTime(r.Header.Get("If-Unmodified-Since"))
+	hasIfUnmodifiedSince := err == nil
+	var minAge time.Duration
+	if r.URL != nil {
+		if s := r.URL.Query().Get("min_age"); s != "" {
+			if minAge, err = time.ParseDuration(s); err != nil {
+				return false, fmt.Errorf("invalid min_age %q: %s", s, err)
+			}
+		}
+	}
+	if !hasIfUnmodifiedSince && minAge == 0 {
+		return true, nil
+	}
+	group, ok := ms.GetMetricGroup(groupingkey.Hash(labels))
+	if !ok {
+		return true, nil
+	}
+	lastPush := group.LastPushTime()
+	if hasIfUnmodifiedSince && lastPush.Truncate(time.Second).After(ifUnmodifiedSince) {
+		return false, nil
+	}
+	if minAge > 0 && time.Since(lastPush) < minAge {
+		return false, nil
+	}
+	return true, nil
+}
+
+// queryParamIsTrue returns true if the query parameter with the given name is
+// set to a true value.
+func queryParamIsTrue(r *http.Request, name string) bool {
+	if r.URL == nil {
+		return false
+	}
+	b, _ := strconv.ParseBool(r.URL.Query().Get(name))
+	return b
+}
+
+var errPushTimeout = errors.New("timeout while reading and parsing the pushed metrics")
+
+// parseMetricFamiliesWithTimeout works like parseMetricFamilies but returns
+// errPushTimeout if parsing takes longer than timeout. Once the timeout has
+// expired, reading the body of r fails: A read in progress is interrupted by a
+// read deadline on the connection (if supported, see responseController) and
+// by closing the body, and further reads return
+// errPushTimeout right away. Thus, the body is not used anymore once it has
+// returned. If timeout is not positive, it behaves exactly like
+// parseMetricFamilies.
+func parseMetricFamiliesWithTimeout(
+	w http.ResponseWriter, r *http.Request, timeout time.Duration, lenient bool,
+) (map[string]*dto.MetricFamily, []skippedLine, error) {
+	if timeout <= 0 {
+		return parseMetricFamilies(r, lenient)
+	}
+	body := &timeoutBody{ReadCloser: r.Body, expired: make(chan struct{})}
+	interrupted := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() {
+		defer close(interrupted)
+		close(body.expired)
+		responseController(r, w).SetReadDeadline(time.Now())
+		body.ReadCloser.Close()
+	})
+	timedReq := *r
+	timedReq.Body = body
+	mfs, skipped, err := parseMetricFamilies(&timedReq, lenient)
+	if !timer.Stop() {
+		<-interrupted
+		return nil, nil, errPushTimeout
+	}
+	return mfs, skipped, err
+}
+
+// timeoutBody is the body of a request parsed by
+// parseMetricFamiliesWithTimeout. Reads fail once expired is closed.
+type timeoutBody struct {
+	io.ReadCloser
+	expired chan struct{}
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	select {
+	case <-b.expired:
+		return 0, errPushTimeout
+	default:
+		return b.ReadCloser.Read(p)
+	}
+}
+
+// parseMetricFamilies reads the metric families from the body of the
+// request, either as delimited protobuf messages or in the text format,
+// depending on the Content-Type header. If lenient is true, malformed lines in
+// the text format are skipped and returned (see parseTextLeniently).
+func parseMetricFamilies(r *http.Request, lenient bool) (map[string]*dto.MetricFamily, []skippedLine, error) {
+	var (
+		metricFamilies map[string]*dto.MetricFamily
+		skipped        []skippedLine
+		err            error
+		format         = "text"
+	)
+	start := time.Now()
+	defer func() {
+		pushParseDuration.WithLabelValues(format).Observe(time.Since(start).Seconds())
+	}()
+	ctMediatype, ctParams, ctErr := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ctErr == nil && ctMediatype == "application/vnd.google.protobuf" &&
+		ctParams["encoding"] == "delimited" &&
+		ctParams["proto"] == "io.prometheus.client.MetricFamily" {
+		format = "protobuf"
+		metricFamilies = map[string]*dto.MetricFamily{}
+		for {
+			mf := &dto.MetricFamily{}
+			if _, err = pbutil.ReadDelimited(r.Body, mf); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				break
+			}
+			metricFamilies[mf.GetName()] = mf
+		}
+	} else {
+		// We could do further content-type checks here, but the
+		// fallback for now will anyway be the text format
+		// version 0.0.4, so just go for it and see if it works.
+		if lenient {
+			return parseTextLeniently(r.Body)
+		}
+		var parser text.Parser
+		metricFamilies, err = parser.TextToMetricFamilies(r.Body)
+	}
+	return metricFamilies, skipped, err
+}
+
+// maxSkippedLines is the maximum number of lines parseTextLeniently skips
+// before giving up.
+const maxSkippedLines = 100
+
+// skippedLine is a line skipped by parseTextLeniently.
+type skippedLine struct {
+	Line  int    `json:"line"`
+	Text  string `json:"text"`
+	Error string `json:"error"`
+}
+
+// parseTextLeniently parses the text format from r. Lines the parser reports an
+// error for are removed from the input, and the parsing is retried with the
+// remainder. The removed lines are returned with their line number in the
+// original input. If more than maxSkippedLines lines would have to be skipped,
+// or if an error cannot be attributed to a line, the parse error is returned.
+func parseTextLeniently(r io.Reader) (map[string]*dto.MetricFamily, []skippedLine, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	lineNumbers := make([]int, len(lines))
+	for i := range lineNumbers {
+		lineNumbers[i] = i + 1
+	}
+	var skipped []skippedLine
+	for {
+		var parser text.Parser
+		metricFamilies, err := parser.TextToMetricFamilies(strings.NewReader(strings.Join(lines, "")))
+		if err == nil {
+			return metricFamilies, skipped, nil
+		}
+		pe, ok := err.(text.ParseError)
+		if !ok || pe.Line < 1 || pe.Line > len(lines) || len(skipped) == maxSkippedLines {
+			return nil, skipped, err
+		}
+		i := pe.Line - 1
+		skipped = append(skipped, skippedLine{
+			Line:  lineNumbers[i],
+			Text:  strings.TrimSuffix(lines[i], "\n"),
+			Error: pe.Msg,
+		})
+		lines = append(lines[:i], lines[i+1:]...)
+		lineNumbers = append(lineNumbers[:i], lineNumbers[i+1:]...)
+	}
+}
+
+// writeSkippedLines writes a report of the skipped lines (if any) to w.
+func writeSkippedLines(w io.Writer, skipped []skippedLine) {
+	if len(skipped) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Skipped %d malformed lines:\n", len(skipped))
+	for _, l := range skipped {
+		fmt.Fprintf(w, "- line %d: %s: %q\n", l.Line, l.Error, l.Text)
+	}
+}
+
+// checkLabelConflicts returns an error if any metric in metricFamilies has a
+// label from groupingLabels with a value different from the one in
+// groupingLabels.
+func checkLabelConflicts(
+	metricFamilies map[string]*dto.MetricFamily,
+	groupingLabels map[string]string,
+) error {
+	for name, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				ln := lp.GetName()
+				if lv, ok := groupingLabels[ln]; ok && lv != lp.GetValue() {
+					return fmt.Errorf(
+						"metric %q has label %s=%q, conflicting with %s=%q from the grouping key",
+						name, ln, lp.GetValue(), ln, lv,
+					)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 // sanitizeLabels ensures that all the labels in groupingLabels and the
-// `instance` label are present in each MetricFamily in metricFamilies. The
-// label values from groupingLabels are set in each MetricFamily, no matter
-// what. After that, if the 'instance' label is not present at all in a
-// MetricFamily, it will be created (with an empty string as value).
+// autoFillLabel are present in each MetricFamily in metricFamilies. If
+// overwrite is true, the label values from groupingLabels are set in each
+// MetricFamily, no matter what. Otherwise, they are only set where the label
+// is missing. After that, if the autoFillLabel is not present at all in a MetricFamily, it
+// will be created (with an empty string as value). If autoFillLabel is the
+// empty string, no label is created that way.
 //
 // Finally, sanitizeLabels sorts the label pairs of all metrics.
 func sanitizeLabels(
 	metricFamilies map[string]*dto.MetricFamily,
 	groupingLabels map[string]string,
+	autoFillLabel string,
+	overwrite bool,
 ) {
 	gLabelsNotYetDone := make(map[string]string, len(groupingLabels))
 
@@ -219,17 +920,19 @@ func sanitizeLabels(
 			for ln, lv := range groupingLabels {
 				gLabelsNotYetDone[ln] = lv
 			}
-			hasInstanceLabel := false
+			hasAutoFillLabel := autoFillLabel == ""
 			for _, lp := range m.GetLabel() {
 				ln := lp.GetName()
 				if lv, ok := gLabelsNotYetDone[ln]; ok {
-					lp.Value = proto.String(lv)
+					if overwrite {
+						lp.Value = proto.String(lv)
+					}
 					delete(gLabelsNotYetDone, ln)
 				}
-				if ln == string(model.InstanceLabel) {
-					hasInstanceLabel = true
+				if ln == autoFillLabel {
+					hasAutoFillLabel = true
 				}
-				if len(gLabelsNotYetDone) == 0 && hasInstanceLabel {
+				if len(gLabelsNotYetDone) == 0 && hasAutoFillLabel {
 					sort.Sort(prometheus.LabelPairSorter(m.Label))
 					continue metric
 				}
@@ -239,14 +942,14 @@ func sanitizeLabels(
 					Name:  proto.String(ln),
 					Value: proto.String(lv),
 				})
-				if ln == string(model.InstanceLabel) {
-					hasInstanceLabel = true
+				if ln == autoFillLabel {
+					hasAutoFillLabel = true
 				}
 				delete(gLabelsNotYetDone, ln) // To prepare map for next metric.
 			}
-			if !hasInstanceLabel {
+			if !hasAutoFillLabel {
 				m.Label = append(m.Label, &dto.LabelPair{
-					Name:  proto.String(string(model.InstanceLabel)),
+					Name:  proto.String(autoFillLabel),
 					Value: proto.String(""),
 				})
 			}
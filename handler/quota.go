@@ -0,0 +1,200 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/julienschmidt/httprouter"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/groupingkey"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Quota limits the metrics stored for a job, i.e. for all groups with the same
+// value of the 'job' label. A limit of 0 means no limit.
+type Quota struct {
+	MaxGroups int   `json:"maxGroups"`
+	MaxSeries int   `json:"maxSeries"`
+	MaxBytes  int64 `json:"maxBytes"`
+}
+
+// QuotaUsage is what a job uses of its Quota. Bytes are estimated by the size
+// of the metrics in the protobuf encoding.
+type QuotaUsage struct {
+	Groups int   `json:"groups"`
+	Series int   `json:"series"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// Quotas contains the Quota for each job.
+type Quotas struct {
+	// Default applies to all jobs not listed in Jobs.
+	Default Quota
+	Jobs    map[string]Quota
+}
+
+// LoadQuotas returns Quotas with the given default Quota. If filename is not
+// empty, the quotas for individual jobs are read from that file, which
+// contains a JSON object mapping job names to Quota objects, e.g.
+// {"batch": {"maxGroups": 100, "maxSeries": 10000, "maxBytes": 1000000}}.
+// Limits missing in such an object mean no limit rather than the default. If
+// filename is empty and the default Quota has no limits, nil is returned,
+// which is a valid value for PushOptions.Quotas (disabling quotas).
+func LoadQuotas(filename string, def Quota) (*Quotas, error) {
+	if filename == "" && def == (Quota{}) {
+		return nil, nil
+	}
+	q := &Quotas{Default: def}
+	if filename == "" {
+		return q, nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&q.Jobs); err != nil {
+		return nil, fmt.Errorf("error reading quota file %s: %s", filename, err)
+	}
+	return q, nil
+}
+
+// forJob returns the Quota for the given job.
+func (q *Quotas) forJob(job string) Quota {
+	if jq, ok := q.Jobs[job]; ok {
+		return jq
+	}
+	return q.Default
+}
+
+// jobUsage returns the usage of the given job in the MetricStore.
+func jobUsage(ms storage.MetricStore, job string) QuotaUsage {
+	u := ms.GetJobUsage(job)
+	return QuotaUsage{Groups: u.Groups, Series: u.Series, Bytes: u.Bytes}
+}
+
+// checkQuota checks if storing metricFamilies under the grouping key given by
+// labels would exceed the Quota of the job. If the push alone exceeds the
+// quota, status code 413 is returned. If the push would make the job exceed
+// its quota, status code 429 is returned. In both cases, the returned error
+// describes the problem. The check is based on the current content of the
+// MetricStore, i.e. concurrent pushes for the same job might exceed the quota
+// together.
+func checkQuota(
+	ms storage.MetricStore,
+	quotas *Quotas,
+	labels map[string]string,
+	metricFamilies map[string]*dto.MetricFamily,
+	replace bool,
+) (int, error) {
+	job := labels["job"]
+	q := quotas.forJob(job)
+
+	var pushed QuotaUsage
+	for _, mf := range metricFamilies {
+		pushed.Series += len(mf.GetMetric())
+		pushed.Bytes += int64(proto.Size(mf))
+	}
+	if q.MaxSeries > 0 && pushed.Series > q.MaxSeries {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf(
+			"push contains %d series, but the quota of job %q is %d series",
+			pushed.Series, job, q.MaxSeries,
+		)
+	}
+	if q.MaxBytes > 0 && pushed.Bytes > q.MaxBytes {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf(
+			"push contains %d bytes, but the quota of job %q is %d bytes",
+			pushed.Bytes, job, q.MaxBytes,
+		)
+	}
+
+	u := jobUsage(ms, job)
+	group, groupExists := ms.GetMetricGroup(groupingkey.Hash(labels))
+	for name, tmf := range group.Metrics {
+		if replace || metricFamilies[name] != nil {
+			// Replaced by this push.
+			u.Series -= len(tmf.MetricFamily.GetMetric())
+			u.Bytes -= int64(proto.Size(tmf.MetricFamily))
+		}
+	}
+	if !groupExists {
+		u.Groups++
+	}
+	u.Series += pushed.Series
+	u.Bytes += pushed.Bytes
+	switch {
+	case q.MaxGroups > 0 && u.Groups > q.MaxGroups:
+		return 429, fmt.Errorf( // Too Many Requests.
+			"push would create group %d of job %q, exceeding its quota of %d groups",
+			u.Groups, job, q.MaxGroups,
+		)
+	case q.MaxSeries > 0 && u.Series > q.MaxSeries:
+		return 429, fmt.Errorf(
+			"push would increase the series of job %q to %d, exceeding its quota of %d series",
+			job, u.Series, q.MaxSeries,
+		)
+	case q.MaxBytes > 0 && u.Bytes > q.MaxBytes:
+		return 429, fmt.Errorf(
+			"push would increase the bytes of job %q to %d, exceeding its quota of %d bytes",
+			job, u.Bytes, q.MaxBytes,
+		)
+	}
+	return 0, nil
+}
+
+// QuotaStatus returns a handler that reports the Quota, the usage, and the
+// remaining quota of the job given as the 'job' parameter as a JSON object.
+// Remaining values of unlimited dimensions are null.
+func QuotaStatus(
+	ms storage.MetricStore, quotas *Quotas,
+) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, _ *http.Request, params httprouter.Params) {
+		job := params.ByName("job")
+		q := quotas.forJob(job)
+		u := jobUsage(ms, job)
+
+		type remaining struct {
+			Groups *int   `json:"groups"`
+			Series *int   `json:"series"`
+			Bytes  *int64 `json:"bytes"`
+		}
+		resp := struct {
+			Job       string     `json:"job"`
+			Quota     Quota      `json:"quota"`
+			Usage     QuotaUsage `json:"usage"`
+			Remaining remaining  `json:"remaining"`
+		}{Job: job, Quota: q, Usage: u}
+		if q.MaxGroups > 0 {
+			r := q.MaxGroups - u.Groups
+			resp.Remaining.Groups = &r
+		}
+		if q.MaxSeries > 0 {
+			r := q.MaxSeries - u.Series
+			resp.Remaining.Series = &r
+		}
+		if q.MaxBytes > 0 {
+			r := q.MaxBytes - u.Bytes
+			resp.Remaining.Bytes = &r
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
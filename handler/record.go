@@ -0,0 +1,133 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Headers added to recorded requests. They are removed again upon replay.
+const (
+	recordedAtHeader         = "X-Pushgateway-Recorded-At"
+	recordedRemoteAddrHeader = "X-Pushgateway-Recorded-Remote-Addr"
+)
+
+// Record returns a Middleware that writes each request that might change the
+// state of the Pushgateway, i.e. each request with a method other than GET and
+// HEAD, to w in the HTTP/1.1 wire format, including its body, so that it can
+// be replayed later (see Replay). The Authorization and Cookie headers are not
+// recorded. The time the request was received and the address of the client
+// are recorded in additional headers. Record has to come after any
+// authenticating middleware in the chain, or requests failing authentication
+// are recorded, too.
+func Record(w io.Writer) Middleware {
+	var mtx sync.Mutex // Serializes writes to w.
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" || r.Method == "HEAD" {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			received := time.Now()
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			rec := &http.Request{
+				Method:        r.Method,
+				URL:           r.URL,
+				Host:          r.Host,
+				Header:        make(http.Header, len(r.Header)+2),
+				ContentLength: int64(len(body)),
+			}
+			if len(body) > 0 {
+				rec.Body = ioutil.NopCloser(bytes.NewReader(body))
+			}
+			for name, values := range r.Header {
+				if name == "Authorization" || name == "Cookie" {
+					continue
+				}
+				rec.Header[name] = values
+			}
+			rec.Header.Set(recordedAtHeader, received.UTC().Format(time.RFC3339Nano))
+			rec.Header.Set(recordedRemoteAddrHeader, r.RemoteAddr)
+			mtx.Lock()
+			rec.Write(w)
+			mtx.Unlock()
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// Replay reads requests as written by Record from r and serves them one after
+// the other with h. It returns how many requests resulted in which status
+// code. An error is returned if r cannot be read or contains anything else than
+// recorded requests. In that case, the requests read so far have been replayed.
+func Replay(h http.Handler, r io.Reader) (map[int]int, error) {
+	statuses := map[int]int{}
+	br := bufio.NewReader(r)
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return statuses, nil
+		}
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return statuses, err
+		}
+		req.RemoteAddr = req.Header.Get(recordedRemoteAddrHeader)
+		req.Header.Del(recordedRemoteAddrHeader)
+		req.Header.Del(recordedAtHeader)
+
+		w := &replayResponseWriter{header: http.Header{}, status: http.StatusOK}
+		h.ServeHTTP(w, req)
+		// The handler might not have read the whole body, but the next
+		// request starts after it.
+		if _, err := io.Copy(ioutil.Discard, req.Body); err != nil {
+			return statuses, err
+		}
+		req.Body.Close()
+		statuses[w.status]++
+	}
+}
+
+// replayResponseWriter discards the response but records its status code.
+type replayResponseWriter struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+}
+
+func (w *replayResponseWriter) Header() http.Header { return w.header }
+
+func (w *replayResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+}
+
+func (w *replayResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return len(b), nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Restore returns a handler that restores a deleted group from its tombstone.
+// The labels parameter has to end with "/restore". The grouping labels are
+// determined from the remainder in the same way as for the handler returned
+// by Delete with the same PushOptions. If there is no tombstone for the group,
+// the response has status code 404.
+//
+// The returned handler is already instrumented for Prometheus.
+func Restore(ms storage.MetricStore, o *PushOptions) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	var ps httprouter.Params
+	var mtx sync.Mutex // Protects ps.
+
+	instrumentedHandlerFunc := prometheus.InstrumentHandlerFunc(
+		"restore",
+		func(w http.ResponseWriter, r *http.Request) {
+			job := ps.ByName("job")
+			labelsString := ps.ByName("labels")
+			mtx.Unlock()
+
+			if !strings.HasSuffix(labelsString, "/restore") {
+				http.NotFound(w, r)
+				return
+			}
+			labels, err := splitLabels(strings.TrimSuffix(labelsString, "/restore"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if job == "" {
+				http.Error(w, "job name is required", http.StatusBadRequest)
+				return
+			}
+			labels["job"] = job
+			if err := enforceGroupingLabels(r, labels); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			autoFillGroupingLabel(r, labels, o)
+			done := make(chan error, 1)
+			ms.SubmitWriteRequest(storage.WriteRequest{
+				Labels:    labels,
+				Timestamp: time.Now(),
+				Restore:   true,
+				Done:      done,
+			})
+			if err := <-done; err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		},
+	)
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		mtx.Lock()
+		ps = params
+		instrumentedHandlerFunc(w, r)
+	}
+}
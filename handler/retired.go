@@ -0,0 +1,97 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// RetiredJobs lists decommissioned job names whose pushes are rejected with
+// status code 410, so that stray pushes do not resurrect groups that have been
+// deleted on purpose. The jobs are read from a file with one job per line,
+// optionally followed by a message for the clients (e.g. pointing to the
+// replacement), as in "<job> [<message>]". Empty lines and lines starting with
+// '#' are ignored. It is safe for concurrent use.
+type RetiredJobs struct {
+	filename string
+
+	mtx  sync.RWMutex // Protects jobs.
+	jobs map[string]string
+}
+
+// NewRetiredJobs returns RetiredJobs with the jobs read from the given file.
+func NewRetiredJobs(filename string) (*RetiredJobs, error) {
+	rj := &RetiredJobs{filename: filename}
+	if err := rj.Reload(); err != nil {
+		return nil, err
+	}
+	return rj, nil
+}
+
+// Reload reads the jobs from the file again. If that fails, the previous jobs
+// stay in effect.
+func (rj *RetiredJobs) Reload() error {
+	file, err := os.Open(rj.filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	jobs := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if _, ok := jobs[fields[0]]; ok {
+			return fmt.Errorf("%s:%d: duplicate job %q", rj.filename, n, fields[0])
+		}
+		jobs[fields[0]] = ""
+		if len(fields) == 2 {
+			jobs[fields[0]] = strings.TrimSpace(fields[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	rj.mtx.Lock()
+	defer rj.mtx.Unlock()
+	rj.jobs = jobs
+	return nil
+}
+
+// check returns an error describing the retirement of the given job, or nil if
+// it is not retired. rj may be nil.
+func (rj *RetiredJobs) check(job string) error {
+	if rj == nil {
+		return nil
+	}
+	rj.mtx.RLock()
+	defer rj.mtx.RUnlock()
+	msg, ok := rj.jobs[job]
+	if !ok {
+		return nil
+	}
+	if msg == "" {
+		return fmt.Errorf("job %q has been retired", job)
+	}
+	return fmt.Errorf("job %q has been retired: %s", job, msg)
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var invalidSampleValues = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pushgateway_invalid_sample_values_total",
+		Help: "Total number of pushed samples with a NaN or infinite value that have been dropped or whose push has been rejected, by job (dry runs excluded).",
+	},
+	[]string{"job"},
+)
+
+func init() {
+	prometheus.MustRegister(invalidSampleValues)
+}
+
+// SampleValueMode determines how pushed samples whose value is NaN or ±Inf are
+// handled. Such values, typically from buggy scripts, often break recording
+// rules downstream.
+type SampleValueMode int
+
+// Possible values for SampleValueMode.
+const (
+	// SampleValuesKeep stores all samples as pushed.
+	SampleValuesKeep SampleValueMode = iota
+	// SampleValuesDrop removes the offending metrics from the push (and
+	// metric families left without metrics).
+	SampleValuesDrop
+	// SampleValuesReject rejects the push with status code 400.
+	SampleValuesReject
+)
+
+// ParseSampleValueMode returns the SampleValueMode for the given name, which
+// is one of 'keep', 'drop', or 'reject'.
+func ParseSampleValueMode(name string) (SampleValueMode, error) {
+	switch name {
+	case "keep":
+		return SampleValuesKeep, nil
+	case "drop":
+		return SampleValuesDrop, nil
+	case "reject":
+		return SampleValuesReject, nil
+	}
+	return 0, fmt.Errorf("unknown handling of sample values %q", name)
+}
+
+// checkSampleValues checks the values of counters, gauges, and untyped metrics
+// and the sums of summaries and histograms in metricFamilies for NaN and ±Inf.
+// (Quantiles are not checked, as NaN is the regular value of a quantile
+// without observations.) It returns the number of offending metrics. In
+// SampleValuesDrop mode, they are removed in place. In SampleValuesReject
+// mode, an error describing the first offending metric is returned, too.
+func checkSampleValues(metricFamilies map[string]*dto.MetricFamily, mode SampleValueMode) (int, error) {
+	if mode == SampleValuesKeep {
+		return 0, nil
+	}
+	invalid := 0
+	for name, mf := range metricFamilies {
+		kept := mf.Metric[:0]
+		for _, m := range mf.GetMetric() {
+			v, ok := sampleValue(m)
+			if !ok || !(math.IsNaN(v) || math.IsInf(v, 0)) {
+				kept = append(kept, m)
+				continue
+			}
+			invalid++
+			if mode == SampleValuesReject {
+				return invalid, fmt.Errorf("metric family %q: sample with labels %s has value %v", name, labelPairsString(m.GetLabel()), v)
+			}
+		}
+		mf.Metric = kept
+		if len(kept) == 0 {
+			delete(metricFamilies, name)
+		}
+	}
+	return invalid, nil
+}
+
+// sampleValue returns the value of m checked by checkSampleValues and true, or
+// false if m has no such value.
+func sampleValue(m *dto.Metric) (float64, bool) {
+	switch {
+	case m.Counter != nil:
+		return m.GetCounter().GetValue(), true
+	case m.Gauge != nil:
+		return m.GetGauge().GetValue(), true
+	case m.Untyped != nil:
+		return m.GetUntyped().GetValue(), true
+	case m.Summary != nil:
+		return m.GetSummary().GetSampleSum(), true
+	case m.Histogram != nil:
+		return m.GetHistogram().GetSampleSum(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,166 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/log"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/groupingkey"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Kinds of schema changes, as used for the change label of schemaChanges.
+const (
+	schemaMetricAdded   = "metric_added"
+	schemaMetricRemoved = "metric_removed"
+	schemaTypeChanged   = "type_changed"
+	schemaLabelsChanged = "labels_changed"
+)
+
+var schemaChanges = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pushgateway_schema_changes_total",
+		Help: "Total number of changes of the pushed metric families compared to the previous push to the same group, by job and kind of change.",
+	},
+	[]string{"job", "change"},
+)
+
+func init() {
+	prometheus.MustRegister(schemaChanges)
+}
+
+// schemaChange is a change of one metric family between two pushes to a group.
+type schemaChange struct {
+	kind, name string
+	// For schemaTypeChanged, the old and the new type. For
+	// schemaLabelsChanged, the label names added and removed.
+	from, to string
+	added    []string
+	removed  []string
+}
+
+func (c schemaChange) String() string {
+	switch c.kind {
+	case schemaTypeChanged:
+		return fmt.Sprintf("%s changed type from %s to %s", c.name, c.from, c.to)
+	case schemaLabelsChanged:
+		var parts []string
+		if len(c.added) > 0 {
+			parts = append(parts, "added labels "+strings.Join(c.added, ","))
+		}
+		if len(c.removed) > 0 {
+			parts = append(parts, "removed labels "+strings.Join(c.removed, ","))
+		}
+		return c.name + " " + strings.Join(parts, " and ")
+	case schemaMetricAdded:
+		return c.name + " added"
+	}
+	return c.name + " removed"
+}
+
+// diffSchema returns the changes of the metric family names, types, and label
+// names in metricFamilies compared to the metric families in group, sorted by
+// metric family name. Metric families missing in metricFamilies are only
+// reported as removed if replace is true, as they are kept in the group
+// otherwise.
+func diffSchema(group storage.MetricGroup, metricFamilies map[string]*dto.MetricFamily, replace bool) []schemaChange {
+	var changes []schemaChange
+	for name, mf := range metricFamilies {
+		tmf, ok := group.Metrics[name]
+		if !ok {
+			changes = append(changes, schemaChange{kind: schemaMetricAdded, name: name})
+			continue
+		}
+		old := tmf.MetricFamily
+		if old.GetType() != mf.GetType() {
+			changes = append(changes, schemaChange{
+				kind: schemaTypeChanged, name: name,
+				from: strings.ToLower(old.GetType().String()),
+				to:   strings.ToLower(mf.GetType().String()),
+			})
+			continue
+		}
+		added, removed := diffLabelNames(labelNames(old), labelNames(mf))
+		if len(added) > 0 || len(removed) > 0 {
+			changes = append(changes, schemaChange{
+				kind: schemaLabelsChanged, name: name,
+				added: added, removed: removed,
+			})
+		}
+	}
+	if replace {
+		for name := range group.Metrics {
+			if _, ok := metricFamilies[name]; !ok {
+				changes = append(changes, schemaChange{kind: schemaMetricRemoved, name: name})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].name < changes[j].name })
+	return changes
+}
+
+// labelNames returns the set of label names used by any metric in mf.
+func labelNames(mf *dto.MetricFamily) map[string]struct{} {
+	names := map[string]struct{}{}
+	for _, m := range mf.GetMetric() {
+		for _, lp := range m.GetLabel() {
+			names[lp.GetName()] = struct{}{}
+		}
+	}
+	return names
+}
+
+// diffLabelNames returns the sorted label names only in new and only in old.
+func diffLabelNames(old, new map[string]struct{}) (added, removed []string) {
+	for name := range new {
+		if _, ok := old[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// reportSchemaChanges logs and counts the changes of metricFamilies compared
+// to the group with the given grouping labels in ms. Nothing is reported for
+// the first push to a group.
+func reportSchemaChanges(ms storage.MetricStore, labels map[string]string, metricFamilies map[string]*dto.MetricFamily, replace bool) {
+	group, ok := ms.GetMetricGroup(groupingkey.Hash(labels))
+	if !ok {
+		return
+	}
+	changes := diffSchema(group, metricFamilies, replace)
+	if len(changes) == 0 {
+		return
+	}
+	descriptions := make([]string, len(changes))
+	for i, c := range changes {
+		schemaChanges.WithLabelValues(labels["job"], c.kind).Inc()
+		descriptions[i] = c.String()
+	}
+	log.Printf("Schema of group %v changed: %s.", labels, strings.Join(descriptions, "; "))
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	scrapesDesc = prometheus.NewDesc(
+		"pushgateway_scrapes_total",
+		"Total number of scrapes of the metrics of the Pushgateway.",
+		nil, nil,
+	)
+	lastScrapeDesc = prometheus.NewDesc(
+		"pushgateway_last_scrape_timestamp_seconds",
+		"Unix time of the last scrape of the metrics of the Pushgateway. 0 if there was none yet.",
+		nil, nil,
+	)
+)
+
+// ScrapeStatus is the scrape activity as reported by LoadStatus.
+type ScrapeStatus struct {
+	Total int `json:"total"`
+	// LastScrape is the start time of the last scrape and LastScraper the
+	// IP address of its client. Both are omitted if there was no scrape
+	// yet.
+	LastScrape  *time.Time `json:"lastScrape,omitempty"`
+	LastScraper string     `json:"lastScraper,omitempty"`
+}
+
+// ScrapeTracker keeps track of the scrapes of the metrics of the Pushgateway,
+// so that operators can verify that Prometheus is actually scraping it. It is
+// a prometheus.Collector exposing the number of scrapes and the time of the
+// last one. Use NewScrapeTracker to create one.
+type ScrapeTracker struct {
+	trustedProxies []*net.IPNet
+
+	mtx         sync.Mutex // Protects the fields below.
+	total       int
+	lastScrape  time.Time
+	lastScraper string
+}
+
+// NewScrapeTracker returns a ScrapeTracker that determines the IP address of
+// the scraping client honoring the given trusted proxies (see
+// PushOptions.TrustedProxies).
+func NewScrapeTracker(trustedProxies []*net.IPNet) *ScrapeTracker {
+	return &ScrapeTracker{trustedProxies: trustedProxies}
+}
+
+// Handler returns a handler that records each request as a scrape before
+// passing it on to h.
+func (t *ScrapeTracker) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.observe(clientIP(r, t.trustedProxies), time.Now())
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (t *ScrapeTracker) observe(scraper string, now time.Time) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.total++
+	t.lastScrape = now
+	t.lastScraper = scraper
+}
+
+// Status returns the current scrape activity.
+func (t *ScrapeTracker) Status() ScrapeStatus {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	s := ScrapeStatus{Total: t.total}
+	if t.total > 0 {
+		lastScrape := t.lastScrape
+		s.LastScrape = &lastScrape
+		s.LastScraper = t.lastScraper
+	}
+	return s
+}
+
+// Describe implements prometheus.Collector.
+func (t *ScrapeTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- scrapesDesc
+	ch <- lastScrapeDesc
+}
+
+// Collect implements prometheus.Collector. As the metrics are collected during
+// a scrape, that scrape itself is already counted.
+func (t *ScrapeTracker) Collect(ch chan<- prometheus.Metric) {
+	s := t.Status()
+	var lastScrape float64
+	if s.LastScrape != nil {
+		lastScrape = float64(s.LastScrape.UnixNano()) / 1e9
+	}
+	ch <- prometheus.MustNewConstMetric(scrapesDesc, prometheus.CounterValue, float64(s.Total))
+	ch <- prometheus.MustNewConstMetric(lastScrapeDesc, prometheus.GaugeValue, lastScrape)
+}
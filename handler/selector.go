@@ -0,0 +1,222 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/model"
+	"github.com/prometheus/log"
+
+	"github.com/prometheus/pushgateway/groupingkey"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// selectorProgressInterval is the number of groups after which a progress line
+// is written by the handler returned by Groups.
+const selectorProgressInterval = 1000
+
+// labelMatcher matches the value of the label Name of a grouping key. A missing
+// label matches like the empty value.
+type labelMatcher struct {
+	Name   string
+	Value  string
+	Negate bool
+	re     *regexp.Regexp // Nil for equality matchers.
+}
+
+func (m labelMatcher) matches(labels map[string]string) bool {
+	v := labels[m.Name]
+	if m.re != nil {
+		return m.re.MatchString(v) != m.Negate
+	}
+	return (v == m.Value) != m.Negate
+}
+
+// parseLabelMatcher parses a matcher of the form '<name>=<value>',
+// '<name>!=<value>', '<name>=~<regex>', or '<name>!~<regex>'. Regular
+// expressions are anchored at both ends.
+func parseLabelMatcher(s string) (labelMatcher, error) {
+	i := strings.IndexAny(s, "=!")
+	if i < 0 {
+		return labelMatcher{}, fmt.Errorf("invalid matcher %q, expected <name>=<value>, <name>!=<value>, <name>=~<regex>, or <name>!~<regex>", s)
+	}
+	m := labelMatcher{Name: s[:i]}
+	if !model.LabelNameRE.MatchString(m.Name) {
+		return labelMatcher{}, fmt.Errorf("invalid label name %q in matcher %q", m.Name, s)
+	}
+	op := s[i:]
+	switch {
+	case strings.HasPrefix(op, "=~"), strings.HasPrefix(op, "!~"):
+		m.Negate = op[0] == '!'
+		m.Value = op[2:]
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return labelMatcher{}, fmt.Errorf("invalid regular expression in matcher %q: %s", s, err)
+		}
+		m.re = re
+	case strings.HasPrefix(op, "!="):
+		m.Negate = true
+		m.Value = op[2:]
+	case strings.HasPrefix(op, "="):
+		m.Value = op[1:]
+	default:
+		return labelMatcher{}, fmt.Errorf("invalid operator in matcher %q", s)
+	}
+	return m, nil
+}
+
+// selectorGroup is the line written by the handler returned by Groups for
+// each matching group.
+type selectorGroup struct {
+	Labels         map[string]string `json:"labels"`
+	Path           string            `json:"path,omitempty"`
+	LastPush       time.Time         `json:"lastPush"`
+	MetricFamilies int               `json:"metricFamilies"`
+}
+
+// selectorProgress counts the groups looked at and matched so far out of all
+// groups.
+type selectorProgress struct {
+	Processed int `json:"processed"`
+	Matched   int `json:"matched"`
+	Total     int `json:"total"`
+}
+
+// selectorLine is a line of the response of the handler returned by Groups.
+// Exactly one of the fields is set.
+type selectorLine struct {
+	Group    *selectorGroup    `json:"group,omitempty"`
+	Progress *selectorProgress `json:"progress,omitempty"`
+	Done     *selectorProgress `json:"done,omitempty"`
+}
+
+// Groups returns a handler that lists (or, if del is true, deletes) all groups
+// whose grouping labels match all the label matchers given as 'match' query
+// parameters (see parseLabelMatcher). Without matchers, all groups are listed,
+// while deleting requires at least one matcher.
+//
+// As there may be many thousands of matching groups, the response is streamed
+// as JSON lines: one 'group' line per matching group, sorted by grouping key,
+// a 'progress' line after every 1000 groups looked at, and a final 'done'
+// line. Groups are looked at one by one, so that the store is never copied as
+// a whole, and groups deleted meanwhile are skipped. The operation is aborted
+// once the client disconnects, in which case the 'done' line is missing.
+// Groups deleted until then stay deleted, the others are left alone.
+//
+// Deletions are submitted with the time of the request, so that pushes
+// received later are not deleted. If the client is subject to grouping labels
+// (see GroupingLabeler), only groups carrying all of them are deleted. If it is
+// restricted to certain jobs (see JobAuthorized), groups of other jobs are
+// neither deleted nor listed in the response of the deletion.
+func Groups(ms storage.MetricStore, o *PushOptions, del bool) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		now := time.Now()
+		var matchers []labelMatcher
+		for _, s := range r.URL.Query()["match"] {
+			m, err := parseLabelMatcher(s)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			matchers = append(matchers, m)
+		}
+		if del && len(matchers) == 0 {
+			http.Error(w, "at least one 'match' parameter is required to delete groups", http.StatusBadRequest)
+			return
+		}
+		if del {
+			for name, value := range GroupingLabels(r) {
+				matchers = append(matchers, labelMatcher{Name: name, Value: value})
+			}
+		}
+
+		// Groups are fetched one by one rather than copying the whole
+		// store upfront.
+		keys := ms.GetGroupingKeys()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+		enc := json.NewEncoder(w)
+		progress := selectorProgress{Total: len(keys)}
+	groupLoop:
+		for _, key := range keys {
+			select {
+			case <-r.Context().Done():
+				break groupLoop
+			default:
+			}
+			progress.Processed++
+			group, ok := ms.GetMetricGroup(key)
+			if ok && matchesAll(matchers, group.Labels) && (!del || JobAuthorized(r, group.Labels["job"])) {
+				progress.Matched++
+				if del {
+					ms.SubmitWriteRequest(storage.WriteRequest{
+						Labels:    group.Labels,
+						Timestamp: now,
+					})
+					if o.GroupStats != nil {
+						o.GroupStats.forget(group.Labels)
+					}
+				}
+				path, _ := groupingkey.Path(group.Labels)
+				if path != "" {
+					path = "/metrics" + path
+				}
+				line := selectorLine{Group: &selectorGroup{
+					Labels:         group.Labels,
+					Path:           path,
+					LastPush:       group.LastPushTime(),
+					MetricFamilies: len(group.Metrics),
+				}}
+				if err := enc.Encode(line); err != nil {
+					break groupLoop
+				}
+			}
+			if progress.Processed%selectorProgressInterval == 0 {
+				p := progress
+				if err := enc.Encode(selectorLine{Progress: &p}); err != nil {
+					break groupLoop
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+		if progress.Processed < progress.Total {
+			log.Printf(
+				"Client disconnected from groups request after %d of %d groups, %d matched, aborting.",
+				progress.Processed, progress.Total, progress.Matched,
+			)
+			return
+		}
+		enc.Encode(selectorLine{Done: &progress})
+	}
+}
+
+// matchesAll returns whether labels match all of the matchers.
+func matchesAll(matchers []labelMatcher, labels map[string]string) bool {
+	for _, m := range matchers {
+		if !m.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
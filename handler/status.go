@@ -41,12 +41,14 @@ func (_ data) FormatTimestamp(ts int64) string {
 	return time.Unix(ts/1000, ts%1000*1000000).String()
 }
 
-// Status serves the status page.
+// Status serves the status page. The grouping labels of each group are listed
+// with the labels in firstClassLabels first, in that order.
 func Status(
 	ms storage.MetricStore,
 	assetFunc func(string) ([]byte, error),
 	flags map[string]string,
 	buildInfo map[string]string,
+	firstClassLabels []string,
 ) func(http.ResponseWriter, *http.Request) {
 	birth := time.Now()
 	return func(w http.ResponseWriter, _ *http.Request) {
@@ -55,6 +57,21 @@ func Status(
 			"value": func(f *float64) string {
 				return strconv.FormatFloat(*f, 'f', -1, 64)
 			},
+			"sortedLabels": func(mg storage.MetricGroup) []string {
+				return mg.SortedLabelsWith(firstClassLabels)
+			},
+			"labelClass": func(ln string) string {
+				for i, fcl := range firstClassLabels {
+					if ln != fcl {
+						continue
+					}
+					if i == 0 {
+						return "label-warning"
+					}
+					return "label-primary"
+				}
+				return "label-info"
+			},
 		})
 		tpl, err := assetFunc("template.html")
 		if err != nil {
@@ -0,0 +1,48 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// checkTimestampAge checks the explicit timestamps of the metrics in
+// metricFamilies. If maxAge is positive, an error describing the first metric
+// with a timestamp older than maxAge before now is returned. Prometheus would
+// silently drop such a sample as out of order (or too old for its head block)
+// once it has ingested a more recent one of the same series.
+func checkTimestampAge(metricFamilies map[string]*dto.MetricFamily, maxAge time.Duration, now time.Time) error {
+	if maxAge <= 0 {
+		return nil
+	}
+	oldest := now.Add(-maxAge)
+	for name, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			if m.TimestampMs == nil {
+				continue
+			}
+			ts := time.Unix(0, m.GetTimestampMs()*int64(time.Millisecond))
+			if ts.Before(oldest) {
+				return fmt.Errorf(
+					"metric family %q: series with labels %s: timestamp %s is older than the maximum age of %s",
+					name, labelPairsString(m.GetLabel()), ts.UTC().Format(time.RFC3339), maxAge,
+				)
+			}
+		}
+	}
+	return nil
+}
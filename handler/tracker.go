@@ -0,0 +1,128 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Possible states of an asynchronous push.
+const (
+	pushPending   = "pending"
+	pushCommitted = "committed"
+	pushRejected  = "rejected"
+)
+
+// PushTracker keeps track of the state of asynchronous pushes, i.e. pushes
+// with the query parameter async=true. Once an asynchronous push has been
+// processed by the MetricStore, its state is kept for the configured
+// retention time. It is safe for concurrent use.
+type PushTracker struct {
+	retention time.Duration
+
+	mtx       sync.Mutex // Protects the fields below.
+	pushes    map[string]*trackedPush
+	lastSweep time.Time
+}
+
+type trackedPush struct {
+	ID        string     `json:"id"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	Submitted time.Time  `json:"submitted"`
+	Completed *time.Time `json:"completed,omitempty"`
+}
+
+// NewPushTracker returns a PushTracker that keeps the state of processed
+// pushes for the given retention time.
+func NewPushTracker(retention time.Duration) *PushTracker {
+	return &PushTracker{
+		retention: retention,
+		pushes:    map[string]*trackedPush{},
+		lastSweep: time.Now(),
+	}
+}
+
+// track registers a new pending push and returns its ID. The push is marked as
+// committed or rejected once an outcome is received from done.
+func (pt *PushTracker) track(done <-chan error) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	now := time.Now()
+
+	pt.mtx.Lock()
+	if now.Sub(pt.lastSweep) > pt.retention {
+		for k, p := range pt.pushes {
+			if p.Completed != nil && now.Sub(*p.Completed) > pt.retention {
+				delete(pt.pushes, k)
+			}
+		}
+		pt.lastSweep = now
+	}
+	pt.pushes[id] = &trackedPush{ID: id, Status: pushPending, Submitted: now}
+	pt.mtx.Unlock()
+
+	go func() {
+		err := <-done
+		completed := time.Now()
+
+		pt.mtx.Lock()
+		defer pt.mtx.Unlock()
+		p := pt.pushes[id]
+		p.Completed = &completed
+		if err != nil {
+			p.Status = pushRejected
+			p.Error = err.Error()
+			return
+		}
+		p.Status = pushCommitted
+	}()
+	return id, nil
+}
+
+// get returns a copy of the tracked push with the given ID and true, or false
+// if no such push is known (anymore).
+func (pt *PushTracker) get(id string) (trackedPush, bool) {
+	pt.mtx.Lock()
+	defer pt.mtx.Unlock()
+	p, ok := pt.pushes[id]
+	if !ok {
+		return trackedPush{}, false
+	}
+	return *p, true
+}
+
+// PushStatus returns a handler that reports the state of the asynchronous push
+// with the ID given as the 'id' parameter as a JSON object.
+func PushStatus(pt *PushTracker) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, _ *http.Request, params httprouter.Params) {
+		p, ok := pt.get(params.ByName("id"))
+		if !ok {
+			http.Error(w, "unknown push ID", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Transform changes the sample values of pushed metrics, e.g. to convert
+// milliseconds to seconds for clients that cannot be changed. It applies to the
+// metric families whose name matches Metric pushed by jobs matching Job.
+type Transform struct {
+	// Metric is a regular expression matched against the whole metric
+	// name, e.g. ".*_milliseconds".
+	Metric string `json:"metric"`
+	// Job is a pattern as understood by path.Match, e.g. "legacy-*". The
+	// empty pattern matches all jobs.
+	Job string `json:"job"`
+	// If Factor is not nil, values are multiplied by it. It has to be
+	// positive. It applies to the values of counters, gauges, and untyped
+	// metrics, to the quantile values and sums of summaries, and to the
+	// sums and bucket upper bounds of histograms.
+	Factor *float64 `json:"factor"`
+	// If Min or Max are not nil, the values of counters, gauges, and
+	// untyped metrics are clamped to them (after applying Factor).
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+
+	re *regexp.Regexp
+}
+
+// matches returns whether the metric family of the given name pushed by the
+// given job is subject to t.
+func (t *Transform) matches(job, name string) bool {
+	if !t.re.MatchString(name) {
+		return false
+	}
+	if t.Job == "" {
+		return true
+	}
+	ok, _ := path.Match(t.Job, job)
+	return ok
+}
+
+// value returns v transformed by t, clamped if clamp is true.
+func (t *Transform) value(v float64, clamp bool) float64 {
+	if t.Factor != nil {
+		v *= *t.Factor
+	}
+	if clamp && t.Min != nil {
+		v = math.Max(v, *t.Min)
+	}
+	if clamp && t.Max != nil {
+		v = math.Min(v, *t.Max)
+	}
+	return v
+}
+
+// LoadTransforms returns the transforms read from the given file, which
+// contains a JSON array of Transform objects, e.g.
+// [{"metric": ".*_milliseconds", "job": "legacy-*", "factor": 0.001},
+// {"metric": "battery_percent", "min": 0, "max": 100}].
+// All transforms matching a metric family are applied in order.
+func LoadTransforms(filename string) ([]Transform, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var transforms []Transform
+	if err := json.NewDecoder(f).Decode(&transforms); err != nil {
+		return nil, fmt.Errorf("error reading transforms file %s: %s", filename, err)
+	}
+	for i := range transforms {
+		t := &transforms[i]
+		if t.re, err = regexp.Compile("^(?:" + t.Metric + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid metric pattern %q in transforms file %s: %s", t.Metric, filename, err)
+		}
+		if _, err := path.Match(t.Job, ""); err != nil {
+			return nil, fmt.Errorf("invalid job pattern %q in transforms file %s", t.Job, filename)
+		}
+		if t.Factor == nil && t.Min == nil && t.Max == nil {
+			return nil, fmt.Errorf("transform %d in transforms file %s has neither factor nor min nor max", i, filename)
+		}
+		if t.Factor != nil && !(*t.Factor > 0) {
+			return nil, fmt.Errorf("transform %d in transforms file %s has non-positive factor", i, filename)
+		}
+		if t.Min != nil && t.Max != nil && *t.Min > *t.Max {
+			return nil, fmt.Errorf("transform %d in transforms file %s has min greater than max", i, filename)
+		}
+	}
+	return transforms, nil
+}
+
+// transformValues applies the transforms to the metric families pushed by the
+// given job in place and returns the sorted names of the metric families
+// subject to any transform.
+func transformValues(job string, metricFamilies map[string]*dto.MetricFamily, transforms []Transform) []string {
+	if len(transforms) == 0 {
+		return nil
+	}
+	var transformed []string
+	for name, mf := range metricFamilies {
+		applied := false
+		for i := range transforms {
+			t := &transforms[i]
+			if !t.matches(job, name) {
+				continue
+			}
+			applied = true
+			for _, m := range mf.GetMetric() {
+				transformMetric(m, t)
+			}
+		}
+		if applied {
+			transformed = append(transformed, name)
+		}
+	}
+	sort.Strings(transformed)
+	return transformed
+}
+
+// transformMetric applies t to the values of m.
+func transformMetric(m *dto.Metric, t *Transform) {
+	switch {
+	case m.Counter != nil:
+		m.Counter.Value = proto.Float64(t.value(m.Counter.GetValue(), true))
+	case m.Gauge != nil:
+		m.Gauge.Value = proto.Float64(t.value(m.Gauge.GetValue(), true))
+	case m.Untyped != nil:
+		m.Untyped.Value = proto.Float64(t.value(m.Untyped.GetValue(), true))
+	case m.Summary != nil:
+		m.Summary.SampleSum = proto.Float64(t.value(m.Summary.GetSampleSum(), false))
+		for _, q := range m.Summary.Quantile {
+			q.Value = proto.Float64(t.value(q.GetValue(), false))
+		}
+	case m.Histogram != nil:
+		m.Histogram.SampleSum = proto.Float64(t.value(m.Histogram.GetSampleSum(), false))
+		for _, b := range m.Histogram.Bucket {
+			b.UpperBound = proto.Float64(t.value(b.GetUpperBound(), false))
+		}
+	}
+}
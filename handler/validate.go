@@ -0,0 +1,140 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/client_golang/model"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/groupingkey"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// checkPush checks if storing metricFamilies under the grouping key given by
+// labels would result in an inconsistent state of the MetricStore, i.e. in
+// metric families of the same name with different help strings or types, or
+// in duplicate series. The metrics in metricFamilies must already be
+// sanitized. If replace is true, the whole group is considered to be replaced
+// by the push. The returned strings describe the detected problems. They are
+// sorted. If there are no problems, nil is returned.
+func checkPush(
+	ms storage.MetricStore,
+	labels map[string]string,
+	metricFamilies map[string]*dto.MetricFamily,
+	replace bool,
+) []string {
+	var problems []string
+
+	seriesSeen := map[uint64]struct{}{}
+	for name, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			sig := metricSignature(name, m)
+			if _, ok := seriesSeen[sig]; ok {
+				problems = append(problems, fmt.Sprintf(
+					"metric family %q contains duplicate series %s",
+					name, labelPairsString(m.GetLabel()),
+				))
+			}
+			seriesSeen[sig] = struct{}{}
+		}
+	}
+
+	key := groupingkey.Hash(labels)
+	for k, group := range ms.GetMetricFamiliesMap() {
+		for name, tmf := range group.Metrics {
+			if k == key && (replace || metricFamilies[name] != nil) {
+				// Will be replaced by this push.
+				continue
+			}
+			mf, ok := metricFamilies[name]
+			if !ok {
+				continue
+			}
+			existingMF := tmf.MetricFamily
+			if mf.GetType() != existingMF.GetType() {
+				problems = append(problems, fmt.Sprintf(
+					"metric family %q has type %s, but type %s in group %v",
+					name, mf.GetType(), existingMF.GetType(), group.Labels,
+				))
+			}
+			if mf.GetHelp() != existingMF.GetHelp() {
+				problems = append(problems, fmt.Sprintf(
+					"metric family %q has help %q, but help %q in group %v",
+					name, mf.GetHelp(), existingMF.GetHelp(), group.Labels,
+				))
+			}
+			for _, m := range existingMF.GetMetric() {
+				if _, ok := seriesSeen[metricSignature(name, m)]; ok {
+					problems = append(problems, fmt.Sprintf(
+						"metric family %q has series %s, which also exists in group %v",
+						name, labelPairsString(m.GetLabel()), group.Labels,
+					))
+				}
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// writeDryRunResult writes the response to a dry-run push. If problems is
+// empty, the response has status 200 and summarizes what would have been
+// stored. Otherwise, the response has status 400 and lists the problems.
+func writeDryRunResult(
+	w http.ResponseWriter,
+	problems []string,
+	metricFamilies map[string]*dto.MetricFamily,
+) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "Push would lead to an inconsistent state:")
+		for _, p := range problems {
+			fmt.Fprintln(w, "-", p)
+		}
+		return
+	}
+	metrics := 0
+	for _, mf := range metricFamilies {
+		metrics += len(mf.GetMetric())
+	}
+	fmt.Fprintf(
+		w, "Push would be accepted: %d metric families with %d metrics.\n",
+		len(metricFamilies), metrics,
+	)
+}
+
+// metricSignature returns a signature for the series identified by the metric
+// name and the labels of m.
+func metricSignature(name string, m *dto.Metric) uint64 {
+	labels := make(map[string]string, len(m.GetLabel())+1)
+	for _, lp := range m.GetLabel() {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	labels[string(model.MetricNameLabel)] = name
+	return model.LabelsToSignature(labels)
+}
+
+func labelPairsString(lps []*dto.LabelPair) string {
+	labels := make(map[string]string, len(lps))
+	for _, lp := range lps {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	return fmt.Sprint(labels)
+}
@@ -0,0 +1,200 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/log"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var webhookErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "pushgateway_validation_webhook_errors_total",
+	Help: "Total number of failed calls of the validation webhook, including those failing open.",
+})
+
+func init() {
+	prometheus.MustRegister(webhookErrors)
+}
+
+// A PushValidator decides whether a push is accepted, after it has been parsed
+// and labeled, but before it is submitted to the MetricStore. Implement it to
+// plug a custom policy into the push handlers (see PushOptions.Validator).
+type PushValidator interface {
+	// ValidatePush returns nil if the push with the given method of the
+	// given metric families to the group with the given grouping labels
+	// is accepted. If it is denied, a *PushDeniedError is returned. Any
+	// other error means the validation itself has failed.
+	ValidatePush(method string, groupingLabels map[string]string, metricFamilies map[string]*dto.MetricFamily) error
+}
+
+// PushDeniedError is returned by a PushValidator denying a push.
+type PushDeniedError struct {
+	Message string
+}
+
+func (e *PushDeniedError) Error() string {
+	if e.Message == "" {
+		return "push denied by validation"
+	}
+	return "push denied by validation: " + e.Message
+}
+
+// WebhookValidator is a PushValidator that delegates the decision to an
+// external HTTP service. For each push, a JSON object like the following is
+// POSTed to URL:
+//
+//	{
+//	  "method": "PUT",
+//	  "groupingKey": {"job": "some_job", "instance": "some_instance"},
+//	  "metricFamilies": [{
+//	    "name": "some_metric",
+//	    "help": "Some help.",
+//	    "type": "GAUGE",
+//	    "metrics": [{"labels": {"job": "some_job", "instance": "some_instance"}, "value": "3.14"}]
+//	  }]
+//	}
+//
+// The value is only set for counters, gauges, and untyped metrics. The service
+// has to respond with status code 200 and a JSON object like
+// {"allowed": false, "message": "metric names must start with 'team_'"}. Any
+// other response is a failure of the validation. In that case, the push is
+// accepted if FailOpen is true.
+type WebhookValidator struct {
+	URL      string
+	FailOpen bool
+	// Client is used to call the webhook. If nil, http.DefaultClient is
+	// used.
+	Client *http.Client
+}
+
+type webhookRequest struct {
+	Method         string                `json:"method"`
+	GroupingKey    map[string]string     `json:"groupingKey"`
+	MetricFamilies []webhookMetricFamily `json:"metricFamilies"`
+}
+
+type webhookMetricFamily struct {
+	Name    string          `json:"name"`
+	Help    string          `json:"help,omitempty"`
+	Type    string          `json:"type"`
+	Metrics []webhookMetric `json:"metrics"`
+}
+
+type webhookMetric struct {
+	Labels      map[string]string `json:"labels"`
+	Value       string            `json:"value,omitempty"`
+	TimestampMs int64             `json:"timestampMs,omitempty"`
+}
+
+type webhookResponse struct {
+	Allowed bool   `json:"allowed"`
+	Message string `json:"message"`
+}
+
+// ValidatePush implements PushValidator.
+func (v *WebhookValidator) ValidatePush(method string, groupingLabels map[string]string, metricFamilies map[string]*dto.MetricFamily) error {
+	err := v.call(method, groupingLabels, metricFamilies)
+	if _, denied := err.(*PushDeniedError); err == nil || denied {
+		return err
+	}
+	webhookErrors.Inc()
+	if v.FailOpen {
+		log.Printf("Validation webhook failed, accepting push to group %v: %s", groupingLabels, err)
+		return nil
+	}
+	return err
+}
+
+func (v *WebhookValidator) call(method string, groupingLabels map[string]string, metricFamilies map[string]*dto.MetricFamily) error {
+	body, err := json.Marshal(newWebhookRequest(method, groupingLabels, metricFamilies))
+	if err != nil {
+		return err
+	}
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(v.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("calling validation webhook: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return fmt.Errorf("validation webhook responded with status code %d", resp.StatusCode)
+	}
+	var decision webhookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return fmt.Errorf("decoding response of validation webhook: %s", err)
+	}
+	if !decision.Allowed {
+		return &PushDeniedError{Message: decision.Message}
+	}
+	return nil
+}
+
+func newWebhookRequest(method string, groupingLabels map[string]string, metricFamilies map[string]*dto.MetricFamily) webhookRequest {
+	names := make([]string, 0, len(metricFamilies))
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	req := webhookRequest{
+		Method:         method,
+		GroupingKey:    groupingLabels,
+		MetricFamilies: make([]webhookMetricFamily, 0, len(names)),
+	}
+	for _, name := range names {
+		mf := metricFamilies[name]
+		wmf := webhookMetricFamily{
+			Name:    name,
+			Help:    mf.GetHelp(),
+			Type:    mf.GetType().String(),
+			Metrics: make([]webhookMetric, 0, len(mf.GetMetric())),
+		}
+		for _, m := range mf.GetMetric() {
+			wm := webhookMetric{
+				Labels:      make(map[string]string, len(m.GetLabel())),
+				TimestampMs: m.GetTimestampMs(),
+			}
+			for _, lp := range m.GetLabel() {
+				wm.Labels[lp.GetName()] = lp.GetValue()
+			}
+			// Values are strings as JSON cannot represent NaN and
+			// infinities.
+			switch {
+			case m.Counter != nil:
+				wm.Value = formatOpenMetricsFloat(m.GetCounter().GetValue())
+			case m.Gauge != nil:
+				wm.Value = formatOpenMetricsFloat(m.GetGauge().GetValue())
+			case m.Untyped != nil:
+				wm.Value = formatOpenMetricsFloat(m.GetUntyped().GetValue())
+			}
+			wmf.Metrics = append(wmf.Metrics, wm)
+		}
+		req.MetricFamilies = append(req.MetricFamilies, wmf)
+	}
+	return req
+}
@@ -0,0 +1,145 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lease implements a leader lease in a file on storage shared by
+// several Pushgateways (e.g. an NFS volume that also holds their shared
+// persistence file), so that only one of them accepts pushes at a time while
+// the others stand by to take over.
+package lease
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Record is the content of a lease file.
+type Record struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// FileLease is a lease stored in the file at Path, held by at most one holder
+// at a time for TTL after each acquisition or renewal. Holders are identified
+// by their Holder ID, which must be unique among all instances sharing the
+// file. As expiry is judged by the local clocks of the instances, their
+// clocks must be reasonably synchronized (i.e. skewed by much less than TTL).
+type FileLease struct {
+	Path   string
+	Holder string
+	TTL    time.Duration
+}
+
+// TryAcquire acquires or renews the lease at the given time if it is not held
+// by another holder, or if the lease of the other holder has expired. It
+// returns the resulting lease record, i.e. the current one if the lease is
+// held by another holder. Concurrent attempts are serialized by a lock file
+// next to the lease file, created exclusively. A lock file older than TTL is
+// considered left over by a crashed instance and removed.
+func (l *FileLease) TryAcquire(now time.Time) (Record, error) {
+	unlock, err := l.lock(now)
+	if err != nil {
+		return Record{}, err
+	}
+	defer unlock()
+
+	current, err := l.read()
+	if err != nil {
+		return Record{}, err
+	}
+	if current.Holder != "" && current.Holder != l.Holder && now.Before(current.Expires) {
+		return current, nil
+	}
+	rec := Record{Holder: l.Holder, Expires: now.Add(l.TTL)}
+	if err := l.write(rec); err != nil {
+		return Record{}, err
+	}
+	return rec, nil
+}
+
+// Release gives up the lease if it is held by l.Holder, so that another holder
+// can acquire it right away.
+func (l *FileLease) Release() error {
+	unlock, err := l.lock(time.Now())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := l.read()
+	if err != nil {
+		return err
+	}
+	if current.Holder != l.Holder {
+		return nil
+	}
+	return os.Remove(l.Path)
+}
+
+func (l *FileLease) lock(now time.Time) (unlock func(), err error) {
+	lockPath := l.Path + ".lock"
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if os.IsExist(err) {
+		if fi, statErr := os.Stat(lockPath); statErr == nil && now.Sub(fi.ModTime()) > l.TTL {
+			os.Remove(lockPath)
+			f, err = os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error locking lease file %s: %s", l.Path, err)
+	}
+	f.Close()
+	return func() { os.Remove(lockPath) }, nil
+}
+
+// read returns the current lease record. A missing lease file results in an
+// empty record.
+func (l *FileLease) read() (Record, error) {
+	var rec Record
+	b, err := ioutil.ReadFile(l.Path)
+	if os.IsNotExist(err) {
+		return rec, nil
+	}
+	if err != nil {
+		return rec, err
+	}
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return rec, fmt.Errorf("error parsing lease file %s: %s", l.Path, err)
+	}
+	return rec, nil
+}
+
+// write writes rec to the lease file atomically.
+func (l *FileLease) write(rec Record) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(l.Path), filepath.Base(l.Path)+".in_progress.")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), l.Path)
+}
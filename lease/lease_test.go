@@ -0,0 +1,80 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLease(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "lease.TestFileLease.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "lease")
+	a := &FileLease{Path: path, Holder: "a", TTL: 10 * time.Second}
+	b := &FileLease{Path: path, Holder: "b", TTL: 10 * time.Second}
+	t0 := time.Now()
+
+	for i, s := range []struct {
+		lease  *FileLease
+		now    time.Time
+		holder string
+	}{
+		{a, t0, "a"},                      // Free.
+		{b, t0.Add(time.Second), "a"},     // Held by a.
+		{a, t0.Add(5 * time.Second), "a"}, // Renewed by a.
+		{b, t0.Add(14 * time.Second), "a"},
+		{b, t0.Add(16 * time.Second), "b"}, // Expired.
+		{a, t0.Add(17 * time.Second), "b"},
+	} {
+		rec, err := s.lease.TryAcquire(s.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Holder != s.holder {
+			t.Errorf("%d: Wanted holder %q, got %q.", i, s.holder, rec.Holder)
+		}
+	}
+
+	// Releasing by a non-holder is a no-op.
+	if err := a.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := a.TryAcquire(t0.Add(18 * time.Second)); rec.Holder != "b" {
+		t.Errorf("Wanted holder b, got %q.", rec.Holder)
+	}
+	if err := b.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := a.TryAcquire(t0.Add(19 * time.Second)); rec.Holder != "a" {
+		t.Errorf("Wanted holder a after release, got %q.", rec.Holder)
+	}
+
+	// A stale lock file is removed, a fresh one blocks.
+	if err := ioutil.WriteFile(path+".lock", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.TryAcquire(time.Now()); err == nil {
+		t.Error("Expected error while locked.")
+	}
+	if _, err := a.TryAcquire(time.Now().Add(time.Minute)); err != nil {
+		t.Errorf("Stale lock file not removed: %s", err)
+	}
+}
@@ -14,32 +14,129 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"net"
 	"net/http"
-	"net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/elazarl/go-bindata-assetfs"
-	"github.com/julienschmidt/httprouter"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/log"
+	"golang.org/x/net/context"
 
+	"github.com/prometheus/pushgateway/discovery"
+	"github.com/prometheus/pushgateway/gateway"
 	"github.com/prometheus/pushgateway/handler"
+	"github.com/prometheus/pushgateway/secret"
 	"github.com/prometheus/pushgateway/storage"
 )
 
 var (
-	listenAddress       = flag.String("web.listen-address", ":9091", "Address to listen on for the web interface, API, and telemetry.")
-	metricsPath         = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-	persistenceFile     = flag.String("persistence.file", "", "File to persist metrics. If empty, metrics are only kept in memory.")
-	persistenceInterval = flag.Duration("persistence.interval", 5*time.Minute, "The minimum interval at which to write out the persistence file.")
+	listenAddress          = flag.String("web.listen-address", ":9091", "Address to listen on for the web interface, API, and telemetry.")
+	telemetryAddress       = flag.String("web.telemetry-address", "", "If set, address to listen on (via plain HTTP, without authentication) for the metrics, pprof, and /-/ready endpoints, which are then not served on -web.listen-address anymore.")
+	ipStack                = flag.String("web.ip-stack", "dual", "IP versions to listen on: 'dual' uses a single socket as provided by the operating system (usually accepting IPv4 and IPv6 for an address without host like ':9091' or '[::]:9091'), 'separate' binds separate IPv4 and IPv6 sockets on the port of -web.listen-address (which must not specify a host), 'ipv4' and 'ipv6' listen on that IP version only.")
+	tlsCertFile            = flag.String("web.tls-cert-file", "", "Path to a PEM-encoded certificate (or other secret source, see -secrets.refresh-interval) to serve HTTPS (including HTTP/2) with. Requires -web.tls-key-file.")
+	tlsKeyFile             = flag.String("web.tls-key-file", "", "Path to the PEM-encoded private key (or other secret source, see -secrets.refresh-interval) for -web.tls-cert-file.")
+	acmeHosts              = flag.String("web.acme-host", "", "Comma-separated list of host names to obtain TLS certificates for automatically via ACME (e.g. from Let's Encrypt) to serve HTTPS with. Mutually exclusive with -web.tls-cert-file. By using this, you agree to the terms of service of the certificate authority.")
+	acmeHTTPAddress        = flag.String("web.acme-http-address", "", "Address to serve ACME http-01 challenges on (typically ':80'). Other requests to it are redirected to HTTPS. If empty, only the tls-alpn-01 challenge on -web.listen-address is used.")
+	acmeCacheDir           = flag.String("web.acme-cache-dir", "acme-cache", "Directory to cache certificates and the account key obtained via ACME in.")
+	acmeEmail              = flag.String("web.acme-email", "", "Contact email address for the ACME account.")
+	acmeDirectoryURL       = flag.String("web.acme-directory-url", "", "Directory URL of the ACME certificate authority. Defaults to Let's Encrypt.")
+	tlsClientCAFile        = flag.String("web.tls-client-ca-file", "", "Path to a PEM file with CA certificates to verify TLS client certificates against (see -web.auth.client-cert). Requires -web.tls-cert-file or -web.acme-host.")
+	basicUsersFile         = flag.String("web.auth.basic-users-file", "", "Path to a file (or other secret source, see -secrets.refresh-interval) with one '<user>:<password>' pair per line. If set, clients may authenticate by HTTP basic authentication.")
+	tokensFile             = flag.String("web.auth.tokens-file", "", "Path to a file (or other secret source, see -secrets.refresh-interval) with one '<identity>:<token>' pair per line. If set, clients may authenticate by a bearer token.")
+	hmacSecretsFile        = flag.String("web.auth.hmac-secrets-file", "", "Path to a file (or other secret source, see -secrets.refresh-interval) with one '<job>:<secret>' pair per line. If set, clients may authenticate requests for a listed job by an HMAC-SHA256 of the request body keyed with the secret of the job in the X-Signature header.")
+	secretsRefresh         = flag.Duration("secrets.refresh-interval", time.Minute, "Interval at which secrets (TLS certificate and key, credentials, canary token) are checked for changes. Secrets are given as a file path, 'file:<path>', 'env:<variable>', or 'exec:<command> [<args>...]' (reading the standard output of the command). Files are re-read if changed, commands are run again. 0 reads secrets only once.")
+	clientCertAuth         = flag.Bool("web.auth.client-cert", false, "Authenticate clients by their verified TLS client certificate, using its common name as identity. Requires -web.tls-client-ca-file.")
+	jwksURL                = flag.String("web.auth.jwks-url", "", "URL of a JSON Web Key Set. If set, clients may authenticate by a JSON Web Token (e.g. issued by an OpenID Connect provider) signed with one of its keys, using its 'sub' claim as identity.")
+	jwtIssuer              = flag.String("web.auth.jwt-issuer", "", "If set, the 'iss' claim of JSON Web Tokens must be equal to it.")
+	jwtAudience            = flag.String("web.auth.jwt-audience", "", "If set, the 'aud' claim of JSON Web Tokens must contain it.")
+	jwtJobsClaim           = flag.String("web.auth.jwt-jobs-claim", "", "Name of a claim of JSON Web Tokens listing the jobs the client may push to or delete from ('*' for all). If empty, all jobs are allowed.")
+	kubernetesAuth         = flag.Bool("web.auth.kubernetes", false, "Authenticate clients by a Kubernetes service account token, verified via TokenReview by the API server of the cluster the Pushgateway runs in. The namespace and pod of the token are enforced as grouping labels (see -web.auth.kubernetes-namespace-label and -web.auth.kubernetes-pod-label).")
+	kubernetesAudience     = flag.String("web.auth.kubernetes-audience", "", "If set, Kubernetes service account tokens must be issued for this audience.")
+	kubernetesNSLabel      = flag.String("web.auth.kubernetes-namespace-label", "namespace", "Grouping label set to the namespace of the Kubernetes service account of the client. If empty, no such label is set.")
+	kubernetesPodLabel     = flag.String("web.auth.kubernetes-pod-label", "pod", "Grouping label set to the pod the Kubernetes service account token of the client is bound to. If empty, no such label is set, and tokens not bound to a pod are accepted.")
+	adminIdentities        = flag.String("web.auth.admin-identities", "", "Comma-separated list of identities (user names, token names, JWT subjects, ...) allowed to use the admin API (freezing, compaction) if authentication is configured. If empty, the admin API can only be read.")
+	anonymousReads         = flag.Bool("web.auth.anonymous-reads", true, "Allow GET and HEAD requests without authentication (e.g. scrapes by Prometheus) if authentication is configured.")
+	rateLimit              = flag.Float64("web.rate-limit", 0, "Maximum average number of requests per second per client (identified by authenticated identity or IP address). Requests exceeding it are rejected with status code 429. 0 means no limit.")
+	rateLimitBurst         = flag.Int("web.rate-limit-burst", 10, "Maximum number of requests per client in a burst exceeding -web.rate-limit.")
+	auditLogFile           = flag.String("web.audit-log-file", "", "Path to a file to append a line to for every request other than GET and HEAD, with the client, its identity, and the outcome. If empty, no audit log is written.")
+	recordFile             = flag.String("web.record-file", "", "Path to a file to append every request other than GET and HEAD to, including its body, for replaying with -replay.file. Authorization headers are not recorded. If empty, no requests are recorded.")
+	replayFile             = flag.String("replay.file", "", "Path to a file with requests recorded by -web.record-file to replay into the metric store upon start-up, e.g. for disaster recovery or for reproducing problems.")
+	keepAliveTimeout       = flag.Duration("web.keep-alive-timeout", 5*time.Minute, "How long an idle HTTP connection is kept open for further requests. Long-lived connections save frequent pushers from opening a new connection (and using up an ephemeral port) for every push. 0 means no timeout.")
+	maxIdleConnections     = flag.Int("web.max-idle-connections", 0, "Maximum number of idle HTTP connections kept open. Connections becoming idle beyond that are closed. 0 means no limit.")
+	maxHeaderBytes         = flag.Int("web.max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size of the headers of an HTTP request in bytes.")
+	enableH2C              = flag.Bool("web.enable-h2c", false, "Accept HTTP/2 without TLS (h2c) on a plaintext listener, in addition to HTTP/1.x.")
+	groupedScrapes         = flag.Bool("web.enable-grouped-scrapes", false, "Expose each group under its own path, listed by /api/v1/targets for the HTTP-based service discovery of Prometheus, so that groups can be scraped as individual targets.")
+	metricsPath            = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+	persistenceFile        = flag.String("persistence.file", "", "File to persist metrics. If empty, metrics are only kept in memory.")
+	persistenceInterval    = flag.Duration("persistence.interval", 5*time.Minute, "The minimum interval at which to write out the persistence file.")
+	persistenceShards      = flag.Int("persistence.shards", 1, "Number of files to shard the persistence file into by grouping key. Shards are written and loaded upon start-up concurrently, which speeds up both for many groups. The persisted state is read no matter how many shards it was written with.")
+	persistenceMaxDeltas   = flag.Int("persistence.max-deltas", 0, "If positive, persisting only writes the groups changed since the previous persisting to a delta file, and the persistence file is only rewritten completely once that many delta files exist (or upon compaction). Existing delta files are applied upon start-up. 0 always rewrites the persistence file completely.")
+	persistenceCompression = flag.String("persistence.compression", "none", "Compression of the persistence file: 'none', 'gzip', or 'zstd'. Existing persistence files are read regardless of their compression.")
+	persistenceLoading     = flag.String("persistence.loading-mode", "block", "How to handle pushes and deletions while the persistence file is loaded upon start-up: 'block' loads it before serving any requests, 'queue' serves requests right away but holds back pushes and deletions until loading is done, 'reject' rejects them with status code 503 and a Retry-After header until then. /-/ready reports not ready while loading.")
+	idempotencyWindow      = flag.Duration("web.idempotency-window", 0, "How long to remember the response to a request with an Idempotency-Key header. Retries with the same key (by the same client) within that window get the original response without being applied again. 0 disables de-duplication.")
+	idempotencyMaxEntries  = flag.Int("web.idempotency-max-entries", 10000, "Maximum number of responses remembered for -web.idempotency-window. If exceeded, the responses expiring first are forgotten.")
+	asyncPushRetention     = flag.Duration("web.async-push-retention", 10*time.Minute, "How long to keep the state of processed asynchronous pushes for querying.")
+	pushTimeout            = flag.Duration("web.push-timeout", 0, "Abort pushes whose body has not been completely read and parsed within this time with status code 408. 0 means no timeout.")
+	ipFilterFile           = flag.String("web.ip-filter-file", "", "Path to a file with 'allow <network>' and 'deny <network>' lines restricting by IP address or CIDR network which clients may send requests other than GET and HEAD (i.e. push or delete). Reloaded upon SIGHUP. If empty, all clients are allowed.")
+	trustedProxies         = flag.String("web.trusted-proxies", "", "Comma-separated list of IP addresses and CIDR networks of reverse proxies whose X-Forwarded-For and X-Real-IP headers are honored when determining the IP address of a client. Otherwise, the address of the direct peer is used.")
+	dedupWindow            = flag.Duration("push.dedup-window", 0, "Detect pushes repeating the exact payload of a push to the same group within this window, and count them in pushgateway_group_duplicate_pushes_total. 0 disables the detection.")
+	skipDuplicates         = flag.Bool("push.skip-duplicates", false, "Do not apply pushes detected as duplicates (see -push.dedup-window) but answer them with status code 202 right away.")
+	maxTimestampAge        = flag.Duration("push.max-timestamp-age", 0, "Reject pushes containing samples with an explicit timestamp older than this with status code 400, as Prometheus would silently drop them as out of order. 0 accepts all timestamps.")
+	disableDelete          = flag.Bool("web.disable-delete", false, "Do not serve the DELETE method at all, i.e. groups can only be replaced, not deleted, via the API.")
+	disablePostMerge       = flag.Bool("push.disable-post-merge", false, "Let POST requests replace the group like PUT requests instead of merging into it.")
+	contentTypes           = flag.String("push.content-types", "lenient", "How to interpret the Content-Type of pushes: 'lenient' parses everything but delimited protobuf in the text format (for compatibility with sloppy clients), 'strict' rejects types other than text/plain (version 0.0.4, the default without Content-Type) and delimited protobuf, as well as charsets other than UTF-8, US-ASCII, and ISO-8859-1, with status code 415.")
+	retiredJobsFile        = flag.String("push.retired-jobs-file", "", "Path to a file listing decommissioned jobs, one '<job> [<message>]' per line. Pushes to them are rejected with status code 410 and the message (e.g. pointing to the replacement). Reloaded upon SIGHUP.")
+	requireInstance        = flag.Bool("push.require-instance", false, "Reject pushes to groups without an instance label in their grouping key with status code 400. A label added by -push.auto-fill-value only counts if -push.auto-fill-label is 'instance'.")
+	schemaDiffs            = flag.Bool("push.schema-diffs", false, "Compare each push to the previous state of its group, and log and count (in pushgateway_schema_changes_total) added and removed metrics as well as changed types and label names.")
+	quotaMaxGroups         = flag.Int("push.quota-max-groups", 0, "Default maximum number of groups per job. Pushes creating more groups are rejected with status code 429. 0 means no limit.")
+	quotaMaxSeries         = flag.Int("push.quota-max-series", 0, "Default maximum number of series per job. Pushes exceeding it are rejected with status code 429 (or 413 if the push alone exceeds it). 0 means no limit.")
+	quotaMaxBytes          = flag.Int64("push.quota-max-bytes", 0, "Default maximum number of bytes of metrics per job. Pushes exceeding it are rejected with status code 429 (or 413 if the push alone exceeds it). 0 means no limit.")
+	transformsFile         = flag.String("push.transforms-file", "", "Path to a JSON file with rules transforming the sample values of pushed metrics, e.g. to convert units (see README.md).")
+	quotaFile              = flag.String("push.quota-file", "", "Path to a JSON file with quotas for individual jobs, overriding the -push.quota-* defaults (see README.md).")
+	firstClassLabels       = flag.String("push.first-class-labels", "job,instance", "Comma-separated list of the most important grouping labels. They are listed first, in the given order, on the status page.")
+	autoFillLabel          = flag.String("push.auto-fill-label", "instance", "Name of the label that is added with an empty value to pushed metrics lacking it, to prevent Prometheus from attaching its own label of that name. If empty, no label is added.")
+	autoFillValue          = flag.String("push.auto-fill-value", "empty", "How to fill in the label configured by -push.auto-fill-label: 'empty' adds it with an empty value to pushed metrics lacking it, 'client-ip' or 'client-hostname' add it to grouping keys lacking it, with the IP address or the reverse DNS name of the client as value, 'static' adds it to grouping keys lacking it with the value of -push.auto-fill-static-value, 'omit' does not add it at all.")
+	autoFillStaticValue    = flag.String("push.auto-fill-static-value", "", "Value of the label configured by -push.auto-fill-label for -push.auto-fill-value=static.")
+	labelConflicts         = flag.String("push.label-conflicts", "overwrite", "How to handle pushed metrics with grouping labels whose values conflict with the grouping key: 'overwrite' silently sets the value from the grouping key (for honor_labels: true), 'reject' rejects the push with status code 400, 'keep' keeps the value pushed in the body and only adds missing grouping labels (for series-level job and instance labels to win).")
+	labelValues            = flag.String("push.label-values", "keep", "How to handle pushed label values that contain control characters (like newlines) or exceed -push.max-label-value-bytes: 'keep' stores them as pushed, 'sanitize' replaces control characters by spaces and truncates values, 'reject' rejects the push with status code 400.")
+	maxLabelValueBytes     = flag.Int("push.max-label-value-bytes", 0, "Maximum length of label values in bytes, enforced as set by -push.label-values. 0 means no limit.")
+	webhookURL             = flag.String("push.validation-webhook-url", "", "URL of a webhook to POST every parsed push to as JSON for validation (see README.md). Pushes it denies are rejected with status code 422. If empty, pushes are not validated.")
+	webhookTimeout         = flag.Duration("push.validation-webhook-timeout", 5*time.Second, "Timeout for calls of the validation webhook.")
+	webhookFailOpen        = flag.Bool("push.validation-webhook-fail-open", false, "Accept pushes if the validation webhook cannot be called or responds with an error. Otherwise, such pushes are rejected with status code 503.")
+	sampleValues           = flag.String("push.sample-values", "keep", "How to handle pushed samples whose value is NaN or +/-Inf: 'keep' stores them as pushed, 'drop' removes them from the push, 'reject' rejects the push with status code 400. Both 'drop' and 'reject' count the samples by job in pushgateway_invalid_sample_values_total.")
+	gcInterval             = flag.Duration("storage.gc-interval", 10*time.Minute, "The interval at which empty groups are removed from the metric store. 0 disables the garbage collection.")
+	compactionInterval     = flag.Duration("storage.compaction-interval", 0, "The interval at which the metric store is compacted and the persistence file is rewritten. 0 disables scheduled compaction. Compaction can always be triggered via the API.")
+	tombstoneRetention     = flag.Duration("storage.tombstone-retention", 0, "How long deleted groups are kept for restoring via the API before they are removed for good. 0 removes them immediately.")
+	retention              = flag.Duration("storage.retention", 0, "Delete groups whose last push is longer ago than this. 0 means groups are kept until deleted via the API.")
+	retentionFile          = flag.String("storage.retention-file", "", "Path to a JSON file with retention rules deleting groups of matching jobs after a maximum age or on a cron-style schedule (see README.md).")
+	historyDir             = flag.String("history.dir", "", "Directory to record the last pushes of each group in, queryable via /api/v1/history. If empty, no history is recorded.")
+	historyLength          = flag.Int("history.length", 100, "Number of recorded pushes kept per group (see -history.dir).")
+	historyInterval        = flag.Duration("history.interval", 0, "Keep only the last push per group within this interval in the history (see -history.dir). 0 records every push.")
+	maxMemoryBytes         = flag.Int64("storage.max-memory-bytes", 0, "Reject pushes with status code 507 while the estimated memory used by the stored metrics exceeds this many bytes. 0 means no limit.")
+	canaryInterval         = flag.Duration("canary.interval", 0, "Interval at which the Pushgateway pushes a heartbeat to itself via HTTP to monitor its push path end to end (see pushgateway_canary_* metrics). 0 disables the canary.")
+	canaryJob              = flag.String("canary.job", "pushgateway_canary", "Job label of the group the canary pushes to.")
+	canaryTokenFile        = flag.String("canary.token-file", "", "Path to a file (or other secret source, see -secrets.refresh-interval) with a bearer token for the pushes of the canary, needed if authentication is configured.")
+	leaseFile              = flag.String("ha.lease-file", "", "Path of a leader lease file on storage shared with other Pushgateways (together with -persistence.file). Only the instance holding the lease accepts pushes and deletions, the others stand by and take over once the lease expires. If empty, no lease is used.")
+	leaseTTL               = flag.Duration("ha.lease-ttl", 15*time.Second, "Time after which the leader lease expires unless renewed. It is renewed every third of this time.")
+	instanceID             = flag.String("ha.instance-id", "", "ID identifying this Pushgateway as holder of the leader lease, unique among all instances sharing it. Defaults to the advertised address (see -discovery.advertise-address).")
+	advertiseAddress       = flag.String("discovery.advertise-address", "", "Address (host:port) under which this Pushgateway is registered with service discovery. Defaults to the host name and the port of -web.listen-address. If -web.telemetry-address is set, its port is registered instead.")
+	consulAddress          = flag.String("discovery.consul.address", "", "Address (host:port) of the local Consul agent to register this Pushgateway with. If empty, no registration with Consul happens.")
+	consulService          = flag.String("discovery.consul.service", "pushgateway", "Name of the Consul service to register.")
+	consulTags             = flag.String("discovery.consul.tags", "", "Comma-separated list of tags for the registered Consul service.")
+	fileSDPath             = flag.String("discovery.file-sd.path", "", "Path of a file to write for file-based service discovery of Prometheus. The file is removed upon shutdown. If empty, no file is written.")
+	stampPushTime          = flag.Bool("metrics.stamp-push-time", false, "Expose pushed samples without an explicit timestamp with the time of their push as timestamp. Only use this if you understand the staleness implications (see README.md).")
+	unsortedMetrics        = flag.Bool("metrics.unsorted", false, "Do not sort the exposed metric families by name and their series by label set. Saves CPU time upon pushes, but the order of the exposition then varies between scrapes.")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:]))
+	}
 	flag.Parse()
 	versionInfoTmpl.Execute(os.Stdout, BuildInfo)
 	flags := map[string]string{}
@@ -47,77 +144,392 @@ func main() {
 		flags[f.Name] = f.Value.String()
 	})
 
-	ms := storage.NewDiskMetricStore(*persistenceFile, *persistenceInterval)
-	prometheus.SetMetricFamilyInjectionHook(ms.GetMetricFamilies)
-	// Enable collect checks for debugging.
-	// prometheus.EnableCollectChecks(true)
-
-	r := httprouter.New()
-	r.Handler("GET", *metricsPath, prometheus.Handler())
-
-	// Handlers for pushing and deleting metrics.
-	r.PUT("/metrics/job/:job/*labels", handler.Push(ms, true))
-	r.POST("/metrics/job/:job/*labels", handler.Push(ms, false))
-	r.DELETE("/metrics/job/:job/*labels", handler.Delete(ms))
-	r.PUT("/metrics/job/:job", handler.Push(ms, true))
-	r.POST("/metrics/job/:job", handler.Push(ms, false))
-	r.DELETE("/metrics/job/:job", handler.Delete(ms))
-
-	// Handlers for the deprecated API.
-	r.PUT("/metrics/jobs/:job/instances/:instance", handler.LegacyPush(ms, true))
-	r.POST("/metrics/jobs/:job/instances/:instance", handler.LegacyPush(ms, false))
-	r.DELETE("/metrics/jobs/:job/instances/:instance", handler.LegacyDelete(ms))
-	r.PUT("/metrics/jobs/:job", handler.LegacyPush(ms, true))
-	r.POST("/metrics/jobs/:job", handler.LegacyPush(ms, false))
-	r.DELETE("/metrics/jobs/:job", handler.LegacyDelete(ms))
-
-	r.Handler("GET", "/static/*filepath", prometheus.InstrumentHandler(
-		"static",
-		http.FileServer(
-			&assetfs.AssetFS{Asset: Asset, AssetDir: AssetDir},
-		),
-	))
-	statusHandler := prometheus.InstrumentHandlerFunc("status", handler.Status(ms, Asset, flags, BuildInfo))
-	r.Handler("GET", "/status", statusHandler)
-	r.Handler("GET", "/", statusHandler)
-
-	// Re-enable pprof.
-	r.GET("/debug/pprof/*pprof", handlePprof)
-
-	log.Printf("Listening on %s.", *listenAddress)
-	l, err := net.Listen("tcp", *listenAddress)
+	compression, err := storage.ParseCompression(*persistenceCompression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	loadingMode, err := handler.ParseLoadingMode(*persistenceLoading)
+	if err != nil {
+		log.Fatal(err)
+	}
+	autoFillMode, err := handler.ParseAutoFillMode(*autoFillValue)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if autoFillMode == handler.AutoFillStatic && *autoFillStaticValue == "" {
+		log.Fatal("-push.auto-fill-value=static requires -push.auto-fill-static-value")
+	}
+	groupStatsLabel := *autoFillLabel
+	if autoFillMode == handler.AutoFillOmit {
+		groupStatsLabel = ""
+	}
+	labelConflictMode, err := handler.ParseLabelConflictMode(*labelConflicts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sampleValueMode, err := handler.ParseSampleValueMode(*sampleValues)
+	if err != nil {
+		log.Fatal(err)
+	}
+	labelValueMode, err := handler.ParseLabelValueMode(*labelValues)
+	if err != nil {
+		log.Fatal(err)
+	}
+	contentTypeMode, err := handler.ParseContentTypeMode(*contentTypes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stack, err := gateway.ParseIPStack(*ipStack)
+	if err != nil {
+		log.Fatal(err)
+	}
+	proxies, err := handler.ParseTrustedProxies(*trustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	quotas, err := handler.LoadQuotas(*quotaFile, handler.Quota{
+		MaxGroups: *quotaMaxGroups,
+		MaxSeries: *quotaMaxSeries,
+		MaxBytes:  *quotaMaxBytes,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	var transforms []handler.Transform
+	if *transformsFile != "" {
+		if transforms, err = handler.LoadTransforms(*transformsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	retentionRules, err := storage.LoadRetentionRules(*retentionFile, *retention)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var validator handler.PushValidator
+	if *webhookURL != "" {
+		validator = &handler.WebhookValidator{
+			URL:      *webhookURL,
+			FailOpen: *webhookFailOpen,
+			Client:   &http.Client{Timeout: *webhookTimeout},
+		}
+	}
+	var (
+		ipFilter    *handler.IPFilter
+		retiredJobs *handler.RetiredJobs
+		reloaders   []reloader
+	)
+	if *ipFilterFile != "" {
+		if ipFilter, err = handler.NewIPFilter(*ipFilterFile, proxies); err != nil {
+			log.Fatal(err)
+		}
+		reloaders = append(reloaders, reloader{*ipFilterFile, ipFilter.Reload})
+	}
+	if *retiredJobsFile != "" {
+		if retiredJobs, err = handler.NewRetiredJobs(*retiredJobsFile); err != nil {
+			log.Fatal(err)
+		}
+		reloaders = append(reloaders, reloader{*retiredJobsFile, retiredJobs.Reload})
+	}
+	if len(reloaders) > 0 {
+		go reloadHandler(reloaders)
+	}
+	mws, err := middlewares(proxies, ipFilter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := &gateway.Options{
+		ListenAddress:         *listenAddress,
+		TelemetryAddress:      *telemetryAddress,
+		IPStack:               stack,
+		TLSCertFile:           *tlsCertFile,
+		TLSKeyFile:            *tlsKeyFile,
+		ACMEHTTPAddress:       *acmeHTTPAddress,
+		ACMECacheDir:          *acmeCacheDir,
+		ACMEEmail:             *acmeEmail,
+		ACMEDirectoryURL:      *acmeDirectoryURL,
+		TLSClientCAFile:       *tlsClientCAFile,
+		EnableH2C:             *enableH2C,
+		KeepAliveTimeout:      *keepAliveTimeout,
+		MaxIdleConnections:    *maxIdleConnections,
+		MaxHeaderBytes:        *maxHeaderBytes,
+		MetricsPath:           *metricsPath,
+		GroupedScrapes:        *groupedScrapes,
+		IdempotencyWindow:     *idempotencyWindow,
+		IdempotencyMaxEntries: *idempotencyMaxEntries,
+		FirstClassLabels:      strings.Split(*firstClassLabels, ","),
+		LoadingMode:           loadingMode,
+		Storage: storage.DiskMetricStoreOptions{
+			PersistenceFile:        *persistenceFile,
+			PersistenceInterval:    *persistenceInterval,
+			PersistenceShards:      *persistenceShards,
+			PersistenceMaxDeltas:   *persistenceMaxDeltas,
+			PersistenceCompression: compression,
+			StampPushTime:          *stampPushTime,
+			UnsortedMetrics:        *unsortedMetrics,
+			GCInterval:             *gcInterval,
+			CompactionInterval:     *compactionInterval,
+			TombstoneRetention:     *tombstoneRetention,
+			RetentionRules:         retentionRules,
+			HistoryDir:             *historyDir,
+			HistoryLength:          *historyLength,
+			HistoryInterval:        *historyInterval,
+		},
+		Push: handler.PushOptions{
+			Tracker:             handler.NewPushTracker(*asyncPushRetention),
+			AutoFillLabel:       *autoFillLabel,
+			AutoFillMode:        autoFillMode,
+			AutoFillStaticValue: *autoFillStaticValue,
+			LabelConflicts:      labelConflictMode,
+			LabelValues:         labelValueMode,
+			MaxLabelValueBytes:  *maxLabelValueBytes,
+			SampleValues:        sampleValueMode,
+			GroupStats:          handler.NewGroupStats(groupStatsLabel),
+			MaxMemoryBytes:      *maxMemoryBytes,
+			Timeout:             *pushTimeout,
+			TrustedProxies:      proxies,
+			Deduplicator:        handler.NewPushDeduplicator(*dedupWindow, *skipDuplicates),
+			Quotas:              quotas,
+			Validator:           validator,
+			SchemaDiffs:         *schemaDiffs,
+			MaxTimestampAge:     *maxTimestampAge,
+			RequireInstance:     *requireInstance,
+			RetiredJobs:         retiredJobs,
+			ContentTypes:        contentTypeMode,
+			Transforms:          transforms,
+		},
+		Asset:       Asset,
+		AssetDir:    AssetDir,
+		Flags:       flags,
+		BuildInfo:   BuildInfo,
+		Middlewares: mws,
+		ReplayFile:  *replayFile,
+
+		DisableDelete:    *disableDelete,
+		DisablePostMerge: *disablePostMerge,
+
+		CanaryInterval:  *canaryInterval,
+		CanaryJob:       *canaryJob,
+		CanaryTokenFile: *canaryTokenFile,
+
+		SecretsRefreshInterval: *secretsRefresh,
+
+		LeaseFile:  *leaseFile,
+		LeaseTTL:   *leaseTTL,
+		InstanceID: *instanceID,
+	}
+	if *leaseFile != "" && *instanceID == "" {
+		opts.InstanceID, err = advertiseAddr(*advertiseAddress, *listenAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *acmeHosts != "" {
+		opts.ACMEHosts = strings.Split(*acmeHosts, ",")
+	}
+
+	if *consulAddress != "" || *fileSDPath != "" {
+		advertise, err := advertiseAddr(*advertiseAddress, *listenAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		scheme := "http"
+		if *tlsCertFile != "" || *acmeHosts != "" {
+			scheme = "https"
+		}
+		if *telemetryAddress != "" {
+			// Prometheus scrapes the telemetry listener, which also
+			// serves /-/ready, via plain HTTP.
+			host, _, _ := net.SplitHostPort(advertise)
+			_, port, err := net.SplitHostPort(*telemetryAddress)
+			if err != nil {
+				log.Fatal(err)
+			}
+			scheme, advertise = "http", net.JoinHostPort(host, port)
+		}
+		if *consulAddress != "" {
+			reg := &discovery.ConsulRegistrar{
+				Address:       *consulAddress,
+				Service:       *consulService,
+				Advertise:     advertise,
+				CheckURL:      scheme + "://" + advertise + "/-/ready",
+				CheckInterval: "10s",
+			}
+			if *consulTags != "" {
+				reg.Tags = strings.Split(*consulTags, ",")
+			}
+			opts.Registrars = append(opts.Registrars, reg)
+		}
+		if *fileSDPath != "" {
+			opts.Registrars = append(opts.Registrars, &discovery.FileSDRegistrar{
+				Path:      *fileSDPath,
+				Advertise: advertise,
+			})
+		}
+	}
+
+	g, err := gateway.New(opts)
 	if err != nil {
 		log.Fatal(err)
 	}
-	go interruptHandler(l)
-	err = (&http.Server{Addr: *listenAddress, Handler: r}).Serve(l)
-	log.Print("HTTP server stopped: ", err)
-	// To give running connections a chance to submit their payload, we wait
-	// for 1sec, but we don't want to wait long (e.g. until all connections
-	// are done) to not delay the shutdown.
-	time.Sleep(time.Second)
-	if err := ms.Shutdown(); err != nil {
-		log.Print("Problem shutting down metric storage: ", err)
+	ctx, cancel := context.WithCancel(context.Background())
+	go interruptHandler(cancel)
+	go stateDumpHandler(g.MetricStore())
+	if err := g.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// middlewares returns the Middlewares configured by flags, in the order
+// IP filtering (if ipFilter is not nil), authentication, rate limiting,
+// auditing, recording.
+func middlewares(trustedProxies []*net.IPNet, ipFilter *handler.IPFilter) ([]handler.Middleware, error) {
+	var (
+		mws            []handler.Middleware
+		authenticators []handler.Authenticator
+	)
+	if ipFilter != nil {
+		mws = append(mws, ipFilter.Middleware())
+	}
+	for _, c := range []struct {
+		spec string
+		new  func(map[string]string) handler.Authenticator
+	}{
+		{*basicUsersFile, func(c map[string]string) handler.Authenticator { return handler.BasicAuthenticator(c) }},
+		{*tokensFile, func(c map[string]string) handler.Authenticator { return handler.TokenAuthenticator(c) }},
+		{*hmacSecretsFile, func(c map[string]string) handler.Authenticator { return handler.HMACAuthenticator(c) }},
+	} {
+		if c.spec == "" {
+			continue
+		}
+		s, err := secret.New(c.spec, *secretsRefresh)
+		if err != nil {
+			return nil, err
+		}
+		a, err := handler.NewSecretAuthenticator(s, c.new)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, a)
+	}
+	if *jwksURL != "" {
+		authenticators = append(authenticators, &handler.JWTAuthenticator{
+			JWKSURL:   *jwksURL,
+			Issuer:    *jwtIssuer,
+			Audience:  *jwtAudience,
+			JobsClaim: *jwtJobsClaim,
+			Client:    &http.Client{Timeout: 10 * time.Second},
+		})
+	}
+	if *kubernetesAuth {
+		a, err := handler.NewInClusterKubernetesAuthenticator(*secretsRefresh)
+		if err != nil {
+			return nil, err
+		}
+		if *kubernetesAudience != "" {
+			a.Audiences = []string{*kubernetesAudience}
+		}
+		a.NamespaceLabel = *kubernetesNSLabel
+		a.PodLabel = *kubernetesPodLabel
+		authenticators = append(authenticators, a)
+	}
+	if *clientCertAuth {
+		if *tlsClientCAFile == "" {
+			return nil, errors.New("-web.auth.client-cert requires -web.tls-client-ca-file")
+		}
+		authenticators = append(authenticators, handler.ClientCertAuthenticator{})
+	}
+	if len(authenticators) > 0 {
+		var admins []string
+		if *adminIdentities != "" {
+			admins = strings.Split(*adminIdentities, ",")
+		}
+		mws = append(mws, handler.Authenticate(*anonymousReads, authenticators...), handler.AdminOnly(admins))
+	} else if *adminIdentities != "" {
+		return nil, errors.New("-web.auth.admin-identities requires authentication to be configured")
 	}
+	if *rateLimit > 0 {
+		mws = append(mws, handler.RateLimit(*rateLimit, *rateLimitBurst, trustedProxies))
+	}
+	if *auditLogFile != "" {
+		f, err := os.OpenFile(*auditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, err
+		}
+		mws = append(mws, handler.Audit(f, trustedProxies))
+	}
+	if *recordFile != "" {
+		f, err := os.OpenFile(*recordFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		mws = append(mws, handler.Record(f))
+	}
+	return mws, nil
 }
 
-func handlePprof(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	switch p.ByName("pprof") {
-	case "/cmdline":
-		pprof.Cmdline(w, r)
-	case "/profile":
-		pprof.Profile(w, r)
-	case "/symbol":
-		pprof.Symbol(w, r)
-	default:
-		pprof.Index(w, r)
+// advertiseAddr returns advertise if it is not empty. Otherwise, it returns the
+// host name of this machine combined with the port of listenAddress.
+func advertiseAddr(advertise, listenAddress string) (string, error) {
+	if advertise != "" {
+		return advertise, nil
+	}
+	_, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return "", err
 	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
 }
 
-func interruptHandler(l net.Listener) {
-	notifier := make(chan os.Signal)
+func interruptHandler(cancel context.CancelFunc) {
+	notifier := make(chan os.Signal, 1)
 	signal.Notify(notifier, os.Interrupt, syscall.SIGTERM)
 	<-notifier
 	log.Print("Received SIGINT/SIGTERM; exiting gracefully...")
-	l.Close()
+	cancel()
+}
+
+// reloader reloads a file upon SIGHUP.
+type reloader struct {
+	filename string
+	reload   func() error
+}
+
+func reloadHandler(reloaders []reloader) {
+	notifier := make(chan os.Signal, 1)
+	signal.Notify(notifier, syscall.SIGHUP)
+	for range notifier {
+		for _, r := range reloaders {
+			if err := r.reload(); err != nil {
+				log.Errorf("Received SIGHUP; reloading %s failed, keeping the previous rules: %s", r.filename, err)
+				continue
+			}
+			log.Printf("Received SIGHUP; reloaded %s.", r.filename)
+		}
+	}
+}
+
+func stateDumpHandler(ms *storage.DiskMetricStore) {
+	notifier := make(chan os.Signal, 1)
+	signal.Notify(notifier, syscall.SIGUSR1)
+	for range notifier {
+		stats := ms.Stats(10)
+		lastPersistence := "never"
+		if !stats.LastPersistenceTime.IsZero() {
+			lastPersistence = stats.LastPersistenceTime.String()
+		}
+		log.Printf(
+			"Received SIGUSR1; state of the metric store: %d groups, %d series, write queue %d/%d, last persisted %s.",
+			stats.Groups, stats.Series,
+			stats.WriteQueueLength, stats.WriteQueueCapacity,
+			lastPersistence,
+		)
+		for i, g := range stats.BiggestGroups {
+			log.Printf("Biggest group #%d: %v with %d series.", i+1, g.Labels, g.Series)
+		}
+	}
 }
@@ -0,0 +1,166 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package secret reads secrets (TLS keys, credentials, tokens) from external
+// sources and keeps them up to date, so that secrets rotated by e.g.
+// Kubernetes or a Vault agent take effect without a restart.
+//
+// A source is given by a spec:
+//
+//	env:<name>                  the environment variable <name>
+//	exec:<command> [<args>...]  the standard output of the command
+//	file:<path>                 the content of the file
+//	<path>                      the content of the file
+//
+// Environment variables are read once. Files are read again whenever their
+// modification time or size changes, commands are run again, both at most
+// once per refresh interval.
+package secret
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/log"
+)
+
+// execTimeout is the maximum time a command providing a secret may run.
+const execTimeout = 30 * time.Second
+
+// Secret is a secret read from a source. Use New to create one.
+type Secret struct {
+	spec, kind, arg string
+	refresh         time.Duration
+
+	mtx     sync.Mutex // Protects the fields below.
+	value   []byte
+	version uint64
+	checked time.Time
+	modTime time.Time
+	size    int64
+}
+
+// New returns a Secret for the source given by spec (see package
+// documentation), refreshed at most every refresh interval. If refresh is not
+// positive, the secret is only read once. The secret is read right away, and
+// an error is returned if that fails.
+func New(spec string, refresh time.Duration) (*Secret, error) {
+	s := &Secret{spec: spec, kind: "file", arg: spec, refresh: refresh}
+	if i := strings.Index(spec, ":"); i > 0 {
+		switch prefix := spec[:i]; prefix {
+		case "env", "exec", "file":
+			s.kind, s.arg = prefix, spec[i+1:]
+		}
+	}
+	if s.arg == "" {
+		return nil, fmt.Errorf("empty secret source %q", spec)
+	}
+	if err := s.update(time.Now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// String returns the spec of the source, which never contains the secret
+// itself.
+func (s *Secret) String() string {
+	return s.spec
+}
+
+// Get returns the current content of the secret and its version, which is
+// increased whenever the content changes. If refreshing fails, the error is
+// logged, and the last content is returned.
+func (s *Secret) Get() ([]byte, uint64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	now := time.Now()
+	if s.kind != "env" && s.refresh > 0 && now.Sub(s.checked) >= s.refresh {
+		if err := s.update(now); err != nil {
+			log.Printf("Error refreshing secret from %s: %s", s.spec, err)
+		}
+	}
+	return s.value, s.version
+}
+
+// update reads the secret if it might have changed. s.mtx must be held (or s
+// not yet shared).
+func (s *Secret) update(now time.Time) error {
+	s.checked = now
+	var (
+		value []byte
+		err   error
+	)
+	switch s.kind {
+	case "env":
+		v, ok := os.LookupEnv(s.arg)
+		if !ok {
+			return fmt.Errorf("environment variable %s not set", s.arg)
+		}
+		value = []byte(v)
+	case "exec":
+		if value, err = run(s.arg); err != nil {
+			return fmt.Errorf("error running %q: %s", s.arg, err)
+		}
+	default:
+		fi, err := os.Stat(s.arg)
+		if err != nil {
+			return err
+		}
+		if s.version > 0 && fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+			return nil
+		}
+		if value, err = ioutil.ReadFile(s.arg); err != nil {
+			return err
+		}
+		s.modTime, s.size = fi.ModTime(), fi.Size()
+	}
+	if s.version == 0 || !bytes.Equal(value, s.value) {
+		s.value = value
+		s.version++
+	}
+	return nil
+}
+
+// run runs the command line (split at white space) and returns its standard
+// output.
+func run(cmdline string) ([]byte, error) {
+	args := strings.Fields(cmdline)
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+		}
+	case <-time.After(execTimeout):
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("timed out after %s", execTimeout)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secret
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSecret(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "secret.TestSecret.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "token")
+	if err := ioutil.WriteFile(path, []byte("one"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SECRET_TEST_TOKEN", "env")
+	defer os.Unsetenv("SECRET_TEST_TOKEN")
+
+	for _, s := range []struct {
+		spec, value string
+	}{
+		{path, "one"},
+		{"file:" + path, "one"},
+		{"env:SECRET_TEST_TOKEN", "env"},
+		{"exec:echo -n exec", "exec"},
+	} {
+		secret, err := New(s.spec, 0)
+		if err != nil {
+			t.Fatalf("%s: %s", s.spec, err)
+		}
+		if value, version := secret.Get(); string(value) != s.value || version != 1 {
+			t.Errorf("%s: Wanted %q in version 1, got %q in version %d.", s.spec, s.value, value, version)
+		}
+	}
+	for _, spec := range []string{"", "env:SECRET_TEST_MISSING", "exec:false", filepath.Join(tempDir, "missing")} {
+		if _, err := New(spec, 0); err == nil {
+			t.Errorf("%q: Expected error.", spec)
+		}
+	}
+
+	// A changed file is picked up after the refresh interval. Failing
+	// to read it keeps the last value.
+	secret, err := New(path, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("two!"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if value, version := secret.Get(); string(value) != "two!" || version != 2 {
+		t.Errorf("Wanted \"two!\" in version 2, got %q in version %d.", value, version)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if value, version := secret.Get(); string(value) != "two!" || version != 2 {
+		t.Errorf("Wanted \"two!\" in version 2 after removal, got %q in version %d.", value, version)
+	}
+}
@@ -14,118 +14,793 @@
 package storage
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/klauspost/compress/zstd"
 	"github.com/prometheus/client_golang/model"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/log"
 
 	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/groupingkey"
 )
 
 const (
 	writeQueueCapacity = 1000
+	// clearedAtRetention is how long the time of the last deletion or
+	// replacement of a group is remembered to detect superseded write
+	// requests. Write requests delayed by more than that are not expected.
+	clearedAtRetention = 10 * time.Minute
+)
+
+// Compression is the compression algorithm used for persistence files.
+type Compression string
+
+// Possible values for Compression.
+const (
+	NoCompression   Compression = "none"
+	GzipCompression Compression = "gzip"
+	ZstdCompression Compression = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
 )
 
+// ParseCompression returns the Compression for the given name. The empty
+// string is accepted as NoCompression.
+func ParseCompression(name string) (Compression, error) {
+	switch c := Compression(name); c {
+	case "", NoCompression:
+		return NoCompression, nil
+	case GzipCompression, ZstdCompression:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown compression %q", name)
+}
+
 // DiskMetricStore is an implementation of MetricStore that persists metrics to
 // disk.
 type DiskMetricStore struct {
-	lock            sync.RWMutex // Protects metricFamilies.
-	writeQueue      chan WriteRequest
-	drain           chan struct{}
-	done            chan error
-	metricGroups    GroupingKeyToMetricGroup
-	persistenceFile string
+	// lock protects metricGroups, memoryUsage, jobUsage, the merged
+	// metric families (mergedFamilies and the three maps below it),
+	// tombstones, clearedAt, and dirty, which determines the shards and
+	// deltas written upon the next persisting. Holding it while recording
+	// pushes to history keeps the recorded states in the order of writes.
+	lock              sync.RWMutex
+	writeQueue        chan WriteRequest
+	compactions       chan chan CompactionResult
+	reloads           chan chan error
+	drain             chan struct{}
+	done              chan error
+	loaded            chan struct{}
+	metricGroups      GroupingKeyToMetricGroup
+	persistenceFile   string
+	persistenceShards int
+	maxDeltas         int
+	compression       Compression
+	stampPushTime     bool
+	sortMetrics       bool
+
+	memoryUsage int64 // Protected by lock.
+	// jobUsage is what is stored per job, see GetJobUsage. Protected by
+	// lock. Entries of jobs without groups are removed by gc.
+	jobUsage map[string]*JobUsage
+	// mergedFamilies is the merged view of all stored metric families by
+	// name, as returned by GetMetricFamilies. Writes only mark the merged
+	// metric families they change as stale in staleFamilies, which are
+	// then merged again upon the next scrape, so that a burst of pushes
+	// between two scrapes does not merge the same metric family over and
+	// over. The contained MetricFamilies are never modified but replaced
+	// upon change. groupsByFamilyName contains the grouping keys of the
+	// groups contributing to each merged metric family, and
+	// inconsistentFamilies the names of the merged metric families with
+	// inconsistent help strings or types. All four are protected by lock.
+	mergedFamilies       map[string]*dto.MetricFamily
+	staleFamilies        map[string]struct{}
+	groupsByFamilyName   map[string]map[uint64]struct{}
+	inconsistentFamilies map[string]struct{}
+	gcReclaimedGroups    prometheus.Counter
+	memoryUsageGauge     prometheus.GaugeFunc
+	writeQueueLength     prometheus.GaugeFunc
+	writeDuration        prometheus.Histogram
+	persistDuration      prometheus.Histogram
+	persistFailures      prometheus.Counter
+	lastPersistSuccess   prometheus.GaugeFunc
+	persistenceFileBytes prometheus.GaugeFunc
+	shardLoadDuration    *prometheus.GaugeVec
+
+	// tombstones contains the deleted groups that can still be restored,
+	// by grouping key. Protected by lock.
+	tombstones         map[uint64]tombstone
+	tombstoneRetention time.Duration
+
+	// clearedAt contains, by grouping key, the receive time of the most
+	// recent write request that deleted or replaced the whole group (see
+	// WriteRequest). Protected by lock.
+	clearedAt map[uint64]time.Time
+
+	// dirty contains the grouping keys of the groups (and tombstones)
+	// changed since the last persisting. Protected by lock.
+	dirty map[uint64]struct{}
+
+	retentionRules         []RetentionRule
+	retentionDeletedGroups prometheus.Counter
+
+	// history records the states of the groups after pushes. Nil if
+	// disabled.
+	history *history
+
+	// persistLock serializes persisting, which happens in the background,
+	// i.e. concurrently with processing write requests.
+	persistLock sync.Mutex
+
+	persistingLock     sync.Mutex // Protects persistingDisabled.
+	persistingDisabled bool
+
+	statsLock           sync.Mutex // Protects the fields below.
+	lastPersistenceTime time.Time
+}
+
+// tombstone is a deleted group kept for restoring. Its fields are exported for
+// gob encoding.
+type tombstone struct {
+	Group   MetricGroup
+	Deleted time.Time
+}
+
+// Stats contains statistics about the state of a DiskMetricStore.
+type Stats struct {
+	Groups             int
+	Series             int
+	WriteQueueLength   int
+	WriteQueueCapacity int
+	// LastPersistenceTime is the time of the last successful persisting
+	// to disk. It is the zero time if nothing has been persisted yet.
+	LastPersistenceTime time.Time
+	// BiggestGroups contains the groups with the most series, sorted by
+	// decreasing number of series.
+	BiggestGroups []GroupSize
 }
 
-type mfStat struct {
-	pos    int  // Where in the result slice is the MetricFamily?
-	copied bool // Has the MetricFamily already been copied?
+// GroupSize is the number of series in the group with the given grouping
+// labels.
+type GroupSize struct {
+	Labels map[string]string
+	Series int
 }
 
+type groupSizesByDecreasingSeries []GroupSize
+
+func (s groupSizesByDecreasingSeries) Len() int           { return len(s) }
+func (s groupSizesByDecreasingSeries) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s groupSizesByDecreasingSeries) Less(i, j int) bool { return s[i].Series > s[j].Series }
+
+// DiskMetricStoreOptions contains options for NewDiskMetricStore.
+type DiskMetricStoreOptions struct {
+	// If PersistenceFile is the empty string, no persisting to disk will
+	// happen. Otherwise, a file of that name is used for persisting
+	// metrics to disk. If the file already exists, metrics are read from
+	// it as part of the start-up.
+	PersistenceFile string
+	// Persisting is happening upon shutdown and after every write action,
+	// but the latter will only happen PersistenceInterval after the
+	// previous persisting.
+	PersistenceInterval time.Duration
+	// PersistenceCompression is the compression used when writing the
+	// persistence file. Upon start-up, the persistence file is read no
+	// matter how it is compressed (or if it is compressed at all).
+	PersistenceCompression Compression
+	// If PersistenceShards is greater than 1, the groups are persisted
+	// across that many files, named like the PersistenceFile with a suffix
+	// '.shard-<i>', by the hash of their grouping key. Shards are written
+	// and, upon start-up, read concurrently, which speeds up both for a
+	// large number of groups. Persisted files are read no matter how many
+	// shards they were written with. Files not matching the configured
+	// sharding are removed after the next successful persisting.
+	PersistenceShards int
+	// If PersistenceMaxDeltas is positive, persisting after writes only
+	// writes the groups changed (or deleted) since the previous persisting
+	// to a delta file, named like the PersistenceFile with a suffix
+	// '.delta-<n>', which reduces disk I/O considerably if only a few of
+	// many groups change. Once PersistenceMaxDeltas delta files exist, the
+	// next persisting rewrites the PersistenceFile (or its shards)
+	// completely and removes the delta files, as does compaction. Upon
+	// start-up, existing delta files are applied in order on top of the
+	// PersistenceFile, no matter how PersistenceMaxDeltas is set.
+	PersistenceMaxDeltas int
+	// If StampPushTime is true, GetMetricFamilies attaches the time of the
+	// push that delivered a sample as its timestamp, unless the sample was
+	// pushed with an explicit timestamp already.
+	StampPushTime bool
+	// GetMetricFamilies returns the metric families sorted by name and
+	// their metrics sorted by label set (see compareMetrics), so that the
+	// exposition of the Pushgateway is deterministic. If UnsortedMetrics
+	// is true, the order depends on map iteration instead, which saves the
+	// sorting upon every write.
+	UnsortedMetrics bool
+	// Every GCInterval, metric families without metrics and groups without
+	// metric families are removed from the store, and a persisting is
+	// triggered if anything has been removed. If GCInterval is not
+	// positive, no such garbage collection happens.
+	GCInterval time.Duration
+	// Every CompactionInterval, the store is compacted (see Compact). If
+	// CompactionInterval is not positive, compaction only happens upon
+	// explicit calls of Compact.
+	CompactionInterval time.Duration
+	// If TombstoneRetention is positive, deleted groups are kept as
+	// tombstones for that long, during which they can be restored (see
+	// WriteRequest). Tombstones are neither part of GetMetricFamilies nor
+	// of GetMetricFamiliesMap, but they are persisted. Expired tombstones
+	// are removed by the garbage collection (see GCInterval).
+	TombstoneRetention time.Duration
+	// RetentionRules are applied every minute to delete groups
+	// automatically (see RetentionRule). Such deletions are treated like
+	// deletions via a WriteRequest, i.e. they leave tombstones if
+	// TombstoneRetention is positive.
+	RetentionRules []RetentionRule
+	// If LoadInBackground is true, NewDiskMetricStore returns right away
+	// and loads the persisted metrics in the background (see Loaded).
+	// Until then, reads return an empty store, and write requests are
+	// queued (they are processed once loading is done).
+	LoadInBackground bool
+	// If HistoryDir is set, the state of a group is recorded in that
+	// directory after each push (including PATCH requests), keeping the
+	// last HistoryLength states per group in a ring buffer, so that
+	// earlier pushes can be inspected via History. If HistoryInterval is
+	// positive, pushes less than HistoryInterval after the push that
+	// started the most recent entry of the group overwrite that entry
+	// instead of starting a new one, i.e. only the last push per interval
+	// is kept. The history of a deleted group is kept on disk.
+	HistoryDir      string
+	HistoryLength   int
+	HistoryInterval time.Duration
+}
+
+// CompactionResult reports the outcome of a compaction.
+type CompactionResult struct {
+	ReclaimedGroups int `json:"reclaimedGroups"`
+	// Estimated memory used by the stored metrics (see MemoryUsage). It
+	// only accounts for the metric families removed as empty, not for the
+	// memory released by rebuilding the internal data structures.
+	MemoryBytesBefore int64 `json:"memoryBytesBefore"`
+	MemoryBytesAfter  int64 `json:"memoryBytesAfter"`
+	// Size of the persistence file. Zero if there is none.
+	FileBytesBefore int64         `json:"fileBytesBefore"`
+	FileBytesAfter  int64         `json:"fileBytesAfter"`
+	Duration        time.Duration `json:"duration"`
+	// Err is the error encountered while rewriting the persistence file,
+	// if any.
+	Err error `json:"-"`
+}
+
+// ErrShutdown is returned by Compact if the DiskMetricStore has been shut
+// down.
+var ErrShutdown = errors.New("metric store has been shut down")
+
 // NewDiskMetricStore returns a DiskMetricStore ready to use. To cleanly shut it
-// down and free resources, the Shutdown() method has to be called.  If
-// persistenceFile is the empty string, no persisting to disk will
-// happen. Otherwise, a file of that name is used for persisting metrics to
-// disk. If the file already exists, metrics are read from it as part of the
-// start-up. Persisting is happening upon shutdown and after every write action,
-// but the latter will only happen persistenceDuration after the previous
-// persisting.
-func NewDiskMetricStore(
-	persistenceFile string,
-	persistenceInterval time.Duration,
-) *DiskMetricStore {
+// down and free resources, the Shutdown() method has to be called. See
+// DiskMetricStoreOptions for the meaning of the various options.
+func NewDiskMetricStore(o *DiskMetricStoreOptions) *DiskMetricStore {
 	dms := &DiskMetricStore{
-		writeQueue:      make(chan WriteRequest, writeQueueCapacity),
-		drain:           make(chan struct{}),
-		done:            make(chan error),
-		metricGroups:    GroupingKeyToMetricGroup{},
-		persistenceFile: persistenceFile,
+		writeQueue:        make(chan WriteRequest, writeQueueCapacity),
+		compactions:       make(chan chan CompactionResult),
+		reloads:           make(chan chan error),
+		drain:             make(chan struct{}),
+		done:              make(chan error),
+		loaded:            make(chan struct{}),
+		metricGroups:      GroupingKeyToMetricGroup{},
+		persistenceFile:   o.PersistenceFile,
+		persistenceShards: o.PersistenceShards,
+		maxDeltas:         o.PersistenceMaxDeltas,
+		compression:       o.PersistenceCompression,
+		stampPushTime:     o.StampPushTime,
+		sortMetrics:       !o.UnsortedMetrics,
+		gcReclaimedGroups: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "pushgateway",
+			Subsystem: "storage",
+			Name:      "gc_reclaimed_groups_total",
+			Help:      "Total number of empty groups removed from the metric store by garbage collection.",
+		}),
+		writeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "pushgateway",
+			Subsystem: "storage",
+			Name:      "write_request_duration_seconds",
+			Help:      "Time spent processing write requests, i.e. applying pushes and deletions to the metric store.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}),
+		persistDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "pushgateway",
+			Subsystem: "storage",
+			Name:      "persist_duration_seconds",
+			Help:      "Time spent writing the persistence file, including failed attempts.",
+		}),
+		persistFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "pushgateway",
+			Subsystem: "storage",
+			Name:      "persist_failures_total",
+			Help:      "Total number of failed attempts to write the persistence file.",
+		}),
+		shardLoadDuration: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "pushgateway",
+				Subsystem: "storage",
+				Name:      "shard_load_duration_seconds",
+				Help:      "Time spent reading each persistence file upon start-up, by shard ('unsharded' for a persistence file without shards).",
+			},
+			[]string{"shard"},
+		),
+		tombstones:         map[uint64]tombstone{},
+		tombstoneRetention: o.TombstoneRetention,
+		clearedAt:          map[uint64]time.Time{},
+		retentionRules:     o.RetentionRules,
+		retentionDeletedGroups: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "pushgateway",
+			Subsystem: "storage",
+			Name:      "retention_deleted_groups_total",
+			Help:      "Total number of groups deleted from the metric store by retention rules.",
+		}),
 	}
-	if err := dms.restore(); err != nil {
-		log.Print("Could not load persisted metrics: ", err)
-		log.Print("Retrying assuming legacy format for persisted metrics...")
-		if err := dms.legacyRestore(); err != nil {
-			log.Print("Could not load persisted metrics in legacy format: ", err)
-		}
+	dms.memoryUsageGauge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "pushgateway",
+			Subsystem: "storage",
+			Name:      "memory_usage_bytes",
+			Help:      "Estimated memory used by the metrics stored in the metric store.",
+		},
+		func() float64 { return float64(dms.MemoryUsage()) },
+	)
+	dms.writeQueueLength = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "pushgateway",
+			Subsystem: "storage",
+			Name:      "write_queue_length",
+			Help:      fmt.Sprintf("Number of write requests waiting to be processed. The queue holds at most %d requests.", writeQueueCapacity),
+		},
+		func() float64 { return float64(len(dms.writeQueue)) },
+	)
+	dms.lastPersistSuccess = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "pushgateway",
+			Subsystem: "storage",
+			Name:      "last_persist_success_timestamp_seconds",
+			Help:      "Unix time of the last successful write of the persistence file. 0 if there was none yet.",
+		},
+		func() float64 {
+			dms.statsLock.Lock()
+			defer dms.statsLock.Unlock()
+			if dms.lastPersistenceTime.IsZero() {
+				return 0
+			}
+			return float64(dms.lastPersistenceTime.UnixNano()) / 1e9
+		},
+	)
+	dms.persistenceFileBytes = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "pushgateway",
+			Subsystem: "storage",
+			Name:      "persistence_file_size_bytes",
+			Help:      "Size of the persistence file (or the sum of all its shards and delta files). 0 if there is none.",
+		},
+		func() float64 { return float64(dms.persistenceFileSize()) },
+	)
+	if o.HistoryDir != "" && o.HistoryLength > 0 {
+		dms.history = newHistory(o.HistoryDir, o.HistoryLength, o.HistoryInterval)
+	}
+	dms.rebuildMergedFamilies()
+	if !o.LoadInBackground {
+		dms.load()
 	}
 
-	go dms.loop(persistenceInterval)
+	go dms.loop(o.PersistenceInterval, o.GCInterval, o.CompactionInterval)
 	return dms
 }
 
+// load loads the persisted metrics into the store and closes dms.loaded once
+// done. Persisted files that cannot be read are logged and skipped so that the
+// groups in the other files are kept (and persisted again) rather than being
+// overwritten by the next persist of an otherwise empty store.
+func (dms *DiskMetricStore) load() {
+	defer close(dms.loaded)
+	if err := dms.reload(true); err != nil {
+		log.Print(err)
+	}
+}
+
+// reload replaces the content of the store by the persisted metrics. Files are
+// read without holding the lock so that reads are not blocked meanwhile. If
+// some of the persisted files cannot be read, the store is left untouched and
+// the error is returned, unless partial is true, in which case the content of
+// the readable files is loaded and the error is logged. An unreadable
+// persistence file is only retried in the legacy format if it is the only
+// persisted file, as there are no shards or delta files in the legacy format.
+func (dms *DiskMetricStore) reload(partial bool) error {
+	start := time.Now()
+	groups, tombstones := GroupingKeyToMetricGroup{}, map[uint64]tombstone{}
+	if err := dms.restore(groups, tombstones); err != nil {
+		switch {
+		case dms.onlyUnshardedFile():
+			log.Print("Could not load persisted metrics: ", err)
+			log.Print("Retrying assuming legacy format for persisted metrics...")
+			groups = GroupingKeyToMetricGroup{}
+			if legacyErr := dms.legacyRestore(groups); legacyErr != nil {
+				return fmt.Errorf("could not load persisted metrics: %s (in legacy format: %s)", err, legacyErr)
+			}
+			tombstones = map[uint64]tombstone{}
+		case partial:
+			log.Printf("Could not load all persisted metrics, keeping the %d groups loaded: %s", len(groups), err)
+		default:
+			return fmt.Errorf("could not load persisted metrics: %s", err)
+		}
+	}
+	memoryUsage, jobUsage := usage(groups)
+
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+	dms.metricGroups = groups
+	dms.tombstones = tombstones
+	dms.clearedAt = map[uint64]time.Time{}
+	dms.dirty = nil // The store is exactly what has been persisted.
+	dms.memoryUsage = memoryUsage
+	dms.jobUsage = jobUsage
+	dms.rebuildMergedFamilies()
+	if len(groups) > 0 {
+		log.Printf("Loaded %d groups in %v.", len(groups), time.Since(start))
+	}
+	return nil
+}
+
+// Reload replaces the content of the store by the metrics persisted by now,
+// e.g. by another instance sharing the persistence file. It returns once done.
+// If the persisted metrics cannot be read, the content of the store is kept and
+// the error is returned. If the DiskMetricStore has been shut down,
+// ErrShutdown is returned.
+func (dms *DiskMetricStore) Reload() error {
+	reply := make(chan error)
+	select {
+	case <-dms.drain:
+		return ErrShutdown
+	default:
+	}
+	select {
+	case dms.reloads <- reply:
+		return <-reply
+	case <-dms.drain:
+		return ErrShutdown
+	}
+}
+
+// SetPersisting enables or disables persisting, which is enabled initially.
+// While disabled, the persistence file is neither written after writes nor
+// upon compaction or shutdown, e.g. because another instance sharing it is in
+// charge of it.
+func (dms *DiskMetricStore) SetPersisting(enabled bool) {
+	dms.persistingLock.Lock()
+	defer dms.persistingLock.Unlock()
+	dms.persistingDisabled = !enabled
+}
+
+func (dms *DiskMetricStore) persisting() bool {
+	dms.persistingLock.Lock()
+	defer dms.persistingLock.Unlock()
+	return !dms.persistingDisabled
+}
+
+// Loaded returns a channel that is closed once the persisted metrics have been
+// loaded. Unless DiskMetricStoreOptions.LoadInBackground is true, that is the
+// case when NewDiskMetricStore returns.
+func (dms *DiskMetricStore) Loaded() <-chan struct{} {
+	return dms.loaded
+}
+
 // SubmitWriteRequest implements the MetricStore interface.
 func (dms *DiskMetricStore) SubmitWriteRequest(req WriteRequest) {
 	dms.writeQueue <- req
 }
 
-// GetMetricFamilies implements the MetricStore interface.
+// GetMetricFamilies implements the MetricStore interface. Unless
+// DiskMetricStoreOptions.UnsortedMetrics is true, the metric families are
+// sorted by name and their metrics by label set.
 func (dms *DiskMetricStore) GetMetricFamilies() []*dto.MetricFamily {
-	result := []*dto.MetricFamily{}
-	mfStatByName := map[string]mfStat{}
+	dms.lock.RLock()
+	if len(dms.staleFamilies) == 0 {
+		defer dms.lock.RUnlock()
+		return dms.mergedFamiliesSlice()
+	}
+	dms.lock.RUnlock()
+
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+	for name := range dms.staleFamilies {
+		dms.mergeFamily(name)
+	}
+	dms.staleFamilies = map[string]struct{}{}
+	return dms.mergedFamiliesSlice()
+}
+
+// mergedFamiliesSlice returns the merged metric families, sorted by name
+// unless DiskMetricStoreOptions.UnsortedMetrics is true. The caller must hold
+// the lock.
+func (dms *DiskMetricStore) mergedFamiliesSlice() []*dto.MetricFamily {
+	result := make([]*dto.MetricFamily, 0, len(dms.mergedFamilies))
+	for _, mf := range dms.mergedFamilies {
+		result = append(result, mf)
+	}
+	if dms.sortMetrics {
+		sort.Slice(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+	}
+	return result
+}
+
+// rebuildMergedFamilies builds the merged view of all metric families from
+// scratch. The caller must hold the write lock (or have exclusive access to
+// dms otherwise).
+func (dms *DiskMetricStore) rebuildMergedFamilies() {
+	dms.mergedFamilies = map[string]*dto.MetricFamily{}
+	dms.staleFamilies = map[string]struct{}{}
+	dms.groupsByFamilyName = map[string]map[uint64]struct{}{}
+	dms.inconsistentFamilies = map[string]struct{}{}
+	for key, group := range dms.metricGroups {
+		for name := range group.Metrics {
+			dms.addToMergedFamilies(name, key)
+		}
+	}
+	for name := range dms.groupsByFamilyName {
+		dms.invalidateFamily(name)
+	}
+}
+
+// addToMergedFamilies registers the group with the given grouping key as a
+// contributor to the merged metric family of the given name. The merged
+// metric family has to be invalidated with invalidateFamily afterwards.
+func (dms *DiskMetricStore) addToMergedFamilies(name string, key uint64) {
+	keys, ok := dms.groupsByFamilyName[name]
+	if !ok {
+		keys = map[uint64]struct{}{}
+		dms.groupsByFamilyName[name] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+// removeFromMergedFamilies is the counterpart of addToMergedFamilies.
+func (dms *DiskMetricStore) removeFromMergedFamilies(name string, key uint64) {
+	keys := dms.groupsByFamilyName[name]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(dms.groupsByFamilyName, name)
+	}
+}
+
+// invalidateFamily marks the merged metric family of the given name as stale
+// after the metric families of that name in the contributing groups have
+// changed. The caller must hold the write lock.
+func (dms *DiskMetricStore) invalidateFamily(name string) {
+	dms.staleFamilies[name] = struct{}{}
+}
+
+// mergeFamily updates the merged metric family of the given name from the
+// metric families of that name in the contributing groups. Its cost is
+// proportional to the number of metrics in the merged metric family. If help
+// strings or types of the contributing metric families are inconsistent, one
+// of them will "win", and the inconsistency is logged once (until it is
+// resolved). The caller must hold the write lock.
+func (dms *DiskMetricStore) mergeFamily(name string) {
+	keys, ok := dms.groupsByFamilyName[name]
+	if !ok {
+		delete(dms.mergedFamilies, name)
+		delete(dms.inconsistentFamilies, name)
+		return
+	}
+	order := make([]uint64, 0, len(keys))
+	for key := range keys {
+		order = append(order, key)
+	}
+	if dms.sortMetrics {
+		// Sorted groups make the winner of inconsistencies and the order
+		// of duplicate label sets deterministic, too.
+		sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+	}
+	var merged *dto.MetricFamily
+	copied, consistent := false, true
+	for _, key := range order {
+		tmf := dms.metricGroups[key].Metrics[name]
+		mf := tmf.MetricFamily
+		if dms.stampPushTime {
+			mf = stampMetricFamily(mf, tmf.Timestamp)
+		}
+		if merged == nil {
+			merged = mf
+			continue
+		}
+		if !copied {
+			merged = copyMetricFamily(merged)
+			copied = true
+		}
+		if mf.GetHelp() != merged.GetHelp() || mf.GetType() != merged.GetType() {
+			if _, ok := dms.inconsistentFamilies[name]; consistent && !ok {
+				log.Printf(
+					"Metric families '%s' and '%s' are inconsistent, help and type of the latter will have priority. This is bad. Fix your pushed metrics!",
+					mf, merged,
+				)
+			}
+			consistent = false
+		}
+		merged.Metric = append(merged.Metric, mf.Metric...)
+	}
+	less := func(i, j int) bool { return compareMetrics(merged.Metric[i], merged.Metric[j]) < 0 }
+	if dms.sortMetrics && !sort.SliceIsSorted(merged.Metric, less) {
+		if !copied {
+			merged = copyMetricFamily(merged)
+		}
+		sort.SliceStable(merged.Metric, less)
+	}
+	if consistent {
+		delete(dms.inconsistentFamilies, name)
+	} else {
+		dms.inconsistentFamilies[name] = struct{}{}
+	}
+	dms.mergedFamilies[name] = merged
+}
+
+// Stats returns statistics about the current state of the DiskMetricStore,
+// including the n biggest groups.
+func (dms *DiskMetricStore) Stats(n int) Stats {
+	stats := Stats{
+		WriteQueueLength:   len(dms.writeQueue),
+		WriteQueueCapacity: cap(dms.writeQueue),
+	}
+
+	dms.statsLock.Lock()
+	stats.LastPersistenceTime = dms.lastPersistenceTime
+	dms.statsLock.Unlock()
 
+	dms.lock.RLock()
+	sizes := make([]GroupSize, 0, len(dms.metricGroups))
+	for _, group := range dms.metricGroups {
+		size := GroupSize{Labels: group.Labels}
+		for _, tmf := range group.Metrics {
+			size.Series += len(tmf.MetricFamily.GetMetric())
+		}
+		stats.Series += size.Series
+		sizes = append(sizes, size)
+	}
+	dms.lock.RUnlock()
+
+	stats.Groups = len(sizes)
+	sort.Sort(groupSizesByDecreasingSeries(sizes))
+	if len(sizes) > n {
+		sizes = sizes[:n]
+	}
+	stats.BiggestGroups = sizes
+	return stats
+}
+
+// Describe implements prometheus.Collector.
+func (dms *DiskMetricStore) Describe(ch chan<- *prometheus.Desc) {
+	dms.gcReclaimedGroups.Describe(ch)
+	dms.memoryUsageGauge.Describe(ch)
+	dms.writeQueueLength.Describe(ch)
+	dms.writeDuration.Describe(ch)
+	dms.persistDuration.Describe(ch)
+	dms.persistFailures.Describe(ch)
+	dms.lastPersistSuccess.Describe(ch)
+	dms.persistenceFileBytes.Describe(ch)
+	dms.shardLoadDuration.Describe(ch)
+	dms.retentionDeletedGroups.Describe(ch)
+	if dms.history != nil {
+		dms.history.dropped.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (dms *DiskMetricStore) Collect(ch chan<- prometheus.Metric) {
+	dms.gcReclaimedGroups.Collect(ch)
+	dms.memoryUsageGauge.Collect(ch)
+	dms.writeQueueLength.Collect(ch)
+	dms.writeDuration.Collect(ch)
+	dms.persistDuration.Collect(ch)
+	dms.persistFailures.Collect(ch)
+	dms.lastPersistSuccess.Collect(ch)
+	dms.persistenceFileBytes.Collect(ch)
+	dms.shardLoadDuration.Collect(ch)
+	dms.retentionDeletedGroups.Collect(ch)
+	if dms.history != nil {
+		dms.history.dropped.Collect(ch)
+	}
+}
+
+// MemoryUsage implements the MetricStore interface. The memory used by a
+// MetricFamily is estimated by the size of its protobuf encoding.
+func (dms *DiskMetricStore) MemoryUsage() int64 {
 	dms.lock.RLock()
 	defer dms.lock.RUnlock()
+	return dms.memoryUsage
+}
 
-	for _, group := range dms.metricGroups {
-		for name, tmf := range group.Metrics {
-			mf := tmf.MetricFamily
-			stat, exists := mfStatByName[name]
-			if exists {
-				existingMF := result[stat.pos]
-				if !stat.copied {
-					mfStatByName[name] = mfStat{
-						pos:    stat.pos,
-						copied: true,
-					}
-					existingMF = copyMetricFamily(existingMF)
-					result[stat.pos] = existingMF
-				}
-				if mf.GetHelp() != existingMF.GetHelp() || mf.GetType() != existingMF.GetType() {
-					log.Printf(
-						"Metric families '%s' and '%s' are inconsistent, help and type of the latter will have priority. This is bad. Fix your pushed metrics!",
-						mf, existingMF,
-					)
-				}
-				for _, metric := range mf.Metric {
-					existingMF.Metric = append(existingMF.Metric, metric)
-				}
-			} else {
-				mfStatByName[name] = mfStat{
-					pos:    len(result),
-					copied: false,
-				}
-				result = append(result, mf)
-			}
+// GetJobUsage implements the MetricStore interface.
+func (dms *DiskMetricStore) GetJobUsage(job string) JobUsage {
+	dms.lock.RLock()
+	defer dms.lock.RUnlock()
+	if u, ok := dms.jobUsage[job]; ok {
+		return *u
+	}
+	return JobUsage{}
+}
+
+// getJobUsage returns the usage of the given job, creating it if needed. The
+// caller must hold the write lock.
+func (dms *DiskMetricStore) getJobUsage(job string) *JobUsage {
+	if dms.jobUsage == nil {
+		dms.jobUsage = map[string]*JobUsage{}
+	}
+	u, ok := dms.jobUsage[job]
+	if !ok {
+		u = &JobUsage{}
+		dms.jobUsage[job] = u
+	}
+	return u
+}
+
+// addUsage accounts for mf being stored for the given job. The caller must
+// hold the write lock.
+func (dms *DiskMetricStore) addUsage(job string, mf *dto.MetricFamily) {
+	size := metricFamilySize(mf)
+	dms.memoryUsage += size
+	u := dms.getJobUsage(job)
+	u.Series += len(mf.GetMetric())
+	u.Bytes += size
+}
+
+// removeUsage is the counterpart of addUsage.
+func (dms *DiskMetricStore) removeUsage(job string, mf *dto.MetricFamily) {
+	size := metricFamilySize(mf)
+	dms.memoryUsage -= size
+	u := dms.getJobUsage(job)
+	u.Series -= len(mf.GetMetric())
+	u.Bytes -= size
+}
+
+// usage returns the memory usage and the usage per job of the given groups.
+func usage(groups GroupingKeyToMetricGroup) (int64, map[string]*JobUsage) {
+	var memoryUsage int64
+	jobUsage := map[string]*JobUsage{}
+	for _, group := range groups {
+		u, ok := jobUsage[group.Labels["job"]]
+		if !ok {
+			u = &JobUsage{}
+			jobUsage[group.Labels["job"]] = u
+		}
+		u.Groups++
+		for _, tmf := range group.Metrics {
+			size := metricFamilySize(tmf.MetricFamily)
+			memoryUsage += size
+			u.Series += len(tmf.MetricFamily.GetMetric())
+			u.Bytes += size
 		}
 	}
-	return result
+	return memoryUsage, jobUsage
+}
+
+// WriteQueueUtilization implements the MetricStore interface.
+func (dms *DiskMetricStore) WriteQueueUtilization() float64 {
+	return float64(len(dms.writeQueue)) / float64(cap(dms.writeQueue))
 }
 
 // Shutdown implements the MetricStore interface.
@@ -134,25 +809,115 @@ func (dms *DiskMetricStore) Shutdown() error {
 	return <-dms.done
 }
 
-func (dms *DiskMetricStore) loop(persistenceInterval time.Duration) {
+// Compact removes empty groups and metric families (like the periodic garbage
+// collection), rebuilds all internal maps to release memory held by them
+// after deletions, and rewrites the persistence file right away. The writing
+// of the persistence file is reported in the Err field of the result. If the
+// DiskMetricStore has been shut down, ErrShutdown is returned.
+func (dms *DiskMetricStore) Compact() (CompactionResult, error) {
+	reply := make(chan CompactionResult, 1)
+	select {
+	case <-dms.drain:
+		return CompactionResult{}, ErrShutdown
+	default:
+	}
+	select {
+	case dms.compactions <- reply:
+		return <-reply, nil
+	case <-dms.drain:
+		return CompactionResult{}, ErrShutdown
+	}
+}
+
+// compact does the work for Compact, apart from persisting. It must only be
+// called from loop.
+func (dms *DiskMetricStore) compact() CompactionResult {
+	result := CompactionResult{
+		MemoryBytesBefore: dms.MemoryUsage(),
+		FileBytesBefore:   dms.persistenceFileSize(),
+	}
+	result.ReclaimedGroups = dms.gc()
+
+	dms.lock.Lock()
+	groups := make(GroupingKeyToMetricGroup, len(dms.metricGroups))
+	for key, group := range dms.metricGroups {
+		groups[key] = copyMetricGroup(group)
+	}
+	dms.metricGroups = groups
+	dms.rebuildMergedFamilies()
+	dms.lock.Unlock()
+
+	result.MemoryBytesAfter = dms.MemoryUsage()
+	return result
+}
+
+func (dms *DiskMetricStore) persistenceFileSize() int64 {
+	names := dms.persistenceFiles()
+	if names == nil {
+		return 0
+	}
+	if deltas, err := dms.deltaFiles(); err == nil {
+		for _, d := range deltas {
+			names = append(names, d.name)
+		}
+	}
+	var size int64
+	for _, name := range names {
+		if fi, err := os.Stat(name); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+func (dms *DiskMetricStore) loop(persistenceInterval, gcInterval, compactionInterval time.Duration) {
+	// Nothing is processed before the persisted metrics have been loaded.
+	select {
+	case <-dms.loaded:
+	default:
+		dms.load()
+	}
+
 	lastPersist := time.Now()
 	persistScheduled := false
 	lastWrite := time.Time{}
-	persistDone := make(chan time.Time)
+	// Buffered so that a persist still running upon shutdown doesn't block
+	// forever.
+	persistDone := make(chan time.Time, 1)
 	var persistTimer *time.Timer
 
+	var gcTick <-chan time.Time
+	if gcInterval > 0 {
+		gcTicker := time.NewTicker(gcInterval)
+		defer gcTicker.Stop()
+		gcTick = gcTicker.C
+	}
+	var compactionTick <-chan time.Time
+	if compactionInterval > 0 {
+		compactionTicker := time.NewTicker(compactionInterval)
+		defer compactionTicker.Stop()
+		compactionTick = compactionTicker.C
+	}
+	var retentionTick <-chan time.Time
+	lastRetention := time.Now()
+	if len(dms.retentionRules) > 0 {
+		retentionTicker := time.NewTicker(time.Minute)
+		defer retentionTicker.Stop()
+		retentionTick = retentionTicker.C
+	}
+
 	checkPersist := func() {
-		if !persistScheduled && lastWrite.After(lastPersist) {
+		if !persistScheduled && lastWrite.After(lastPersist) && dms.persisting() {
 			persistTimer = time.AfterFunc(
 				persistenceInterval-lastWrite.Sub(lastPersist),
 				func() {
 					persistStarted := time.Now()
-					if err := dms.persist(); err != nil {
+					if err := dms.persist(false); err != nil {
 						log.Print("Error persisting metrics: ", err)
 					} else {
 						log.Printf(
-							"Metrics persisted to '%s'.",
-							dms.persistenceFile,
+							"Metrics persisted to '%s'%s.",
+							dms.persistenceFile, dms.shardsSuffix(),
 						)
 					}
 					persistDone <- persistStarted
@@ -162,12 +927,65 @@ func (dms *DiskMetricStore) loop(persistenceInterval time.Duration) {
 		}
 	}
 
+	// compact compacts the store and then persists it in the background so
+	// that write requests are not blocked by disk I/O. Once done, the
+	// result is sent to reply or, if reply is nil, logged.
+	compact := func(reply chan<- CompactionResult) {
+		start := time.Now()
+		result := dms.compact()
+		go func() {
+			result.Err = dms.persist(true)
+			result.FileBytesAfter = dms.persistenceFileSize()
+			result.Duration = time.Since(start)
+			if reply != nil {
+				reply <- result
+				return
+			}
+			if result.Err != nil {
+				log.Print("Error persisting metrics after compaction: ", result.Err)
+			}
+			log.Printf(
+				"Compaction removed %d empty groups; estimated memory usage %d -> %d bytes, persistence file size %d -> %d bytes.",
+				result.ReclaimedGroups,
+				result.MemoryBytesBefore, result.MemoryBytesAfter,
+				result.FileBytesBefore, result.FileBytesAfter,
+			)
+		}()
+	}
+
 	for {
 		select {
 		case wr := <-dms.writeQueue:
-			dms.processWriteRequest(wr)
+			dms.processInstrumentedWriteRequest(wr)
 			lastWrite = time.Now()
 			checkPersist()
+		case reply := <-dms.compactions:
+			compact(reply)
+		case reply := <-dms.reloads:
+			reply <- dms.reload(false)
+		case <-compactionTick:
+			compact(nil)
+		case <-gcTick:
+			reclaimed := dms.gc()
+			if reclaimed > 0 {
+				log.Printf("Garbage collection removed %d empty groups.", reclaimed)
+			}
+			purged := dms.purgeTombstones(time.Now())
+			if purged > 0 {
+				log.Printf("Garbage collection removed %d expired tombstones.", purged)
+			}
+			if reclaimed > 0 || purged > 0 {
+				lastWrite = time.Now()
+				checkPersist()
+			}
+		case now := <-retentionTick:
+			deleted := dms.applyRetention(now, lastRetention)
+			lastRetention = now
+			if deleted > 0 {
+				log.Printf("Retention rules deleted %d groups.", deleted)
+				lastWrite = time.Now()
+				checkPersist()
+			}
 		case lastPersist = <-persistDone:
 			persistScheduled = false
 			checkPersist() // In case something has been written in the meantime.
@@ -180,9 +998,10 @@ func (dms *DiskMetricStore) loop(persistenceInterval time.Duration) {
 			for {
 				select {
 				case wr := <-dms.writeQueue:
-					dms.processWriteRequest(wr)
+					dms.processInstrumentedWriteRequest(wr)
 				default:
-					dms.done <- dms.persist()
+					dms.history.close()
+					dms.done <- dms.persist(false)
 					return
 				}
 			}
@@ -190,32 +1009,405 @@ func (dms *DiskMetricStore) loop(persistenceInterval time.Duration) {
 	}
 }
 
+// processInstrumentedWriteRequest calls processWriteRequest and observes the
+// time it took.
+func (dms *DiskMetricStore) processInstrumentedWriteRequest(wr WriteRequest) {
+	start := time.Now()
+	dms.processWriteRequest(wr)
+	dms.writeDuration.Observe(time.Since(start).Seconds())
+}
+
 func (dms *DiskMetricStore) processWriteRequest(wr WriteRequest) {
 	dms.lock.Lock()
 	defer dms.lock.Unlock()
+	var err error
+	if wr.Done != nil {
+		defer func() { wr.Done <- err }()
+	}
 
-	key := model.LabelsToSignature(wr.Labels)
+	key := groupingkey.Hash(wr.Labels)
+	dms.markDirty(key)
 
+	if wr.Restore {
+		err = dms.restoreGroup(key)
+		return
+	}
+	ordered := !wr.Timestamp.IsZero()
+	if ordered && wr.Timestamp.Before(dms.clearedAt[key]) {
+		// The group has been deleted or replaced by a request received
+		// later. Last writer wins.
+		err = ErrSuperseded
+		return
+	}
+	if wr.Patch {
+		err = dms.patchGroup(key, wr)
+		return
+	}
 	if wr.MetricFamilies == nil {
 		// Delete.
-		delete(dms.metricGroups, key)
+		if name := wr.MetricFamilyName; name != "" {
+			group, ok := dms.metricGroups[key]
+			if !ok {
+				return
+			}
+			tmf, ok := group.Metrics[name]
+			if !ok || ordered && tmf.Timestamp.After(wr.Timestamp) {
+				return
+			}
+			delete(group.Metrics, name)
+			dms.removeUsage(group.Labels["job"], tmf.MetricFamily)
+			if len(group.Metrics) == 0 {
+				delete(dms.metricGroups, key)
+				dms.getJobUsage(group.Labels["job"]).Groups--
+			}
+			dms.removeFromMergedFamilies(name, key)
+			dms.invalidateFamily(name)
+			return
+		}
+		dms.clearGroup(key, wr.Timestamp)
 		return
 	}
-	// Update.
+	if wr.Replace {
+		dms.clearGroup(key, wr.Timestamp)
+	}
+	// Update. A tombstone of the group is superseded by the new metrics.
+	delete(dms.tombstones, key)
 	for name, mf := range wr.MetricFamilies {
 		group, ok := dms.metricGroups[key]
+		if tmf, ok := group.Metrics[name]; ok && ordered && tmf.Timestamp.After(wr.Timestamp) {
+			// Pushed by a request received later. Last writer wins.
+			continue
+		}
 		if !ok {
 			group = MetricGroup{
 				Labels:  wr.Labels,
 				Metrics: NameToTimestampedMetricFamilyMap{},
 			}
 			dms.metricGroups[key] = group
+			dms.getJobUsage(wr.Labels["job"]).Groups++
 		}
+		if tmf, ok := group.Metrics[name]; ok {
+			dms.removeUsage(group.Labels["job"], tmf.MetricFamily)
+			shareSchema(mf, tmf.MetricFamily)
+		}
+		dms.addUsage(group.Labels["job"], mf)
 		group.Metrics[name] = TimestampedMetricFamily{
 			Timestamp:    wr.Timestamp,
 			MetricFamily: mf,
 		}
+		dms.addToMergedFamilies(name, key)
+		dms.invalidateFamily(name)
+	}
+	if group, ok := dms.metricGroups[key]; ok && (wr.Replace || len(wr.Annotations) > 0) {
+		base := group.Annotations
+		if wr.Replace {
+			base = nil
+		}
+		group.Annotations = mergeAnnotations(base, wr.Annotations)
+		dms.metricGroups[key] = group
+	}
+	if group, ok := dms.metricGroups[key]; ok && len(wr.MetricFamilies) > 0 {
+		dms.history.record(key, group, wr.Timestamp)
+	}
+}
+
+// patchGroup replaces the existing metrics of the group with the given grouping
+// key by the metrics of the same label set in wr.MetricFamilies (see the Patch
+// field of WriteRequest). Metric families pushed by requests received later
+// than wr are left alone (last writer wins). The caller must hold the write
+// lock.
+func (dms *DiskMetricStore) patchGroup(key uint64, wr WriteRequest) error {
+	group, ok := dms.metricGroups[key]
+	if !ok {
+		return fmt.Errorf("group %v not found", wr.Labels)
+	}
+	patched := make(map[string]*dto.MetricFamily, len(wr.MetricFamilies))
+	for name, mf := range wr.MetricFamilies {
+		tmf, ok := group.Metrics[name]
+		if !ok {
+			return fmt.Errorf("unknown metric family %q", name)
+		}
+		old := tmf.MetricFamily
+		if old.GetType() != mf.GetType() {
+			return fmt.Errorf("metric family %q has type %s, not %s", name, old.GetType(), mf.GetType())
+		}
+		index := make(map[uint64]int, len(old.GetMetric()))
+		for i, m := range old.GetMetric() {
+			index[labelPairsSignature(m.GetLabel())] = i
+		}
+		newMF := copyMetricFamily(old)
+		for _, m := range mf.GetMetric() {
+			i, ok := index[labelPairsSignature(m.GetLabel())]
+			if !ok {
+				return fmt.Errorf("unknown metric %s%s in metric family %q", name, labelPairsString(m.GetLabel()), name)
+			}
+			// Share the label pairs of the old metric.
+			m.Label = old.Metric[i].Label
+			newMF.Metric[i] = m
+		}
+		if wr.Timestamp.IsZero() || !tmf.Timestamp.After(wr.Timestamp) {
+			patched[name] = newMF
+		}
+	}
+	for name, mf := range patched {
+		dms.removeUsage(group.Labels["job"], group.Metrics[name].MetricFamily)
+		dms.addUsage(group.Labels["job"], mf)
+		group.Metrics[name] = TimestampedMetricFamily{
+			Timestamp:    wr.Timestamp,
+			MetricFamily: mf,
+		}
+		dms.invalidateFamily(name)
+	}
+	dms.history.record(key, group, wr.Timestamp)
+	return nil
+}
+
+// labelPairsSignature returns the signature of the label set of the given label
+// pairs.
+func labelPairsSignature(lps []*dto.LabelPair) uint64 {
+	labels := make(map[string]string, len(lps))
+	for _, lp := range lps {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	return model.LabelsToSignature(labels)
+}
+
+// labelPairsString returns the given label pairs in the text format, e.g.
+// '{a="b",c="d"}'.
+func labelPairsString(lps []*dto.LabelPair) string {
+	pairs := make([]string, 0, len(lps))
+	for _, lp := range lps {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", lp.GetName(), lp.GetValue()))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// mergeAnnotations returns a new map with the annotations of base updated by
+// those of update, where an empty value removes the annotation. It returns nil
+// if no annotations are left.
+func mergeAnnotations(base, update map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(update))
+	for name, value := range base {
+		merged[name] = value
+	}
+	for name, value := range update {
+		if value == "" {
+			delete(merged, name)
+			continue
+		}
+		merged[name] = value
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+// clearGroup deletes the metric families of the group with the given grouping
+// key that were pushed by requests received up to the given time, and it
+// remembers that time to reject superseded write requests. If nothing is left,
+// the whole group is deleted (see deleteGroup). A zero time clears the whole
+// group. The caller must hold the write lock.
+func (dms *DiskMetricStore) clearGroup(key uint64, received time.Time) {
+	if !received.IsZero() {
+		dms.clearedAt[key] = received
+	}
+	group, ok := dms.metricGroups[key]
+	if !ok {
+		return
+	}
+	if !received.IsZero() && group.LastPushTime().After(received) {
+		for name, tmf := range group.Metrics {
+			if tmf.Timestamp.After(received) {
+				continue
+			}
+			delete(group.Metrics, name)
+			dms.removeUsage(group.Labels["job"], tmf.MetricFamily)
+			dms.removeFromMergedFamilies(name, key)
+			dms.invalidateFamily(name)
+		}
+		return
 	}
+	dms.deleteGroup(key, group, received)
+}
+
+// deleteGroup deletes the given group with the given grouping key, leaving a
+// tombstone deleted at the given time if tombstones are kept. The caller must
+// hold the write lock.
+func (dms *DiskMetricStore) deleteGroup(key uint64, group MetricGroup, deleted time.Time) {
+	delete(dms.metricGroups, key)
+	dms.markDirty(key)
+	if dms.tombstoneRetention > 0 {
+		dms.tombstones[key] = tombstone{Group: group, Deleted: deleted}
+	}
+	dms.getJobUsage(group.Labels["job"]).Groups--
+	for name, tmf := range group.Metrics {
+		dms.removeUsage(group.Labels["job"], tmf.MetricFamily)
+		dms.removeFromMergedFamilies(name, key)
+		dms.invalidateFamily(name)
+	}
+}
+
+// restoreGroup moves the group with the given grouping key from its tombstone
+// back into the store. It returns ErrNoTombstone if there is no tombstone. The
+// caller must hold the write lock.
+func (dms *DiskMetricStore) restoreGroup(key uint64) error {
+	ts, ok := dms.tombstones[key]
+	if !ok {
+		return ErrNoTombstone
+	}
+	delete(dms.tombstones, key)
+	dms.metricGroups[key] = ts.Group
+	dms.getJobUsage(ts.Group.Labels["job"]).Groups++
+	for name, tmf := range ts.Group.Metrics {
+		dms.addUsage(ts.Group.Labels["job"], tmf.MetricFamily)
+		dms.addToMergedFamilies(name, key)
+		dms.invalidateFamily(name)
+	}
+	return nil
+}
+
+// purgeTombstones removes the tombstones that have expired at the given time
+// and returns their number.
+func (dms *DiskMetricStore) purgeTombstones(now time.Time) int {
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+
+	purged := 0
+	for key, ts := range dms.tombstones {
+		if now.Sub(ts.Deleted) > dms.tombstoneRetention {
+			delete(dms.tombstones, key)
+			dms.markDirty(key)
+			purged++
+		}
+	}
+	return purged
+}
+
+// gc removes metric families without metrics and groups without metric
+// families. Such empty groups can result from pushes of metric families
+// without any metrics (possible with the protobuf format) and would otherwise
+// linger in the store and the persistence file forever. gc returns the number
+// of removed groups. It also forgets deletions and replacements of groups that
+// are too old to supersede any write request still to come.
+func (dms *DiskMetricStore) gc() int {
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+
+	reclaimed := 0
+	for key, group := range dms.metricGroups {
+		for name, tmf := range group.Metrics {
+			if len(tmf.MetricFamily.GetMetric()) == 0 {
+				dms.removeUsage(group.Labels["job"], tmf.MetricFamily)
+				delete(group.Metrics, name)
+				dms.removeFromMergedFamilies(name, key)
+				dms.invalidateFamily(name)
+				dms.markDirty(key)
+			}
+		}
+		if len(group.Metrics) == 0 {
+			delete(dms.metricGroups, key)
+			dms.getJobUsage(group.Labels["job"]).Groups--
+			reclaimed++
+		}
+	}
+	dms.gcReclaimedGroups.Add(float64(reclaimed))
+	for job, u := range dms.jobUsage {
+		if u.Groups == 0 {
+			delete(dms.jobUsage, job)
+		}
+	}
+	for key, t := range dms.clearedAt {
+		if time.Since(t) > clearedAtRetention {
+			delete(dms.clearedAt, key)
+		}
+	}
+	return reclaimed
+}
+
+// markDirty records that the group (or tombstone) with the given grouping key
+// has changed since the last persisting. The caller must hold the write lock.
+func (dms *DiskMetricStore) markDirty(key uint64) {
+	if dms.dirty == nil {
+		dms.dirty = map[uint64]struct{}{}
+	}
+	dms.dirty[key] = struct{}{}
+}
+
+// shareSchema checks if mf has the same schema as old, i.e. the same name, help
+// string, type, and label names of its metrics (in the same order), which is
+// the common case for a job pushing again with only the sample values changed.
+// In that case, the strings making up the schema of old are shared with mf so
+// that the ones freshly allocated while parsing mf become garbage right away
+// instead of being retained until the next push. Label values are shared where
+// they are equal, too. Only the strings are shared, never the label pairs or
+// metrics themselves, as the MetricFamilies returned by GetMetricFamilies must
+// not be affected by any later modification of mf. It returns whether the
+// schema is shared.
+func shareSchema(mf, old *dto.MetricFamily) bool {
+	if mf.GetName() != old.GetName() ||
+		mf.GetType() != old.GetType() ||
+		mf.GetHelp() != old.GetHelp() ||
+		len(mf.Metric) != len(old.Metric) {
+		return false
+	}
+	for i, m := range mf.Metric {
+		if !labelNamesEqual(m.Label, old.Metric[i].Label) {
+			return false
+		}
+	}
+	mf.Name = old.Name
+	mf.Help = old.Help
+	for i, m := range mf.Metric {
+		for j, lp := range m.Label {
+			oldLP := old.Metric[i].Label[j]
+			lp.Name = oldLP.Name
+			if lp.GetValue() == oldLP.GetValue() {
+				lp.Value = oldLP.Value
+			}
+		}
+	}
+	return true
+}
+
+func labelNamesEqual(a, b []*dto.LabelPair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].GetName() != b[i].GetName() {
+			return false
+		}
+	}
+	return true
+}
+
+// metricFamilySize returns the estimated memory used by mf.
+func metricFamilySize(mf *dto.MetricFamily) int64 {
+	return int64(proto.Size(mf))
+}
+
+// GetMetricGroup implements the MetricStore interface.
+func (dms *DiskMetricStore) GetMetricGroup(key uint64) (MetricGroup, bool) {
+	dms.lock.RLock()
+	defer dms.lock.RUnlock()
+	group, ok := dms.metricGroups[key]
+	if !ok {
+		return MetricGroup{}, false
+	}
+	return copyMetricGroup(group), true
+}
+
+// GetGroupingKeys implements the MetricStore interface.
+func (dms *DiskMetricStore) GetGroupingKeys() []uint64 {
+	dms.lock.RLock()
+	keys := make([]uint64, 0, len(dms.metricGroups))
+	for key := range dms.metricGroups {
+		keys = append(keys, key)
+	}
+	dms.lock.RUnlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
 }
 
 // GetMetricFamiliesMap implements the MetricStore interface.
@@ -224,29 +1416,386 @@ func (dms *DiskMetricStore) GetMetricFamiliesMap() GroupingKeyToMetricGroup {
 	defer dms.lock.RUnlock()
 	groupsCopy := make(GroupingKeyToMetricGroup, len(dms.metricGroups))
 	for k, g := range dms.metricGroups {
-		metricsCopy := make(NameToTimestampedMetricFamilyMap, len(g.Metrics))
-		groupsCopy[k] = MetricGroup{Labels: g.Labels, Metrics: metricsCopy}
-		for n, tmf := range g.Metrics {
-			metricsCopy[n] = tmf
-		}
+		groupsCopy[k] = copyMetricGroup(g)
 	}
 	return groupsCopy
 }
 
-func (dms *DiskMetricStore) persist() error {
+// snapshot returns a copy of the metric groups and the tombstones that can be
+// read without holding the lock, together with the grouping keys of the groups
+// changed since the previous snapshot, which are no longer considered changed
+// afterwards. If dirtyOnly is true, only the changed groups and tombstones are
+// copied. Only the maps are copied. The MetricFamilies themselves are shared,
+// as they are never modified but replaced upon change. Thus, taking a snapshot
+// is cheap compared to encoding it.
+func (dms *DiskMetricStore) snapshot(dirtyOnly bool) (GroupingKeyToMetricGroup, map[uint64]tombstone, []uint64) {
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+	dirty := make([]uint64, 0, len(dms.dirty))
+	for k := range dms.dirty {
+		dirty = append(dirty, k)
+	}
+	dms.dirty = nil
+	groups := GroupingKeyToMetricGroup{}
+	tombstones := map[uint64]tombstone{}
+	copyGroup := func(k uint64) {
+		if g, ok := dms.metricGroups[k]; ok {
+			groups[k] = copyMetricGroup(g)
+		}
+		if ts, ok := dms.tombstones[k]; ok {
+			tombstones[k] = tombstone{Group: copyMetricGroup(ts.Group), Deleted: ts.Deleted}
+		}
+	}
+	if dirtyOnly {
+		for _, k := range dirty {
+			copyGroup(k)
+		}
+		return groups, tombstones, dirty
+	}
+	for k := range dms.metricGroups {
+		copyGroup(k)
+	}
+	for k := range dms.tombstones {
+		copyGroup(k)
+	}
+	return groups, tombstones, dirty
+}
+
+// copyMetricGroup returns a copy of g with its own Metrics map. The
+// Annotations map is shared as it is never modified.
+func copyMetricGroup(g MetricGroup) MetricGroup {
+	metrics := make(NameToTimestampedMetricFamilyMap, len(g.Metrics))
+	for n, tmf := range g.Metrics {
+		metrics[n] = tmf
+	}
+	return MetricGroup{Labels: g.Labels, Metrics: metrics, Annotations: g.Annotations}
+}
+
+// persist writes a snapshot of the store to the persistence file. Unless full
+// is true, only the changes since the previous persisting are written to a
+// delta file if configured (see PersistenceMaxDeltas). It is safe to call
+// concurrently with any other method. Concurrent calls are serialized.
+func (dms *DiskMetricStore) persist(full bool) error {
 	if dms.persistenceFile == "" {
 		return nil
 	}
+	dms.persistLock.Lock()
+	defer dms.persistLock.Unlock()
+	if !dms.persisting() {
+		return nil
+	}
+
+	start := time.Now()
+	err := dms.writeSnapshot(full)
+	dms.persistDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		dms.persistFailures.Inc()
+		return err
+	}
+	dms.statsLock.Lock()
+	dms.lastPersistenceTime = time.Now()
+	dms.statsLock.Unlock()
+	return nil
+}
+
+// writeSnapshot does the work for persist. If writing fails, the changed groups
+// are considered changed again.
+func (dms *DiskMetricStore) writeSnapshot(full bool) (err error) {
+	deltas, err := dms.deltaFiles()
+	if err != nil {
+		return err
+	}
+	seq := 1
+	if len(deltas) > 0 {
+		seq = deltas[len(deltas)-1].seq + 1
+	}
+	full = full || dms.maxDeltas <= 0 || len(deltas) >= dms.maxDeltas
+	groups, tombstones, dirty := dms.snapshot(!full)
+	defer func() {
+		if err == nil {
+			return
+		}
+		dms.lock.Lock()
+		defer dms.lock.Unlock()
+		for _, k := range dirty {
+			dms.markDirty(k)
+		}
+	}()
+
+	if !full {
+		if len(dirty) == 0 {
+			return nil
+		}
+		return dms.writePersistenceFile(dms.deltaFileName(seq), newDelta(dirty, groups, tombstones))
+	}
+	if len(deltas) > 0 {
+		// If removing the delta files fails (or the process crashes
+		// before), they are applied upon start-up on top of the new
+		// persistence file. The last delta file (with the changes
+		// contained in the snapshot) ensures that doing so yields the
+		// state of the snapshot rather than an older one.
+		name := dms.deltaFileName(seq)
+		if err = dms.writePersistenceFile(name, newDelta(dirty, groups, tombstones)); err != nil {
+			return err
+		}
+		deltas = append(deltas, deltaFile{name: name, seq: seq})
+	}
+	if err = dms.writePersistenceFiles(groups, tombstones); err != nil {
+		return err
+	}
+	for _, d := range deltas {
+		if err = os.Remove(d.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delta is the content of a delta file: the groups and tombstones with the
+// grouping keys in Keys as of the time of writing. A key without a group (or
+// without a tombstone) means that the group (or the tombstone) has been
+// deleted. Its fields are exported for gob encoding.
+type delta struct {
+	Keys       []uint64
+	Groups     GroupingKeyToMetricGroup
+	Tombstones map[uint64]tombstone
+}
+
+// newDelta returns the delta of the given groups and tombstones with the given
+// grouping keys.
+func newDelta(keys []uint64, groups GroupingKeyToMetricGroup, tombstones map[uint64]tombstone) delta {
+	d := delta{
+		Keys:       keys,
+		Groups:     GroupingKeyToMetricGroup{},
+		Tombstones: map[uint64]tombstone{},
+	}
+	for _, k := range keys {
+		if g, ok := groups[k]; ok {
+			d.Groups[k] = g
+		}
+		if ts, ok := tombstones[k]; ok {
+			d.Tombstones[k] = ts
+		}
+	}
+	return d
+}
+
+// apply applies d to the given groups and tombstones.
+func (d delta) apply(groups GroupingKeyToMetricGroup, tombstones map[uint64]tombstone) {
+	for _, k := range d.Keys {
+		delete(groups, k)
+		delete(tombstones, k)
+	}
+	for k, g := range d.Groups {
+		groups[k] = g
+	}
+	for k, ts := range d.Tombstones {
+		tombstones[k] = ts
+	}
+}
+
+// deltaFile is an existing delta file, see deltaFiles.
+type deltaFile struct {
+	name string
+	seq  int
+}
+
+func (dms *DiskMetricStore) deltaFileName(seq int) string {
+	return fmt.Sprintf("%s.delta-%d", dms.persistenceFile, seq)
+}
+
+// deltaFiles returns all existing delta files by increasing sequence number.
+func (dms *DiskMetricStore) deltaFiles() ([]deltaFile, error) {
+	seqs, err := dms.numberedFiles(".delta-")
+	if err != nil {
+		return nil, err
+	}
+	files := make([]deltaFile, len(seqs))
+	for i, seq := range seqs {
+		files[i] = deltaFile{name: dms.deltaFileName(seq), seq: seq}
+	}
+	return files, nil
+}
+
+// numberedFiles returns the sorted numbers n of all existing files named like
+// the persistence file with the suffix <infix><n>.
+func (dms *DiskMetricStore) numberedFiles(infix string) ([]int, error) {
+	infos, err := ioutil.ReadDir(path.Dir(dms.persistenceFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	prefix := path.Base(dms.persistenceFile) + infix
+	var numbers []int
+	for _, fi := range infos {
+		if !strings.HasPrefix(fi.Name(), prefix) {
+			continue
+		}
+		// Leftover temporary files don't parse.
+		if i, err := strconv.Atoi(fi.Name()[len(prefix):]); err == nil && i >= 0 {
+			numbers = append(numbers, i)
+		}
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+// persistedFile is an existing persistence file, see persistedFiles.
+type persistedFile struct {
+	name, shard string
+}
+
+// persistenceFiles returns the names of the files written with the configured
+// sharding, or nil if persistence is disabled.
+func (dms *DiskMetricStore) persistenceFiles() []string {
+	if dms.persistenceFile == "" {
+		return nil
+	}
+	if dms.persistenceShards <= 1 {
+		return []string{dms.persistenceFile}
+	}
+	names := make([]string, dms.persistenceShards)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s.shard-%d", dms.persistenceFile, i)
+	}
+	return names
+}
+
+// onlyUnshardedFile returns whether the unsharded persistence file is the only
+// persisted file, i.e. there are neither shards nor delta files.
+func (dms *DiskMetricStore) onlyUnshardedFile() bool {
+	files, err := dms.persistedFiles()
+	if err != nil || len(files) != 1 || files[0].name != dms.persistenceFile {
+		return false
+	}
+	deltas, err := dms.deltaFiles()
+	return err == nil && len(deltas) == 0
+}
+
+// persistedFiles returns all existing persistence files, no matter with which
+// sharding they have been written: the unsharded persistence file first, then
+// the shards by increasing index.
+func (dms *DiskMetricStore) persistedFiles() ([]persistedFile, error) {
+	var files []persistedFile
+	if _, err := os.Stat(dms.persistenceFile); err == nil {
+		files = append(files, persistedFile{dms.persistenceFile, "unsharded"})
+	}
+	shards, err := dms.numberedFiles(".shard-")
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range shards {
+		files = append(files, persistedFile{
+			name:  fmt.Sprintf("%s.shard-%d", dms.persistenceFile, i),
+			shard: strconv.Itoa(i),
+		})
+	}
+	return files, nil
+}
+
+// shardsSuffix returns a suffix for log messages about the persistence file
+// mentioning the number of shards, if sharded.
+func (dms *DiskMetricStore) shardsSuffix() string {
+	if dms.persistenceShards <= 1 {
+		return ""
+	}
+	return fmt.Sprintf(" in %d shards", dms.persistenceShards)
+}
+
+// writePersistenceFiles writes the given groups and tombstones to the files
+// returned by persistenceFiles, distributed by grouping key and concurrently
+// if sharded. Afterwards, all other persistence files are removed.
+func (dms *DiskMetricStore) writePersistenceFiles(
+	groups GroupingKeyToMetricGroup, tombstones map[uint64]tombstone,
+) error {
+	names := dms.persistenceFiles()
+	// Tombstones follow as a second value so that older versions, which
+	// only read the first one, can still read the files.
+	if len(names) == 1 {
+		if err := dms.writePersistenceFile(names[0], groups, tombstones); err != nil {
+			return err
+		}
+	} else {
+		n := uint64(len(names))
+		shardGroups := make([]GroupingKeyToMetricGroup, n)
+		shardTombstones := make([]map[uint64]tombstone, n)
+		for i := range names {
+			shardGroups[i] = GroupingKeyToMetricGroup{}
+			shardTombstones[i] = map[uint64]tombstone{}
+		}
+		for key, group := range groups {
+			shardGroups[key%n][key] = group
+		}
+		for key, ts := range tombstones {
+			shardTombstones[key%n][key] = ts
+		}
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i, name := range names {
+			wg.Add(1)
+			go func(i int, name string) {
+				defer wg.Done()
+				errs[i] = dms.writePersistenceFile(name, shardGroups[i], shardTombstones[i])
+			}(i, name)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	files, err := dms.persistedFiles()
+	if err != nil {
+		return err
+	}
+	current := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		current[name] = struct{}{}
+	}
+	for _, f := range files {
+		if _, ok := current[f.name]; ok {
+			continue
+		}
+		if err := os.Remove(f.name); err != nil {
+			return err
+		}
+		log.Printf("Removed persistence file '%s' not matching the configured sharding.", f.name)
+	}
+	return nil
+}
+
+// writePersistenceFile writes the given values (gob encoded one after the
+// other) to the named file atomically, i.e. by writing a temporary file first
+// and renaming it afterwards.
+func (dms *DiskMetricStore) writePersistenceFile(name string, values ...interface{}) error {
 	f, err := ioutil.TempFile(
-		path.Dir(dms.persistenceFile),
-		path.Base(dms.persistenceFile)+".in_progress.",
+		path.Dir(name),
+		path.Base(name)+".in_progress.",
 	)
 	if err != nil {
 		return err
 	}
 	inProgressFileName := f.Name()
-	e := gob.NewEncoder(f)
-	if err := e.Encode(dms.metricGroups); err != nil {
+	w, err := dms.newCompressingWriter(f)
+	if err != nil {
+		f.Close()
+		os.Remove(inProgressFileName)
+		return err
+	}
+	e := gob.NewEncoder(w)
+	for _, v := range values {
+		if err := e.Encode(v); err != nil {
+			w.Close()
+			f.Close()
+			os.Remove(inProgressFileName)
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
 		f.Close()
 		os.Remove(inProgressFileName)
 		return err
@@ -255,26 +1804,172 @@ func (dms *DiskMetricStore) persist() error {
 		os.Remove(inProgressFileName)
 		return err
 	}
-	return os.Rename(inProgressFileName, dms.persistenceFile)
+	return os.Rename(inProgressFileName, name)
 }
 
-func (dms *DiskMetricStore) restore() error {
+// restore reads all persisted files (see persistedFiles) concurrently and
+// merges them into the given groups and tombstones. If a group is contained in more than one file
+// (which can only happen if removing files not matching the configured
+// sharding failed), the file coming last in the order of persistedFiles
+// wins. Afterwards, the delta files (see deltaFiles) are applied in order.
+// Files that could be read are merged even if others could not.
+func (dms *DiskMetricStore) restore(groups GroupingKeyToMetricGroup, tombstones map[uint64]tombstone) error {
 	if dms.persistenceFile == "" {
 		return nil
 	}
-	f, err := os.Open(dms.persistenceFile)
+	files, err := dms.persistedFiles()
+	if err != nil {
+		return err
+	}
+	type result struct {
+		groups     GroupingKeyToMetricGroup
+		tombstones map[uint64]tombstone
+		err        error
+	}
+	results := make([]result, len(files))
+	var wg sync.WaitGroup
+	for i, f := range files {
+		wg.Add(1)
+		go func(r *result, f persistedFile) {
+			defer wg.Done()
+			start := time.Now()
+			r.groups, r.tombstones, r.err = readPersistenceFile(f.name)
+			dms.shardLoadDuration.WithLabelValues(f.shard).Set(time.Since(start).Seconds())
+		}(&results[i], f)
+	}
+	wg.Wait()
+
+	for i, r := range results {
+		if r.err != nil {
+			if err == nil {
+				err = fmt.Errorf("reading '%s': %s", files[i].name, r.err)
+			}
+			continue
+		}
+		for key, group := range r.groups {
+			groups[key] = group
+		}
+		for key, ts := range r.tombstones {
+			tombstones[key] = ts
+		}
+	}
+
+	deltas, derr := dms.deltaFiles()
+	if derr != nil {
+		if err == nil {
+			err = derr
+		}
+		return err
+	}
+	for _, f := range deltas {
+		d, derr := readDeltaFile(f.name)
+		if derr != nil {
+			if err == nil {
+				err = fmt.Errorf("reading '%s': %s", f.name, derr)
+			}
+			continue
+		}
+		d.apply(groups, tombstones)
+	}
+	return err
+}
+
+// readDeltaFile reads the delta from the named file. A file that does not
+// exist (e.g. because it has been removed by another instance meanwhile)
+// yields an empty delta and no error.
+func readDeltaFile(name string) (delta, error) {
+	var d delta
+	f, err := os.Open(name)
 	if os.IsNotExist(err) {
-		return nil
+		return d, nil
 	}
 	if err != nil {
-		return err
+		return d, err
+	}
+	defer f.Close()
+	r, err := newDecompressingReader(f)
+	if err != nil {
+		return d, err
+	}
+	defer r.Close()
+	err = gob.NewDecoder(r).Decode(&d)
+	return d, err
+}
+
+// readPersistenceFile reads the groups and tombstones from the named file. A
+// file that does not exist yields no groups and no error.
+func readPersistenceFile(name string) (GroupingKeyToMetricGroup, map[uint64]tombstone, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
 	}
 	defer f.Close()
-	d := gob.NewDecoder(f)
-	return d.Decode(&dms.metricGroups)
+	r, err := newDecompressingReader(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	var (
+		groups     GroupingKeyToMetricGroup
+		tombstones map[uint64]tombstone
+	)
+	d := gob.NewDecoder(r)
+	if err := d.Decode(&groups); err != nil {
+		return nil, nil, err
+	}
+	// Files written by older versions contain no tombstones.
+	if err := d.Decode(&tombstones); err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	return groups, tombstones, nil
 }
 
-func (dms *DiskMetricStore) legacyRestore() error {
+// newCompressingWriter wraps w according to the configured compression. The
+// returned WriteCloser has to be closed before w is closed. Closing it will
+// not close w.
+func (dms *DiskMetricStore) newCompressingWriter(w io.Writer) (io.WriteCloser, error) {
+	switch dms.compression {
+	case GzipCompression:
+		return gzip.NewWriter(w), nil
+	case ZstdCompression:
+		return zstd.NewWriter(w)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// newDecompressingReader detects the compression of the data in r by its
+// magic number and returns a reader for the decompressed data. Data without a
+// known magic number (as written without compression or by earlier versions)
+// is read as is. Closing the returned ReadCloser will not close r.
+func newDecompressingReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		d, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (dms *DiskMetricStore) legacyRestore(groups GroupingKeyToMetricGroup) error {
 	if dms.persistenceFile == "" {
 		return nil
 	}
@@ -313,14 +2008,14 @@ func (dms *DiskMetricStore) legacyRestore() error {
 			"job":      job,
 			"instance": instance,
 		}
-		key := model.LabelsToSignature(labels)
-		group, ok := dms.metricGroups[key]
+		key := groupingkey.Hash(labels)
+		group, ok := groups[key]
 		if !ok {
 			group = MetricGroup{
 				Labels:  labels,
 				Metrics: NameToTimestampedMetricFamilyMap{},
 			}
-			dms.metricGroups[key] = group
+			groups[key] = group
 		}
 		group.Metrics[name] = tmf
 	}
@@ -346,6 +2041,28 @@ func legacyReadTimestampedMetricFamily(d *gob.Decoder) (TimestampedMetricFamily,
 	return TimestampedMetricFamily{MetricFamily: mf, Timestamp: timestamp}, nil
 }
 
+// compareMetrics compares the label sets of a and b, whose label pairs are
+// sorted by name, lexicographically by label name and value, and returns -1,
+// 0, or 1. A label set that is a prefix of the other sorts first.
+func compareMetrics(a, b *dto.Metric) int {
+	la, lb := a.GetLabel(), b.GetLabel()
+	for i := 0; i < len(la) && i < len(lb); i++ {
+		if c := strings.Compare(la[i].GetName(), lb[i].GetName()); c != 0 {
+			return c
+		}
+		if c := strings.Compare(la[i].GetValue(), lb[i].GetValue()); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(la) < len(lb):
+		return -1
+	case len(la) > len(lb):
+		return 1
+	}
+	return 0
+}
+
 func copyMetricFamily(mf *dto.MetricFamily) *dto.MetricFamily {
 	return &dto.MetricFamily{
 		Name:   mf.Name,
@@ -354,3 +2071,20 @@ func copyMetricFamily(mf *dto.MetricFamily) *dto.MetricFamily {
 		Metric: append([]*dto.Metric{}, mf.Metric...),
 	}
 }
+
+// stampMetricFamily returns a copy of mf where all metrics without a timestamp
+// have the timestamp ts attached. Metrics are only copied if they need a
+// timestamp, and mf itself is never modified.
+func stampMetricFamily(mf *dto.MetricFamily, ts time.Time) *dto.MetricFamily {
+	tsMs := proto.Int64(ts.UnixNano() / int64(time.Millisecond))
+	stamped := copyMetricFamily(mf)
+	for i, m := range stamped.Metric {
+		if m.TimestampMs != nil {
+			continue
+		}
+		mCopy := *m
+		mCopy.TimestampMs = tsMs
+		stamped.Metric[i] = &mCopy
+	}
+	return stamped
+}
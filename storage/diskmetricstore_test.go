@@ -14,11 +14,13 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
 	"path"
+	"reflect"
 	"sort"
 	"testing"
 	"time"
@@ -26,7 +28,10 @@ import (
 	"github.com/golang/protobuf/proto"
 
 	"github.com/prometheus/client_golang/model"
+	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/groupingkey"
 )
 
 var (
@@ -355,233 +360,1733 @@ func TestGetMetricFamilies(t *testing.T) {
 	)
 
 	dms := &DiskMetricStore{metricGroups: mg}
+	dms.rebuildMergedFamilies()
 
 	if err := checkMetricFamilies(dms, mf1acd, mf2, mf3, mf4); err != nil {
 		t.Error(err)
 	}
 }
 
-func TestAddDeletePersistRestore(t *testing.T) {
-	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestAddDeletePersistRestore.")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.RemoveAll(tempDir)
-	fileName := path.Join(tempDir, "persistence")
-	dms := NewDiskMetricStore(fileName, 100*time.Millisecond)
+func TestGetMetricFamiliesIncremental(t *testing.T) {
+	dms := &DiskMetricStore{metricGroups: GroupingKeyToMetricGroup{}, clearedAt: map[uint64]time.Time{}}
+	dms.rebuildMergedFamilies()
 
-	// Submit a single simple metric family.
-	ts1 := time.Now()
-	dms.SubmitWriteRequest(WriteRequest{
-		Labels: map[string]string{
-			"job":      "job1",
-			"instance": "instance1",
-		},
-		Timestamp:      ts1,
-		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	labels1 := map[string]string{"job": "job1", "instance": "instance2"}
+	labels2 := map[string]string{"job": "job2", "instance": "instance1"}
+	labels3 := map[string]string{"job": "job3", "instance": "instance2"}
+	dms.processWriteRequest(WriteRequest{
+		Labels:         labels1,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1a, "mf2": mf2},
 	})
-	time.Sleep(time.Microsecond) // Give loop() time to process.
-	if err := checkMetricFamilies(dms, mf3); err != nil {
+	dms.processWriteRequest(WriteRequest{
+		Labels:         labels2,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1c},
+	})
+	dms.processWriteRequest(WriteRequest{
+		Labels:         labels3,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1d, "mf4": mf4},
+	})
+	if err := checkMetricFamilies(dms, mf1acd, mf2, mf4); err != nil {
 		t.Error(err)
 	}
+	before := dms.GetMetricFamilies()
 
-	// Submit two metric families for a different instance.
-	ts2 := ts1.Add(time.Second)
-	dms.SubmitWriteRequest(WriteRequest{
-		Labels: map[string]string{
-			"job":      "job1",
-			"instance": "instance2",
-		},
-		Timestamp:      ts2,
-		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1b, "mf2": mf2},
+	// Delete two groups, and overwrite mf2 with mf3 (which has a different
+	// name, so mf2 stays).
+	dms.processWriteRequest(WriteRequest{Labels: labels2})
+	dms.processWriteRequest(WriteRequest{Labels: labels3})
+	dms.processWriteRequest(WriteRequest{
+		Labels:         labels1,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
 	})
-	time.Sleep(time.Microsecond) // Give loop() time to process.
-	if err := checkMetricFamilies(dms, mf1b, mf2, mf3); err != nil {
+	if err := checkMetricFamilies(dms, mf1a, mf2, mf3); err != nil {
 		t.Error(err)
 	}
 
-	// Submit a metric family with the same name for the same job/instance again.
-	// Should overwrite the previous metric family for the same job/instance
-	ts3 := ts2.Add(time.Second)
-	dms.SubmitWriteRequest(WriteRequest{
-		Labels: map[string]string{
-			"job":      "job1",
-			"instance": "instance2",
-		},
-		Timestamp:      ts3,
-		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1a},
-	})
-	time.Sleep(time.Microsecond) // Give loop() time to process.
+	// Previously returned metric families must not have been modified.
+	for _, mf := range before {
+		if mf.GetName() == "mf1" && len(mf.Metric) != len(mf1acd.Metric) {
+			t.Errorf("Previously returned metric family %v has been modified.", mf)
+		}
+	}
+
+	// Building the view from scratch yields the same result.
+	dms.rebuildMergedFamilies()
 	if err := checkMetricFamilies(dms, mf1a, mf2, mf3); err != nil {
 		t.Error(err)
 	}
+}
 
-	// Shutdown the dms.
-	if err := dms.Shutdown(); err != nil {
+func TestJobUsage(t *testing.T) {
+	dms := &DiskMetricStore{
+		metricGroups:       GroupingKeyToMetricGroup{},
+		clearedAt:          map[uint64]time.Time{},
+		tombstones:         map[uint64]tombstone{},
+		tombstoneRetention: time.Hour,
+		gcReclaimedGroups: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "test_counter",
+			Help: "Not used.",
+		}),
+	}
+	dms.rebuildMergedFamilies()
+
+	labels1 := map[string]string{"job": "job1", "instance": "instance1"}
+	labels2 := map[string]string{"job": "job1", "instance": "instance2"}
+	labels3 := map[string]string{"job": "job3", "instance": "instance2"}
+	// checkUsage compares the usage tracked by dms with the usage
+	// calculated from scratch.
+	checkUsage := func(step string) {
+		memoryUsage, jobUsage := usage(dms.metricGroups)
+		if expected, got := memoryUsage, dms.MemoryUsage(); expected != got {
+			t.Errorf("%s: Wanted memory usage %d, got %d.", step, expected, got)
+		}
+		for _, job := range []string{"job1", "job3"} {
+			var expected JobUsage
+			if u, ok := jobUsage[job]; ok {
+				expected = *u
+			}
+			if got := dms.GetJobUsage(job); expected != got {
+				t.Errorf("%s: Wanted usage %+v of %s, got %+v.", step, expected, job, got)
+			}
+		}
+	}
+
+	dms.processWriteRequest(WriteRequest{
+		Labels:         labels1,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1a, "mf2": mf2},
+	})
+	dms.processWriteRequest(WriteRequest{
+		Labels:         labels2,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	})
+	dms.processWriteRequest(WriteRequest{
+		Labels:         labels3,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1d},
+	})
+	checkUsage("push")
+	if expected, got := 2, dms.GetJobUsage("job1").Groups; expected != got {
+		t.Errorf("Wanted %d groups, got %d.", expected, got)
+	}
+
+	dms.processWriteRequest(WriteRequest{
+		Labels:         labels1,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf2": mf3},
+		Replace:        true,
+	})
+	checkUsage("replace")
+	dms.processWriteRequest(WriteRequest{Labels: labels1, MetricFamilyName: "mf2"})
+	checkUsage("delete metric family")
+	dms.processWriteRequest(WriteRequest{Labels: labels3})
+	checkUsage("delete group")
+	if err := dms.restoreGroup(groupingkey.Hash(labels3)); err != nil {
 		t.Fatal(err)
 	}
+	checkUsage("restore group")
+	dms.processWriteRequest(WriteRequest{
+		Labels:         labels3,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": {Name: proto.String("mf1")}},
+		Replace:        true,
+	})
+	dms.gc()
+	checkUsage("gc")
+	if _, ok := dms.jobUsage["job3"]; ok {
+		t.Error("Usage of job without groups not removed by gc.")
+	}
 
-	// Load it again.
-	dms = NewDiskMetricStore(fileName, 100*time.Millisecond)
-	if err := checkMetricFamilies(dms, mf1a, mf2, mf3); err != nil {
-		t.Error(err)
+	group, ok := dms.GetMetricGroup(groupingkey.Hash(labels2))
+	if !ok {
+		t.Fatal("Group not found.")
 	}
-	// Spot-check timestamp.
-	tmf := dms.metricGroups[model.LabelsToSignature(map[string]string{
-		"job":      "job1",
-		"instance": "instance2",
-	})].Metrics["mf1"]
-	if expected, got := ts3, tmf.Timestamp; expected != got {
-		t.Errorf("Expected timestamp %v, got %v.", expected, got)
+	if expected, got := "mf3", group.Metrics["mf3"].MetricFamily.GetName(); expected != got {
+		t.Errorf("Wanted metric family %q, got %q.", expected, got)
+	}
+	if _, ok := dms.GetMetricGroup(groupingkey.Hash(labels1)); ok {
+		t.Error("Deleted group found.")
 	}
+}
 
-	// Delete a group.
-	dms.SubmitWriteRequest(WriteRequest{
-		Labels: map[string]string{
-			"job":      "job1",
-			"instance": "instance1",
-		},
+func TestDeleteMetricFamily(t *testing.T) {
+	dms := &DiskMetricStore{metricGroups: GroupingKeyToMetricGroup{}, clearedAt: map[uint64]time.Time{}}
+	dms.rebuildMergedFamilies()
+
+	labels := map[string]string{"job": "job1", "instance": "instance2"}
+	dms.processWriteRequest(WriteRequest{
+		Labels:         labels,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1a, "mf2": mf2},
 	})
-	time.Sleep(time.Microsecond) // Give loop() time to process.
+
+	// Deleting a non-existing metric family is a no-op.
+	dms.processWriteRequest(WriteRequest{Labels: labels, MetricFamilyName: "mf3"})
 	if err := checkMetricFamilies(dms, mf1a, mf2); err != nil {
 		t.Error(err)
 	}
 
-	// Submit another one.
-	ts4 := ts3.Add(time.Second)
-	dms.SubmitWriteRequest(WriteRequest{
-		Labels: map[string]string{
-			"job":      "job3",
-			"instance": "instance2",
-		},
-		Timestamp:      ts4,
-		MetricFamilies: map[string]*dto.MetricFamily{"mf4": mf4},
-	})
-	time.Sleep(time.Microsecond) // Give loop() time to process.
-	if err := checkMetricFamilies(dms, mf1a, mf2, mf4); err != nil {
+	dms.processWriteRequest(WriteRequest{Labels: labels, MetricFamilyName: "mf1"})
+	if err := checkMetricFamilies(dms, mf2); err != nil {
 		t.Error(err)
 	}
+	if expected, got := int64(proto.Size(mf2)), dms.memoryUsage; expected != got {
+		t.Errorf("Wanted memory usage %d, got %d.", expected, got)
+	}
 
-	// Delete a job does not remove anything because there is no suitable
-	// grouping.
-	dms.SubmitWriteRequest(WriteRequest{
-		Labels: map[string]string{
-			"job": "job1",
-		},
-	})
-	time.Sleep(time.Microsecond) // Give loop() time to process.
-	if err := checkMetricFamilies(dms, mf1a, mf2, mf4); err != nil {
+	// Deleting the last metric family deletes the group.
+	dms.processWriteRequest(WriteRequest{Labels: labels, MetricFamilyName: "mf2"})
+	if err := checkMetricFamilies(dms); err != nil {
 		t.Error(err)
 	}
+	if expected, got := 0, len(dms.metricGroups); expected != got {
+		t.Errorf("Wanted %d groups, got %d.", expected, got)
+	}
+}
 
-	// Delete another group.
-	dms.SubmitWriteRequest(WriteRequest{
-		Labels: map[string]string{
-			"job":      "job3",
+func TestGetMetricFamiliesStampPushTime(t *testing.T) {
+	pushTime := time.Unix(1000, 0)
+
+	mg := GroupingKeyToMetricGroup{}
+	addGroup(
+		mg,
+		map[string]string{
+			"job":      "job1",
 			"instance": "instance2",
 		},
-	})
-	time.Sleep(time.Microsecond) // Give loop() time to process.
-	if err := checkMetricFamilies(dms, mf1a, mf2); err != nil {
+		NameToTimestampedMetricFamilyMap{
+			"mf2": TimestampedMetricFamily{
+				Timestamp:    pushTime,
+				MetricFamily: mf2,
+			},
+		},
+	)
+
+	dms := &DiskMetricStore{metricGroups: mg, stampPushTime: true}
+	dms.rebuildMergedFamilies()
+
+	mf2Stamped := proto.Clone(mf2).(*dto.MetricFamily)
+	for _, m := range mf2Stamped.Metric {
+		if m.TimestampMs == nil {
+			m.TimestampMs = proto.Int64(1000000)
+		}
+	}
+	if err := checkMetricFamilies(dms, mf2Stamped); err != nil {
 		t.Error(err)
 	}
-	// Check that no empty  map entry for job3 was left behind.
-	if _, stillExists := dms.metricGroups[model.LabelsToSignature(map[string]string{
-		"job":      "job3",
-		"instance": "instance2",
-	})]; stillExists {
-		t.Error("An instance map for 'job3' still exists.")
+	// The stored metric family must not have been modified.
+	for _, m := range mf2.Metric {
+		if ts := m.GetTimestampMs(); ts == 1000000 {
+			t.Errorf("Stored metric %v unexpectedly got stamped.", m)
+		}
 	}
+}
 
-	// Shutdown the dms again, directly after a number of write request
-	// (to check draining).
-	for i := 0; i < 10; i++ {
-		dms.SubmitWriteRequest(WriteRequest{
-			Labels: map[string]string{
-				"job":      "job3",
-				"instance": "instance2",
+func TestGetMetricFamiliesSorted(t *testing.T) {
+	gauge := func(name string, labels ...string) *dto.MetricFamily {
+		m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(1)}}
+		for i := 0; i < len(labels); i += 2 {
+			m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+		}
+		return &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{m}}
+	}
+	dms := &DiskMetricStore{metricGroups: GroupingKeyToMetricGroup{}, clearedAt: map[uint64]time.Time{}, sortMetrics: true}
+	dms.rebuildMergedFamilies()
+	for _, instance := range []string{"c", "a", "d", "b", "aa"} {
+		dms.processWriteRequest(WriteRequest{
+			Labels: map[string]string{"job": "job1", "instance": instance},
+			MetricFamilies: map[string]*dto.MetricFamily{
+				"z": gauge("z", "instance", instance, "job", "job1"),
+				"x": gauge("x", "instance", instance, "job", "job1"),
+				"y": gauge("y", "instance", instance),
 			},
-			Timestamp:      ts4,
-			MetricFamilies: map[string]*dto.MetricFamily{"mf4": mf4},
 		})
 	}
-	if err := dms.Shutdown(); err != nil {
-		t.Fatal(err)
-	}
-	if err := checkMetricFamilies(dms, mf1a, mf2, mf4); err != nil {
-		t.Error(err)
+	check := func() {
+		var got []string
+		for _, mf := range dms.GetMetricFamilies() {
+			for _, m := range mf.GetMetric() {
+				got = append(got, mf.GetName()+" "+m.GetLabel()[0].GetValue())
+			}
+		}
+		expected := []string{"x a", "x aa", "x b", "x c", "x d", "y a", "y aa", "y b", "y c", "y d", "z a", "z aa", "z b", "z c", "z d"}
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("Wanted %v, got %v.", expected, got)
+		}
 	}
-}
+	check()
 
-func TestNoPersistence(t *testing.T) {
-	dms := NewDiskMetricStore("", 100*time.Millisecond)
+	// Building the view from scratch yields the same order.
+	dms.rebuildMergedFamilies()
+	check()
+}
 
-	ts1 := time.Now()
-	dms.SubmitWriteRequest(WriteRequest{
-		Labels: map[string]string{
+func TestStats(t *testing.T) {
+	mg := GroupingKeyToMetricGroup{}
+	addGroup(
+		mg,
+		map[string]string{
 			"job":      "job1",
+			"instance": "instance2",
+		},
+		NameToTimestampedMetricFamilyMap{
+			"mf1": TimestampedMetricFamily{MetricFamily: mf1a},
+			"mf2": TimestampedMetricFamily{MetricFamily: mf2},
+		},
+	)
+	addGroup(
+		mg,
+		map[string]string{
+			"job":      "job2",
 			"instance": "instance1",
 		},
-		Timestamp:      ts1,
-		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
-	})
-	time.Sleep(time.Microsecond) // Give loop() time to process.
-	if err := checkMetricFamilies(dms, mf3); err != nil {
-		t.Error(err)
+		NameToTimestampedMetricFamilyMap{
+			"mf1": TimestampedMetricFamily{MetricFamily: mf1c},
+		},
+	)
+	dms := &DiskMetricStore{
+		metricGroups: mg,
+		writeQueue:   make(chan WriteRequest, writeQueueCapacity),
 	}
 
-	if err := dms.Shutdown(); err != nil {
-		t.Fatal(err)
+	stats := dms.Stats(1)
+	if expected, got := 2, stats.Groups; expected != got {
+		t.Errorf("Wanted %d groups, got %d.", expected, got)
 	}
-
-	dms = NewDiskMetricStore("", 100*time.Millisecond)
-	if err := checkMetricFamilies(dms); err != nil {
-		t.Error(err)
+	if expected, got := 4, stats.Series; expected != got {
+		t.Errorf("Wanted %d series, got %d.", expected, got)
+	}
+	if expected, got := writeQueueCapacity, stats.WriteQueueCapacity; expected != got {
+		t.Errorf("Wanted write queue capacity %d, got %d.", expected, got)
+	}
+	if !stats.LastPersistenceTime.IsZero() {
+		t.Errorf("Wanted zero last persistence time, got %v.", stats.LastPersistenceTime)
+	}
+	if expected, got := 1, len(stats.BiggestGroups); expected != got {
+		t.Fatalf("Wanted %d biggest groups, got %d.", expected, got)
+	}
+	if expected, got := "job1", stats.BiggestGroups[0].Labels["job"]; expected != got {
+		t.Errorf("Wanted biggest group of job %q, got %q.", expected, got)
+	}
+	if expected, got := 3, stats.BiggestGroups[0].Series; expected != got {
+		t.Errorf("Wanted %d series in biggest group, got %d.", expected, got)
 	}
 }
 
-func checkMetricFamilies(dms *DiskMetricStore, expectedMFs ...*dto.MetricFamily) error {
-	gotMFs := dms.GetMetricFamilies()
-	if expected, got := len(expectedMFs), len(gotMFs); expected != got {
-		return fmt.Errorf("expected %d metric families, got %d", expected, got)
+func TestGCAndMemoryUsage(t *testing.T) {
+	dms := NewDiskMetricStore(&DiskMetricStoreOptions{})
+	emptyMF := &dto.MetricFamily{
+		Name: proto.String("empty"),
+		Type: dto.MetricType_COUNTER.Enum(),
 	}
+	done := make(chan error, 2)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"empty": emptyMF},
+		Done:           done,
+	})
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:    map[string]string{"job": "job2"},
+		Timestamp: time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{
+			"empty": emptyMF,
+			"mf2":   mf2,
+		},
+		Done: done,
+	})
+	<-done
+	<-done
 
-	expectedMFsAsStrings := make([]string, len(expectedMFs))
-	for i, mf := range expectedMFs {
-		sort.Sort(metricSorter(mf.Metric))
-		expectedMFsAsStrings[i] = mf.String()
+	if expected, got := 2*int64(proto.Size(emptyMF))+int64(proto.Size(mf2)), dms.MemoryUsage(); expected != got {
+		t.Errorf("Wanted memory usage %d, got %d.", expected, got)
+	}
+	if expected, got := 1, dms.gc(); expected != got {
+		t.Errorf("Wanted %d reclaimed groups, got %d.", expected, got)
+	}
+	groups := dms.GetMetricFamiliesMap()
+	if expected, got := 1, len(groups); expected != got {
+		t.Fatalf("Wanted %d remaining groups, got %d.", expected, got)
+	}
+	group := groups[model.LabelsToSignature(map[string]string{"job": "job2"})]
+	if _, ok := group.Metrics["empty"]; ok {
+		t.Error("Empty metric family has not been removed.")
+	}
+	if _, ok := group.Metrics["mf2"]; !ok {
+		t.Error("Non-empty metric family has been removed.")
+	}
+	if expected, got := 0, dms.gc(); expected != got {
+		t.Errorf("Wanted %d reclaimed groups, got %d.", expected, got)
+	}
+	if expected, got := int64(proto.Size(mf2)), dms.MemoryUsage(); expected != got {
+		t.Errorf("Wanted memory usage %d, got %d.", expected, got)
 	}
-	sort.Strings(expectedMFsAsStrings)
 
-	gotMFsAsStrings := make([]string, len(gotMFs))
-	for i, mf := range gotMFs {
-		sort.Sort(metricSorter(mf.Metric))
-		gotMFsAsStrings[i] = mf.String()
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:    map[string]string{"job": "job2"},
+		Timestamp: time.Now(),
+		Done:      done,
+	})
+	<-done
+	if expected, got := int64(0), dms.MemoryUsage(); expected != got {
+		t.Errorf("Wanted memory usage %d, got %d.", expected, got)
 	}
-	sort.Strings(gotMFsAsStrings)
 
-	for i, got := range gotMFsAsStrings {
-		expected := expectedMFsAsStrings[i]
-		if expected != got {
-			return fmt.Errorf("expected metric family %#v, got %#v", expected, got)
-		}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
 	}
-	return nil
 }
 
-type metricSorter []*dto.Metric
-
-func (s metricSorter) Len() int {
-	return len(s)
-}
+func TestCompact(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestCompact.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(&DiskMetricStoreOptions{
+		PersistenceFile:     fileName,
+		PersistenceInterval: time.Hour,
+	})
 
-func (s metricSorter) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
-}
+	done := make(chan error, 2)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf2": mf2},
+		Done:           done,
+	})
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:    map[string]string{"job": "job2"},
+		Timestamp: time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"empty": {
+			Name: proto.String("empty"),
+			Type: dto.MetricType_COUNTER.Enum(),
+		}},
+		Done: done,
+	})
+	<-done
+	<-done
 
-func (s metricSorter) Less(i, j int) bool {
-	for n, lp := range s[i].Label {
-		vi := lp.GetValue()
+	result, err := dms.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if expected, got := 1, result.ReclaimedGroups; expected != got {
+		t.Errorf("Wanted %d reclaimed groups, got %d.", expected, got)
+	}
+	empty := &dto.MetricFamily{Name: proto.String("empty"), Type: dto.MetricType_COUNTER.Enum()}
+	if expected, got := int64(proto.Size(mf2)+proto.Size(empty)), result.MemoryBytesBefore; expected != got {
+		t.Errorf("Wanted memory usage %d before compaction, got %d.", expected, got)
+	}
+	if expected, got := int64(proto.Size(mf2)), result.MemoryBytesAfter; expected != got {
+		t.Errorf("Wanted memory usage %d after compaction, got %d.", expected, got)
+	}
+	if result.FileBytesBefore != 0 || result.FileBytesAfter == 0 {
+		t.Errorf("Unexpected persistence file sizes %d -> %d.", result.FileBytesBefore, result.FileBytesAfter)
+	}
+	if _, err := os.Stat(fileName); err != nil {
+		t.Errorf("Persistence file not written: %s", err)
+	}
+	if err := checkMetricFamilies(dms, mf2); err != nil {
+		t.Error(err)
+	}
+
+	// Check the storage metrics.
+	for _, s := range []struct {
+		metric   prometheus.Metric
+		expected func(*dto.Metric) bool
+	}{
+		{dms.writeDuration, func(m *dto.Metric) bool { return m.GetHistogram().GetSampleCount() == 2 }},
+		{dms.persistDuration, func(m *dto.Metric) bool { return m.GetHistogram().GetSampleCount() == 1 }},
+		{dms.persistFailures, func(m *dto.Metric) bool { return m.GetCounter().GetValue() == 0 }},
+		{dms.writeQueueLength, func(m *dto.Metric) bool { return m.GetGauge().GetValue() == 0 }},
+		{dms.lastPersistSuccess, func(m *dto.Metric) bool { return m.GetGauge().GetValue() > 0 }},
+		{dms.persistenceFileBytes, func(m *dto.Metric) bool {
+			return m.GetGauge().GetValue() == float64(result.FileBytesAfter)
+		}},
+	} {
+		var m dto.Metric
+		if err := s.metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		if !s.expected(&m) {
+			t.Errorf("Unexpected value of %s: %s", s.metric.Desc(), m.String())
+		}
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dms.Compact(); err != ErrShutdown {
+		t.Errorf("Wanted error %v after shutdown, got %v.", ErrShutdown, err)
+	}
+}
+
+func TestPushesDuringPersist(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestPushesDuringPersist.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	dms := NewDiskMetricStore(&DiskMetricStoreOptions{
+		PersistenceFile:     path.Join(tempDir, "persistence"),
+		PersistenceInterval: time.Millisecond,
+	})
+
+	push := func(i int) time.Duration {
+		done := make(chan error, 1)
+		start := time.Now()
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": fmt.Sprint(i)},
+			Timestamp:      time.Now(),
+			MetricFamilies: map[string]*dto.MetricFamily{"mf2": mf2},
+			Done:           done,
+		})
+		<-done
+		return time.Since(start)
+	}
+
+	// Simulate a persisting that is stuck in disk I/O. Both the scheduled
+	// persisting and the one of a compaction have to wait for it.
+	dms.persistLock.Lock()
+	compacted := make(chan CompactionResult)
+	go func() {
+		result, _ := dms.Compact()
+		compacted <- result
+	}()
+	var maxLatency time.Duration
+	for i := 0; i < 100; i++ {
+		if latency := push(i); latency > maxLatency {
+			maxLatency = latency
+		}
+	}
+	if maxLatency > 100*time.Millisecond {
+		t.Errorf("Push latency went up to %v while persisting.", maxLatency)
+	}
+	select {
+	case <-compacted:
+		t.Error("Compaction finished while persisting was blocked.")
+	default:
+	}
+	dms.persistLock.Unlock()
+
+	result := <-compacted
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 100, len(dms.GetMetricFamiliesMap()); expected != got {
+		t.Errorf("Wanted %d groups, got %d.", expected, got)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dms := &DiskMetricStore{
+		metricGroups:       GroupingKeyToMetricGroup{},
+		tombstones:         map[uint64]tombstone{},
+		tombstoneRetention: time.Hour,
+		clearedAt:          map[uint64]time.Time{},
+	}
+	dms.rebuildMergedFamilies()
+	labels1 := map[string]string{"job": "job1"}
+	labels2 := map[string]string{"job": "job2"}
+	dms.processWriteRequest(WriteRequest{
+		Labels:         labels1,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf2": mf2},
+	})
+	dms.processWriteRequest(WriteRequest{
+		Labels:         labels2,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	})
+	dms.processWriteRequest(WriteRequest{Labels: labels2})
+
+	groups, tombstones, _ := dms.snapshot(false)
+
+	// Changes after taking the snapshot must not show up in it.
+	dms.processWriteRequest(WriteRequest{
+		Labels:         labels1,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf4": mf4},
+	})
+	dms.processWriteRequest(WriteRequest{Labels: labels2, Restore: true})
+	dms.processWriteRequest(WriteRequest{
+		Labels:         labels2,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf4": mf4},
+	})
+
+	if expected, got := 1, len(groups); expected != got {
+		t.Fatalf("Wanted %d groups in snapshot, got %d.", expected, got)
+	}
+	if expected, got := 1, len(groups[model.LabelsToSignature(labels1)].Metrics); expected != got {
+		t.Errorf("Wanted %d metric families in snapshot, got %d.", expected, got)
+	}
+	if expected, got := 1, len(tombstones); expected != got {
+		t.Fatalf("Wanted %d tombstones in snapshot, got %d.", expected, got)
+	}
+	if expected, got := 1, len(tombstones[model.LabelsToSignature(labels2)].Group.Metrics); expected != got {
+		t.Errorf("Wanted %d metric families in tombstone, got %d.", expected, got)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestTombstones.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	opts := &DiskMetricStoreOptions{
+		PersistenceFile:     path.Join(tempDir, "persistence"),
+		PersistenceInterval: time.Hour,
+		TombstoneRetention:  time.Hour,
+	}
+	dms := NewDiskMetricStore(opts)
+	labels := map[string]string{"job": "job1"}
+
+	process := func(wr WriteRequest) error {
+		done := make(chan error, 1)
+		wr.Labels = labels
+		wr.Timestamp = time.Now()
+		wr.Done = done
+		dms.SubmitWriteRequest(wr)
+		return <-done
+	}
+
+	if err := process(WriteRequest{Restore: true}); err != ErrNoTombstone {
+		t.Errorf("Wanted error %v, got %v.", ErrNoTombstone, err)
+	}
+	process(WriteRequest{MetricFamilies: map[string]*dto.MetricFamily{"mf2": mf2}})
+	process(WriteRequest{})
+	if err := checkMetricFamilies(dms); err != nil {
+		t.Error(err)
+	}
+	if expected, got := int64(0), dms.MemoryUsage(); expected != got {
+		t.Errorf("Wanted memory usage %d, got %d.", expected, got)
+	}
+	if err := process(WriteRequest{Restore: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMetricFamilies(dms, mf2); err != nil {
+		t.Error(err)
+	}
+	if expected, got := int64(proto.Size(mf2)), dms.MemoryUsage(); expected != got {
+		t.Errorf("Wanted memory usage %d, got %d.", expected, got)
+	}
+	// The tombstone is gone after restoring.
+	if err := process(WriteRequest{Restore: true}); err != ErrNoTombstone {
+		t.Errorf("Wanted error %v, got %v.", ErrNoTombstone, err)
+	}
+
+	// Tombstones survive a restart.
+	process(WriteRequest{})
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	dms = NewDiskMetricStore(opts)
+	if err := checkMetricFamilies(dms); err != nil {
+		t.Error(err)
+	}
+	if expected, got := 0, dms.purgeTombstones(time.Now()); expected != got {
+		t.Errorf("Wanted %d purged tombstones, got %d.", expected, got)
+	}
+	if err := process(WriteRequest{Restore: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMetricFamilies(dms, mf2); err != nil {
+		t.Error(err)
+	}
+
+	// A push supersedes the tombstone.
+	process(WriteRequest{})
+	process(WriteRequest{MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3}})
+	if err := process(WriteRequest{Restore: true}); err != ErrNoTombstone {
+		t.Errorf("Wanted error %v, got %v.", ErrNoTombstone, err)
+	}
+
+	// Expired tombstones are purged.
+	process(WriteRequest{})
+	if expected, got := 1, dms.purgeTombstones(time.Now().Add(2*time.Hour)); expected != got {
+		t.Errorf("Wanted %d purged tombstones, got %d.", expected, got)
+	}
+	if err := process(WriteRequest{Restore: true}); err != ErrNoTombstone {
+		t.Errorf("Wanted error %v, got %v.", ErrNoTombstone, err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	rules := []RetentionRule{
+		{Job: "nightly-*", MaxAge: Duration(time.Hour)},
+		{Job: "scratch", Schedule: mustParseSchedule(t, "0 3 * * *")},
+	}
+	dms := NewDiskMetricStore(&DiskMetricStoreOptions{
+		TombstoneRetention: time.Hour,
+		RetentionRules:     rules,
+	})
+	start := time.Date(2015, 6, 1, 2, 59, 30, 0, time.Local)
+
+	process := func(wr WriteRequest) error {
+		done := make(chan error, 1)
+		wr.Done = done
+		dms.SubmitWriteRequest(wr)
+		return <-done
+	}
+	for job, pushed := range map[string]time.Time{
+		"nightly-a": start.Add(-2 * time.Hour),
+		"nightly-b": start,
+		"scratch":   start,
+		"other":     start.Add(-2 * time.Hour),
+	} {
+		process(WriteRequest{
+			Labels:         map[string]string{"job": job},
+			Timestamp:      pushed,
+			MetricFamilies: map[string]*dto.MetricFamily{"mf2": mf2},
+		})
+	}
+	jobs := func() string {
+		var jobs []string
+		for _, group := range dms.GetMetricFamiliesMap() {
+			jobs = append(jobs, group.Labels["job"])
+		}
+		sort.Strings(jobs)
+		return fmt.Sprint(jobs)
+	}
+
+	if expected, got := 1, dms.applyRetention(start, start.Add(-time.Minute)); expected != got {
+		t.Errorf("Wanted %d deleted groups, got %d.", expected, got)
+	}
+	if expected, got := "[nightly-b other scratch]", jobs(); expected != got {
+		t.Errorf("Wanted jobs %s, got %s.", expected, got)
+	}
+	// 3:00 is due now.
+	if expected, got := 1, dms.applyRetention(start.Add(time.Minute), start); expected != got {
+		t.Errorf("Wanted %d deleted groups, got %d.", expected, got)
+	}
+	if expected, got := "[nightly-b other]", jobs(); expected != got {
+		t.Errorf("Wanted jobs %s, got %s.", expected, got)
+	}
+	if expected, got := 0, dms.applyRetention(start.Add(2*time.Minute), start.Add(time.Minute)); expected != got {
+		t.Errorf("Wanted %d deleted groups, got %d.", expected, got)
+	}
+	// Deleted groups leave tombstones.
+	if err := process(WriteRequest{Labels: map[string]string{"job": "nightly-a"}, Restore: true}); err != nil {
+		t.Error(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	for _, s := range []struct {
+		spec    string
+		matches []string
+		misses  []string
+	}{
+		{
+			spec:    "0 3 * * *",
+			matches: []string{"2015-06-01 03:00", "2015-06-02 03:00"},
+			misses:  []string{"2015-06-01 03:01", "2015-06-01 15:00"},
+		},
+		{
+			spec:    "*/15 8-17 * * 1-5",
+			matches: []string{"2015-06-01 08:00", "2015-06-05 17:45"},
+			misses:  []string{"2015-06-01 08:10", "2015-06-06 12:00", "2015-06-01 18:00"},
+		},
+		{
+			spec:    "30 0 1,15 * 7",
+			matches: []string{"2015-06-01 00:30", "2015-06-15 00:30", "2015-06-07 00:30"},
+			misses:  []string{"2015-06-02 00:30"},
+		},
+	} {
+		schedule := mustParseSchedule(t, s.spec)
+		for _, ts := range s.matches {
+			if !schedule.Matches(mustParseTime(t, ts)) {
+				t.Errorf("Wanted %q to match %s.", s.spec, ts)
+			}
+		}
+		for _, ts := range s.misses {
+			if schedule.Matches(mustParseTime(t, ts)) {
+				t.Errorf("Wanted %q not to match %s.", s.spec, ts)
+			}
+		}
+	}
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("Wanted error for %q.", spec)
+		}
+	}
+}
+
+func TestLoadRetentionRules(t *testing.T) {
+	f, err := ioutil.TempFile("", "diskmetricstore.TestLoadRetentionRules.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, `[{"job": "nightly-*", "maxAge": "7d"}, {"job": "scratch", "schedule": "0 3 * * *"}]`)
+	f.Close()
+
+	rules, err := LoadRetentionRules(f.Name(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 3, len(rules); expected != got {
+		t.Fatalf("Wanted %d rules, got %d.", expected, got)
+	}
+	if expected, got := Duration(7*24*time.Hour), rules[0].MaxAge; expected != got {
+		t.Errorf("Wanted max age %v, got %v.", expected, got)
+	}
+	if expected, got := "0 3 * * *", rules[1].Schedule.String(); expected != got {
+		t.Errorf("Wanted schedule %q, got %q.", expected, got)
+	}
+	if expected, got := Duration(time.Hour), rules[2].MaxAge; expected != got || rules[2].Job != "" {
+		t.Errorf("Wanted max age %v for all jobs, got %v for %q.", expected, got, rules[2].Job)
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte(`[{"job": "scratch"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRetentionRules(f.Name(), 0); err == nil {
+		t.Error("Wanted error for rule without maxAge and schedule.")
+	}
+}
+
+func mustParseSchedule(t *testing.T, spec string) *Schedule {
+	s, err := ParseSchedule(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func mustParseTime(t *testing.T, s string) time.Time {
+	ts, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func TestLastWriterWins(t *testing.T) {
+	dms := &DiskMetricStore{
+		metricGroups: GroupingKeyToMetricGroup{},
+		clearedAt:    map[uint64]time.Time{},
+	}
+	dms.rebuildMergedFamilies()
+	labels := map[string]string{"job": "job1"}
+	t0 := time.Now()
+
+	process := func(wr WriteRequest) error {
+		done := make(chan error, 1)
+		wr.Labels = labels
+		wr.Done = done
+		dms.processWriteRequest(wr)
+		return <-done
+	}
+
+	// A PUT received at t1 is still parsed while a DELETE received at t2
+	// is processed. The PUT must not bring the group back.
+	if err := process(WriteRequest{Timestamp: t0, MetricFamilies: map[string]*dto.MetricFamily{"mf2": mf2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := process(WriteRequest{Timestamp: t0.Add(2 * time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := process(WriteRequest{
+		Timestamp:      t0.Add(time.Second),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+		Replace:        true,
+	}); err != ErrSuperseded {
+		t.Errorf("Wanted error %v, got %v.", ErrSuperseded, err)
+	}
+	if err := checkMetricFamilies(dms); err != nil {
+		t.Error(err)
+	}
+
+	// A DELETE received at t4 is processed after a POST received at t5,
+	// so only the metrics pushed before t4 are deleted.
+	process(WriteRequest{Timestamp: t0.Add(3 * time.Second), MetricFamilies: map[string]*dto.MetricFamily{"mf2": mf2}})
+	process(WriteRequest{Timestamp: t0.Add(5 * time.Second), MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3}})
+	if err := process(WriteRequest{Timestamp: t0.Add(4 * time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMetricFamilies(dms, mf3); err != nil {
+		t.Error(err)
+	}
+
+	// A POST received at t6 is processed after a POST received at t7
+	// pushing the same metric family, so the latter's version is kept.
+	mf3b := proto.Clone(mf3).(*dto.MetricFamily)
+	mf3b.Metric[0].Untyped.Value = proto.Float64(23)
+	process(WriteRequest{Timestamp: t0.Add(7 * time.Second), MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3b}})
+	process(WriteRequest{Timestamp: t0.Add(6 * time.Second), MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3}})
+	if err := checkMetricFamilies(dms, mf3b); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	dms := &DiskMetricStore{
+		metricGroups: GroupingKeyToMetricGroup{},
+		clearedAt:    map[uint64]time.Time{},
+	}
+	dms.rebuildMergedFamilies()
+	labels := map[string]string{"job": "job1"}
+	key := model.LabelsToSignature(labels)
+
+	for i, s := range []struct {
+		wr       WriteRequest
+		expected map[string]string
+	}{
+		{ // Annotations without a group are dropped.
+			wr:       WriteRequest{MetricFamilies: map[string]*dto.MetricFamily{}, Annotations: map[string]string{"a": "1"}},
+			expected: nil,
+		},
+		{
+			wr:       WriteRequest{MetricFamilies: map[string]*dto.MetricFamily{"mf2": mf2}, Annotations: map[string]string{"a": "1", "b": "2"}},
+			expected: map[string]string{"a": "1", "b": "2"},
+		},
+		{ // Merged, with an empty value removing an annotation.
+			wr:       WriteRequest{MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3}, Annotations: map[string]string{"a": "", "c": "3"}},
+			expected: map[string]string{"b": "2", "c": "3"},
+		},
+		{ // Without annotations, nothing changes.
+			wr:       WriteRequest{MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3}},
+			expected: map[string]string{"b": "2", "c": "3"},
+		},
+		{ // Only annotations.
+			wr:       WriteRequest{MetricFamilies: map[string]*dto.MetricFamily{}, Annotations: map[string]string{"d": "4"}},
+			expected: map[string]string{"b": "2", "c": "3", "d": "4"},
+		},
+		{ // Replaced.
+			wr:       WriteRequest{MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3}, Annotations: map[string]string{"e": "5"}, Replace: true},
+			expected: map[string]string{"e": "5"},
+		},
+		{
+			wr:       WriteRequest{MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3}, Replace: true},
+			expected: nil,
+		},
+	} {
+		s.wr.Labels = labels
+		dms.processWriteRequest(s.wr)
+		if got := dms.metricGroups[key].Annotations; !reflect.DeepEqual(s.expected, got) {
+			t.Errorf("%d: Wanted annotations %v, got %v.", i, s.expected, got)
+		}
+	}
+}
+
+func TestPatch(t *testing.T) {
+	dms := &DiskMetricStore{
+		metricGroups: GroupingKeyToMetricGroup{},
+		clearedAt:    map[uint64]time.Time{},
+	}
+	dms.rebuildMergedFamilies()
+	labels := map[string]string{"job": "job1"}
+	gauge := func(values ...float64) *dto.MetricFamily {
+		mf := &dto.MetricFamily{Name: proto.String("g"), Type: dto.MetricType_GAUGE.Enum()}
+		for i, v := range values {
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("job"), Value: proto.String("job1")},
+					{Name: proto.String("shard"), Value: proto.String(fmt.Sprint(i))},
+				},
+				Gauge: &dto.Gauge{Value: proto.Float64(v)},
+			})
+		}
+		return mf
+	}
+	process := func(wr WriteRequest) error {
+		done := make(chan error, 1)
+		wr.Labels = labels
+		wr.Done = done
+		dms.processWriteRequest(wr)
+		return <-done
+	}
+	t0 := time.Now()
+
+	if err := process(WriteRequest{Timestamp: t0, MetricFamilies: map[string]*dto.MetricFamily{"g": gauge(1, 2, 3)}, Patch: true}); err == nil {
+		t.Error("Expected error for patch of missing group.")
+	}
+	process(WriteRequest{Timestamp: t0, MetricFamilies: map[string]*dto.MetricFamily{"g": gauge(1, 2, 3), "mf3": mf3}})
+
+	// Patch the second metric only.
+	patch := gauge(0, 20)
+	patch.Metric = patch.Metric[1:]
+	if err := process(WriteRequest{Timestamp: t0.Add(time.Second), MetricFamilies: map[string]*dto.MetricFamily{"g": patch}, Patch: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMetricFamilies(dms, gauge(1, 20, 3), mf3); err != nil {
+		t.Error(err)
+	}
+
+	// Unknown metric families, unknown metrics, and type mismatches are
+	// rejected without changing anything.
+	untyped := proto.Clone(mf3).(*dto.MetricFamily)
+	untyped.Metric[0].Untyped.Value = proto.Float64(23)
+	unknown := gauge(7)
+	unknown.Metric[0].Label[1].Value = proto.String("x")
+	for _, mfs := range []map[string]*dto.MetricFamily{
+		{"g": gauge(7), "mf2": mf2},
+		{"g": gauge(7, 7, 7, 7)},
+		{"g": gauge(7), "mf3": gauge(7)},
+		{"mf3": untyped, "g": unknown},
+	} {
+		if err := process(WriteRequest{Timestamp: t0.Add(time.Second), MetricFamilies: mfs, Patch: true}); err == nil {
+			t.Errorf("Expected error for patch with %v.", mfs)
+		}
+	}
+	if err := checkMetricFamilies(dms, gauge(1, 20, 3), mf3); err != nil {
+		t.Error(err)
+	}
+
+	// A patch received before the last push of the metric family does
+	// not overwrite it.
+	if err := process(WriteRequest{Timestamp: t0, MetricFamilies: map[string]*dto.MetricFamily{"g": gauge(7)}, Patch: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMetricFamilies(dms, gauge(1, 20, 3), mf3); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReplaceHistogram(t *testing.T) {
+	dms := &DiskMetricStore{
+		metricGroups: GroupingKeyToMetricGroup{},
+		clearedAt:    map[uint64]time.Time{},
+	}
+	dms.rebuildMergedFamilies()
+	labels := map[string]string{"job": "job1"}
+	histogram := func(bounds ...float64) *dto.MetricFamily {
+		h := &dto.Histogram{SampleCount: proto.Uint64(uint64(len(bounds)))}
+		for i, b := range bounds {
+			h.Bucket = append(h.Bucket, &dto.Bucket{
+				UpperBound:      proto.Float64(b),
+				CumulativeCount: proto.Uint64(uint64(i + 1)),
+			})
+		}
+		return &dto.MetricFamily{
+			Name: proto.String("h"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{
+				Label:     []*dto.LabelPair{{Name: proto.String("job"), Value: proto.String("job1")}},
+				Histogram: h,
+			}},
+		}
+	}
+
+	dms.processWriteRequest(WriteRequest{
+		Labels:         labels,
+		MetricFamilies: map[string]*dto.MetricFamily{"h": histogram(1, 2, math.Inf(+1)), "mf3": mf3},
+	})
+	// A POST with a different bucket layout replaces the histogram as a
+	// whole without touching the other metric family.
+	dms.processWriteRequest(WriteRequest{
+		Labels:         labels,
+		MetricFamilies: map[string]*dto.MetricFamily{"h": histogram(0.5, math.Inf(+1))},
+	})
+	if err := checkMetricFamilies(dms, histogram(0.5, math.Inf(+1)), mf3); err != nil {
+		t.Error(err)
+	}
+	// Same for a PATCH.
+	done := make(chan error, 1)
+	dms.processWriteRequest(WriteRequest{
+		Labels:         labels,
+		MetricFamilies: map[string]*dto.MetricFamily{"h": histogram(5)},
+		Patch:          true,
+		Done:           done,
+	})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMetricFamilies(dms, histogram(5), mf3); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSortedLabelsWith(t *testing.T) {
+	mg := MetricGroup{Labels: map[string]string{
+		"job":       "job1",
+		"pod":       "pod1",
+		"namespace": "ns1",
+		"a":         "b",
+		"z":         "y",
+	}}
+	expected := []string{"namespace", "pod", "job", "a", "z"}
+	got := mg.SortedLabelsWith([]string{"namespace", "instance", "pod", "job"})
+	if fmt.Sprint(expected) != fmt.Sprint(got) {
+		t.Errorf("Wanted sorted labels %v, got %v.", expected, got)
+	}
+}
+
+func TestAddDeletePersistRestore(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestAddDeletePersistRestore.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(&DiskMetricStoreOptions{
+		PersistenceFile:     fileName,
+		PersistenceInterval: 100 * time.Millisecond,
+	})
+
+	// Submit a single simple metric family.
+	ts1 := time.Now()
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels: map[string]string{
+			"job":      "job1",
+			"instance": "instance1",
+		},
+		Timestamp:      ts1,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	})
+	time.Sleep(time.Microsecond) // Give loop() time to process.
+	if err := checkMetricFamilies(dms, mf3); err != nil {
+		t.Error(err)
+	}
+
+	// Submit two metric families for a different instance.
+	ts2 := ts1.Add(time.Second)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels: map[string]string{
+			"job":      "job1",
+			"instance": "instance2",
+		},
+		Timestamp:      ts2,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1b, "mf2": mf2},
+	})
+	time.Sleep(time.Microsecond) // Give loop() time to process.
+	if err := checkMetricFamilies(dms, mf1b, mf2, mf3); err != nil {
+		t.Error(err)
+	}
+
+	// Submit a metric family with the same name for the same job/instance again.
+	// Should overwrite the previous metric family for the same job/instance
+	ts3 := ts2.Add(time.Second)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels: map[string]string{
+			"job":      "job1",
+			"instance": "instance2",
+		},
+		Timestamp:      ts3,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1a},
+	})
+	time.Sleep(time.Microsecond) // Give loop() time to process.
+	if err := checkMetricFamilies(dms, mf1a, mf2, mf3); err != nil {
+		t.Error(err)
+	}
+
+	// Shutdown the dms.
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Load it again.
+	dms = NewDiskMetricStore(&DiskMetricStoreOptions{
+		PersistenceFile:     fileName,
+		PersistenceInterval: 100 * time.Millisecond,
+	})
+	if err := checkMetricFamilies(dms, mf1a, mf2, mf3); err != nil {
+		t.Error(err)
+	}
+	// Spot-check timestamp.
+	tmf := dms.metricGroups[model.LabelsToSignature(map[string]string{
+		"job":      "job1",
+		"instance": "instance2",
+	})].Metrics["mf1"]
+	if expected, got := ts3, tmf.Timestamp; expected != got {
+		t.Errorf("Expected timestamp %v, got %v.", expected, got)
+	}
+
+	// Delete a group.
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels: map[string]string{
+			"job":      "job1",
+			"instance": "instance1",
+		},
+	})
+	time.Sleep(time.Microsecond) // Give loop() time to process.
+	if err := checkMetricFamilies(dms, mf1a, mf2); err != nil {
+		t.Error(err)
+	}
+
+	// Submit another one.
+	ts4 := ts3.Add(time.Second)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels: map[string]string{
+			"job":      "job3",
+			"instance": "instance2",
+		},
+		Timestamp:      ts4,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf4": mf4},
+	})
+	time.Sleep(time.Microsecond) // Give loop() time to process.
+	if err := checkMetricFamilies(dms, mf1a, mf2, mf4); err != nil {
+		t.Error(err)
+	}
+
+	// Delete a job does not remove anything because there is no suitable
+	// grouping.
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels: map[string]string{
+			"job": "job1",
+		},
+	})
+	time.Sleep(time.Microsecond) // Give loop() time to process.
+	if err := checkMetricFamilies(dms, mf1a, mf2, mf4); err != nil {
+		t.Error(err)
+	}
+
+	// Delete another group.
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels: map[string]string{
+			"job":      "job3",
+			"instance": "instance2",
+		},
+	})
+	time.Sleep(time.Microsecond) // Give loop() time to process.
+	if err := checkMetricFamilies(dms, mf1a, mf2); err != nil {
+		t.Error(err)
+	}
+	// Check that no empty  map entry for job3 was left behind.
+	if _, stillExists := dms.metricGroups[model.LabelsToSignature(map[string]string{
+		"job":      "job3",
+		"instance": "instance2",
+	})]; stillExists {
+		t.Error("An instance map for 'job3' still exists.")
+	}
+
+	// Shutdown the dms again, directly after a number of write request
+	// (to check draining).
+	for i := 0; i < 10; i++ {
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels: map[string]string{
+				"job":      "job3",
+				"instance": "instance2",
+			},
+			Timestamp:      ts4,
+			MetricFamilies: map[string]*dto.MetricFamily{"mf4": mf4},
+		})
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMetricFamilies(dms, mf1a, mf2, mf4); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPersistCompression(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestPersistCompression.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	for _, scenario := range []struct {
+		compression Compression
+		magic       []byte
+	}{
+		{GzipCompression, gzipMagic},
+		{ZstdCompression, zstdMagic},
+	} {
+		fileName := path.Join(tempDir, string(scenario.compression))
+		dms := NewDiskMetricStore(&DiskMetricStoreOptions{
+			PersistenceFile:        fileName,
+			PersistenceInterval:    100 * time.Millisecond,
+			PersistenceCompression: scenario.compression,
+		})
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels: map[string]string{
+				"job":      "job1",
+				"instance": "instance1",
+			},
+			Timestamp:      time.Now(),
+			MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+		})
+		if err := dms.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(content, scenario.magic) {
+			t.Errorf("%s: persistence file does not start with the expected magic number", scenario.compression)
+		}
+
+		// Load it again without compression configured.
+		dms = NewDiskMetricStore(&DiskMetricStoreOptions{
+			PersistenceFile:     fileName,
+			PersistenceInterval: 100 * time.Millisecond,
+		})
+		if err := checkMetricFamilies(dms, mf3); err != nil {
+			t.Errorf("%s: %s", scenario.compression, err)
+		}
+	}
+}
+
+func TestLoadInBackground(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestLoadInBackground.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "metrics")
+
+	dms := NewDiskMetricStore(&DiskMetricStoreOptions{PersistenceFile: fileName})
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	})
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	dms = NewDiskMetricStore(&DiskMetricStoreOptions{PersistenceFile: fileName, LoadInBackground: true})
+	// A write request submitted while loading is applied on top.
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance2"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf4": mf4},
+	})
+	select {
+	case <-dms.Loaded():
+	case <-time.After(time.Second):
+		t.Fatal("Loading not done after a second.")
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMetricFamilies(dms, mf3, mf4); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStandbyReload(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestStandbyReload.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "metrics")
+
+	leader := NewDiskMetricStore(&DiskMetricStoreOptions{PersistenceFile: fileName})
+	standby := NewDiskMetricStore(&DiskMetricStoreOptions{PersistenceFile: fileName})
+	standby.SetPersisting(false)
+	leader.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	})
+	if err := leader.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	// The standby must neither overwrite the persisted state upon
+	// shutdown nor before taking over.
+	if err := standby.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMetricFamilies(standby, mf3); err != nil {
+		t.Error(err)
+	}
+	standby.SetPersisting(true)
+	standby.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance2"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf4": mf4},
+	})
+	if err := standby.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := standby.Reload(); err != ErrShutdown {
+		t.Errorf("Wanted ErrShutdown reloading after shutdown, got %v.", err)
+	}
+
+	dms := NewDiskMetricStore(&DiskMetricStoreOptions{PersistenceFile: fileName})
+	defer dms.Shutdown()
+	if err := checkMetricFamilies(dms, mf3, mf4); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPersistenceShards(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestPersistenceShards.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "metrics")
+
+	// Each scenario loads what the previous one has persisted.
+	for _, scenario := range []struct {
+		shards int
+		files  []string
+	}{
+		{4, []string{"metrics.shard-0", "metrics.shard-1", "metrics.shard-2", "metrics.shard-3"}},
+		{2, []string{"metrics.shard-0", "metrics.shard-1"}},
+		{1, []string{"metrics"}},
+		{3, []string{"metrics.shard-0", "metrics.shard-1", "metrics.shard-2"}},
+	} {
+		dms := NewDiskMetricStore(&DiskMetricStoreOptions{
+			PersistenceFile:     fileName,
+			PersistenceInterval: 100 * time.Millisecond,
+			PersistenceShards:   scenario.shards,
+		})
+		if len(scenario.files) == 4 {
+			for i := 0; i < 20; i++ {
+				dms.SubmitWriteRequest(WriteRequest{
+					Labels: map[string]string{
+						"job":      "job1",
+						"instance": fmt.Sprint("instance", i),
+					},
+					Timestamp:      time.Now(),
+					MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+				})
+			}
+		}
+		if err := dms.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := 20, len(dms.GetMetricFamiliesMap()); expected != got {
+			t.Errorf("%d shards: expected %d groups, got %d", scenario.shards, expected, got)
+		}
+
+		infos, err := ioutil.ReadDir(tempDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		for _, fi := range infos {
+			files = append(files, fi.Name())
+		}
+		if !reflect.DeepEqual(scenario.files, files) {
+			t.Errorf("%d shards: expected files %v, got %v", scenario.shards, scenario.files, files)
+		}
+	}
+}
+
+func TestCorruptPersistenceShard(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestCorruptPersistenceShard.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "metrics")
+	opts := &DiskMetricStoreOptions{
+		PersistenceFile:     fileName,
+		PersistenceInterval: 100 * time.Millisecond,
+		PersistenceShards:   4,
+	}
+
+	dms := NewDiskMetricStore(opts)
+	for i := 0; i < 20; i++ {
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels: map[string]string{
+				"job":      "job1",
+				"instance": fmt.Sprint("instance", i),
+			},
+			Timestamp:      time.Now(),
+			MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+		})
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := fileName + ".shard-1"
+	lost, _, err := readPersistenceFile(corrupt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lost) == 0 {
+		t.Fatalf("No groups persisted in %s.", corrupt)
+	}
+	if err := ioutil.WriteFile(corrupt, []byte("garbage"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// The groups of the other shards are loaded (and not retried in the
+	// legacy format, which would yield none).
+	dms = NewDiskMetricStore(opts)
+	if expected, got := 20-len(lost), len(dms.GetMetricFamiliesMap()); expected != got {
+		t.Errorf("Expected %d groups, got %d.", expected, got)
+	}
+	// Reloading fails and leaves the store untouched.
+	if err := dms.Reload(); err == nil {
+		t.Error("Expected error when reloading with a corrupt shard.")
+	}
+	if expected, got := 20-len(lost), len(dms.GetMetricFamiliesMap()); expected != got {
+		t.Errorf("Expected %d groups after failed reload, got %d.", expected, got)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The groups of the other shards have been persisted again.
+	dms = NewDiskMetricStore(opts)
+	if expected, got := 20-len(lost), len(dms.GetMetricFamiliesMap()); expected != got {
+		t.Errorf("Expected %d groups after restart, got %d.", expected, got)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPersistenceDeltas(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestPersistenceDeltas.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "metrics")
+	labels := func(instance string) map[string]string {
+		return map[string]string{"job": "job1", "instance": instance}
+	}
+
+	// Each scenario loads what the previous one has persisted.
+	for i, scenario := range []struct {
+		writes    []WriteRequest
+		instances []string
+		files     []string
+	}{
+		{
+			writes: []WriteRequest{
+				{Labels: labels("i1"), MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3}},
+				{Labels: labels("i2"), MetricFamilies: map[string]*dto.MetricFamily{"mf4": mf4}},
+			},
+			instances: []string{"i1", "i2"},
+			files:     []string{"metrics.delta-1"},
+		},
+		{
+			writes: []WriteRequest{
+				{Labels: labels("i1")},
+				{Labels: labels("i3"), MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3}},
+			},
+			instances: []string{"i2", "i3"},
+			files:     []string{"metrics.delta-1", "metrics.delta-2"},
+		},
+		{
+			// Two delta files exist, so everything is rewritten.
+			writes: []WriteRequest{
+				{Labels: labels("i4"), MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3}},
+			},
+			instances: []string{"i2", "i3", "i4"},
+			files:     []string{"metrics"},
+		},
+		{
+			writes: []WriteRequest{
+				{Labels: labels("i2")},
+			},
+			instances: []string{"i3", "i4"},
+			files:     []string{"metrics", "metrics.delta-1"},
+		},
+		{
+			// Nothing changed, so no delta file is written.
+			instances: []string{"i3", "i4"},
+			files:     []string{"metrics", "metrics.delta-1"},
+		},
+	} {
+		dms := NewDiskMetricStore(&DiskMetricStoreOptions{
+			PersistenceFile:      fileName,
+			PersistenceInterval:  time.Hour,
+			PersistenceMaxDeltas: 2,
+		})
+		for _, wr := range scenario.writes {
+			dms.SubmitWriteRequest(wr)
+		}
+		if err := dms.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+
+		infos, err := ioutil.ReadDir(tempDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		for _, fi := range infos {
+			files = append(files, fi.Name())
+		}
+		if !reflect.DeepEqual(scenario.files, files) {
+			t.Errorf("%d. expected files %v, got %v", i, scenario.files, files)
+		}
+
+		// Check what is loaded from the files.
+		dms = NewDiskMetricStore(&DiskMetricStoreOptions{PersistenceFile: fileName})
+		dms.SetPersisting(false)
+		var instances []string
+		for _, group := range dms.GetMetricFamiliesMap() {
+			instances = append(instances, group.Labels["instance"])
+		}
+		dms.Shutdown()
+		sort.Strings(instances)
+		if !reflect.DeepEqual(scenario.instances, instances) {
+			t.Errorf("%d. expected instances %v, got %v", i, scenario.instances, instances)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestHistory.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	labels := map[string]string{"job": "job1"}
+	gauge := func(v float64) map[string]*dto.MetricFamily {
+		return map[string]*dto.MetricFamily{"g": {
+			Name: proto.String("g"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{{Name: proto.String("job"), Value: proto.String("job1")}},
+				Gauge: &dto.Gauge{Value: proto.Float64(v)},
+			}},
+		}}
+	}
+	t0 := time.Now()
+	// Each scenario continues the history of the previous one.
+	for i, scenario := range []struct {
+		interval time.Duration
+		pushes   []time.Duration // Offsets from t0, pushing their index + values.
+		values   []float64       // Expected recorded values, most recent first.
+		starts   []time.Duration // Expected start offsets from t0.
+	}{
+		{
+			pushes: []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second, 4 * time.Second},
+			values: []float64{4, 3, 2},
+			starts: []time.Duration{4 * time.Second, 3 * time.Second, 2 * time.Second},
+		},
+		{
+			// Downsampled: The first push overwrites the last entry of
+			// the previous scenario, the second starts a new one.
+			interval: time.Hour,
+			pushes:   []time.Duration{10 * time.Second, 2 * time.Hour},
+			values:   []float64{1, 0, 3},
+			starts:   []time.Duration{2 * time.Hour, 4 * time.Second, 3 * time.Second},
+		},
+	} {
+		dms := NewDiskMetricStore(&DiskMetricStoreOptions{
+			HistoryDir:      tempDir,
+			HistoryLength:   3,
+			HistoryInterval: scenario.interval,
+		})
+		for j, offset := range scenario.pushes {
+			dms.SubmitWriteRequest(WriteRequest{
+				Labels:         labels,
+				Timestamp:      t0.Add(offset),
+				MetricFamilies: gauge(float64(j)),
+			})
+		}
+		if err := dms.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := dms.History(labels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := len(scenario.values), len(entries); expected != got {
+			t.Fatalf("%d: Wanted %d entries, got %d.", i, expected, got)
+		}
+		for j, e := range entries {
+			if expected, got := scenario.values[j], e.MetricFamilies[0].GetMetric()[0].GetGauge().GetValue(); expected != got {
+				t.Errorf("%d: Wanted value %v in entry %d, got %v.", i, expected, j, got)
+			}
+			if expected, got := t0.Add(scenario.starts[j]), e.Start; !expected.Equal(got) {
+				t.Errorf("%d: Wanted start %v in entry %d, got %v.", i, expected, j, got)
+			}
+		}
+	}
+
+	dms := NewDiskMetricStore(&DiskMetricStoreOptions{HistoryDir: tempDir, HistoryLength: 3})
+	entries, err := dms.History(map[string]string{"job": "job2"})
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Wanted no entries for unknown group, got %v, %v.", entries, err)
+	}
+	dms.Shutdown()
+	dms = NewDiskMetricStore(&DiskMetricStoreOptions{})
+	if _, err := dms.History(labels); err != ErrNoHistory {
+		t.Errorf("Wanted ErrNoHistory, got %v.", err)
+	}
+	dms.Shutdown()
+}
+
+func TestNoPersistence(t *testing.T) {
+	dms := NewDiskMetricStore(&DiskMetricStoreOptions{
+		PersistenceInterval: 100 * time.Millisecond,
+	})
+
+	ts1 := time.Now()
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels: map[string]string{
+			"job":      "job1",
+			"instance": "instance1",
+		},
+		Timestamp:      ts1,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	})
+	time.Sleep(time.Microsecond) // Give loop() time to process.
+	if err := checkMetricFamilies(dms, mf3); err != nil {
+		t.Error(err)
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	dms = NewDiskMetricStore(&DiskMetricStoreOptions{
+		PersistenceInterval: 100 * time.Millisecond,
+	})
+	if err := checkMetricFamilies(dms); err != nil {
+		t.Error(err)
+	}
+}
+
+func checkMetricFamilies(dms *DiskMetricStore, expectedMFs ...*dto.MetricFamily) error {
+	gotMFs := dms.GetMetricFamilies()
+	if expected, got := len(expectedMFs), len(gotMFs); expected != got {
+		return fmt.Errorf("expected %d metric families, got %d", expected, got)
+	}
+
+	expectedMFsAsStrings := make([]string, len(expectedMFs))
+	for i, mf := range expectedMFs {
+		sort.Sort(metricSorter(mf.Metric))
+		expectedMFsAsStrings[i] = mf.String()
+	}
+	sort.Strings(expectedMFsAsStrings)
+
+	gotMFsAsStrings := make([]string, len(gotMFs))
+	for i, mf := range gotMFs {
+		sort.Sort(metricSorter(mf.Metric))
+		gotMFsAsStrings[i] = mf.String()
+	}
+	sort.Strings(gotMFsAsStrings)
+
+	for i, got := range gotMFsAsStrings {
+		expected := expectedMFsAsStrings[i]
+		if expected != got {
+			return fmt.Errorf("expected metric family %#v, got %#v", expected, got)
+		}
+	}
+	return nil
+}
+
+type metricSorter []*dto.Metric
+
+func (s metricSorter) Len() int {
+	return len(s)
+}
+
+func (s metricSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s metricSorter) Less(i, j int) bool {
+	for n, lp := range s[i].Label {
+		vi := lp.GetValue()
 		vj := s[j].Label[n].GetValue()
 		if vi != vj {
 			return vi < vj
@@ -589,3 +2094,113 @@ func (s metricSorter) Less(i, j int) bool {
 	}
 	return true
 }
+
+func TestShareSchema(t *testing.T) {
+	old := proto.Clone(mf1a).(*dto.MetricFamily)
+	mf := proto.Clone(mf1a).(*dto.MetricFamily)
+	mf.Metric[0].Untyped.Value = proto.Float64(42)
+	mf.Metric[0].Label[0].Value = proto.String("changed")
+	if !shareSchema(mf, old) {
+		t.Fatal("Expected schema to be shared.")
+	}
+	if mf.Name != old.Name || mf.Help != old.Help {
+		t.Error("Name and help string are not shared.")
+	}
+	if mf.Metric[0].Label[0] == old.Metric[0].Label[0] {
+		t.Error("Label pairs are shared.")
+	}
+	if mf.Metric[0].Label[0].Name != old.Metric[0].Label[0].Name {
+		t.Error("Label names are not shared.")
+	}
+	if mf.Metric[0].Label[1].Value != old.Metric[0].Label[1].Value {
+		t.Error("Unchanged label values are not shared.")
+	}
+	if expected, got := "changed", mf.Metric[0].Label[0].GetValue(); expected != got {
+		t.Errorf("Wanted label value %q, got %q.", expected, got)
+	}
+	if expected, got := 42., mf.Metric[0].GetUntyped().GetValue(); expected != got {
+		t.Errorf("Wanted value %v, got %v.", expected, got)
+	}
+
+	// Modifying mf later must not affect old.
+	mf.Metric[0].Label[1].Value = proto.String("modified")
+	if got := old.Metric[0].Label[1].GetValue(); got == "modified" {
+		t.Error("Modifying a shared label pair modified the old metric family.")
+	}
+	if !proto.Equal(old, mf1a) {
+		t.Errorf("Wanted unchanged old metric family %v, got %v.", mf1a, old)
+	}
+
+	mf = proto.Clone(mf1a).(*dto.MetricFamily)
+	mf.Metric[0].Label[0].Name = proto.String("changed")
+	if shareSchema(mf, old) {
+		t.Error("Expected schema with changed label name not to be shared.")
+	}
+	mf = proto.Clone(mf1a).(*dto.MetricFamily)
+	mf.Type = dto.MetricType_GAUGE.Enum()
+	if shareSchema(mf, old) {
+		t.Error("Expected schema with changed type not to be shared.")
+	}
+	mf = proto.Clone(mf1a).(*dto.MetricFamily)
+	mf.Help = proto.String("changed")
+	if shareSchema(mf, old) {
+		t.Error("Expected schema with changed help string not to be shared.")
+	}
+}
+
+// benchmarkMetricFamily returns a freshly allocated MetricFamily with 100
+// metrics, as it would result from parsing a push. If changeSchema is true,
+// the label values depend on i.
+func benchmarkMetricFamily(i int, changeSchema bool) *dto.MetricFamily {
+	mf := &dto.MetricFamily{
+		Name: proto.String("benchmark_metric"),
+		Help: proto.String("A metric for benchmarking."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for j := 0; j < 100; j++ {
+		value := fmt.Sprint("value", j)
+		if changeSchema {
+			value = fmt.Sprint("value", j, "_", i)
+		}
+		mf.Metric = append(mf.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{
+				{Name: proto.String("instance"), Value: proto.String("")},
+				{Name: proto.String("job"), Value: proto.String("benchmark")},
+				{Name: proto.String("label"), Value: proto.String(value)},
+			},
+			Gauge: &dto.Gauge{Value: proto.Float64(float64(i))},
+		})
+	}
+	return mf
+}
+
+func benchmarkProcessWriteRequest(b *testing.B, changeSchema bool) {
+	dms := &DiskMetricStore{
+		metricGroups: GroupingKeyToMetricGroup{},
+		gcReclaimedGroups: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "benchmark_counter",
+			Help: "Not used.",
+		}),
+	}
+	dms.rebuildMergedFamilies()
+	labels := map[string]string{"job": "benchmark"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dms.processWriteRequest(WriteRequest{
+			Labels:    labels,
+			Timestamp: time.Now(),
+			MetricFamilies: map[string]*dto.MetricFamily{
+				"benchmark_metric": benchmarkMetricFamily(i, changeSchema),
+			},
+		})
+	}
+}
+
+func BenchmarkProcessWriteRequestSameSchema(b *testing.B) {
+	benchmarkProcessWriteRequest(b, false)
+}
+
+func BenchmarkProcessWriteRequestChangingSchema(b *testing.B) {
+	benchmarkProcessWriteRequest(b, true)
+}
@@ -0,0 +1,269 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/log"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/groupingkey"
+)
+
+// historyQueueCapacity is the number of recorded group states that may wait to
+// be written to disk before further ones are dropped.
+const historyQueueCapacity = 1024
+
+// ErrNoHistory is returned by History if history recording is disabled.
+var ErrNoHistory = errors.New("history recording is disabled")
+
+// HistoryEntry is a state of a group as recorded after a push.
+type HistoryEntry struct {
+	// Timestamp is the time of the last push contributing to the entry.
+	Timestamp time.Time
+	// Start is the time of the first push contributing to the entry. It
+	// only differs from Timestamp if pushes have been downsampled (see
+	// DiskMetricStoreOptions.HistoryInterval).
+	Start time.Time
+	// MetricFamilies are the metric families of the group, sorted by name.
+	MetricFamilies []*dto.MetricFamily
+}
+
+// historySlot is the content of a slot file. Its fields are exported for gob
+// encoding.
+type historySlot struct {
+	Seq uint64
+	HistoryEntry
+}
+
+type historyRecord struct {
+	key   uint64
+	entry HistoryEntry
+}
+
+// ringState is the state of the ring buffer of a group.
+type ringState struct {
+	next  uint64 // Sequence number of the next slot to write.
+	start time.Time
+}
+
+// history keeps the last states of each group on disk, in a ring buffer of
+// slot files per group. The directory of a group is named by its grouping key
+// in hexadecimal notation, the slot files by their index.
+type history struct {
+	dir      string
+	length   int
+	interval time.Duration
+	queue    chan historyRecord
+	done     chan struct{}
+	dropped  prometheus.Counter
+
+	mtx   sync.Mutex // Protects rings and serializes file access.
+	rings map[uint64]*ringState
+}
+
+func newHistory(dir string, length int, interval time.Duration) *history {
+	h := &history{
+		dir:      dir,
+		length:   length,
+		interval: interval,
+		queue:    make(chan historyRecord, historyQueueCapacity),
+		done:     make(chan struct{}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "pushgateway",
+			Subsystem: "storage",
+			Name:      "history_dropped_total",
+			Help:      "Total number of group states not recorded in the history because writing to disk could not keep up.",
+		}),
+		rings: map[uint64]*ringState{},
+	}
+	go h.loop()
+	return h
+}
+
+// record queues the current state of the given group to be written to its
+// ring buffer. The metric families of the group are copied, as encoding them
+// later would race with the DiskMetricStore updating their cached sizes. The
+// caller must hold the lock of the DiskMetricStore. If the queue is full, the
+// state is dropped.
+func (h *history) record(key uint64, group MetricGroup, ts time.Time) {
+	if h == nil {
+		return
+	}
+	names := make([]string, 0, len(group.Metrics))
+	for name := range group.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	mfs := make([]*dto.MetricFamily, 0, len(names))
+	for _, name := range names {
+		mfs = append(mfs, proto.Clone(group.Metrics[name].MetricFamily).(*dto.MetricFamily))
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	select {
+	case h.queue <- historyRecord{key: key, entry: HistoryEntry{Timestamp: ts, MetricFamilies: mfs}}:
+	default:
+		h.dropped.Inc()
+	}
+}
+
+func (h *history) loop() {
+	defer close(h.done)
+	for r := range h.queue {
+		if err := h.write(r); err != nil {
+			log.Printf("Error recording history of group with key %s: %s", groupingkey.Format(r.key), err)
+		}
+	}
+}
+
+// close writes all queued states and waits until done.
+func (h *history) close() {
+	if h == nil {
+		return
+	}
+	close(h.queue)
+	<-h.done
+}
+
+func (h *history) groupDir(key uint64) string {
+	return filepath.Join(h.dir, groupingkey.Format(key))
+}
+
+// write writes r to the next slot of the ring buffer of its group or, if the
+// slot written last has been started less than the history interval before,
+// overwrites that one.
+func (h *history) write(r historyRecord) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	dir := h.groupDir(r.key)
+	ring, ok := h.rings[r.key]
+	if !ok {
+		slots, err := h.readSlots(dir)
+		if err != nil {
+			return err
+		}
+		ring = &ringState{}
+		if n := len(slots); n > 0 {
+			ring.next = slots[n-1].Seq + 1
+			ring.start = slots[n-1].Start
+		}
+		h.rings[r.key] = ring
+	}
+	seq := ring.next
+	if ring.next > 0 && h.interval > 0 && r.entry.Timestamp.Sub(ring.start) < h.interval {
+		seq--
+		r.entry.Start = ring.start
+	} else {
+		r.entry.Start = r.entry.Timestamp
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	name := filepath.Join(dir, strconv.FormatUint(seq%uint64(h.length), 10))
+	f, err := ioutil.TempFile(dir, ".in_progress.")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(historySlot{Seq: seq, HistoryEntry: r.entry}); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return err
+	}
+	ring.next = seq + 1
+	ring.start = r.entry.Start
+	return nil
+}
+
+// readSlots returns the slots in the given group directory sorted by sequence
+// number. A missing directory results in no slots.
+func (h *history) readSlots(dir string) ([]historySlot, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	slots := make([]historySlot, 0, len(files))
+	for _, fi := range files {
+		if _, err := strconv.ParseUint(fi.Name(), 10, 64); err != nil {
+			continue // Not a slot file.
+		}
+		f, err := os.Open(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var slot historySlot
+		err = gob.NewDecoder(f).Decode(&slot)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading history slot %s: %s", filepath.Join(dir, fi.Name()), err)
+		}
+		slots = append(slots, slot)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].Seq < slots[j].Seq })
+	// Slots beyond the ring length are left over from a configuration with
+	// a greater length.
+	if len(slots) > h.length {
+		slots = slots[len(slots)-h.length:]
+	}
+	return slots, nil
+}
+
+// History returns the recorded states of the group with the given grouping
+// labels, most recent first. States queued but not written yet are not
+// included. If history recording is disabled (see
+// DiskMetricStoreOptions.HistoryDir), ErrNoHistory is returned. A group
+// without any recorded states results in an empty slice.
+func (dms *DiskMetricStore) History(labels map[string]string) ([]HistoryEntry, error) {
+	h := dms.history
+	if h == nil {
+		return nil, ErrNoHistory
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	slots, err := h.readSlots(h.groupDir(groupingkey.Hash(labels)))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]HistoryEntry, len(slots))
+	for i, slot := range slots {
+		entries[len(slots)-1-i] = slot.HistoryEntry
+	}
+	return entries, nil
+}
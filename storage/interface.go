@@ -14,6 +14,7 @@
 package storage
 
 import (
+	"errors"
 	"sort"
 	"time"
 
@@ -45,6 +46,25 @@ type MetricStore interface {
 	// the internal state of the MetricStore and completely owned by the
 	// caller.
 	GetMetricFamiliesMap() GroupingKeyToMetricGroup
+	// GetMetricGroup returns the MetricGroup with the given grouping key
+	// under the same conditions as GetMetricFamiliesMap, without copying
+	// any other group. The second return value is false if there is no
+	// such group.
+	GetMetricGroup(key uint64) (MetricGroup, bool)
+	// GetGroupingKeys returns the grouping keys of all groups in ascending
+	// order, e.g. to look at the groups one by one with GetMetricGroup.
+	GetGroupingKeys() []uint64
+	// GetJobUsage returns what is stored for the given job, i.e. for all
+	// groups with that value of the 'job' label.
+	GetJobUsage(job string) JobUsage
+	// MemoryUsage returns an estimate of the memory in bytes used by the
+	// saved MetricFamilies.
+	MemoryUsage() int64
+	// WriteQueueUtilization returns the fraction of the capacity of the
+	// queue of submitted write requests that is in use, between 0 and 1. At
+	// 1, SubmitWriteRequest blocks until a write request has been
+	// processed.
+	WriteQueueUtilization() float64
 	// Shutdown must only be called after the caller has made sure that
 	// SubmitWriteRequests is not called anymore. (If it is called later,
 	// the request might get submitted, but not processed anymore.) The
@@ -58,21 +78,76 @@ type MetricStore interface {
 	Shutdown() error
 }
 
+// JobUsage is what is stored for a job. Bytes are estimated by the size of the
+// metric families in the protobuf encoding, like MemoryUsage.
+type JobUsage struct {
+	Groups int
+	Series int
+	Bytes  int64
+}
+
 // WriteRequest is a request to change the MetricStore, i.e. to process it, a
 // write lock has to be acquired. If MetricFamilies is nil, this is a request to
-// delete metrics that share the given Labels as a grouping key. Otherwise, this
+// delete metrics that share the given Labels as a grouping key (or, if
+// MetricFamilyName is not empty, only the metric family of that name within
+// the group, deleting the group if it ends up empty). Otherwise, this
 // is a request to update the MetricStore with the MetricFamilies. The key in
 // MetricFamilies is the name of the mapped metric family. All metrics in
 // MetricFamilies MUST have already set job and other labels that are consistent
 // with the Labels fields. The Timestamp field marks the time the request was
 // received from the network. It is not related to the timestamp_ms field in the
-// Metric proto message.
+// Metric proto message. If Done is not nil, the outcome of processing the
+// request is sent to it once the request has been processed, i.e. nil if the
+// request has been applied, or an error if it has been rejected. Done must
+// have a capacity of at least one so that sending never blocks. If Restore is
+// true, this is a request to restore the group with the given Labels as a
+// grouping key from the tombstone left by its deletion (if the MetricStore
+// keeps tombstones), and MetricFamilies is ignored. If there is no such
+// tombstone, ErrNoTombstone is sent to Done. If Replace is true, the group is
+// deleted before the update with MetricFamilies, in one step.
+//
+// If Patch is true, this is a request to update only the values of existing
+// metrics of the group, identified by their metric family name and label set,
+// leaving all other metrics untouched. If the group lacks any of the metric
+// families or metrics in MetricFamilies, or a metric family has a different
+// type, nothing is changed, and an error describing the problem is sent to
+// Done.
+//
+// Annotations of an update are merged into the annotations of the group (see
+// MetricGroup), where an empty value removes the annotation of that name. With
+// Replace, they replace the annotations of the group instead. An update with
+// an empty MetricFamilies map only changes the annotations of the group if the
+// group exists.
+//
+// Write requests for the same group may be processed in a different order than
+// they were received (e.g. a push with a large body still being parsed while a
+// later delete is submitted already). Therefore, the DiskMetricStore resolves
+// conflicts by the Timestamp (last writer wins): A delete or replace only
+// removes metric families pushed by requests received up to its Timestamp,
+// an update does not overwrite metric families pushed by requests received
+// later, and a request received before the most recent delete or replace of
+// the group is not applied at all, whereupon ErrSuperseded is sent to Done. A
+// WriteRequest with a zero Timestamp is always applied as is.
 type WriteRequest struct {
-	Labels         map[string]string
-	Timestamp      time.Time
-	MetricFamilies map[string]*dto.MetricFamily
+	Labels           map[string]string
+	Timestamp        time.Time
+	MetricFamilies   map[string]*dto.MetricFamily
+	MetricFamilyName string
+	Annotations      map[string]string
+	Restore          bool
+	Replace          bool
+	Patch            bool
+	Done             chan<- error
 }
 
+// ErrNoTombstone is the outcome of a WriteRequest to restore a group that has
+// no tombstone (anymore).
+var ErrNoTombstone = errors.New("no deleted group to restore")
+
+// ErrSuperseded is the outcome of a WriteRequest received before the most
+// recent delete or replace of its group, which therefore wins.
+var ErrSuperseded = errors.New("superseded by a more recent delete or replace of the group")
+
 // TimestampedMetricFamily adds the push timestamp to a MetricFamily-DTO.
 type TimestampedMetricFamily struct {
 	Timestamp    time.Time
@@ -84,23 +159,54 @@ type TimestampedMetricFamily struct {
 type GroupingKeyToMetricGroup map[uint64]MetricGroup
 
 // MetricGroup adds the grouping labels to a NameToTimestampedMetricFamilyMap.
+// Annotations are arbitrary metadata attached to the group by pushes (e.g. the
+// URL of the build that pushed), which are not exposed as labels. The
+// Annotations map is never modified but replaced upon change.
 type MetricGroup struct {
-	Labels  map[string]string
-	Metrics NameToTimestampedMetricFamilyMap
+	Labels      map[string]string
+	Metrics     NameToTimestampedMetricFamilyMap
+	Annotations map[string]string
+}
+
+// LastPushTime returns the most recent push timestamp of the metric families in
+// the group. It returns the zero time if the group contains no metric
+// families.
+func (mg MetricGroup) LastPushTime() time.Time {
+	var last time.Time
+	for _, tmf := range mg.Metrics {
+		if tmf.Timestamp.After(last) {
+			last = tmf.Timestamp
+		}
+	}
+	return last
 }
 
 // SortedLabels returns the label names of the grouping labels sorted
 // lexicographically but with the "job" label always first. This method exists
 // for presentation purposes, see template.html.
 func (mg MetricGroup) SortedLabels() []string {
-	lns := make([]string, 1, len(mg.Labels))
-	lns[0] = "job"
+	return mg.SortedLabelsWith([]string{"job"})
+}
+
+// SortedLabelsWith returns the label names of the grouping labels. Those
+// contained in firstClass come first, in the order of firstClass. The
+// remaining label names follow, sorted lexicographically.
+func (mg MetricGroup) SortedLabelsWith(firstClass []string) []string {
+	lns := make([]string, 0, len(mg.Labels))
+	isFirstClass := make(map[string]bool, len(firstClass))
+	for _, ln := range firstClass {
+		if _, ok := mg.Labels[ln]; ok && !isFirstClass[ln] {
+			lns = append(lns, ln)
+		}
+		isFirstClass[ln] = true
+	}
+	n := len(lns)
 	for ln := range mg.Labels {
-		if ln != "job" {
+		if !isFirstClass[ln] {
 			lns = append(lns, ln)
 		}
 	}
-	sort.Strings(lns[1:])
+	sort.Strings(lns[n:])
 	return lns
 }
 
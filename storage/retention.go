@@ -0,0 +1,270 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRetentionCatchUp limits how far back applyRetention looks for scheduled
+// wipes it might have missed, e.g. because the loop was busy.
+const maxRetentionCatchUp = time.Hour
+
+// RetentionRule describes when groups are deleted automatically. A group is
+// subject to the rule if the value of its 'job' label matches Job.
+type RetentionRule struct {
+	// Job is a pattern as understood by path.Match, e.g. "nightly-*". The
+	// empty pattern matches all jobs.
+	Job string `json:"job"`
+	// If MaxAge is positive, groups whose last push is longer ago than
+	// MaxAge are deleted.
+	MaxAge Duration `json:"maxAge"`
+	// If Schedule is not nil, all groups subject to the rule are deleted
+	// at every minute matched by it.
+	Schedule *Schedule `json:"schedule"`
+}
+
+// matches returns whether groups of the given job are subject to the rule.
+func (r RetentionRule) matches(job string) bool {
+	if r.Job == "" {
+		return true
+	}
+	ok, _ := path.Match(r.Job, job)
+	return ok
+}
+
+// LoadRetentionRules returns the retention rules read from the given file,
+// which contains a JSON array of RetentionRule objects, e.g.
+// [{"job": "nightly-*", "maxAge": "7d"}, {"job": "scratch", "schedule": "0 3 * * *"}].
+// If maxAge is positive, a rule deleting groups of all jobs after maxAge is
+// appended. If filename is empty, no file is read.
+func LoadRetentionRules(filename string, maxAge time.Duration) ([]RetentionRule, error) {
+	var rules []RetentionRule
+	if filename != "" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(&rules); err != nil {
+			return nil, fmt.Errorf("error reading retention file %s: %s", filename, err)
+		}
+		for i, r := range rules {
+			if _, err := path.Match(r.Job, ""); err != nil {
+				return nil, fmt.Errorf("invalid job pattern %q in retention file %s", r.Job, filename)
+			}
+			if r.MaxAge <= 0 && r.Schedule == nil {
+				return nil, fmt.Errorf("rule %d in retention file %s has neither maxAge nor schedule", i, filename)
+			}
+		}
+	}
+	if maxAge > 0 {
+		rules = append(rules, RetentionRule{MaxAge: Duration(maxAge)})
+	}
+	return rules, nil
+}
+
+// Duration is a time.Duration that is represented in JSON as a string
+// understood by time.ParseDuration, optionally with the additional unit "d"
+// for days, e.g. "7d" or "36h".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		*d = Duration(time.Duration(days) * 24 * time.Hour)
+		return nil
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(dur)
+	return nil
+}
+
+// Schedule is a set of minutes in time described by a cron expression with
+// the five fields minute, hour, day of month, month, and day of week. Each
+// field is '*' or a comma-separated list of numbers and ranges ('a-b'), and
+// '*' as well as ranges may be followed by a step ('/n'). Names of months and
+// days of week are not supported. Both 0 and 7 denote Sunday. As usual, if
+// neither day of month nor day of week is '*', a day matching either of them
+// is matched. (A field starting with '*' counts as '*' here, as in the
+// original cron.) In JSON, a Schedule is represented by its cron expression.
+type Schedule struct {
+	spec                          string
+	minute, hour, dom, month, dow uint64
+	domRestricted, dowRestricted  bool
+}
+
+// ParseSchedule returns the Schedule for the given cron expression.
+func ParseSchedule(spec string) (*Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q does not have 5 fields", spec)
+	}
+	s := &Schedule{spec: spec}
+	for i, f := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dom, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dow, 0, 7},
+	} {
+		bits, err := parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %s", spec, err)
+		}
+		*f.bits = bits
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domRestricted = !strings.HasPrefix(fields[2], "*")
+	s.dowRestricted = !strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// parseCronField returns a bit set of the values described by the given field
+// of a cron expression.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			bounds := strings.SplitN(rng, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// Matches returns whether the minute of t is part of the Schedule.
+func (s *Schedule) Matches(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 ||
+		s.hour&(1<<uint(t.Hour())) == 0 ||
+		s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// String returns the cron expression of the Schedule.
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *Schedule) UnmarshalJSON(b []byte) error {
+	var spec string
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return err
+	}
+	parsed, err := ParseSchedule(spec)
+	if err != nil {
+		return err
+	}
+	*s = *parsed
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s *Schedule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.spec)
+}
+
+// applyRetention deletes the groups due for deletion by the retention rules at
+// time now, given that the rules were last applied at time last, and returns
+// the number of deleted groups. Scheduled wipes are done if any minute after
+// last up to and including now is part of their Schedule.
+func (dms *DiskMetricStore) applyRetention(now, last time.Time) int {
+	if now.Sub(last) > maxRetentionCatchUp {
+		last = now.Add(-maxRetentionCatchUp)
+	}
+	wipes := make([]bool, len(dms.retentionRules))
+	for t := last.Truncate(time.Minute).Add(time.Minute); !t.After(now); t = t.Add(time.Minute) {
+		for i, r := range dms.retentionRules {
+			if r.Schedule != nil && r.Schedule.Matches(t) {
+				wipes[i] = true
+			}
+		}
+	}
+
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+
+	deleted := 0
+	for key, group := range dms.metricGroups {
+		job := group.Labels["job"]
+		for i, r := range dms.retentionRules {
+			if !r.matches(job) {
+				continue
+			}
+			if wipes[i] || r.MaxAge > 0 && now.Sub(group.LastPushTime()) > time.Duration(r.MaxAge) {
+				dms.deleteGroup(key, group, now)
+				deleted++
+				break
+			}
+		}
+	}
+	dms.retentionDeletedGroups.Add(float64(deleted))
+	return deleted
+}